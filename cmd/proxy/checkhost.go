@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"custom-proxy/pkg/proxy"
+)
+
+// checkHostUsage describes the check-host subcommand
+const checkHostUsage = `Usage: proxy [flags] check-host [-expect blocked|allowed] [host|URL ...]
+       proxy [flags] check-host -lint
+
+Prints whether each host would be blocked by blocked_domains_file or the
+blocklist_categories, and the rule, category and file:line that matches it.
+Hosts matching only log_only or max_bytes categories are ALLOWED, with the
+rule shown. With no arguments, hosts (or URLs) are read from standard
+input, one per line. Rules match hosts, so a URL is decided by its host
+and port (80 or 443 if it has none); a bare host, without :port, is only
+checked against rules that don't name a port.
+Exits 1 if any decision differs from -expect.
+
+-lint checks the rule files instead: it lists every entry of
+blocked_domains_file and the blocklist_categories files that is skipped on
+load, as invalid or as a duplicate, with its file and line, and exits 1 if
+there are any.
+`
+
+// runCheckHost runs the check-host subcommand and returns the exit status
+func runCheckHost(config *proxy.Config, args []string, stdin io.Reader, stdout io.Writer) int {
+	fs := flag.NewFlagSet("check-host", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), checkHostUsage) }
+	expect := fs.String("expect", "", "Expected decision for every host: blocked or allowed")
+	lint := fs.Bool("lint", false, "List the invalid and duplicate entries of the rule files")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if *expect != "" && *expect != "blocked" && *expect != "allowed" {
+		fmt.Fprintf(os.Stderr, "Error: -expect must be 'blocked' or 'allowed', not %q\n", *expect)
+		return 2
+	}
+	if *lint && fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Error: -lint takes no hosts")
+		return 2
+	}
+
+	// Load the rules as the server would, but treat a missing file as an
+	// error rather than an empty rule set
+	if _, err := os.Stat(config.BlockedDomainsFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: blocked_domains_file: %v\n", err)
+		return 2
+	}
+	filter := proxy.NewFilter(nil)
+	// Linting lists every invalid entry, so strict_rules mustn't stop it at
+	// the first
+	strict := config.StrictRules && !*lint
+	report, err := filter.LoadRules(config.BlockedDomainsFile, strict)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	categoryReports, err := filter.LoadCategories(config.BlocklistCategories, strict)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	if *lint {
+		return lintRules(append([]*proxy.RuleReport{report}, categoryReports...), stdout)
+	}
+
+	targets := fs.Args()
+	if len(targets) == 0 {
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				targets = append(targets, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading hosts: %v\n", err)
+			return 2
+		}
+	}
+
+	status := 0
+	for _, target := range targets {
+		host, port, err := targetHost(target)
+		if err != nil {
+			fmt.Fprintf(stdout, "%s ERROR %v\n", target, err)
+			status = 1
+			continue
+		}
+
+		match, matched := filter.Match(host, port)
+		decision := "allowed"
+		line := fmt.Sprintf("%s ALLOWED", target)
+		if matched {
+			if match.Blocks() {
+				decision = "blocked"
+				line = fmt.Sprintf("%s BLOCKED", target)
+			}
+			line += " rule=" + match.Rule
+			if match.Category != "" {
+				line += fmt.Sprintf(" category=%s action=%s", match.Category, match.Action)
+			}
+			if match.MaxBytes > 0 {
+				line += fmt.Sprintf(" max_bytes=%d", match.MaxBytes)
+			}
+			if file, n, ok := filter.RuleSource(match.Rule); ok {
+				line += fmt.Sprintf(" (%s:%d)", file, n)
+			}
+		}
+		if *expect != "" && decision != *expect {
+			line += " UNEXPECTED"
+			status = 1
+		}
+		fmt.Fprintln(stdout, line)
+	}
+	return status
+}
+
+// lintRules prints the skipped entries and a summary of each report,
+// returning 1 if any entries were skipped
+func lintRules(reports []*proxy.RuleReport, stdout io.Writer) int {
+	status := 0
+	for _, report := range reports {
+		for _, issue := range report.Skipped() {
+			fmt.Fprintf(stdout, "%s:%d: %q: %s\n", report.File, issue.Line, issue.Entry, issue.Reason)
+		}
+		fmt.Fprintf(stdout, "%s: %d accepted, %d invalid, %d duplicate\n", report.File, report.Accepted, len(report.Invalid), len(report.Duplicates))
+		if len(report.Skipped()) > 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+// targetHost returns the host and port to check for a host, host:port or
+// URL; the port is 0 for a bare host
+func targetHost(target string) (string, int, error) {
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", 0, err
+		}
+		if u.Hostname() == "" {
+			return "", 0, fmt.Errorf("no host in %q", target)
+		}
+		port := 80
+		if u.Scheme == "https" {
+			port = 443
+		}
+		if u.Port() != "" {
+			if port, err = strconv.Atoi(u.Port()); err != nil {
+				return "", 0, fmt.Errorf("invalid port in %q", target)
+			}
+		}
+		return u.Hostname(), port, nil
+	}
+	if host, portStr, err := net.SplitHostPort(target); err == nil {
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid port in %q", target)
+		}
+		return host, port, nil
+	}
+	return target, 0, nil
+}
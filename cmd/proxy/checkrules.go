@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"custom-proxy/pkg/proxy"
+)
+
+// checkRulesUsage describes the check-rules subcommand
+const checkRulesUsage = `Usage: proxy [flags] check-rules [-client IP] [-user name] [-method method]
+                   [-category name] [-time time] [-expect action] URL|host:port
+
+Evaluates a sample request against expression_rules_file and prints the
+first rule that matches it, with its action and file:line, or NO_MATCH if
+none does. The destination is a URL, whose path is tested too, or a
+host:port, which is checked as a CONNECT unless -method says otherwise.
+-category defaults to the category the blocklists give the host; -time,
+"YYYY-MM-DD HH:MM" in local time or RFC 3339, defaults to now.
+Exits 1 if the action differs from -expect (allow, block, route,
+rate_limit or none).
+`
+
+// runCheckRules runs the check-rules subcommand and returns the exit status
+func runCheckRules(config *proxy.Config, args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("check-rules", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), checkRulesUsage) }
+	client := fs.String("client", "127.0.0.1", "Client IP address")
+	user := fs.String("user", "", "Authenticated proxy user")
+	method := fs.String("method", "", "Request method (default GET for a URL, CONNECT for host:port)")
+	category := fs.String("category", "", "Blocklist category of the host (default: looked up)")
+	at := fs.String("time", "", "Time of the request (default now)")
+	expect := fs.String("expect", "", "Expected action: allow, block, route, rate_limit or none")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	switch *expect {
+	case "", "allow", "block", "route", "rate_limit", "none":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: -expect must be allow, block, route, rate_limit or none, not %q\n", *expect)
+		return 2
+	}
+	if config.ExpressionRulesFile == "" {
+		fmt.Fprintln(os.Stderr, "Error: expression_rules_file is not set")
+		return 2
+	}
+	rules, err := proxy.LoadExprRules(config.ExpressionRulesFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+
+	in := proxy.ExprInput{User: *user, Method: strings.ToUpper(*method), Category: *category, Time: time.Now()}
+	if in.ClientIP = net.ParseIP(*client); in.ClientIP == nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -client address %q\n", *client)
+		return 2
+	}
+	if *at != "" {
+		if in.Time, err = parseSampleTime(*at); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 2
+		}
+	}
+
+	target := fs.Arg(0)
+	if in.Host, in.Port, err = targetHost(target); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	if strings.Contains(target, "://") {
+		if in.Method == "" {
+			in.Method = "GET"
+		}
+		in.Path = urlPath(target)
+	} else {
+		if in.Port == 0 {
+			fmt.Fprintf(os.Stderr, "Error: %q needs a port, or give a URL\n", target)
+			return 2
+		}
+		if in.Method == "" {
+			in.Method = "CONNECT"
+		}
+	}
+
+	if *category == "" {
+		if in.Category, err = lookupCategory(config, in.Host, in.Port); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 2
+		}
+	}
+
+	action := "none"
+	line := target + " NO_MATCH"
+	if match, ok := rules.Match(in); ok {
+		action = match.Action
+		line = fmt.Sprintf("%s %s rule=%q (%s:%d)", target, strings.ToUpper(match.Action), match.Rule, match.File, match.Line)
+		if match.Route != nil {
+			line += " route=" + match.Route.String()
+		}
+	}
+	if in.Category != "" {
+		line += " category=" + in.Category
+	}
+	if *expect != "" && action != *expect {
+		line += " UNEXPECTED"
+		fmt.Fprintln(stdout, line)
+		return 1
+	}
+	fmt.Fprintln(stdout, line)
+	return 0
+}
+
+// parseSampleTime parses "YYYY-MM-DD HH:MM" in local time, or RFC 3339
+func parseSampleTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -time %q (want \"YYYY-MM-DD HH:MM\" or RFC 3339)", s)
+	}
+	return t.Local(), nil
+}
+
+// urlPath returns a URL's path without the query, as the proxy tests it
+func urlPath(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	path, _, _ := strings.Cut(u.RequestURI(), "?")
+	return path
+}
+
+// lookupCategory returns the blocklist category the host's matching rule
+// belongs to, if any, loading the rule files as check-host does
+func lookupCategory(config *proxy.Config, host string, port int) (string, error) {
+	filter := proxy.NewFilter(nil)
+	if _, err := os.Stat(config.BlockedDomainsFile); err == nil {
+		if _, err := filter.LoadRules(config.BlockedDomainsFile, config.StrictRules); err != nil {
+			return "", err
+		}
+	}
+	if _, err := filter.LoadCategories(config.BlocklistCategories, config.StrictRules); err != nil {
+		return "", err
+	}
+	match, _ := filter.Match(host, port)
+	return match.Category, nil
+}
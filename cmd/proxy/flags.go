@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"custom-proxy/pkg/proxy"
+)
+
+// configFlags maps command-line flag names to configuration keys
+type configFlags map[string]string
+
+// registerConfigFlags defines a kebab-case flag for every configuration key,
+// e.g. -listen-port for listen_port. Boolean keys get boolean flags so that
+// -enable-connect-tunneling works without a value.
+func registerConfigFlags(fs *flag.FlagSet) configFlags {
+	flags := make(configFlags)
+	t := reflect.TypeOf(proxy.Config{})
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		name := strings.ReplaceAll(key, "_", "-")
+		usage := fmt.Sprintf("Override %s from the config file", key)
+		if t.Field(i).Type.Kind() == reflect.Bool {
+			fs.Bool(name, false, usage)
+		} else {
+			fs.String(name, "", usage)
+		}
+		flags[name] = key
+	}
+	return flags
+}
+
+// overrides returns the configuration values of the flags the user actually
+// set, so unset flags don't replace file values with zero defaults
+func (flags configFlags) overrides(fs *flag.FlagSet) map[string]string {
+	overrides := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := flags[f.Name]; ok {
+			overrides[key] = f.Value.String()
+		}
+	})
+	return overrides
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"custom-proxy/pkg/proxy"
+)
+
+// logQueryUsage describes the logquery subcommand
+const logQueryUsage = `Usage: proxy [flags] logquery [-since 24h] [-client IP] [-limit 20] top-hosts|top-clients|blocked
+
+Runs a report over the access log database at log_db_path, which the proxy
+writes when log_backend is sqlite or both:
+
+  top-hosts    destinations by requests, with bytes sent to clients
+  top-clients  clients by requests, with bytes sent to them
+  blocked      blocked destinations with the rule and category
+
+-client takes the client IP as logged, so with log_anonymize_ips it must
+be the anonymized form. The database can be queried while the proxy runs.
+`
+
+// runLogQuery runs the logquery subcommand and returns the exit status
+func runLogQuery(config *proxy.Config, args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("logquery", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), logQueryUsage) }
+	since := fs.Duration("since", 24*time.Hour, "Report on entries this recent; 0 for all")
+	client := fs.String("client", "", "Only entries from this client IP")
+	limit := fs.Int("limit", 20, "Rows to print")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if *limit < 1 {
+		fmt.Fprintln(os.Stderr, "Error: -limit must be at least 1")
+		return 2
+	}
+
+	// Opening read-only would report a missing file as a vague SQLite error
+	if _, err := os.Stat(config.LogDBPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: log_db_path: %v\n", err)
+		return 2
+	}
+
+	query := proxy.LogQuery{Report: fs.Arg(0), Client: *client, Limit: *limit}
+	if *since > 0 {
+		query.Since = time.Now().Add(-*since)
+	}
+	report, err := proxy.QueryLogDB(config.LogDBPath, query)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(report.Columns, "\t"))
+	for _, row := range report.Rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+	return 0
+}
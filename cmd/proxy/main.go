@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"custom-proxy/pkg/proxy"
+)
+
+// exitForcedShutdown is the exit status after a second signal cut the
+// graceful shutdown short
+const exitForcedShutdown = 3
+
+// forceExitTimeout bounds how long a forced shutdown may take
+const forceExitTimeout = 5 * time.Second
+
+func main() {
+	configPath := flag.String("config", "config/proxy.conf", "Path to configuration file")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration and exit")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration and referenced files strictly, then exit")
+	showVersion := flag.Bool("version", false, "Print version and build information and exit")
+	flags := registerConfigFlags(flag.CommandLine)
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(proxy.VersionString())
+		os.Exit(0)
+	}
+
+	// Load configuration; precedence is flags > env > file > defaults
+	config, warnings, err := proxy.LoadConfigFile(*configPath, flags.overrides(flag.CommandLine))
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Subcommands run offline against the loaded configuration
+	switch flag.Arg(0) {
+	case "":
+	case "check-host":
+		os.Exit(runCheckHost(config, flag.Args()[1:], os.Stdin, os.Stdout))
+	case "check-rules":
+		os.Exit(runCheckRules(config, flag.Args()[1:], os.Stdout))
+	case "logquery":
+		os.Exit(runLogQuery(config, flag.Args()[1:], os.Stdout))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", flag.Arg(0))
+		os.Exit(2)
+	}
+
+	if *checkConfig {
+		// Any warning is fatal, as with strict_config
+		if len(config.Files) > 1 {
+			fmt.Printf("Merged files: %s\n", strings.Join(config.Files, ", "))
+		}
+		problems := proxy.CheckConfigFiles(config)
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", problem)
+		}
+		if len(warnings) > 0 || len(problems) > 0 {
+			fmt.Fprintf(os.Stderr, "Configuration check failed: %d warning(s), %d error(s)\n", len(warnings), len(problems))
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		os.Exit(0)
+	}
+
+	if *printConfig {
+		proxy.PrintConfig(os.Stdout, config)
+		os.Exit(0)
+	}
+
+	// Create server
+	server, err := proxy.NewServer(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating server: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Handle graceful shutdown; Start returns once draining is done. A
+	// second signal closes every connection instead of waiting out the
+	// grace period, and the process exits with exitForcedShutdown.
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, shutdownSignals...)
+
+	var forced atomic.Bool
+	go func() {
+		<-sigChan
+		go server.Shutdown()
+		<-sigChan
+		forced.Store(true)
+		fmt.Fprintln(os.Stderr, "Second signal received, closing all connections")
+		go server.ForceShutdown()
+
+		// Don't let a stuck handler keep the process alive
+		time.Sleep(forceExitTimeout)
+		fmt.Fprintln(os.Stderr, "Forced shutdown did not finish, exiting")
+		os.Exit(exitForcedShutdown)
+	}()
+
+	// Reload configuration, filter rules and the log file on SIGHUP
+	if reloadSignal != nil {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, reloadSignal)
+
+		go func() {
+			for range hupChan {
+				server.ReloadConfig()
+			}
+		}()
+	}
+
+	// Dump runtime statistics to the diagnostic log on SIGUSR1
+	if statsSignal != nil {
+		usr1Chan := make(chan os.Signal, 1)
+		signal.Notify(usr1Chan, statsSignal)
+
+		go func() {
+			for range usr1Chan {
+				server.LogStats()
+			}
+		}()
+	}
+
+	// Start server
+	if err := server.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Server error: %v\n", err)
+		server.Shutdown()
+		os.Exit(1)
+	}
+	if forced.Load() {
+		os.Exit(exitForcedShutdown)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// shutdownSignals start a graceful shutdown
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// reloadSignal asks the server to reload its configuration
+var reloadSignal os.Signal = syscall.SIGHUP
+
+// statsSignal asks the server to dump its statistics
+var statsSignal os.Signal = syscall.SIGUSR1
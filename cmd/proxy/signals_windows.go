@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// shutdownSignals start a graceful shutdown. Go delivers Ctrl-C and
+// Ctrl-Break as os.Interrupt, and closing the console window, logging off
+// and shutting down the system as SIGTERM; after those Windows ends the
+// process within a few seconds, however much of shutdown_grace_period is
+// left.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// reloadSignal is nil on Windows, which has no SIGHUP; restart the proxy to
+// apply configuration changes
+var reloadSignal os.Signal
+
+// statsSignal is nil on Windows, which has no SIGUSR1
+var statsSignal os.Signal
@@ -2,3 +2,9 @@ module custom-proxy
 
 go 1.21
 
+require (
+	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/oschwald/maxminddb-golang v1.12.0
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
+)
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// deniedLogInterval limits DENIED_CLIENT log entries to one per client IP
+// per interval, so a port scan can't flood the log
+const deniedLogInterval = 1 * time.Minute
+
+// ClientAllowlist decides which source addresses may use the proxy at all
+type ClientAllowlist struct {
+	mu         sync.RWMutex
+	networks   []*net.IPNet // empty allows everyone
+	lastLogged map[string]time.Time
+}
+
+// NewClientAllowlist creates an allowlist from the configuration
+func NewClientAllowlist(config *Config) *ClientAllowlist {
+	a := &ClientAllowlist{lastLogged: make(map[string]time.Time)}
+	a.Reconfigure(config)
+	return a
+}
+
+// Reconfigure applies a reloaded allowed_client_cidrs list
+func (a *ClientAllowlist) Reconfigure(config *Config) {
+	// Validate has already checked the CIDRs
+	networks, _ := parseCIDRList(config.AllowedClientCIDRs)
+
+	a.mu.Lock()
+	a.networks = networks
+	a.mu.Unlock()
+}
+
+// Allowed reports whether the client at addr may connect
+func (a *ClientAllowlist) Allowed(addr net.Addr) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if len(a.networks) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range a.networks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldLog reports whether a denial for ip should be logged, at most once
+// per deniedLogInterval
+func (a *ClientAllowlist) shouldLog(ip string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := a.lastLogged[ip]; ok && now.Sub(last) < deniedLogInterval {
+		return false
+	}
+
+	// Forget expired entries once the map grows
+	if len(a.lastLogged) >= 1024 {
+		for key, last := range a.lastLogged {
+			if now.Sub(last) >= deniedLogInterval {
+				delete(a.lastLogged, key)
+			}
+		}
+	}
+	a.lastLogged[ip] = now
+	return true
+}
+
+// rejectDeniedClient closes a connection from outside allowed_client_cidrs,
+// first answering 403 if denied_client_403 is set
+func (s *Server) rejectDeniedClient(conn net.Conn, label string) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	conn = &labeledConn{Conn: conn, label: label, release: func() {}}
+	req := &HTTPRequest{Method: "UNKNOWN", ID: newRequestID()}
+	if s.config.Load().DeniedClient403 {
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		s.sendErrorResponse(conn, req, 403, "Forbidden")
+	}
+	if s.allowlist.shouldLog(GetClientIP(conn)) {
+		s.logRequest(conn, req, "DENIED_CLIENT", 403, 0, 0, "allowed_client_cidrs")
+	}
+}
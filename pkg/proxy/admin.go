@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// bindAdmin binds the admin listener, returning nil when admin_listen is
+// unset
+func (s *Server) bindAdmin(config *Config) (net.Listener, error) {
+	if config.AdminListen == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", config.AdminListen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on admin address %s: %w", config.AdminListen, err)
+	}
+	return listener, nil
+}
+
+// startAdmin serves the health endpoints on the admin listener, behind
+// guardAdmin:
+//
+//	/healthz  200 while the process is up
+//	/readyz   200 when the proxy can take traffic, 503 otherwise
+//	/proxy.pac, /wpad.dat  the PAC script, when one is configured
+//	/stats    the statistics snapshot as JSON
+//	/stats/timeseries  per-minute statistics for the last stats_retention
+//	/dashboard  a page charting them
+//	/metrics  the same statistics for Prometheus
+//	/config   the effective configuration and where each value came from
+//	/filter/rules  the blocking rules; runtime rules are added and removed here
+//	/filter/stats  how often each blocking rule has matched
+//	/connections  the open client connections, which can be terminated here
+func (s *Server) startAdmin(listener net.Listener, config *Config) {
+	s.mu.Lock()
+	s.admin = s.serveAdmin(listener)
+	s.mu.Unlock()
+
+	s.diag.Infof("Admin server listening on %s", config.AdminListen)
+}
+
+// serveAdmin serves the admin endpoints on listener
+func (s *Server) serveAdmin(listener net.Listener) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/proxy.pac", s.handlePAC)
+	mux.HandleFunc("/wpad.dat", s.handlePAC)
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/stats/timeseries", s.handleTimeseries)
+	mux.HandleFunc(dashboardPath, s.handleDashboard)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/config", s.handleConfig)
+	mux.HandleFunc("/filter/rules", s.handleFilterRules)
+	mux.HandleFunc("/filter/rules/", s.handleFilterRule)
+	mux.HandleFunc("/filter/stats", s.handleFilterStats)
+	mux.HandleFunc("/connections", s.handleConnections)
+	mux.HandleFunc("/connections/", s.handleTerminateConnection)
+
+	admin := &http.Server{Handler: s.guardAdmin(mux), ReadHeaderTimeout: 10 * time.Second}
+	go admin.Serve(listener)
+	return admin
+}
+
+// handleHealthz reports liveness
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports readiness, listing each check
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	problems := s.readinessProblems()
+
+	w.Header().Set("Content-Type", "text/plain")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleConfig serves the running configuration as JSON: the files it was
+// loaded from and every setting with its source, secrets redacted
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	config := s.config.Load()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Source   string          `json:"source"`
+		Files    []string        `json:"files"`
+		Settings []ConfigSetting `json:"settings"`
+	}{config.Source, config.Files, config.Settings()})
+}
+
+// readinessProblems runs the readiness checks, returning why the proxy
+// isn't ready to take traffic. Readiness turns false as soon as shutdown
+// starts, so load balancers stop sending traffic before the drain ends.
+func (s *Server) readinessProblems() []string {
+	var problems []string
+
+	select {
+	case <-s.shutdown:
+		return []string{"shutting down"}
+	default:
+	}
+
+	s.mu.Lock()
+	bound := len(s.listeners)
+	s.mu.Unlock()
+	if bound == 0 {
+		problems = append(problems, "listener: not bound")
+	}
+
+	if !s.engine.Stats().Loaded {
+		problems = append(problems, "filter: rules not loaded")
+	}
+
+	if err := s.logger.Err(); err != nil {
+		problems = append(problems, fmt.Sprintf("log: %v", err))
+	}
+
+	config := s.config.Load()
+	if config.ReadinessCanary != "" {
+		conn, err := net.DialTimeout("tcp", config.ReadinessCanary, config.ReadinessCanaryTimeout)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("canary: %v", err))
+		} else {
+			conn.Close()
+		}
+	}
+
+	return problems
+}
+
+// isHealthCheck reports whether req is a health check on the proxy port,
+// which is answered directly instead of being forwarded
+func isHealthCheck(config *Config, req *HTTPRequest) bool {
+	return config.HealthCheckPath != "" && req.Method == "GET" && req.RequestTarget == config.HealthCheckPath
+}
+
+// sendHealthCheckResponse answers a health check on the proxy port
+func (s *Server) sendHealthCheckResponse(conn net.Conn) {
+	status, body := "200 OK", "ok"
+	select {
+	case <-s.shutdown:
+		status, body = "503 Service Unavailable", "shutting down"
+	default:
+	}
+
+	response := fmt.Sprintf("HTTP/1.1 %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", status, len(body), body)
+	conn.Write([]byte(response))
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testAdminToken = "s3cret-admin-token"
+
+// startAdminServer serves the admin endpoints of a server built from config on
+// a loopback port, returning their base URL
+func startAdminServer(t *testing.T, config *Config) string {
+	t.Helper()
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := s.serveAdmin(l)
+	t.Cleanup(func() { admin.Close() })
+	return "http://" + l.Addr().String()
+}
+
+// adminRequest sends method path to the admin server at base with the
+// given headers, returning the response
+func adminRequest(t *testing.T, base, method, path string, headers map[string]string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, base+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestAdminRejections(t *testing.T) {
+	config := testConfig(t)
+	config.AdminToken = testAdminToken
+	config.ErrorLogPath = filepath.Join(t.TempDir(), "error.log")
+	config.LogLevel = "info"
+	base := startAdminServer(t, config)
+
+	bearer := "Bearer " + testAdminToken
+	tests := []struct {
+		name         string
+		method, path string
+		headers      map[string]string
+		want         int
+	}{
+		{"no token", "GET", "/healthz", nil, http.StatusUnauthorized},
+		{"wrong token", "GET", "/stats", map[string]string{"Authorization": "Bearer wrong"}, http.StatusUnauthorized},
+		{"not a bearer token", "GET", "/stats", map[string]string{"Authorization": "Basic " + testAdminToken}, http.StatusUnauthorized},
+		{"token", "GET", "/healthz", map[string]string{"Authorization": bearer}, http.StatusOK},
+		{"dashboard page without token", "GET", dashboardPath, nil, http.StatusOK},
+		{"mutation without token", "DELETE", "/connections/1", map[string]string{adminCSRFHeader: "1"}, http.StatusUnauthorized},
+		{"mutation without CSRF header", "DELETE", "/connections/1", map[string]string{"Authorization": bearer}, http.StatusForbidden},
+		{"POST without CSRF header", "POST", "/filter/rules", map[string]string{"Authorization": bearer}, http.StatusForbidden},
+		{"mutation with CSRF header", "DELETE", "/connections/1", map[string]string{"Authorization": bearer, adminCSRFHeader: "1"}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp := adminRequest(t, base, tt.method, tt.path, tt.headers)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: %s %s got %d, want %d", tt.name, tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("%s: 401 without a Bearer challenge", tt.name)
+		}
+	}
+
+	// Every request is audited, rejected or not
+	audit, err := os.ReadFile(config.ErrorLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Admin GET /healthz from 127.0.0.1 rejected with 401: admin token required",
+		"Admin GET /stats from 127.0.0.1 rejected with 401: invalid admin token",
+		"Admin DELETE /connections/1 from 127.0.0.1 rejected with 403: " + adminCSRFHeader + " header required",
+		"Admin GET /healthz from 127.0.0.1: 200",
+	} {
+		if !strings.Contains(string(audit), want) {
+			t.Errorf("audit log lacks %q:\n%s", want, audit)
+		}
+	}
+}
+
+func TestAdminAllowedCIDRs(t *testing.T) {
+	config := testConfig(t)
+	config.AdminAllowedCIDRs = []string{"10.0.0.0/8"}
+	base := startAdminServer(t, config)
+	if resp := adminRequest(t, base, "GET", "/healthz", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("caller outside admin_allowed_cidrs got %d, want 403", resp.StatusCode)
+	}
+
+	config = testConfig(t)
+	config.AdminAllowedCIDRs = []string{"10.0.0.0/8", "127.0.0.0/8"}
+	base = startAdminServer(t, config)
+	if resp := adminRequest(t, base, "GET", "/healthz", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("caller within admin_allowed_cidrs got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestAdminListenNeedsToken(t *testing.T) {
+	tests := []struct {
+		listen, token string
+		ok            bool
+	}{
+		{"127.0.0.1:9090", "", true},
+		{"[::1]:9090", "", true},
+		{"localhost:9090", "", true},
+		{"0.0.0.0:9090", "", false},
+		{":9090", "", false},
+		{"192.0.2.1:9090", "", false},
+		{"0.0.0.0:9090", testAdminToken, true},
+	}
+	for _, tt := range tests {
+		overrides := map[string]string{"admin_listen": tt.listen, "admin_token": tt.token}
+		_, _, err := LoadConfigFile(writeConfigFile(t, ""), overrides)
+		if (err == nil) != tt.ok {
+			t.Errorf("admin_listen %q with token %q: LoadConfigFile returned %v", tt.listen, tt.token, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "admin_token is required") {
+			t.Errorf("admin_listen %q: unexpected error %v", tt.listen, err)
+		}
+	}
+}
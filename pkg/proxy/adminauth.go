@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminCSRFHeader must accompany admin requests that change state. A page
+// in a browser can't add it to a cross-origin request without a CORS
+// preflight, which the admin server never approves.
+const adminCSRFHeader = "X-Proxy-Admin"
+
+// adminRecorder remembers the status an admin handler answered with
+type adminRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *adminRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *adminRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// guardAdmin wraps the admin endpoints: callers must be within
+// admin_allowed_cidrs, present admin_token as a bearer token when one is
+// set (except to load the dashboard page), and send adminCSRFHeader with
+// anything but GET and HEAD. Every
+// request is written to the diagnostic log with its outcome.
+func (s *Server) guardAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller := adminCaller(r)
+		status, reason := checkAdminRequest(s.config.Load(), r, caller)
+		if status != 0 {
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="proxy admin"`)
+			}
+			http.Error(w, reason, status)
+			s.diag.Warnf("Admin %s %s from %s rejected with %d: %s", r.Method, r.URL.Path, caller, status, reason)
+			return
+		}
+
+		recorder := &adminRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		s.diag.Infof("Admin %s %s from %s: %d", r.Method, r.URL.Path, caller, recorder.status)
+	})
+}
+
+// adminCaller returns the address an admin request came from
+func adminCaller(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// checkAdminRequest returns the status and reason an admin request from
+// caller is refused with, or 0 if it may proceed
+func checkAdminRequest(config *Config, r *http.Request, caller string) (int, string) {
+	// Validate has already checked the CIDRs
+	if networks, _ := parseCIDRList(config.AdminAllowedCIDRs); len(networks) > 0 {
+		ip := net.ParseIP(caller)
+		allowed := false
+		for _, network := range networks {
+			if ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return http.StatusForbidden, "client not in admin_allowed_cidrs"
+		}
+	}
+
+	// The dashboard page asks for the token itself
+	if config.AdminToken != "" && !(r.Method == http.MethodGet && r.URL.Path == dashboardPath) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return http.StatusUnauthorized, "admin token required"
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(config.AdminToken)) != 1 {
+			return http.StatusUnauthorized, "invalid admin token"
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Header.Get(adminCSRFHeader) == "" {
+		return http.StatusForbidden, adminCSRFHeader + " header required for " + r.Method
+	}
+	return 0, ""
+}
+
+// isLoopbackListen reports whether an addr:port only accepts connections
+// from this machine
+func isLoopbackListen(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
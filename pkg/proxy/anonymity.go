@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// clientAddressHeaders carry the client's address to the origin
+var clientAddressHeaders = []string{"x-forwarded-for", "x-real-ip", "forwarded"}
+
+// viaPseudonym identifies the proxy in the Via header without naming the
+// host; the comment after it names the software and version
+const viaPseudonym = "proxy"
+
+// anonymityStrippedHeaders returns the lowercase request headers removed
+// before forwarding in the configured anonymity mode:
+//
+//	transparent  none
+//	anonymous    client address headers; Via is added
+//	elite        client address headers, Via, Proxy-Connection and
+//	             anonymity_strip_headers
+func anonymityStrippedHeaders(config *Config) []string {
+	switch config.Anonymity {
+	case "anonymous":
+		return clientAddressHeaders
+	case "elite":
+		stripped := append([]string{"via", "proxy-connection"}, clientAddressHeaders...)
+		for _, name := range config.ExtraStripHeaders {
+			stripped = append(stripped, strings.ToLower(name))
+		}
+		return stripped
+	}
+	return nil
+}
+
+// applyAnonymity rewrites req's headers for the configured anonymity mode.
+// It runs after the header rules, so they can't reintroduce what it strips.
+// Requests to reverse proxy backends keep their X-Forwarded-* headers.
+func applyAnonymity(config *Config, req *HTTPRequest) {
+	if req.ReverseRoute != "" {
+		return
+	}
+	for _, name := range anonymityStrippedHeaders(config) {
+		delete(req.Headers, name)
+	}
+
+	if config.Anonymity == "anonymous" {
+		via := strings.TrimPrefix(req.Version, "HTTP/") + " " + viaPseudonym + " (" + Product() + ")"
+		if existing, ok := req.Headers["via"]; ok {
+			via = existing + ", " + via
+		}
+		req.Headers["via"] = via
+	}
+}
+
+// checkAnonymityRules rejects request header rules that set or add a header
+// the anonymity mode strips, since the rule would silently have no effect
+func checkAnonymityRules(config *Config, rules *HeaderRules) error {
+	stripped := make(map[string]bool)
+	for _, name := range anonymityStrippedHeaders(config) {
+		stripped[name] = true
+	}
+
+	for _, rule := range rules.rules {
+		if !rule.response && rule.action != "remove" && stripped[rule.name] {
+			return fmt.Errorf("header rule %s %s conflicts with anonymity=%s, which strips it", rule.action, capitalizeHeader(rule.name), config.Anonymity)
+		}
+	}
+	return nil
+}
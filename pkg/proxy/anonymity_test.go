@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// identifyingHeaders are sent with each request, as a client behind
+// another proxy might send them
+var identifyingHeaders = []string{
+	"X-Forwarded-For: 198.51.100.7",
+	"X-Real-IP: 198.51.100.7",
+	"Forwarded: for=198.51.100.7",
+	"Via: 1.1 upstream-proxy",
+	"Proxy-Connection: keep-alive",
+	"X-Client-Tag: laptop-42",
+	"User-Agent: test-client",
+}
+
+func TestAnonymityHeadersReachingOrigin(t *testing.T) {
+	tests := []struct {
+		mode    string
+		present []string // headers the origin must see
+		absent  []string // headers it must not
+		via     string   // the Via it must see, "" for none
+	}{
+		{
+			mode:    "transparent",
+			present: []string{"X-Forwarded-For", "X-Real-Ip", "Forwarded", "Proxy-Connection", "X-Client-Tag", "User-Agent"},
+			via:     "1.1 upstream-proxy",
+		},
+		{
+			mode:    "anonymous",
+			present: []string{"Proxy-Connection", "X-Client-Tag", "User-Agent"},
+			absent:  []string{"X-Forwarded-For", "X-Real-Ip", "Forwarded"},
+			via:     "1.1 upstream-proxy, 1.1 proxy (" + Product() + ")",
+		},
+		{
+			mode:    "elite",
+			present: []string{"User-Agent"},
+			absent:  []string{"X-Forwarded-For", "X-Real-Ip", "Forwarded", "Via", "Proxy-Connection", "X-Client-Tag"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			received := make(chan http.Header, 1)
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- r.Header.Clone()
+			}))
+			defer origin.Close()
+
+			config := testConfig(t)
+			config.Anonymity = tt.mode
+			config.ExtraStripHeaders = []string{"X-Client-Tag"}
+			_, addr := startServer(t, config)
+
+			conn := dialProxy(t, addr)
+			fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\n%s\r\n\r\n", origin.URL, hostOf(origin.URL), strings.Join(identifyingHeaders, "\r\n"))
+			readResponse(t, conn, 5*time.Second)
+			headers := <-received
+
+			for _, name := range tt.present {
+				if _, ok := headers[name]; !ok {
+					t.Errorf("%s didn't reach the origin", name)
+				}
+			}
+			for _, name := range tt.absent {
+				if value, ok := headers[name]; ok {
+					t.Errorf("%s reached the origin: %q", name, value)
+				}
+			}
+			if got := headers.Get("Via"); got != tt.via {
+				t.Errorf("origin got Via %q, want %q", got, tt.via)
+			}
+		})
+	}
+}
+
+func TestAnonymityConflictingHeaderRule(t *testing.T) {
+	config := testConfig(t)
+	config.Anonymity = "anonymous"
+	config.HeaderRulesFile = filepath.Join(t.TempDir(), "header_rules.txt")
+	if err := os.WriteFile(config.HeaderRulesFile, []byte("request set X-Forwarded-For ${client_ip}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(config); err == nil || !strings.Contains(err.Error(), "conflicts with anonymity=anonymous") {
+		t.Errorf("NewServer returned %v, want the rule rejected", err)
+	}
+
+	// Removing a header the mode strips anyway is harmless
+	os.WriteFile(config.HeaderRulesFile, []byte("request remove X-Forwarded-For\n"), 0644)
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer rejected a remove rule: %v", err)
+	}
+	s.Shutdown()
+}
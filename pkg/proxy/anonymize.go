@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+)
+
+// IPAnonymizer rewrites client IPs before they are written to persistent logs
+type IPAnonymizer struct {
+	mode string // none, truncate or hash
+	key  []byte
+}
+
+// NewIPAnonymizer creates an anonymizer for the given mode; for hash mode an
+// empty key means a random key is generated for the lifetime of the process
+func NewIPAnonymizer(mode, key string) *IPAnonymizer {
+	a := &IPAnonymizer{mode: mode, key: []byte(key)}
+	if mode == "hash" && len(a.key) == 0 {
+		a.key = make([]byte, 32)
+		rand.Read(a.key)
+	}
+	return a
+}
+
+// Anonymize returns the anonymized form of ip; values that are not IP
+// addresses (e.g. already hashed) are returned unchanged
+func (a *IPAnonymizer) Anonymize(ip string) string {
+	if a == nil || a.mode == "none" || a.mode == "" {
+		return ip
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	switch a.mode {
+	case "truncate":
+		// Zero the last octet of IPv4 and the last 80 bits of IPv6
+		if v4 := parsed.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return parsed.Mask(net.CIDRMask(48, 128)).String()
+	case "hash":
+		mac := hmac.New(sha256.New, a.key)
+		mac.Write(parsed)
+		return hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+
+	return ip
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnonymizeTruncate(t *testing.T) {
+	a := NewIPAnonymizer("truncate", "")
+	tests := []struct {
+		ip, want string
+	}{
+		{"192.0.2.10", "192.0.2.0"},
+		{"192.0.2.255", "192.0.2.0"},
+		{"::ffff:192.0.2.10", "192.0.2.0"},
+		{"2001:db8:1234:5678:9abc:def0:1234:5678", "2001:db8:1234::"},
+		{"2001:db8::1", "2001:db8::"},
+		// Already anonymized addresses come out the same
+		{"192.0.2.0", "192.0.2.0"},
+		{"2001:db8:1234::", "2001:db8:1234::"},
+		// Anything else is left alone
+		{"3a7bd3e2360a3d29", "3a7bd3e2360a3d29"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := a.Anonymize(tt.ip); got != tt.want {
+			t.Errorf("Anonymize(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAnonymizeHash(t *testing.T) {
+	a := NewIPAnonymizer("hash", "secret")
+	for _, ip := range []string{"192.0.2.10", "2001:db8::1"} {
+		hashed := a.Anonymize(ip)
+		if hashed == ip || len(hashed) != 16 {
+			t.Errorf("Anonymize(%q) = %q, want a 16-character hash", ip, hashed)
+		}
+		// The same client stays correlatable
+		if again := a.Anonymize(ip); again != hashed {
+			t.Errorf("Anonymize(%q) = %q, then %q", ip, hashed, again)
+		}
+		// A hash isn't hashed again
+		if again := a.Anonymize(hashed); again != hashed {
+			t.Errorf("Anonymize(%q) = %q, want it unchanged", hashed, again)
+		}
+	}
+
+	if a.Anonymize("192.0.2.10") == a.Anonymize("192.0.2.11") {
+		t.Error("different clients hash the same")
+	}
+	if a.Anonymize("192.0.2.10") != a.Anonymize("::ffff:192.0.2.10") {
+		t.Error("an IPv4-mapped address hashes differently from its IPv4 form")
+	}
+	if NewIPAnonymizer("hash", "other").Anonymize("192.0.2.10") == a.Anonymize("192.0.2.10") {
+		t.Error("different keys give the same hash")
+	}
+	if NewIPAnonymizer("hash", "").Anonymize("192.0.2.10") == NewIPAnonymizer("hash", "").Anonymize("192.0.2.10") {
+		t.Error("generated keys give the same hash")
+	}
+}
+
+func TestAnonymizeNone(t *testing.T) {
+	for _, a := range []*IPAnonymizer{nil, NewIPAnonymizer("none", "")} {
+		if got := a.Anonymize("192.0.2.10"); got != "192.0.2.10" {
+			t.Errorf("Anonymize = %q, want the address unchanged", got)
+		}
+	}
+}
+
+// TestLoggerAnonymizes checks that the access log gets the anonymized
+// address, while the entry the caller built keeps the real one
+func TestLoggerAnonymizes(t *testing.T) {
+	config := DefaultConfig()
+	config.LogFilePath = filepath.Join(t.TempDir(), "access.log")
+	config.LogFormat = "clf"
+	config.LogAnonymizeIPs = "truncate"
+	l, err := NewLogger(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	entry := LogEntry{Timestamp: time.Now(), ClientIP: "192.0.2.10", Method: "GET", RequestTarget: "http://example.com/"}
+	l.Log(entry)
+	if entry.ClientIP != "192.0.2.10" {
+		t.Errorf("caller's entry changed to %q", entry.ClientIP)
+	}
+
+	data, err := os.ReadFile(config.LogFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "192.0.2.0 - ") {
+		t.Errorf("log line %q doesn't start with the truncated address", data)
+	}
+}
@@ -0,0 +1,366 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against for unknown users, so a lookup takes the
+// same time whether or not the user exists. It is made on first use, so
+// commands that never check a password don't pay for a bcrypt.
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// getDummyHash returns dummyHash, making it first if need be
+func getDummyHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	return dummyHash
+}
+
+// credentialsTTL is how long a verified user and password are remembered,
+// sparing the bcrypt comparison on the client's next requests, as Squid's
+// credentialsttl does
+const credentialsTTL = 1 * time.Minute
+
+// maxVerifiedCredentials bounds the verified credentials remembered; the
+// cache is emptied when full
+const maxVerifiedCredentials = 10000
+
+// UserFile holds the users of an htpasswd-style file of user:bcrypt-hash
+// lines, used for Basic proxy authentication
+type UserFile struct {
+	users    map[string][]byte
+	verified map[[sha256.Size]byte]time.Time // expiry of verified credentials, by digest of user and password
+	loads    int                             // counts set calls, so a check against replaced users isn't remembered
+	mu       sync.RWMutex
+	diag     *DiagLogger
+}
+
+// NewUserFile creates an empty user file
+func NewUserFile(diag *DiagLogger) *UserFile {
+	return &UserFile{
+		users:    make(map[string][]byte),
+		verified: make(map[[sha256.Size]byte]time.Time),
+		diag:     diag,
+	}
+}
+
+// Load replaces the users with those read from path. Lines that aren't
+// user:bcrypt-hash are skipped with a warning.
+func (u *UserFile) Load(path string) error {
+	users, err := u.read(path)
+	if err != nil {
+		return err
+	}
+	u.set(path, users)
+	return nil
+}
+
+// read reads the users in path without applying them
+func (u *UserFile) read(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open users file: %w", err)
+	}
+	defer file.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, hash, ok := strings.Cut(line, ":")
+		if !ok || name == "" {
+			u.diag.Warnf("%s:%d: expected user:hash", path, lineNum)
+			continue
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			u.diag.Warnf("%s:%d: user %s does not have a bcrypt hash", path, lineNum, name)
+			continue
+		}
+		users[name] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read users file: %w", err)
+	}
+	return users, nil
+}
+
+// set replaces the users with those read from path, forgetting the
+// credentials verified against the old ones
+func (u *UserFile) set(path string, users map[string][]byte) {
+	u.mu.Lock()
+	u.users = users
+	u.verified = make(map[[sha256.Size]byte]time.Time)
+	u.loads++
+	u.mu.Unlock()
+
+	u.diag.Infof("Loaded %d users from %s", len(users), path)
+}
+
+// Verify checks a username and password. A pair that verified within the
+// last credentialsTTL is accepted without comparing it again.
+func (u *UserFile) Verify(name, password string) bool {
+	key := sha256.Sum256([]byte(name + "\x00" + password))
+	now := time.Now()
+
+	u.mu.RLock()
+	hash, ok := u.users[name]
+	expires, cached := u.verified[key]
+	loads := u.loads
+	u.mu.RUnlock()
+
+	if cached && now.Before(expires) {
+		return true
+	}
+	if !ok {
+		bcrypt.CompareHashAndPassword(getDummyHash(), []byte(password))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	u.mu.Lock()
+	if u.loads == loads {
+		if len(u.verified) >= maxVerifiedCredentials {
+			u.verified = make(map[[sha256.Size]byte]time.Time)
+		}
+		u.verified[key] = now.Add(credentialsTTL)
+	}
+	u.mu.Unlock()
+	return true
+}
+
+// TokenFile holds named bearer tokens read from a file of name:token lines
+type TokenFile struct {
+	tokens map[string][sha256.Size]byte // token digests by name
+	mu     sync.RWMutex
+	diag   *DiagLogger
+}
+
+// NewTokenFile creates an empty token file
+func NewTokenFile(diag *DiagLogger) *TokenFile {
+	return &TokenFile{
+		tokens: make(map[string][sha256.Size]byte),
+		diag:   diag,
+	}
+}
+
+// Load replaces the tokens with those read from path. Lines that aren't
+// name:token are skipped with a warning.
+func (t *TokenFile) Load(path string) error {
+	tokens, err := t.read(path)
+	if err != nil {
+		return err
+	}
+	t.set(path, tokens)
+	return nil
+}
+
+// read reads the tokens in path without applying them
+func (t *TokenFile) read(path string) (map[string][sha256.Size]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tokens file: %w", err)
+	}
+	defer file.Close()
+
+	tokens := make(map[string][sha256.Size]byte)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, token, ok := strings.Cut(line, ":")
+		if !ok || name == "" || token == "" {
+			t.diag.Warnf("%s:%d: expected name:token", path, lineNum)
+			continue
+		}
+		tokens[name] = sha256.Sum256([]byte(token))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tokens file: %w", err)
+	}
+	return tokens, nil
+}
+
+// set replaces the tokens with those read from path
+func (t *TokenFile) set(path string, tokens map[string][sha256.Size]byte) {
+	t.mu.Lock()
+	t.tokens = tokens
+	t.mu.Unlock()
+
+	t.diag.Infof("Loaded %d tokens from %s", len(tokens), path)
+}
+
+// Lookup returns the name of token. Every token is compared, in constant
+// time over digests, so timing reveals neither a match nor its position.
+func (t *TokenFile) Lookup(token string) (string, bool) {
+	digest := sha256.Sum256([]byte(token))
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	match := ""
+	for name, candidate := range t.tokens {
+		if subtle.ConstantTimeCompare(digest[:], candidate[:]) == 1 {
+			match = name
+		}
+	}
+	return match, match != ""
+}
+
+// Authentication failures, logged as the AUTH_FAILED reason; they never
+// include the presented credentials
+var (
+	errNoCredentials      = errors.New("missing credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticator decides who sent a request. Authenticate returns the
+// identity of the client, empty if it has none, which is logged as the
+// user and selects its policy; or ok false with the Proxy-Authenticate
+// challenge to answer the 407 with. Several challenges are separated by
+// newlines; an empty one challenges Basic with auth_realm. NewAuthenticator
+// builds the one auth_mode selects; WithAuthenticator supplies another.
+type Authenticator interface {
+	Authenticate(req *HTTPRequest, conn ConnInfo) (identity string, ok bool, challenge string)
+}
+
+// NoAuth lets every request through with no identity
+type NoAuth struct{}
+
+// Authenticate accepts the request
+func (NoAuth) Authenticate(req *HTTPRequest, conn ConnInfo) (string, bool, string) {
+	return "", true, ""
+}
+
+// TokenAuth checks a bearer token. The header is "Bearer <token>" or Basic
+// credentials whose password is the named user's token in Tokens; the
+// legacy Token must match the whole header and has no identity.
+type TokenAuth struct {
+	Token  string     // authentication_token; empty for none
+	Tokens *TokenFile // auth_tokens_file; nil for none
+	Realm  string
+}
+
+// Authenticate checks the request's Proxy-Authorization header
+func (a *TokenAuth) Authenticate(req *HTTPRequest, conn ConnInfo) (string, bool, string) {
+	challenge := fmt.Sprintf("Basic realm=%q\nBearer realm=%q", a.Realm, a.Realm)
+	header := req.Headers["proxy-authorization"]
+	if header == "" {
+		return "", false, challenge
+	}
+	if a.Token != "" && subtle.ConstantTimeCompare([]byte(header), []byte(a.Token)) == 1 {
+		return "", true, ""
+	}
+	if a.Tokens == nil {
+		return "", false, challenge
+	}
+	if scheme, token, ok := strings.Cut(header, " "); ok && strings.EqualFold(scheme, "Bearer") {
+		if name, ok := a.Tokens.Lookup(strings.TrimSpace(token)); ok {
+			return name, true, ""
+		}
+		return "", false, challenge
+	}
+	if user, token, ok := parseBasicAuth(header); ok {
+		if name, ok := a.Tokens.Lookup(token); ok && name == user {
+			return name, true, ""
+		}
+	}
+	return "", false, challenge
+}
+
+// BasicAuth checks Basic credentials against the users in Users
+type BasicAuth struct {
+	Users *UserFile
+	Realm string
+}
+
+// Authenticate checks the request's Proxy-Authorization header
+func (a *BasicAuth) Authenticate(req *HTTPRequest, conn ConnInfo) (string, bool, string) {
+	name, password, ok := parseBasicAuth(req.Headers["proxy-authorization"])
+	if !ok || !a.Users.Verify(name, password) {
+		return "", false, fmt.Sprintf("Basic realm=%q", a.Realm)
+	}
+	return name, true, ""
+}
+
+// NewAuthenticator returns the built-in Authenticator for config's
+// auth_mode, checking credentials against users and tokens as loaded from
+// auth_users_file and auth_tokens_file
+func NewAuthenticator(config *Config, users *UserFile, tokens *TokenFile) Authenticator {
+	switch config.AuthMode {
+	case "token":
+		auth := &TokenAuth{Token: config.AuthToken, Realm: config.AuthRealm}
+		if config.AuthTokensFile != "" {
+			auth.Tokens = tokens
+		}
+		return auth
+	case "basic":
+		return &BasicAuth{Users: users, Realm: config.AuthRealm}
+	}
+	return NoAuth{}
+}
+
+// authenticator returns the Authenticator for requests under config: the
+// one given to WithAuthenticator, or the built-in one for auth_mode
+func (s *Server) authenticator(config *Config) Authenticator {
+	if s.options.auth != nil {
+		return s.options.auth
+	}
+	return NewAuthenticator(config, s.users, s.tokens)
+}
+
+// authChallenge returns the Proxy-Authenticate headers sent with a 407 for
+// an Authenticator's challenge
+func authChallenge(config *Config, challenge string) []string {
+	if challenge == "" {
+		challenge = fmt.Sprintf("Basic realm=%q", config.AuthRealm)
+	}
+	lines := strings.FieldsFunc(challenge, func(r rune) bool { return r == '\n' || r == '\r' })
+	headers := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			headers = append(headers, "Proxy-Authenticate: "+line)
+		}
+	}
+	return headers
+}
+
+// parseBasicAuth decodes a "Basic <base64 user:password>" header
+func parseBasicAuth(header string) (string, string, bool) {
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeUsersFile writes an htpasswd file giving user password, hashed at
+// the lowest cost so the test stays fast
+func writeUsersFile(t *testing.T, path, user, password string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(user+":"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUserFileVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsersFile(t, path, "alice", "secret")
+	users := NewUserFile(nil)
+	if err := users.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, password string
+		want           bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+		{"alice", "", false},
+	}
+	for _, tt := range tests {
+		if got := users.Verify(tt.name, tt.password); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %t, want %t", tt.name, tt.password, got, tt.want)
+		}
+	}
+	if len(users.verified) != 1 {
+		t.Errorf("%d credentials remembered, want only the one that verified", len(users.verified))
+	}
+}
+
+func TestUserFileRemembersVerified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsersFile(t, path, "alice", "secret")
+	users := NewUserFile(nil)
+	if err := users.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if !users.Verify("alice", "secret") {
+		t.Fatal("Verify failed for the right password")
+	}
+
+	// With the hash gone, only the cache can accept the password
+	users.mu.Lock()
+	users.users["alice"] = []byte("$2a$04$invalidinvalidinvalidinvalidinvalidinvalidinvalidinva")
+	users.mu.Unlock()
+	if !users.Verify("alice", "secret") {
+		t.Error("verified credentials weren't remembered")
+	}
+
+	// Until they expire
+	users.mu.Lock()
+	for key := range users.verified {
+		users.verified[key] = time.Now().Add(-time.Second)
+	}
+	users.mu.Unlock()
+	if users.Verify("alice", "secret") {
+		t.Error("expired credentials were still accepted")
+	}
+}
+
+func TestUserFileReloadForgetsVerified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsersFile(t, path, "alice", "secret")
+	users := NewUserFile(nil)
+	if err := users.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if !users.Verify("alice", "secret") {
+		t.Fatal("Verify failed for the right password")
+	}
+
+	writeUsersFile(t, path, "alice", "changed")
+	if err := users.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if users.Verify("alice", "secret") {
+		t.Error("old password accepted after the users file was reloaded")
+	}
+	if !users.Verify("alice", "changed") {
+		t.Error("new password rejected after the users file was reloaded")
+	}
+}
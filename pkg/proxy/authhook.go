@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authHookRequest is the document POSTed to auth_hook_url for each request
+type authHookRequest struct {
+	ClientIP string `json:"client_ip"`
+	Username string `json:"username,omitempty"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Method   string `json:"method"`
+	Target   string `json:"target"`
+}
+
+// AuthVerdict is the hook's decision. A denial may carry the status code
+// and message to send the client, defaulting to 403 Forbidden.
+type AuthVerdict struct {
+	Allow   bool   `json:"allow"`
+	Status  int    `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// cachedVerdict is a verdict and when it stops being used
+type cachedVerdict struct {
+	verdict AuthVerdict
+	expires time.Time
+}
+
+// AuthHook asks an external service whether a request may proceed, caching
+// verdicts per client, user and destination for auth_hook_cache_ttl
+type AuthHook struct {
+	client *http.Client
+
+	mu       sync.Mutex // guards the fields below; never held during a hook call
+	url      string
+	timeout  time.Duration
+	ttl      time.Duration
+	maxSize  int
+	verdicts map[string]cachedVerdict
+}
+
+// NewAuthHook creates an auth hook from the configuration
+func NewAuthHook(config *Config) *AuthHook {
+	h := &AuthHook{
+		client:   &http.Client{},
+		verdicts: make(map[string]cachedVerdict),
+	}
+	h.Reconfigure(config)
+	return h
+}
+
+// Reconfigure applies reloaded hook settings; cached verdicts are dropped
+// if the hook URL changed
+func (h *AuthHook) Reconfigure(config *Config) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if config.AuthHookURL != h.url {
+		h.verdicts = make(map[string]cachedVerdict)
+	}
+	h.url = config.AuthHookURL
+	h.timeout = config.AuthHookTimeout
+	h.ttl = config.AuthHookCacheTTL
+	h.maxSize = config.AuthHookCacheSize
+}
+
+// Enabled reports whether a hook URL is configured
+func (h *AuthHook) Enabled() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.url != ""
+}
+
+// Check returns the verdict for req from clientIP, from the cache or by
+// calling the hook. An error means the hook couldn't be reached or gave
+// an unusable answer; the caller applies auth_hook_fail_open.
+func (h *AuthHook) Check(clientIP string, req *HTTPRequest) (AuthVerdict, error) {
+	key := clientIP + "|" + req.Username + "|" + req.Host + ":" + strconv.Itoa(req.Port)
+
+	h.mu.Lock()
+	url, timeout := h.url, h.timeout
+	if cached, ok := h.verdicts[key]; ok && time.Now().Before(cached.expires) {
+		h.mu.Unlock()
+		return cached.verdict, nil
+	}
+	h.mu.Unlock()
+
+	verdict, err := h.call(url, timeout, authHookRequest{
+		ClientIP: clientIP,
+		Username: req.Username,
+		Host:     req.Host,
+		Port:     req.Port,
+		Method:   req.Method,
+		Target:   req.RequestTarget,
+	})
+	if err != nil {
+		return AuthVerdict{}, err
+	}
+
+	h.store(key, verdict)
+	return verdict, nil
+}
+
+// call POSTs one request to the hook and decodes its verdict
+func (h *AuthHook) call(url string, timeout time.Duration, body authHookRequest) (AuthVerdict, error) {
+	var verdict AuthVerdict
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return verdict, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return verdict, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return verdict, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return verdict, fmt.Errorf("auth hook returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&verdict); err != nil {
+		return verdict, fmt.Errorf("invalid auth hook response: %w", err)
+	}
+	return verdict, nil
+}
+
+// store caches a verdict. When the cache is full, expired verdicts are
+// dropped first, then arbitrary ones, so it stays within auth_hook_cache_size.
+func (h *AuthHook) store(key string, verdict AuthVerdict) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.ttl <= 0 || h.maxSize <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if len(h.verdicts) >= h.maxSize {
+		for k, cached := range h.verdicts {
+			if now.After(cached.expires) {
+				delete(h.verdicts, k)
+			}
+		}
+		for k := range h.verdicts {
+			if len(h.verdicts) < h.maxSize {
+				break
+			}
+			delete(h.verdicts, k)
+		}
+	}
+	h.verdicts[key] = cachedVerdict{verdict: verdict, expires: now.Add(h.ttl)}
+}
+
+// denial returns the status code and single-line message to send for a
+// denying verdict
+func (v AuthVerdict) denial() (int, string) {
+	status, message := v.Status, v.Message
+	if status < 400 || status > 599 {
+		status = 403
+	}
+	message = strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, message)
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	return status, message
+}
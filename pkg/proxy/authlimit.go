@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// AuthFailureLimiter slows password guessing: each client may present
+// auth_failure_limit wrong credentials a minute, in a burst or spread out,
+// and is then refused with 429 before its credentials are checked until
+// the allowance refills. Requests without credentials, such as the first
+// try of a client waiting to be challenged, don't count.
+type AuthFailureLimiter struct {
+	mu         sync.Mutex
+	buckets    map[string]*tokenBucket
+	limit      float64 // failures allowed per minute, and the burst
+	ipv6Prefix int
+	lastGC     time.Time
+}
+
+// NewAuthFailureLimiter creates a failure limiter from the configuration
+func NewAuthFailureLimiter(config *Config) *AuthFailureLimiter {
+	al := &AuthFailureLimiter{
+		buckets: make(map[string]*tokenBucket),
+		lastGC:  time.Now(),
+	}
+	al.Reconfigure(config)
+	return al
+}
+
+// Reconfigure applies a reloaded auth_failure_limit; clients keep what is
+// left of their allowance, capped at the new limit
+func (al *AuthFailureLimiter) Reconfigure(config *Config) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.limit = float64(config.AuthFailureLimit)
+	al.ipv6Prefix = config.IPv6LimitPrefix
+}
+
+// Blocked reports whether the client at addr has used up its allowance,
+// and how long until it may try again
+func (al *AuthFailureLimiter) Blocked(addr net.Addr) (bool, time.Duration) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.limit <= 0 {
+		return false, 0
+	}
+	bucket := al.refill(addr, time.Now())
+	if bucket == nil || bucket.tokens >= 1 {
+		return false, 0
+	}
+	return true, time.Duration((1 - bucket.tokens) / al.rate() * float64(time.Second))
+}
+
+// Fail counts a failed attempt by the client at addr
+func (al *AuthFailureLimiter) Fail(addr net.Addr) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.limit <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(al.lastGC) >= rateLimitGCInterval {
+		al.gc(now)
+	}
+	bucket := al.refill(addr, now)
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: al.limit, last: now}
+		al.buckets[connLimitKey(addr, al.ipv6Prefix)] = bucket
+	}
+	bucket.tokens = math.Max(0, bucket.tokens-1)
+}
+
+// rate is the allowance regained per second; the caller must hold al.mu
+func (al *AuthFailureLimiter) rate() float64 {
+	return al.limit / 60
+}
+
+// refill tops up addr's bucket for the time since it was last used,
+// returning nil if the client has no recent failures; the caller must hold
+// al.mu
+func (al *AuthFailureLimiter) refill(addr net.Addr, now time.Time) *tokenBucket {
+	bucket, ok := al.buckets[connLimitKey(addr, al.ipv6Prefix)]
+	if !ok {
+		return nil
+	}
+	bucket.tokens = math.Min(al.limit, bucket.tokens+now.Sub(bucket.last).Seconds()*al.rate())
+	bucket.last = now
+	return bucket
+}
+
+// gc drops the buckets of clients whose allowance has refilled; the caller
+// must hold al.mu
+func (al *AuthFailureLimiter) gc(now time.Time) {
+	for key, bucket := range al.buckets {
+		if now.Sub(bucket.last) >= time.Minute {
+			delete(al.buckets, key)
+		}
+	}
+	al.lastGC = now
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ipFailureThreshold is how many consecutive failed dials put an upstream
+// address into its cooldown
+const ipFailureThreshold = 2
+
+// maxTrackedIPs bounds the failure table; entries past their cooldown are
+// dropped when it fills up
+const maxTrackedIPs = 10000
+
+// minDialAttempt is the least time given to one address when the connect
+// timeout is shared between several
+const minDialAttempt = 2 * time.Second
+
+// ResolvedAddrBlockedError refuses a dial to a host name whose every
+// address is blocked by an IP rule
+type ResolvedAddrBlockedError struct {
+	Host string
+	IP   string // the first blocked address
+	Rule string
+}
+
+func (e *ResolvedAddrBlockedError) Error() string {
+	return fmt.Sprintf("%s resolves to blocked address %s (rule %s)", e.Host, e.IP, e.Rule)
+}
+
+// ipFailure tracks consecutive dial failures to one upstream address
+type ipFailure struct {
+	count int
+	until time.Time // deprioritized until then
+}
+
+// AddrBalancer spreads requests across the addresses an origin resolves to
+// and moves addresses that keep failing to the back of the order for a
+// cooldown period
+type AddrBalancer struct {
+	next     atomic.Uint32 // round-robin position
+	mu       sync.Mutex
+	failures map[string]*ipFailure
+}
+
+// NewAddrBalancer creates a balancer with no failures recorded
+func NewAddrBalancer() *AddrBalancer {
+	return &AddrBalancer{failures: make(map[string]*ipFailure)}
+}
+
+// Order returns the addresses to try, in order. upstream_ip_selection picks
+// the starting point (round_robin, random, or first to keep the resolver's
+// order); families are then interleaved as in RFC 8305, and addresses in
+// their cooldown go last.
+func (b *AddrBalancer) Order(addrs []net.IPAddr, selection string) []net.IP {
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+
+	switch selection {
+	case "round_robin":
+		offset := int(b.next.Add(1)) % len(ips)
+		ips = append(ips[offset:], ips[:offset]...)
+	case "random":
+		rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+	}
+	ips = interleaveFamilies(ips)
+
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ordered := make([]net.IP, 0, len(ips))
+	var cooling []net.IP
+	for _, ip := range ips {
+		if failure, ok := b.failures[ip.String()]; ok && now.Before(failure.until) {
+			cooling = append(cooling, ip)
+			continue
+		}
+		ordered = append(ordered, ip)
+	}
+	return append(ordered, cooling...)
+}
+
+// interleaveFamilies alternates IPv6 and IPv4 addresses, starting with the
+// family of the first, keeping the order within each family
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var first, second []net.IP
+	for _, ip := range ips {
+		if len(first) == 0 || (ip.To4() == nil) == (first[0].To4() == nil) {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// ReportSuccess clears an address's failures
+func (b *AddrBalancer) ReportSuccess(ip net.IP) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, ip.String())
+}
+
+// ReportFailure counts a failed dial, starting a cooldown once an address
+// has failed ipFailureThreshold times in a row
+func (b *AddrBalancer) ReportFailure(ip net.IP, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	key := ip.String()
+	failure, ok := b.failures[key]
+	if !ok {
+		if len(b.failures) >= maxTrackedIPs {
+			for k, f := range b.failures {
+				if now.After(f.until) {
+					delete(b.failures, k)
+				}
+			}
+		}
+		failure = &ipFailure{}
+		b.failures[key] = failure
+	}
+	failure.count++
+	if failure.count >= ipFailureThreshold {
+		failure.until = now.Add(cooldown)
+	}
+}
+
+// dialDirect connects straight to req's destination. A host name is
+// resolved once to all its addresses; those the address check blocks are
+// dropped, and the rest are dialed as literals in the balancer's order
+// until one connects, sharing upstream_connect_timeout between them. The
+// address used is recorded in req.UpstreamIP.
+func (f *Forwarder) dialDirect(ctx context.Context, req *HTTPRequest, config *Config) (net.Conn, error) {
+	port := strconv.Itoa(req.Port)
+	timeout := config.UpstreamConnectTimeout
+	if net.ParseIP(req.Host) != nil {
+		req.Trace.begin(phaseConnect)
+		return f.dialAddr(ctx, net.JoinHostPort(req.Host, port), timeout)
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	req.Trace.begin(phaseDNS)
+	addrs, err := f.resolver.LookupIPAddr(ctx, req.Host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: req.Host, IsNotFound: true}
+	}
+	if addrs, err = f.vetAddrs(req, addrs); err != nil {
+		return nil, err
+	}
+
+	req.Trace.begin(phaseConnect)
+	ips := f.balancer.Order(addrs, config.UpstreamIPSelection)
+	var firstErr error
+	for i, ip := range ips {
+		attempt := timeout
+		if timeout > 0 {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				break
+			}
+			attempt = max(remaining/time.Duration(len(ips)-i), min(remaining, minDialAttempt))
+		}
+
+		conn, err := f.dialAddr(ctx, net.JoinHostPort(ip.String(), port), attempt)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if err == nil {
+			f.balancer.ReportSuccess(ip)
+			req.UpstreamIP = ip.String()
+			return conn, nil
+		}
+		f.balancer.ReportFailure(ip, config.UpstreamIPCooldown)
+		f.diag.Debugf("Upstream dial to %s at %s failed: %v", req.Host, ip, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("connect timeout exceeded")
+	}
+	return nil, firstErr
+}
+
+// vetAddrs returns the addresses the address check passes, or a
+// ResolvedAddrBlockedError if it blocks them all
+func (f *Forwarder) vetAddrs(req *HTTPRequest, addrs []net.IPAddr) ([]net.IPAddr, error) {
+	if f.checkAddr == nil {
+		return addrs, nil
+	}
+	var blocked *ResolvedAddrBlockedError
+	approved := addrs[:0:0]
+	for _, addr := range addrs {
+		if rule, ok := f.checkAddr(req, addr.IP); ok {
+			f.diag.Debugf("Request %s: %s resolved to blocked address %s (rule %s)", req.ID, req.Host, addr.IP, rule)
+			if blocked == nil {
+				blocked = &ResolvedAddrBlockedError{Host: req.Host, IP: addr.IP.String(), Rule: rule}
+			}
+			continue
+		}
+		approved = append(approved, addr)
+	}
+	if len(approved) == 0 {
+		return nil, blocked
+	}
+	return approved, nil
+}
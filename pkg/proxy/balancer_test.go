@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rebindingResolver answers each lookup with the next of its answers, as
+// a malicious authoritative server switching a name's address would
+type rebindingResolver struct {
+	mu      sync.Mutex
+	answers []string
+	lookups int
+}
+
+func (r *rebindingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ip := r.answers[r.lookups%len(r.answers)]
+	r.lookups++
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+}
+
+// TestDialPinsVettedAddress checks that a host name is resolved once per
+// dial, and the address the check passed is the one dialed, so an answer
+// that changes between the check and the dial can't reach a blocked address
+func TestDialPinsVettedAddress(t *testing.T) {
+	resolver := &rebindingResolver{answers: []string{"203.0.113.10", "127.0.0.1"}}
+	var dialed []string
+	f := NewForwarder(DefaultConfig(), nil)
+	f.SetResolver(resolver)
+	f.SetDialer(func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+		dialed = append(dialed, address)
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+	f.SetAddrCheck(func(req *HTTPRequest, ip net.IP) (string, bool) {
+		return "127.0.0.0/8", ip.IsLoopback()
+	})
+	config := DefaultConfig()
+
+	// The first answer is public and passes; the dial must use it rather
+	// than look the name up again and get the loopback answer
+	req := &HTTPRequest{Host: "rebind.example", Port: 80}
+	conn, err := f.dialDirect(context.Background(), req, config)
+	if err != nil {
+		t.Fatalf("dial with a public answer failed: %v", err)
+	}
+	conn.Close()
+	if resolver.lookups != 1 {
+		t.Errorf("dial looked the name up %d times, want once", resolver.lookups)
+	}
+	if len(dialed) != 1 || dialed[0] != "203.0.113.10:80" {
+		t.Errorf("dialed %v, want the vetted address 203.0.113.10:80", dialed)
+	}
+	if req.UpstreamIP != "203.0.113.10" {
+		t.Errorf("request records upstream IP %q, want 203.0.113.10", req.UpstreamIP)
+	}
+
+	// The next answer is loopback, which is refused without a dial
+	req = &HTTPRequest{Host: "rebind.example", Port: 80}
+	_, err = f.dialDirect(context.Background(), req, config)
+	var blocked *ResolvedAddrBlockedError
+	if !errors.As(err, &blocked) || blocked.IP != "127.0.0.1" {
+		t.Errorf("dial with a loopback answer returned %v, want it blocked", err)
+	}
+	if len(dialed) != 1 {
+		t.Errorf("dialed %v after the loopback answer, want no new dial", dialed)
+	}
+}
@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BandwidthProfile simulates a slower link for the connections mapped to
+// it: their reads and writes are paced to its rates, and the first byte of
+// each response is held back by its added round-trip time
+type BandwidthProfile struct {
+	Name string
+	down int64 // bytes per second to the client; 0 for no limit
+	up   int64 // bytes per second from the client; 0 for no limit
+	rtt  time.Duration
+}
+
+// bandwidthMapping maps a client network or a destination host pattern to
+// a profile
+type bandwidthMapping struct {
+	network     *net.IPNet // client addresses; nil for a host mapping
+	hostPattern string     // exact host, *.suffix or * for every host
+	profile     *BandwidthProfile
+}
+
+// BandwidthProfiles holds the profiles and the ordered mappings of the
+// bandwidth profiles file
+type BandwidthProfiles struct {
+	profiles map[string]*BandwidthProfile
+	mappings []bandwidthMapping
+}
+
+// LoadBandwidthProfiles loads the bandwidth profiles file, whose lines are:
+//
+//	profile name [down=bps] [up=bps] [rtt=duration]
+//	client cidr profile-name
+//	host host-pattern profile-name
+//
+// Rates are in bits per second, with an optional k, m or g suffix. The
+// first mapping that matches a request applies. An empty path loads no
+// profiles.
+func LoadBandwidthProfiles(path string) (*BandwidthProfiles, error) {
+	bp := &BandwidthProfiles{profiles: make(map[string]*BandwidthProfile)}
+	if path == "" {
+		return bp, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bandwidth profiles file: %w", err)
+	}
+	defer file.Close()
+
+	type pending struct {
+		line    int
+		mapping bandwidthMapping
+		profile string
+	}
+	var mappings []pending
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch strings.ToLower(fields[0]) {
+		case "profile":
+			profile, err := parseBandwidthProfile(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+			}
+			if _, ok := bp.profiles[profile.Name]; ok {
+				return nil, fmt.Errorf("%s:%d: profile %q defined twice", path, lineNum, profile.Name)
+			}
+			bp.profiles[profile.Name] = profile
+		case "client":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s:%d: want \"client cidr profile\"", path, lineNum)
+			}
+			networks, err := parseCIDRList(fields[1:2])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+			}
+			mappings = append(mappings, pending{lineNum, bandwidthMapping{network: networks[0]}, fields[2]})
+		case "host":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s:%d: want \"host host-pattern profile\"", path, lineNum)
+			}
+			mappings = append(mappings, pending{lineNum, bandwidthMapping{hostPattern: strings.ToLower(fields[1])}, fields[2]})
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown directive %q (want profile, client or host)", path, lineNum, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read bandwidth profiles file: %w", err)
+	}
+
+	// Mappings may come before the profiles they name
+	for _, m := range mappings {
+		profile, ok := bp.profiles[m.profile]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown profile %q", path, m.line, m.profile)
+		}
+		m.mapping.profile = profile
+		bp.mappings = append(bp.mappings, m.mapping)
+	}
+	return bp, nil
+}
+
+// parseBandwidthProfile parses the name and settings of a profile line
+func parseBandwidthProfile(fields []string) (*BandwidthProfile, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("profile needs a name")
+	}
+	profile := &BandwidthProfile{Name: fields[0]}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid profile setting %q (want key=value)", field)
+		}
+		switch key {
+		case "down", "up":
+			bps, err := parseBitRate(value)
+			if err != nil {
+				return nil, fmt.Errorf("profile %s: invalid %s rate %q", profile.Name, key, value)
+			}
+			if key == "down" {
+				profile.down = bps / 8
+			} else {
+				profile.up = bps / 8
+			}
+		case "rtt":
+			d, err := parseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("profile %s: invalid rtt %q", profile.Name, value)
+			}
+			profile.rtt = d
+		default:
+			return nil, fmt.Errorf("profile %s: unknown setting %q", profile.Name, key)
+		}
+	}
+	return profile, nil
+}
+
+// parseBitRate parses a rate of at least 8 bits per second, with an
+// optional k, m or g (decimal) multiplier
+func parseBitRate(value string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToLower(value[len(value)-1:]) {
+	case "k":
+		multiplier = 1000
+	case "m":
+		multiplier = 1000 * 1000
+	case "g":
+		multiplier = 1000 * 1000 * 1000
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n*float64(multiplier) < 8 {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// Len returns the number of profiles
+func (bp *BandwidthProfiles) Len() int {
+	return len(bp.profiles)
+}
+
+// Match returns the profile of the first mapping that matches a request
+// from clientIP for host, or nil
+func (bp *BandwidthProfiles) Match(clientIP net.IP, host string) *BandwidthProfile {
+	host = strings.ToLower(host)
+	for _, m := range bp.mappings {
+		if m.network != nil {
+			if clientIP != nil && m.network.Contains(clientIP) {
+				return m.profile
+			}
+			continue
+		}
+		if m.hostPattern == "*" || host == m.hostPattern {
+			return m.profile
+		}
+		if suffix, ok := strings.CutPrefix(m.hostPattern, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return m.profile
+			}
+		}
+	}
+	return nil
+}
+
+// shaper paces one client connection to a bandwidth profile
+type shaper struct {
+	profile *BandwidthProfile
+	down    *pacer      // writes to the client; nil for no limit
+	up      *pacer      // reads from the client; nil for no limit
+	rttDue  atomic.Bool // the added RTT is owed before the next write
+}
+
+func newShaper(profile *BandwidthProfile) *shaper {
+	sh := &shaper{profile: profile}
+	if profile.down > 0 {
+		sh.down = newPacer(profile.down)
+	}
+	if profile.up > 0 {
+		sh.up = newPacer(profile.up)
+	}
+	return sh
+}
+
+// pacer is a token bucket of bytes, refilled at rate per second up to a
+// burst of a twentieth of a second's worth
+type pacer struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newPacer(rate int64) *pacer {
+	burst := math.Max(512, float64(rate)/20)
+	return &pacer{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// chunk returns how many of n bytes to move at once
+func (p *pacer) chunk(n int) int {
+	if n > int(p.burst) {
+		return int(p.burst)
+	}
+	return n
+}
+
+// wait takes n bytes from the bucket, sleeping until it has them; the
+// bucket may go into debt, which later callers wait out
+func (p *pacer) wait(n int) {
+	p.mu.Lock()
+	now := time.Now()
+	p.tokens = math.Min(p.burst, p.tokens+now.Sub(p.last).Seconds()*p.rate)
+	p.last = now
+	p.tokens -= float64(n)
+	debt := p.tokens
+	p.mu.Unlock()
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / p.rate * float64(time.Second)))
+	}
+}
+
+// read reads from conn at the profile's uplink rate
+func (sh *shaper) read(conn net.Conn, b []byte) (int, error) {
+	if sh.up == nil {
+		return conn.Read(b)
+	}
+	n, err := conn.Read(b[:sh.up.chunk(len(b))])
+	sh.up.wait(n)
+	return n, err
+}
+
+// write writes to conn at the profile's downlink rate, after the added RTT
+// if a response is starting
+func (sh *shaper) write(conn net.Conn, b []byte) (int, error) {
+	if sh.rttDue.Swap(false) && sh.profile.rtt > 0 {
+		time.Sleep(sh.profile.rtt)
+	}
+	if sh.down == nil {
+		return conn.Write(b)
+	}
+	written := 0
+	for written < len(b) {
+		n := sh.down.chunk(len(b) - written)
+		sh.down.wait(n)
+		n, err := conn.Write(b[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// shapeRequest applies the profile for req to the connection it arrived
+// on, from the bandwidth profiles loaded when the connection was accepted,
+// so a reload only changes the profiles of new connections. A pipelined
+// request mapped to the same profile carries on with its buckets.
+func (c *labeledConn) shapeRequest(req *HTTPRequest) {
+	if c == nil || c.profiles == nil {
+		return
+	}
+	var clientIP net.IP
+	if tcpAddr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = tcpAddr.IP
+	}
+	profile := c.profiles.Match(clientIP, req.Host)
+	if profile == nil {
+		c.shape.Store(nil)
+		return
+	}
+	sh := c.shape.Load()
+	if sh == nil || sh.profile != profile {
+		sh = newShaper(profile)
+		c.shape.Store(sh)
+	}
+	sh.rttDue.Store(true)
+}
+
+// bandwidthProfile returns the name of the profile conn is shaped to, if any
+func bandwidthProfile(conn net.Conn) string {
+	if lc := clientConn(conn); lc != nil {
+		if sh := lc.shape.Load(); sh != nil {
+			return sh.profile.Name
+		}
+	}
+	return ""
+}
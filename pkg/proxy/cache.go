@@ -0,0 +1,451 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheEntry represents a cached HTTP response
+type CacheEntry struct {
+	Headers      map[string]string
+	StatusCode   int
+	StatusText   string // reason phrase of the status line, such as "OK"
+	Body         []byte
+	Expires      time.Time // zero for an entry that is kept until evicted
+	LastAccessed time.Time
+	Size         int64
+}
+
+// CacheBackend stores responses for a Server. The in-memory *Cache is the
+// default; cache_backend = redis uses a RedisCache shared by several
+// proxies, and WithCache supplies any other.
+type CacheBackend interface {
+	// Get returns the response stored under key, if any and not expired.
+	// A backend that can't be reached reports a miss.
+	Get(key string) (*CacheEntry, bool)
+
+	// Put stores entry under key, reporting whether it was stored
+	Put(key string, entry *CacheEntry) bool
+
+	// Delete removes the response stored under key
+	Delete(key string)
+
+	// Clear removes every response; the counters are kept
+	Clear()
+
+	// Stats describes the backend's usage and counters for /stats
+	Stats() CacheStats
+}
+
+// expired reports whether the entry's Expires time has passed
+func (e *CacheEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// defaultCacheTTL is cache_default_ttl unless it is set: how long a
+// response without s-maxage, max-age or Expires is served from the cache
+const defaultCacheTTL = time.Hour
+
+// cacheEntryOverhead estimates the memory an entry takes beyond its key,
+// body and header strings: the CacheEntry itself, its map slot and its place
+// in the LRU list
+const cacheEntryOverhead = 256
+
+// Cache provides LRU caching for HTTP responses
+type Cache struct {
+	entries     map[string]*CacheEntry
+	accessOrder []string // LRU list
+	maxEntries  int
+	maxSize     int64 // Maximum total size in bytes
+	currentSize int64
+	mu          sync.RWMutex
+	diag        *DiagLogger
+
+	// Counters, kept across Clear
+	hits             atomic.Int64
+	misses           atomic.Int64
+	puts             atomic.Int64
+	entryEvictions   atomic.Int64 // evicted to stay within cache_max_entries
+	sizeEvictions    atomic.Int64 // evicted to stay within cache_max_size_mb
+	expiredEvictions atomic.Int64 // dropped once past their Expires time
+	bytesServed      atomic.Int64
+}
+
+// CacheStats is a point-in-time copy of a cache's usage and counters
+type CacheStats struct {
+	Entries          int
+	Bytes            int64
+	MaxEntries       int
+	MaxBytes         int64
+	Hits             int64
+	Misses           int64
+	Puts             int64
+	EntryEvictions   int64
+	SizeEvictions    int64
+	ExpiredEvictions int64
+	BytesServed      int64 // response bodies returned by Get
+}
+
+// NewCache creates a new cache instance holding up to maxEntries responses
+// and maxSize bytes
+func NewCache(maxEntries int, maxSize int64, diag *DiagLogger) *Cache {
+	return &Cache{
+		entries:     make(map[string]*CacheEntry),
+		accessOrder: make([]string, 0),
+		maxEntries:  maxEntries,
+		maxSize:     maxSize,
+		diag:        diag,
+	}
+}
+
+// Get retrieves a cached response
+func (c *Cache) Get(key string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.entries[key]
+	if exists && entry.expired(time.Now()) {
+		c.remove(key)
+		c.expiredEvictions.Add(1)
+		exists = false
+	}
+	if !exists {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.bytesServed.Add(int64(len(entry.Body)))
+
+	// Update access time and move to end of LRU list
+	entry.LastAccessed = time.Now()
+	c.moveToEnd(key)
+
+	return entry, true
+}
+
+// Put stores a response in the cache, evicting the least recently used
+// entries to make room. An entry larger than the whole cache is not stored,
+// and Put reports false.
+func (c *Cache) Put(key string, entry *CacheEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Calculate entry size
+	entrySize := cacheEntryOverhead + int64(len(key)+len(entry.Body))
+	for k, v := range entry.Headers {
+		entrySize += int64(len(k) + len(v))
+	}
+	if entrySize > c.maxSize {
+		c.diag.Debugf("Cache: not storing %s (%d bytes is over the %d byte cache)", key, entrySize, c.maxSize)
+		return false
+	}
+	entry.Size = entrySize
+	entry.LastAccessed = time.Now()
+
+	// Check if key already exists
+	c.remove(key)
+
+	// Evict if necessary
+	for len(c.entries) > 0 {
+		if len(c.entries) >= c.maxEntries {
+			c.evictLRU(&c.entryEvictions)
+		} else if c.currentSize+entrySize > c.maxSize {
+			c.evictLRU(&c.sizeEvictions)
+		} else {
+			break
+		}
+	}
+
+	// Add new entry
+	c.puts.Add(1)
+	c.entries[key] = entry
+	c.currentSize += entrySize
+	c.accessOrder = append(c.accessOrder, key)
+	return true
+}
+
+// Delete removes the response stored under key
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+}
+
+// remove drops key's entry, if there is one
+func (c *Cache) remove(key string) {
+	if existing, exists := c.entries[key]; exists {
+		c.currentSize -= existing.Size
+		delete(c.entries, key)
+		c.removeFromOrder(key)
+	}
+}
+
+// SetMaxEntries changes the entry limit, evicting entries if the cache is
+// now over it
+func (c *Cache) SetMaxEntries(maxEntries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxEntries = maxEntries
+	for len(c.entries) > c.maxEntries && len(c.entries) > 0 {
+		c.evictLRU(&c.entryEvictions)
+	}
+}
+
+// SetMaxSize changes the size limit in bytes, evicting entries if the cache
+// is now over it
+func (c *Cache) SetMaxSize(maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxSize = maxSize
+	for c.currentSize > c.maxSize && len(c.entries) > 0 {
+		c.evictLRU(&c.sizeEvictions)
+	}
+}
+
+// moveToEnd moves a key to the end of the access order list
+func (c *Cache) moveToEnd(key string) {
+	// Remove from current position
+	c.removeFromOrder(key)
+	// Add to end
+	c.accessOrder = append(c.accessOrder, key)
+}
+
+// removeFromOrder removes a key from the access order list
+func (c *Cache) removeFromOrder(key string) {
+	for i, k := range c.accessOrder {
+		if k == key {
+			c.accessOrder = append(c.accessOrder[:i], c.accessOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// evictLRU evicts the least recently used entry, counting it in counter
+func (c *Cache) evictLRU(counter *atomic.Int64) {
+	if len(c.accessOrder) == 0 {
+		return
+	}
+
+	// Remove first (oldest) entry
+	key := c.accessOrder[0]
+	c.accessOrder = c.accessOrder[1:]
+
+	if entry, exists := c.entries[key]; exists {
+		c.currentSize -= entry.Size
+		delete(c.entries, key)
+		counter.Add(1)
+		c.diag.Debugf("Cache: evicted %s (%d bytes)", key, entry.Size)
+	}
+}
+
+// Clear clears all cache entries; the counters are kept
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*CacheEntry)
+	c.accessOrder = make([]string, 0)
+	c.currentSize = 0
+}
+
+// GetStats returns the number of entries and bytes cached, and the limits
+// on each
+func (c *Cache) GetStats() (entries int, size int64, maxEntries int, maxSize int64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries), c.currentSize, c.maxEntries, c.maxSize
+}
+
+// Stats returns the cache's current usage and limits, and its counters
+func (c *Cache) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:             c.hits.Load(),
+		Misses:           c.misses.Load(),
+		Puts:             c.puts.Load(),
+		EntryEvictions:   c.entryEvictions.Load(),
+		SizeEvictions:    c.sizeEvictions.Load(),
+		ExpiredEvictions: c.expiredEvictions.Load(),
+		BytesServed:      c.bytesServed.Load(),
+	}
+	stats.Entries, stats.Bytes, stats.MaxEntries, stats.MaxBytes = c.GetStats()
+	return stats
+}
+
+// MakeCacheKey creates a cache key for a GET request from its scheme,
+// host, port and path and query, so that origin-form requests for the same
+// path on different hosts don't share an entry. The host and port are
+// req's destination, from the Host header for an origin-form target, and
+// after any rewrite. Other methods get "", and aren't cached.
+func MakeCacheKey(req *HTTPRequest) string {
+	// Only cache GET requests
+	if req.Method != "GET" || req.Host == "" {
+		return ""
+	}
+	scheme := "http"
+	if strings.HasPrefix(req.RequestTarget, "https://") {
+		scheme = "https"
+	}
+	host := strings.TrimSuffix(strings.ToLower(req.Host), ".")
+	target := requestPath(req.RequestTarget)
+	if target == "" {
+		return ""
+	}
+	return req.Method + " " + scheme + "://" + net.JoinHostPort(host, strconv.Itoa(req.Port)) + target
+}
+
+// IsCacheable checks if a response can be cached
+func IsCacheable(method string, statusCode int) bool {
+	// Only cache successful GET requests
+	if method != "GET" {
+		return false
+	}
+	// Cache 200 OK responses
+	return statusCode == 200
+}
+
+// CacheCapture copies a response as it is relayed to the client, so it can
+// be stored once it has been relayed whole. Only a response framed by
+// Content-Length and allowed in a shared cache is kept, and its body only
+// up to the capture's limit.
+type CacheCapture struct {
+	status     string // reason phrase of the status line
+	headers    map[string]string
+	length     int64 // the Content-Length, or -1
+	body       capture
+	storable   bool
+	authorized bool          // the request carried Authorization
+	defaultTTL time.Duration // freshness of a response that doesn't give its own
+	expires    time.Time     // when the response stops being fresh
+}
+
+// newCacheCapture starts a capture keeping bodies of up to maxBody bytes,
+// fresh for defaultTTL unless the response says otherwise. authorized says
+// the request carried Authorization, so only a response marked public may
+// be stored.
+func newCacheCapture(maxBody int64, defaultTTL time.Duration, authorized bool) *CacheCapture {
+	return &CacheCapture{body: capture{max: maxBody}, defaultTTL: defaultTTL, authorized: authorized}
+}
+
+// response records the head relayed to the client; status is the reason
+// phrase of its status line, and length is the body length frameResponse
+// found, or -1. Its body is then written to c. A response is only stored
+// if a shared cache may serve it without revalidating: not one marked
+// no-store, no-cache or private, one that sets a cookie, one that varies
+// by request headers, one already stale, or, for a request with
+// Authorization, one not marked public.
+func (c *CacheCapture) response(status string, headers []string, length int64) {
+	c.status = status
+	c.length = length
+	c.storable = length >= 0
+	c.headers = make(map[string]string, len(headers))
+	for _, line := range headers {
+		name, value, _ := strings.Cut(line, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		switch strings.ToLower(name) {
+		case "connection", "keep-alive", "transfer-encoding", "proxy-connection":
+			// Hop-by-hop, and set afresh when the entry is served
+			continue
+		case "set-cookie", "vary":
+			c.storable = false
+		}
+		c.headers[name] = value
+	}
+
+	cacheControl := headerValue(c.headers, "Cache-Control")
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cacheDirective(cacheControl, directive); ok {
+			c.storable = false
+		}
+	}
+	if _, public := cacheDirective(cacheControl, "public"); c.authorized && !public {
+		c.storable = false
+	}
+	now := time.Now()
+	expires, ok := freshUntil(c.headers, cacheControl, now)
+	if !ok {
+		expires = now.Add(c.defaultTTL)
+	}
+	c.expires = expires
+	if !now.Before(expires) {
+		c.storable = false
+	}
+}
+
+// freshUntil returns when a response with headers stops being fresh, from
+// s-maxage, then max-age, then Expires, less any Age it has already spent
+// in other caches; ok is false if none of them is given. An Expires that
+// can't be parsed means already expired.
+func freshUntil(headers map[string]string, cacheControl string, now time.Time) (time.Time, bool) {
+	age := time.Duration(0)
+	if seconds, err := strconv.ParseInt(headerValue(headers, "Age"), 10, 64); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := cacheDirective(cacheControl, directive); ok {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return now, true
+			}
+			return now.Add(time.Duration(seconds)*time.Second - age), true
+		}
+	}
+	if value := headerValue(headers, "Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			return now, true
+		}
+		// Expires is relative to the origin's clock, as given in Date
+		if date, err := http.ParseTime(headerValue(headers, "Date")); err == nil {
+			return now.Add(expires.Sub(date) - age), true
+		}
+		return expires, true
+	}
+	return time.Time{}, false
+}
+
+// cacheDirective finds the directive name in a Cache-Control value,
+// returning its argument without quotes, if it has one
+func cacheDirective(cacheControl, name string) (string, bool) {
+	for _, item := range strings.Split(cacheControl, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+		if strings.EqualFold(strings.TrimSpace(key), name) {
+			return strings.Trim(strings.TrimSpace(value), "\""), true
+		}
+	}
+	return "", false
+}
+
+// headerValue returns the value of the header name in headers, matched
+// without regard to case, or ""
+func headerValue(headers map[string]string, name string) string {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+func (c *CacheCapture) Write(p []byte) (int, error) {
+	return c.body.Write(p)
+}
+
+// entry returns the captured response as a cache entry, or false if it
+// can't be stored: it wasn't relayed whole, its body was over the limit, or
+// its headers keep it out of a shared cache
+func (c *CacheCapture) entry(statusCode int) (*CacheEntry, bool) {
+	if c == nil || !c.storable || c.body.skipped || c.body.size != c.length {
+		return nil, false
+	}
+	body := c.body.data
+	if body == nil {
+		body = []byte{}
+	}
+	return &CacheEntry{Headers: c.headers, StatusCode: statusCode, StatusText: c.status, Body: body, Expires: c.expires}, true
+}
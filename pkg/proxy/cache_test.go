@@ -0,0 +1,492 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cachingOrigin serves /page with a Content-Length, /private with
+// Cache-Control: no-store and /chunked chunked, counting the requests it
+// gets
+func cachingOrigin(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var requests atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/private":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/chunked":
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("X-Origin", "yes")
+		io.WriteString(w, "hello from the origin")
+	}))
+	t.Cleanup(origin.Close)
+	return origin, &requests
+}
+
+// cachingServer starts a proxy with the in-memory cache enabled
+func cachingServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	config := testConfig(t)
+	config.EnableCaching = true
+	return startServer(t, config)
+}
+
+func TestCacheServesSecondGet(t *testing.T) {
+	origin, requests := cachingOrigin(t)
+	s, addr := cachingServer(t)
+
+	for i := 0; i < 2; i++ {
+		resp := proxyGet(t, dialProxy(t, addr), origin.URL+"/page", 5*time.Second)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "hello from the origin" {
+			t.Fatalf("GET %d got %d %q", i+1, resp.StatusCode, body)
+		}
+		if resp.Header.Get("X-Origin") != "yes" {
+			t.Errorf("GET %d lost the origin's headers", i+1)
+		}
+		waitFor(t, func() bool { return s.Stats().TotalRequests == int64(i+1) })
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("origin got %d requests, want 1 with the second served from cache", n)
+	}
+	stats := s.cache.Stats()
+	if stats.Puts != 1 || stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("cache counted %d puts, %d hits and %d misses, want 1 of each", stats.Puts, stats.Hits, stats.Misses)
+	}
+	snap := s.Stats()
+	if n := snap.RequestsByAction["CACHE_HIT"]; n != 1 {
+		t.Errorf("%d requests logged as CACHE_HIT, want 1", n)
+	}
+	if snap.CacheHitRatio != 0.5 || snap.CacheBytesServed != int64(len("hello from the origin")) {
+		t.Errorf("stats report a hit ratio of %v and %d bytes served from cache, want 0.5 and the one body", snap.CacheHitRatio, snap.CacheBytesServed)
+	}
+}
+
+func TestCacheSkipsUnstorableResponses(t *testing.T) {
+	origin, requests := cachingOrigin(t)
+	s, addr := cachingServer(t)
+
+	for _, path := range []string{"/private", "/chunked"} {
+		requests.Store(0)
+		for i := 0; i < 2; i++ {
+			resp := proxyGet(t, dialProxy(t, addr), origin.URL+path, 5*time.Second)
+			io.ReadAll(resp.Body)
+		}
+		if n := requests.Load(); n != 2 {
+			t.Errorf("%s: origin got %d requests, want both", path, n)
+		}
+	}
+	if puts := s.cache.Stats().Puts; puts != 0 {
+		t.Errorf("cache stored %d responses, want none", puts)
+	}
+}
+
+// sizedEntry returns a response that, stored under a six-character key,
+// takes exactly size bytes of the cache's budget
+func sizedEntry(size int) *CacheEntry {
+	return &CacheEntry{StatusCode: 200, Body: []byte(strings.Repeat("x", size-cacheEntryOverhead-6))}
+}
+
+func TestCacheByteBudget(t *testing.T) {
+	const entrySize, budget = 1000, 10000
+	cache := NewCache(1000, budget, nil)
+
+	// Exactly full: ten entries fit without evicting any
+	for i := 0; i < 10; i++ {
+		if !cache.Put(fmt.Sprintf("key-%02d", i), sizedEntry(entrySize)) {
+			t.Fatalf("Put %d refused", i)
+		}
+	}
+	if stats := cache.Stats(); stats.Entries != 10 || stats.Bytes != budget || stats.SizeEvictions != 0 {
+		t.Fatalf("full cache holds %d entries in %d bytes after %d evictions, want 10 in %d and none", stats.Entries, stats.Bytes, stats.SizeEvictions, budget)
+	}
+
+	// One more evicts the least recently used, which a Get keeps key-00
+	// from being
+	cache.Get("key-00")
+	cache.Put("key-10", sizedEntry(entrySize))
+	if _, ok := cache.Get("key-01"); ok {
+		t.Error("least recently used entry wasn't evicted")
+	}
+	if _, ok := cache.Get("key-00"); !ok {
+		t.Error("recently read entry was evicted")
+	}
+
+	// Entries of mixed sizes never take the cache over its budget
+	for i := 0; i < 200; i++ {
+		cache.Put(fmt.Sprintf("mix-%02d", i%100), sizedEntry(entrySize/2+(i*37)%(3*entrySize)))
+		if bytes := cache.Stats().Bytes; bytes > budget {
+			t.Fatalf("cache holds %d bytes after Put %d, over its %d byte budget", bytes, i, budget)
+		}
+	}
+	var sum int64
+	for _, entry := range cache.entries {
+		sum += entry.Size
+	}
+	if stats := cache.Stats(); stats.Bytes != sum || stats.SizeEvictions == 0 {
+		t.Errorf("cache counts %d bytes for entries of %d after %d size evictions", stats.Bytes, sum, stats.SizeEvictions)
+	}
+
+	// An entry bigger than the whole budget is refused rather than emptying
+	// the cache
+	entries := cache.Stats().Entries
+	if cache.Put("huge-0", sizedEntry(budget+1)) {
+		t.Error("entry over the whole budget was stored")
+	}
+	if stats := cache.Stats(); stats.Entries != entries {
+		t.Errorf("refused entry changed the cache from %d entries to %d", entries, stats.Entries)
+	}
+}
+
+func TestCacheMaxSizeConfigured(t *testing.T) {
+	config := testConfig(t)
+	config.EnableCaching = true
+	config.CacheMaxSizeMB = 3
+	s, _ := startServer(t, config)
+	if max := s.cache.Stats().MaxBytes; max != 3<<20 {
+		t.Errorf("cache limited to %d bytes, want cache_max_size_mb's %d", max, 3<<20)
+	}
+}
+
+func TestCacheExpiredEvictions(t *testing.T) {
+	config := testConfig(t)
+	config.EnableCaching = true
+	s, _ := startServer(t, config)
+	s.cache.Put("fresh", &CacheEntry{StatusCode: 200, Body: []byte("ok"), Expires: time.Now().Add(time.Hour)})
+	s.cache.Put("stale", &CacheEntry{StatusCode: 200, Body: []byte("ok"), Expires: time.Now().Add(-time.Second)})
+
+	for _, key := range []string{"fresh", "stale", "stale"} {
+		s.cache.Get(key)
+	}
+	if stats := s.Stats(); stats.CacheEvicted["expired"] != 1 || stats.CacheEvictions != 1 || stats.CacheEntries != 1 {
+		t.Errorf("stats report %d of %d evictions expired and %d entries left, want the one stale entry dropped", stats.CacheEvicted["expired"], stats.CacheEvictions, stats.CacheEntries)
+	}
+
+	var text strings.Builder
+	s.DumpStats(&text)
+	if !strings.Contains(text.String(), "1 evictions (0 for entries, 0 for size, 1 expired)") {
+		t.Errorf("stats text doesn't count the expired entry:\n%s", text.String())
+	}
+	metrics := httptest.NewRecorder()
+	s.handleMetrics(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `proxy_cache_evictions_total{reason="expired"} 1`; !strings.Contains(metrics.Body.String(), want) {
+		t.Errorf("metrics don't include %s:\n%s", want, metrics.Body.String())
+	}
+}
+
+// Run with -race: Get, Put and Clear race each other. The counters must
+// add up to what the callers saw, and survive Clear.
+func TestCacheCountersConcurrent(t *testing.T) {
+	cache := NewCache(8, 1<<20, nil)
+	body := []byte("cached body")
+
+	var gets, hits, puts, served atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				key := fmt.Sprintf("key-%d", (i+j)%16)
+				switch j % 10 {
+				case 0, 1, 2:
+					if cache.Put(key, &CacheEntry{StatusCode: 200, Body: body}) {
+						puts.Add(1)
+					}
+				case 9:
+					if i == 0 {
+						cache.Clear()
+					}
+				default:
+					gets.Add(1)
+					if entry, ok := cache.Get(key); ok {
+						hits.Add(1)
+						served.Add(int64(len(entry.Body)))
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	check := func(when string) {
+		stats := cache.Stats()
+		if stats.Hits != hits.Load() || stats.Hits+stats.Misses != gets.Load() {
+			t.Errorf("%s: counted %d hits and %d misses for %d Gets of which %d hit", when, stats.Hits, stats.Misses, gets.Load(), hits.Load())
+		}
+		if stats.Puts != puts.Load() || stats.BytesServed != served.Load() {
+			t.Errorf("%s: counted %d puts and %d bytes served, want %d and %d", when, stats.Puts, stats.BytesServed, puts.Load(), served.Load())
+		}
+		if stats.EntryEvictions == 0 {
+			t.Errorf("%s: no evictions counted with 16 keys in 8 entries", when)
+		}
+	}
+	check("after the race")
+
+	cache.Clear()
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("Clear left %d entries in %d bytes", stats.Entries, stats.Bytes)
+	}
+	check("after Clear")
+}
+
+// fakeRedis is a Redis server serving GET, SET and DEL from a map, and
+// answering anything else with an error
+type fakeRedis struct {
+	addr string
+	mu   sync.Mutex
+	data map[string][]byte
+	sets [][]string // the SET commands received, with their arguments
+}
+
+// startFakeRedis starts a fakeRedis, stopped when the test ends
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	r := &fakeRedis{addr: l.Addr().String(), data: make(map[string][]byte)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				conn := &redisConn{Conn: c, r: bufio.NewReader(c)}
+				for {
+					reply, err := conn.readReply()
+					args, _ := reply.([]any)
+					if err != nil || len(args) < 2 {
+						return
+					}
+					words := make([]string, len(args))
+					for i, arg := range args {
+						word, _ := arg.([]byte)
+						words[i] = string(word)
+					}
+					key := words[1]
+					r.mu.Lock()
+					switch strings.ToUpper(words[0]) {
+					case "GET":
+						if value, ok := r.data[key]; ok {
+							fmt.Fprintf(c, "$%d\r\n%s\r\n", len(value), value)
+						} else {
+							io.WriteString(c, "$-1\r\n")
+						}
+					case "SET":
+						r.data[key] = []byte(words[2])
+						r.sets = append(r.sets, words)
+						io.WriteString(c, "+OK\r\n")
+					case "DEL":
+						delete(r.data, key)
+						io.WriteString(c, ":1\r\n")
+					default:
+						io.WriteString(c, "-ERR unknown command\r\n")
+					}
+					r.mu.Unlock()
+				}
+			}()
+		}
+	}()
+	return r
+}
+
+// setCommands returns the SET commands received so far
+func (r *fakeRedis) setCommands() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string(nil), r.sets...)
+}
+
+func TestCacheKeepsStatusText(t *testing.T) {
+	var requests atomic.Int64
+	origin := stallingUpstream(t, func(conn net.Conn) {
+		requests.Add(1)
+		io.WriteString(conn, "HTTP/1.1 200 Fine Thanks\r\nContent-Length: 5\r\n\r\nhello")
+	})
+
+	for _, backend := range []string{"memory", "redis"} {
+		t.Run(backend, func(t *testing.T) {
+			requests.Store(0)
+			config := testConfig(t)
+			config.EnableCaching = true
+			config.CacheBackend = backend
+			if backend == "redis" {
+				config.RedisAddress = startFakeRedis(t).addr
+			}
+			s, addr := startServer(t, config)
+
+			for i := 0; i < 2; i++ {
+				resp := proxyGet(t, dialProxy(t, addr), "http://"+origin+"/page", 5*time.Second)
+				if body, _ := io.ReadAll(resp.Body); resp.Status != "200 Fine Thanks" || string(body) != "hello" {
+					t.Errorf("GET %d got %q %q, want the origin's status line and body", i+1, resp.Status, body)
+				}
+				waitFor(t, func() bool { return s.Stats().TotalRequests == int64(i+1) })
+			}
+			if n := requests.Load(); n != 1 {
+				t.Errorf("origin got %d requests, want 1 with the second served from cache", n)
+			}
+		})
+	}
+
+	// An entry stored without a reason phrase is served with the standard one
+	s, _ := cachingServer(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		s.serveCachedResponse(server, &CacheEntry{StatusCode: http.StatusOK, Body: []byte{}})
+		server.Close()
+	}()
+	if line, _ := bufio.NewReader(client).ReadString('\n'); line != "HTTP/1.1 200 OK\r\n" {
+		t.Errorf("entry without a reason phrase served as %q", line)
+	}
+}
+
+func TestMakeCacheKey(t *testing.T) {
+	tests := []struct {
+		req  *HTTPRequest
+		want string
+	}{
+		{&HTTPRequest{Method: "GET", RequestTarget: "http://Example.com/a?b=1", Host: "Example.com", Port: 80}, "GET http://example.com:80/a?b=1"},
+		// An origin-form target is keyed by its Host, the same as the
+		// absolute-form one
+		{&HTTPRequest{Method: "GET", RequestTarget: "/a?b=1", Host: "example.com", Port: 80}, "GET http://example.com:80/a?b=1"},
+		{&HTTPRequest{Method: "GET", RequestTarget: "/a?b=1", Host: "example.org", Port: 80}, "GET http://example.org:80/a?b=1"},
+		{&HTTPRequest{Method: "GET", RequestTarget: "/a", Host: "example.com.", Port: 8080}, "GET http://example.com:8080/a"},
+		{&HTTPRequest{Method: "GET", RequestTarget: "https://example.com/a", Host: "example.com", Port: 443}, "GET https://example.com:443/a"},
+		{&HTTPRequest{Method: "GET", RequestTarget: "/a", Host: "::1", Port: 80}, "GET http://[::1]:80/a"},
+		{&HTTPRequest{Method: "POST", RequestTarget: "/a", Host: "example.com", Port: 80}, ""},
+	}
+	for _, tt := range tests {
+		if got := MakeCacheKey(tt.req); got != tt.want {
+			t.Errorf("MakeCacheKey(%s %s, host %s:%d) = %q, want %q", tt.req.Method, tt.req.RequestTarget, tt.req.Host, tt.req.Port, got, tt.want)
+		}
+	}
+}
+
+func TestCacheCaptureStorable(t *testing.T) {
+	now := time.Now()
+	date := now.UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name       string
+		authorized bool
+		headers    []string
+		want       bool
+		wantFresh  time.Duration // how long the entry is fresh for
+	}{
+		{"no freshness given", false, nil, true, time.Hour},
+		{"max-age", false, []string{"Cache-Control: max-age=60"}, true, 60 * time.Second},
+		{"s-maxage wins", false, []string{"Cache-Control: max-age=60, s-maxage=600"}, true, 600 * time.Second},
+		{"age spent elsewhere", false, []string{"Cache-Control: max-age=60", "Age: 20"}, true, 40 * time.Second},
+		{"expires", false, []string{"Date: " + date, "Expires: " + now.Add(time.Hour).UTC().Format(http.TimeFormat)}, true, time.Hour},
+		{"max-age over expires", false, []string{"Cache-Control: max-age=60", "Expires: " + now.Add(time.Hour).UTC().Format(http.TimeFormat)}, true, 60 * time.Second},
+		{"already stale", false, []string{"Cache-Control: max-age=0"}, false, 0},
+		{"expired", false, []string{"Date: " + date, "Expires: " + now.Add(-time.Hour).UTC().Format(http.TimeFormat)}, false, 0},
+		{"bad expires", false, []string{"Expires: 0"}, false, 0},
+		{"no-cache", false, []string{"Cache-Control: no-cache"}, false, 0},
+		{"no-store", false, []string{"Cache-Control: No-Store"}, false, 0},
+		{"private", false, []string{"Cache-Control: private, max-age=60"}, false, 0},
+		{"set-cookie", false, []string{"Set-Cookie: a=b"}, false, 0},
+		{"vary", false, []string{"Vary: Accept-Encoding"}, false, 0},
+		{"authorized", true, []string{"Cache-Control: max-age=60"}, false, 0},
+		{"authorized public", true, []string{"Cache-Control: public, max-age=60"}, true, 60 * time.Second},
+	}
+	for _, tt := range tests {
+		c := newCacheCapture(1024, time.Hour, tt.authorized)
+		c.response("OK", append([]string{"Content-Length: 2"}, tt.headers...), 2)
+		c.Write([]byte("ok"))
+		entry, ok := c.entry(200)
+		if ok != tt.want {
+			t.Errorf("%s: storable=%t, want %t", tt.name, ok, tt.want)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if fresh := entry.Expires.Sub(now); fresh < tt.wantFresh-2*time.Second || fresh > tt.wantFresh+2*time.Second {
+			t.Errorf("%s: entry fresh for %v, want %v", tt.name, fresh, tt.wantFresh)
+		}
+	}
+}
+
+// TestCacheKeyedByHost sends origin-form requests for the same path to two
+// origins, and checks neither is answered with the other's cached response
+func TestCacheKeyedByHost(t *testing.T) {
+	var hosts []string
+	for _, name := range []string{"site-A", "site-B"} {
+		name := name
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		defer origin.Close()
+		hosts = append(hosts, hostOf(origin.URL))
+	}
+	s, addr := cachingServer(t)
+
+	for round := 0; round < 2; round++ {
+		for i, host := range hosts {
+			conn := dialProxy(t, addr)
+			fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+			resp := readResponse(t, conn, 5*time.Second)
+			if body, _ := io.ReadAll(resp.Body); string(body) != []string{"site-A", "site-B"}[i] {
+				t.Errorf("round %d: GET / for %s got %q", round+1, host, body)
+			}
+		}
+	}
+	if stats := s.cache.Stats(); stats.Puts != 2 || stats.Hits != 2 {
+		t.Errorf("cache counted %d puts and %d hits, want 2 of each", stats.Puts, stats.Hits)
+	}
+}
+
+// TestRedisPutSetsTTL checks every entry is stored in Redis with a TTL: its
+// own freshness, or cache_default_ttl
+func TestRedisPutSetsTTL(t *testing.T) {
+	redis := startFakeRedis(t)
+	config := DefaultConfig()
+	config.RedisAddress, config.CacheDefaultTTL = redis.addr, 10*time.Minute
+	cache := NewRedisCache(config, nil)
+	defer cache.Close()
+
+	tests := []struct {
+		expires time.Time
+		wantTTL time.Duration
+	}{
+		{time.Time{}, 10 * time.Minute},
+		{time.Now().Add(time.Minute), time.Minute},
+	}
+	for i, tt := range tests {
+		if !cache.Put(fmt.Sprintf("key%d", i), &CacheEntry{StatusCode: 200, Body: []byte("ok"), Expires: tt.expires}) {
+			t.Fatalf("Put %d failed", i)
+		}
+		sets := redis.setCommands()
+		set := sets[len(sets)-1]
+		if len(set) != 5 || !strings.EqualFold(set[3], "PX") {
+			t.Errorf("entry %d stored with %q, want a PX TTL", i, set[:min(len(set), 2)])
+			continue
+		}
+		ms, err := strconv.ParseInt(set[4], 10, 64)
+		if ttl := time.Duration(ms) * time.Millisecond; err != nil || ttl > tt.wantTTL || ttl < tt.wantTTL-5*time.Second {
+			t.Errorf("entry %d stored with PX %s, want about %v", i, set[4], tt.wantTTL)
+		}
+	}
+	if cache.Put("stale", &CacheEntry{StatusCode: 200, Expires: time.Now().Add(-time.Second)}) {
+		t.Error("Put stored an entry that had already expired")
+	}
+}
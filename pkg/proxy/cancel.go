@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Causes of request cancellation, logged as the CANCELLED reason
+var (
+	errClientClosed   = errors.New("client closed the connection")
+	errShuttingDown   = errors.New("server shutting down")
+	errRequestTooLong = errors.New("max_request_duration exceeded")
+)
+
+// requestContext returns the context for the request on one connection,
+// derived from parent and bounded by max_request_duration
+func requestContext(parent context.Context, config *Config) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	if config.MaxRequestDuration <= 0 {
+		return ctx, cancel
+	}
+	timed, stop := context.WithTimeoutCause(ctx, config.MaxRequestDuration, errRequestTooLong)
+	return timed, func(cause error) {
+		cancel(cause)
+		stop()
+	}
+}
+
+// watchClient cancels a request if its client closes the connection while
+// the request is being served. The request has been read by then, so the
+// read deadline is lifted; a connection carries one request, so anything
+// else the client sends is discarded. The watcher ends when conn is closed.
+func watchClient(conn net.Conn, reader io.Reader, cancel context.CancelCauseFunc) {
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		io.Copy(io.Discard, reader)
+		cancel(errClientClosed)
+	}()
+}
+
+// watchAfterRequest starts watchClient once req has been read in full: at
+// once for a request without a body, otherwise when the upload reaches the
+// end of the body. A client that has already sent another request isn't
+// watched, as the watcher would consume it; watched reports whether the
+// watcher was started.
+func watchAfterRequest(conn net.Conn, reader *bufio.Reader, req *HTTPRequest, cancel context.CancelCauseFunc) (watched func() bool) {
+	var started atomic.Bool
+	watch := func() {
+		if reader.Buffered() == 0 {
+			started.Store(true)
+			watchClient(conn, reader, cancel)
+		}
+	}
+	if req.Body == nil {
+		watch()
+	} else {
+		req.Body = &eofHook{reader: req.Body, fn: watch}
+	}
+	return started.Load
+}
+
+// eofHook calls fn the first time reader returns io.EOF
+type eofHook struct {
+	reader io.Reader
+	fn     func()
+	called bool
+}
+
+func (h *eofHook) Read(p []byte) (int, error) {
+	n, err := h.reader.Read(p)
+	if err == io.EOF && !h.called {
+		h.called = true
+		h.fn()
+	}
+	return n, err
+}
+
+// sendCancelled answers and logs a request whose context was cancelled. A
+// client that went away, or whose response had already started, gets no
+// error response.
+func (s *Server) sendCancelled(ctx context.Context, conn net.Conn, req *HTTPRequest, responseStarted bool, bytesUp, bytesDown int64) {
+	cause := context.Cause(ctx)
+	status := 0
+	if !responseStarted && cause != errClientClosed {
+		message := "Service Unavailable"
+		status = 503
+		if cause == errRequestTooLong {
+			status, message = 504, "Gateway Timeout"
+		}
+		conn.SetWriteDeadline(time.Time{})
+		s.sendErrorResponse(conn, req, status, message)
+	}
+	s.logRequest(conn, req, "CANCELLED", status, bytesUp, bytesDown, cause.Error())
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// What happens to requests matching a blocklist category
+const (
+	actionBlock         = "block"
+	actionLogOnly       = "log_only"        // forwarded, with the match logged
+	actionBlockWithPage = "block_with_page" // blocked with the category's own page
+	actionMaxBytes      = "max_bytes"       // forwarded, with the response body cut off at a size
+)
+
+// blocklistCategory is a themed blocklist, such as ads or malware, and the
+// action taken on requests matching it
+type blocklistCategory struct {
+	Name     string
+	Action   string // block, log_only, block_with_page or max_bytes
+	Page     string // HTML template answering block_with_page requests
+	MaxBytes int64  // response body limit of max_bytes requests
+	File     string
+}
+
+// parseBlocklistCategory parses a blocklist_categories entry:
+// name:action:file, where action is block, log_only,
+// block_with_page:page-file or max_bytes:size
+func parseBlocklistCategory(entry string) (blocklistCategory, error) {
+	name, rest, ok := strings.Cut(entry, ":")
+	sep := strings.LastIndex(rest, ":")
+	if sep > 0 && filepath.VolumeName(rest[sep-1:]) != "" {
+		// A Windows drive letter belongs to the file, as in block:C:\lists\ads.txt
+		sep = strings.LastIndex(rest[:sep-1], ":")
+	}
+	if !ok || name == "" || sep < 0 {
+		return blocklistCategory{}, fmt.Errorf("blocklist category %q must be name:action:file", entry)
+	}
+	category := blocklistCategory{Name: name, Action: rest[:sep], File: cleanPath(rest[sep+1:])}
+	if page, ok := strings.CutPrefix(category.Action, actionBlockWithPage+":"); ok {
+		category.Action, category.Page = actionBlockWithPage, cleanPath(page)
+	}
+	if size, ok := strings.CutPrefix(category.Action, actionMaxBytes+":"); ok {
+		maxBytes, err := parseByteSize(size)
+		if err != nil || maxBytes <= 0 {
+			return blocklistCategory{}, fmt.Errorf("blocklist category %s: invalid max_bytes size %q", name, size)
+		}
+		category.Action, category.MaxBytes = actionMaxBytes, maxBytes
+	}
+	switch {
+	case category.File == "":
+		return blocklistCategory{}, fmt.Errorf("blocklist category %s needs a file", name)
+	case category.Action == actionBlockWithPage && category.Page == "":
+		return blocklistCategory{}, fmt.Errorf("blocklist category %s: block_with_page needs a page file", name)
+	case category.Action == actionMaxBytes && category.MaxBytes == 0:
+		return blocklistCategory{}, fmt.Errorf("blocklist category %s: max_bytes needs a size", name)
+	case category.Action != actionBlock && category.Action != actionLogOnly && category.Action != actionBlockWithPage && category.Action != actionMaxBytes:
+		return blocklistCategory{}, fmt.Errorf("blocklist category %s: action must be block, log_only, block_with_page:file or max_bytes:size", name)
+	}
+	return category, nil
+}
+
+// parseByteSize parses a size in bytes, with an optional KB, MB or GB
+// suffix (powers of 1024)
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	unit := int64(1)
+	for suffix, size := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			value, unit = strings.TrimSpace(number), size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > (1<<63-1)/unit {
+		return 0, fmt.Errorf("size %s is too large", value)
+	}
+	return n * unit, nil
+}
+
+// parseBlocklistCategories parses every blocklist_categories entry
+func parseBlocklistCategories(entries []string) ([]blocklistCategory, error) {
+	var categories []blocklistCategory
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		category, err := parseBlocklistCategory(entry)
+		if err != nil {
+			return nil, err
+		}
+		if seen[category.Name] {
+			return nil, fmt.Errorf("blocklist category %s is listed twice", category.Name)
+		}
+		seen[category.Name] = true
+		categories = append(categories, category)
+	}
+	return categories, nil
+}
+
+// categorySet holds a category's rules
+type categorySet struct {
+	blocklistCategory
+	page    *template.Template
+	domains map[string]ruleSource
+	ips     map[string]ruleSource
+	report  *RuleReport // from reading File
+}
+
+// FilterMatch is a rule a host matched, as returned by Filter.Match
+type FilterMatch struct {
+	Rule     string
+	Category string // empty for blocked_domains_file and runtime rules
+	Action   string
+	MaxBytes int64              // for max_bytes
+	page     *template.Template // for block_with_page
+}
+
+// Blocks reports whether the match stops the request; log_only and
+// max_bytes matches let it through
+func (m FilterMatch) Blocks() bool {
+	return m.Action != actionLogOnly && m.Action != actionMaxBytes
+}
+
+// LoadCategories replaces the category blocklists with those of the
+// blocklist_categories entries, which are matched in order. Unlike
+// blocked_domains_file, a missing file is an error. Rules still present
+// keep their hit counts. A report is returned for each file; with strict,
+// an invalid entry is an error.
+func (f *Filter) LoadCategories(entries []string, strict bool) ([]*RuleReport, error) {
+	sets, err := f.readCategories(entries, strict)
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]*RuleReport, len(sets))
+	for i, set := range sets {
+		reports[i] = set.report
+	}
+	f.setCategories(sets)
+	return reports, nil
+}
+
+// readCategories reads the categories' files without applying them,
+// carrying over the hit counts of categories already loaded
+func (f *Filter) readCategories(entries []string, strict bool) ([]*categorySet, error) {
+	categories, err := parseBlocklistCategories(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.RLock()
+	previous := make(map[string]*categorySet, len(f.categories))
+	for _, set := range f.categories {
+		previous[set.Name] = set
+	}
+	f.mu.RUnlock()
+
+	sets := make([]*categorySet, 0, len(categories))
+	for _, category := range categories {
+		set := &categorySet{blocklistCategory: category}
+		file, err := os.Open(category.File)
+		if err != nil {
+			return nil, fmt.Errorf("blocklist category %s: %w", category.Name, err)
+		}
+		var old []map[string]ruleSource
+		if prev, ok := previous[category.Name]; ok {
+			old = []map[string]ruleSource{prev.domains, prev.ips}
+		}
+		var report *RuleReport
+		set.domains, set.ips, report, err = readRules(file, category.File, old...)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("blocklist category %s: %w", category.Name, err)
+		}
+		if strict {
+			if err := report.InvalidErr(); err != nil {
+				return nil, fmt.Errorf("blocklist category %s: %w", category.Name, err)
+			}
+		}
+		if category.Action == actionBlockWithPage {
+			if set.page, err = template.ParseFiles(category.Page); err != nil {
+				return nil, fmt.Errorf("blocklist category %s page: %w", category.Name, err)
+			}
+		}
+		set.report = report
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// setCategories replaces the categories with sets
+func (f *Filter) setCategories(sets []*categorySet) {
+	for _, set := range sets {
+		f.diag.Infof("Loaded %d domain and %d IP rules in category %s (%s) from %s%s", len(set.domains), len(set.ips), set.Name, set.Action, set.File, set.report.skippedSummary())
+		set.report.warnSkipped(f.diag)
+	}
+	f.mu.Lock()
+	f.categories = sets
+	f.mu.Unlock()
+}
+
+// sendBlockPage answers a request blocked by a block_with_page category
+// with its page, rendered with the same data as error page templates
+func (s *Server) sendBlockPage(conn net.Conn, req *HTTPRequest, page *template.Template) {
+	var body bytes.Buffer
+	data := errorPageData{Status: 403, Message: "Forbidden", RequestID: req.ID, Host: req.Host, Proxy: Product()}
+	if err := page.Execute(&body, data); err != nil {
+		s.diag.Warnf("Block page %s failed: %v", page.Name(), err)
+		s.sendErrorResponse(conn, req, 403, "Forbidden")
+		return
+	}
+	s.writeResponse(conn, req, 403, "Forbidden", "text/html; charset=utf-8", body.Bytes(), nil)
+}
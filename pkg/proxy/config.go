@@ -0,0 +1,2066 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the proxy server configuration
+type Config struct {
+	ListenAddress       string        `json:"listen_address"`
+	ListenPort          int           `json:"listen_port"`
+	Listeners           []string      `json:"listeners"` // [label=][tls://]addr:port entries
+	TLSListen           bool          `json:"tls_listen"`
+	TLSCertFile         string        `json:"tls_cert_file"`
+	TLSKeyFile          string        `json:"tls_key_file"`
+	ReusePort           bool          `json:"reuse_port"`   // SO_REUSEPORT, so several processes can share the listen ports
+	RunAsUser           string        `json:"run_as_user"`  // switch to this user once the listeners are bound
+	RunAsGroup          string        `json:"run_as_group"` // and this group; empty uses the user's primary group
+	ConcurrencyModel    string        `json:"concurrency_model"`
+	ThreadPoolSize      int           `json:"thread_pool_size"`
+	MinWorkers          int           `json:"min_workers"`         // 0 means thread_pool_size
+	MaxWorkers          int           `json:"max_workers"`         // 0 means thread_pool_size
+	WorkerIdleTimeout   time.Duration `json:"worker_idle_timeout"` // idle workers above min_workers exit after this
+	QueueSize           int           `json:"queue_size"`          // connections waiting for a worker; 0 means twice thread_pool_size
+	QueueOverflow       string        `json:"queue_overflow"`      // drop, reject (503) or block when the queue is full
+	QueueWaitTimeout    time.Duration `json:"queue_wait_timeout"`
+	QueueMaxWait        time.Duration `json:"queue_max_wait"` // connections queued longer get 503 from their worker; 0 means no limit
+	LogFilePath         string        `json:"log_file_path"`
+	LogMaxSizeMB        int           `json:"log_max_size_mb"`
+	LogFormat           string        `json:"log_format"`
+	LogFailurePolicy    string        `json:"log_failure_policy"`
+	AddRequestIDHeader  bool          `json:"add_request_id_header"`
+	ServerHeader        bool          `json:"server_header"` // name the proxy and its version on error responses
+	ErrorPagesDir       string        `json:"error_pages_dir"`
+	DebugErrors         bool          `json:"debug_errors"`
+	LogHeaders          []string      `json:"log_headers"`
+	LogAnonymizeIPs     string        `json:"log_anonymize_ips"`
+	LogAnonymizeKey     string        `json:"log_anonymize_key"`
+	LogLevel            string        `json:"log_level"`
+	ErrorLogPath        string        `json:"error_log_path"`
+	BlockedDomainsFile  string        `json:"blocked_domains_file"`
+	BlocklistCategories []string      `json:"blocklist_categories"`    // name:action:file entries
+	PersistRuntimeRules string        `json:"persist_runtime_rules"`   // state file keeping admin API filter rules across restarts
+	FilterStatsFile     string        `json:"filter_stats_file"`       // per-rule hit counts are written here on shutdown
+	EnforceSafeSearch   bool          `json:"enforce_safesearch"`      // send search engines to their SafeSearch enforcement hosts
+	SafeSearchHosts     []string      `json:"safesearch_hosts"`        // host=enforcement-host entries
+	HTTPSUpgradeDomains []string      `json:"https_upgrade_domains"`   // exact or *.suffix hosts whose plain HTTP requests are upgraded
+	HTTPSUpgradeMode    string        `json:"https_upgrade_mode"`      // redirect (308 to https) or rewrite (fetched over TLS)
+	BlockedExtensions   []string      `json:"blocked_extensions"`      // file extensions whose downloads are refused
+	ExpressionRulesFile string        `json:"expression_rules_file"`   // ordered allow, block, route and rate_limit expressions
+	HeaderRulesFile     string        `json:"header_rules_file"`       // request/response header rewrite rules
+	RewriteRulesFile    string        `json:"rewrite_rules_file"`      // host and path patterns mapped to destination, path and query rewrites
+	RewriteMaxPasses    int           `json:"rewrite_max_passes"`      // rewrite rules applied to one request at most
+	RoutingRulesFile    string        `json:"routing_rules_file"`      // host patterns mapped to DIRECT, PROXY or SOCKS5 routes
+	DefaultRoute        string        `json:"default_route"`           // route for hosts no rule matches
+	FallbackDirect      bool          `json:"fallback_direct"`         // connect directly when a parent proxy is unreachable
+	FailoverDirect      bool          `json:"failover_direct"`         // connect directly when every parent of a route is down
+	ParentCheckInterval time.Duration `json:"parent_check_interval"`   // how often parent proxies are probed
+	ParentProbeHost     string        `json:"parent_probe_host"`       // host:port probes tunnel to; empty probes with a TCP connect
+	ParentFailThreshold int           `json:"parent_fail_threshold"`   // consecutive failed dials that mark a parent down
+	UpstreamIPSelection string        `json:"upstream_ip_selection"`   // round_robin, random or first across an origin's addresses
+	UpstreamIPCooldown  time.Duration `json:"upstream_ip_cooldown"`    // how long failing addresses are tried last
+	Anonymity           string        `json:"anonymity"`               // transparent, anonymous or elite
+	ExtraStripHeaders   []string      `json:"anonymity_strip_headers"` // extra request headers elite mode removes
+	EnableCaching       bool          `json:"enable_caching"`
+	CacheMaxEntries     int           `json:"cache_max_entries"`
+	CacheMaxSizeMB      int           `json:"cache_max_size_mb"`
+	CacheDefaultTTL     time.Duration `json:"cache_default_ttl"` // how long a response that doesn't say is fresh for
+	CacheBackend        string        `json:"cache_backend"`     // memory or redis
+	RedisAddress        string        `json:"redis_address"`     // host:port of the Redis server for cache_backend = redis
+	RedisPassword       string        `json:"redis_password"`    // sent with AUTH when set
+	RedisDB             int           `json:"redis_db"`          // database number selected on each connection
+	EnableConnectTunnel bool          `json:"enable_connect_tunneling"`
+	InspectSNI          bool          `json:"inspect_sni"`        // filter CONNECT tunnels on their TLS server name
+	InspectSNIStrict    bool          `json:"inspect_sni_strict"` // also require the server name to match the CONNECT host
+	SNISniffTimeout     time.Duration `json:"sni_sniff_timeout"`
+	AuthMode            string        `json:"auth_mode"`            // none, token or basic
+	AuthToken           string        `json:"authentication_token"` // legacy single token, matched against the whole header
+	AuthTokensFile      string        `json:"auth_tokens_file"`     // name:token lines for token mode
+	AuthRealm           string        `json:"auth_realm"`
+	AuthUsersFile       string        `json:"auth_users_file"`    // htpasswd-style bcrypt users for basic mode
+	AuthFailureLimit    int           `json:"auth_failure_limit"` // wrong credentials a client may present per minute; 0 disables the limit
+	PoliciesFile        string        `json:"policies_file"`      // per-user filtering and limits
+	DefaultPolicy       string        `json:"default_policy"`     // policy for unauthenticated and unmapped users
+
+	// External authorization hook; empty auth_hook_url disables it
+	AuthHookURL       string        `json:"auth_hook_url"`
+	AuthHookTimeout   time.Duration `json:"auth_hook_timeout"`
+	AuthHookCacheTTL  time.Duration `json:"auth_hook_cache_ttl"`  // 0 disables verdict caching
+	AuthHookCacheSize int           `json:"auth_hook_cache_size"` // cached verdicts kept at most
+	AuthHookFailOpen  bool          `json:"auth_hook_fail_open"`  // allow requests when the hook fails
+
+	// External policy program; empty policy_exec disables it
+	PolicyExec          string        `json:"policy_exec"`
+	PolicyExecTimeout   time.Duration `json:"policy_exec_timeout"`    // bounds waiting for a worker and the run together
+	PolicyExecCacheTTL  time.Duration `json:"policy_exec_cache_ttl"`  // 0 disables verdict caching
+	PolicyExecCacheSize int           `json:"policy_exec_cache_size"` // cached verdicts kept at most
+	PolicyExecWorkers   int           `json:"policy_exec_workers"`    // programs run at once at most
+	PolicyExecFailOpen  bool          `json:"policy_exec_fail_open"`  // allow requests when the program fails
+
+	// Response scanning; setting scan_icap_url or scan_command enables it
+	ScanICAPURL      string        `json:"scan_icap_url"`      // icap://host[:port]/service answering RESPMOD
+	ScanCommand      string        `json:"scan_command"`       // reads the body on stdin, exits non-zero on detection
+	ScanContentTypes []string      `json:"scan_content_types"` // type/subtype or type/*; with scan_extensions empty, all responses
+	ScanExtensions   []string      `json:"scan_extensions"`
+	ScanMaxBytes     int64         `json:"scan_max_bytes"` // larger responses stream through unscanned
+	ScanTimeout      time.Duration `json:"scan_timeout"`
+	ScanFailOpen     bool          `json:"scan_fail_open"` // forward responses when the scanner fails
+
+	// Record and replay of plain HTTP exchanges; empty record_dir disables both
+	RecordDir          string `json:"record_dir"`
+	RecordMaxBodyBytes int64  `json:"record_max_body_bytes"` // larger bodies are recorded without their content
+	ReplayMode         string `json:"replay_mode"`           // off, hybrid (misses are forwarded) or strict (misses get 404)
+
+	// Fault injection for testing clients; off unless enable_fault_injection
+	// is set, and then only on the listeners named
+	EnableFaultInjection    bool     `json:"enable_fault_injection"`
+	FaultInjectionFile      string   `json:"fault_injection_file"`      // host and path patterns mapped to latency, status and body faults
+	FaultInjectionListeners []string `json:"fault_injection_listeners"` // labels of the listeners entries faults apply on
+
+	// Client and destination mappings to simulated link speeds
+	BandwidthProfilesFile string `json:"bandwidth_profiles_file"`
+
+	// Per-request timing breakdowns in the error log, for the clients or
+	// requests asked for; the phases are always measured
+	TimingDebugClients        []string `json:"timing_debug_clients"`         // CIDRs whose requests are broken down
+	TimingDebugHeader         string   `json:"timing_debug_header"`          // request header that asks for a breakdown, removed before forwarding
+	TimingDebugResponseHeader bool     `json:"timing_debug_response_header"` // also send X-Proxy-Timing to the client
+
+	// Timeouts; zero disables the client and upstream I/O timeouts
+	ClientIdleTimeout      time.Duration `json:"client_idle_timeout"`   // wait for a request to start
+	ClientHeaderTimeout    time.Duration `json:"client_header_timeout"` // receive the whole request head
+	ClientReadTimeout      time.Duration `json:"client_read_timeout"`   // receive the request body
+	UpstreamConnectTimeout time.Duration `json:"upstream_connect_timeout"`
+	UpstreamIOTimeout      time.Duration `json:"upstream_io_timeout"`
+	MaxRequestDuration     time.Duration `json:"max_request_duration"` // 0 lets a request run as long as data flows
+	ReadBufferSize         int           `json:"read_buffer_size"`
+	ShutdownGracePeriod    time.Duration `json:"shutdown_grace_period"` // 0 closes connections immediately
+
+	// Time from the request being sent to the whole response head arriving;
+	// zero leaves the wait to upstream_io_timeout
+	UpstreamResponseHeaderTimeout time.Duration `json:"upstream_response_header_timeout"`
+
+	// Request bodies are streamed to the origin; zero disables these limits
+	MaxUploadBytes     int64         `json:"max_upload_bytes"`
+	MinUploadRate      int64         `json:"min_upload_rate"` // bytes per second, enforced after the grace period
+	MinUploadRateGrace time.Duration `json:"min_upload_rate_grace"`
+
+	// Source addresses allowed to use the proxy; empty allows all
+	AllowedClientCIDRs []string `json:"allowed_client_cidrs"`
+	DeniedClient403    bool     `json:"denied_client_403"` // answer 403 before closing denied clients
+
+	// Connection limits; zero disables them
+	MaxConnections      int    `json:"max_connections"`
+	ConnectionLimitMode string `json:"connection_limit_mode"` // reject (503) or block
+	MaxConnectionsPerIP int    `json:"max_connections_per_ip"`
+	IPv6LimitPrefix     int    `json:"ipv6_limit_prefix"` // IPv6 clients are counted per network of this size
+
+	// Connections to each destination host:port; zero disables the cap
+	MaxConnectionsPerUpstream int           `json:"max_connections_per_upstream"`
+	UpstreamLimitWait         time.Duration `json:"upstream_limit_wait"` // 0 refuses at once with 503
+
+	// Load shedding: connections are answered 503 before parsing while any
+	// signal is at its threshold; zero disables a signal
+	ShedQueueDepth        int           `json:"shed_queue_depth"` // connections waiting for a worker
+	ShedActiveConnections int           `json:"shed_active_connections"`
+	ShedGoroutines        int           `json:"shed_goroutines"`
+	ShedLatency           time.Duration `json:"shed_latency"`     // moving average of the upstream time to first byte
+	ShedRetryAfter        time.Duration `json:"shed_retry_after"` // sent as Retry-After, in whole seconds
+
+	// Per-client request rate limiting; a zero rate disables it
+	RateLimitRPS         float64  `json:"rate_limit_rps"`
+	RateLimitBurst       int      `json:"rate_limit_burst"`
+	RateLimitExemptCIDRs []string `json:"rate_limit_exempt_cidrs"`
+
+	// Health checks
+	AdminListen            string        `json:"admin_listen"`      // addr:port for /healthz and /readyz; empty disables
+	AdminToken             string        `json:"admin_token"`       // bearer token every admin request must present
+	HealthCheckPath        string        `json:"health_check_path"` // GET path answered on the proxy port; empty disables
+	ReadinessCanary        string        `json:"readiness_canary"`  // host:port that /readyz test-dials
+	ReadinessCanaryTimeout time.Duration `json:"readiness_canary_timeout"`
+	AdminAllowedCIDRs      []string      `json:"admin_allowed_cidrs"`
+	StatsRetention         time.Duration `json:"stats_retention"`
+
+	// StatsD or DogStatsD metrics over UDP; empty statsd_address disables them
+	StatsdAddress    string  `json:"statsd_address"`     // host:port of the agent
+	StatsdPrefix     string  `json:"statsd_prefix"`      // prepended to every metric name
+	StatsdTags       bool    `json:"statsd_tags"`        // add DogStatsD tags for action, method and listener
+	StatsdSampleRate float64 `json:"statsd_sample_rate"` // fraction of requests whose timings are sent
+
+	// Access log shipping to an HTTP collector; empty log_ship_url disables it
+	LogShipURL        string        `json:"log_ship_url"`          // endpoint batches are POSTed to
+	LogShipInterval   time.Duration `json:"log_ship_interval"`     // longest a partial batch waits
+	LogShipBatchSize  int           `json:"log_ship_batch_size"`   // entries that trigger a batch
+	LogShipSpoolDir   string        `json:"log_ship_spool_dir"`    // where unsent batches wait; empty keeps them in memory
+	LogShipSpoolMaxMB int           `json:"log_ship_spool_max_mb"` // spool size past which the oldest batches are dropped
+
+	// Access log database for local queries (see the logquery command)
+	LogBackend         string `json:"log_backend"`           // file, sqlite or both
+	LogDBPath          string `json:"log_db_path"`           // SQLite database written when log_backend isn't file
+	LogDBRetentionDays int    `json:"log_db_retention_days"` // older entries are pruned; 0 keeps them all
+
+	// Destination country and AS number in access log entries
+	GeoIPDatabase          string `json:"geoip_database"`            // MaxMind DB with countries; empty disables them
+	GeoIPASNDatabase       string `json:"geoip_asn_database"`        // MaxMind DB with AS numbers; empty disables them
+	LogGeoIPMaxConnections int    `json:"log_geoip_max_connections"` // skip lookups while more connections are active; 0 never skips
+
+	// Reverse proxy listeners, which route by Host to configured backends
+	ReverseProxyFile        string   `json:"reverse_proxy_file"`         // host patterns mapped to backend URLs
+	ReverseProxyListeners   []string `json:"reverse_proxy_listeners"`    // labels of the listeners that act as reverse proxies
+	ReverseProxyUnknownHost string   `json:"reverse_proxy_unknown_host"` // 404, or a URL requests for other hosts are redirected to
+
+	// What happens when blocked_domains_file or a category list can't be loaded
+	FilterFailurePolicy string `json:"filter_failure_policy"` // open or closed
+	StrictRules         bool   `json:"strict_rules"`          // an invalid rules file entry fails the load instead of being skipped
+
+	// Proxy auto-config script served at /proxy.pac and /wpad.dat
+	PACFilePath      string   `json:"pac_file_path"`      // static script to serve
+	PACAuto          bool     `json:"pac_auto"`           // generate a script pointing at this proxy
+	PACDirectDomains []string `json:"pac_direct_domains"` // exact or *.suffix hosts the generated script sends DIRECT
+
+	// TLS interception of CONNECT tunnels; empty mitm_domains disables it
+	MITMDomains []string `json:"mitm_domains"` // exact or *.suffix patterns
+	CACertFile  string   `json:"ca_cert_file"`
+	CAKeyFile   string   `json:"ca_key_file"`
+
+	// Verification of origin certificates for https:// request targets and
+	// intercepted tunnels; empty upstream_ca_file uses the system roots
+	UpstreamCAFile             string `json:"upstream_ca_file"`
+	UpstreamInsecureSkipVerify bool   `json:"upstream_insecure_skip_verify"`
+
+	StrictConfig bool `json:"strict_config"`
+
+	// Source is the file the configuration was loaded from and Overrides
+	// the command-line values applied on top of it, both reused on reload.
+	// Files lists every file merged, Source and its includes, in load order.
+	Source    string            `json:"-"`
+	Files     []string          `json:"-"`
+	Overrides map[string]string `json:"-"`
+
+	// sources records where each explicitly set key's value came from
+	sources map[string]string
+
+	// secretRefs records the env: and file: references secrets were read from
+	secretRefs map[string]string
+}
+
+// ConfigError reports an invalid value for a configuration key
+type ConfigError struct {
+	Key     string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Message
+}
+
+// invalidConfig returns a ConfigError for key
+func invalidConfig(key, message string) error {
+	return &ConfigError{Key: key, Message: message}
+}
+
+// DefaultConfig returns a configuration with sensible defaults
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddress:       "0.0.0.0",
+		ListenPort:          8888,
+		ConcurrencyModel:    "thread_per_connection",
+		ThreadPoolSize:      10,
+		WorkerIdleTimeout:   30 * time.Second,
+		QueueOverflow:       "drop",
+		QueueWaitTimeout:    5 * time.Second,
+		LogFilePath:         "proxy.log",
+		LogMaxSizeMB:        100,
+		LogFormat:           "default",
+		LogFailurePolicy:    "degrade",
+		ServerHeader:        true,
+		LogAnonymizeIPs:     "none",
+		Anonymity:           "transparent",
+		DefaultRoute:        "DIRECT",
+		RewriteMaxPasses:    5,
+		ParentCheckInterval: 10 * time.Second,
+		ParentFailThreshold: 2,
+		UpstreamIPSelection: "round_robin",
+		UpstreamIPCooldown:  30 * time.Second,
+		LogLevel:            "info",
+		BlockedDomainsFile:  filepath.FromSlash("config/blocked_domains.txt"),
+		SafeSearchHosts:     append([]string(nil), defaultSafeSearchHosts...),
+		HTTPSUpgradeMode:    upgradeRedirect,
+		EnableCaching:       false,
+		CacheMaxEntries:     1000,
+		CacheMaxSizeMB:      100,
+		CacheDefaultTTL:     defaultCacheTTL,
+		CacheBackend:        "memory",
+		EnableConnectTunnel: false,
+		SNISniffTimeout:     1 * time.Second,
+		AuthToken:           "",
+		AuthRealm:           "proxy",
+		AuthFailureLimit:    10,
+
+		AuthHookTimeout:   2 * time.Second,
+		AuthHookCacheTTL:  1 * time.Minute,
+		AuthHookCacheSize: 10000,
+
+		PolicyExecTimeout:   2 * time.Second,
+		PolicyExecCacheTTL:  1 * time.Minute,
+		PolicyExecCacheSize: 10000,
+		PolicyExecWorkers:   4,
+
+		ScanMaxBytes: 10 << 20,
+		ScanTimeout:  30 * time.Second,
+
+		RecordMaxBodyBytes: 1 << 20,
+		ReplayMode:         replayOff,
+
+		ClientIdleTimeout:      30 * time.Second,
+		ClientHeaderTimeout:    30 * time.Second,
+		ClientReadTimeout:      30 * time.Second,
+		UpstreamConnectTimeout: 30 * time.Second,
+		UpstreamIOTimeout:      30 * time.Second,
+		ReadBufferSize:         8192,
+		ShutdownGracePeriod:    30 * time.Second,
+
+		MinUploadRateGrace: 10 * time.Second,
+
+		ConnectionLimitMode: "reject",
+		IPv6LimitPrefix:     64,
+
+		ShedRetryAfter: time.Second,
+
+		RateLimitBurst: 1,
+
+		ReadinessCanaryTimeout: 2 * time.Second,
+		StatsRetention:         6 * time.Hour,
+
+		StatsdPrefix:     "proxy.",
+		StatsdSampleRate: 1,
+
+		LogShipInterval:   5 * time.Second,
+		LogShipBatchSize:  500,
+		LogShipSpoolMaxMB: 100,
+
+		LogBackend:         "file",
+		LogDBPath:          "proxy-log.db",
+		LogDBRetentionDays: 30,
+
+		ReverseProxyUnknownHost: "404",
+
+		FilterFailurePolicy: "open",
+	}
+}
+
+// LoadConfig loads configuration from a JSON file, then applies environment
+// and command-line overrides. Values go through Set as they do for the other
+// formats; use LoadConfigFile to also get warnings about unknown keys.
+func LoadConfig(path string, overrides map[string]string) (*Config, error) {
+	config, _, err := loadParsedConfig(path, overrides, parseJSONConfig)
+	return config, err
+}
+
+// inferAuthMode fills in an unset auth_mode: setting a token enables token
+// auth as it did before auth_mode existed
+func (c *Config) inferAuthMode() {
+	if c.AuthMode == "" {
+		c.AuthMode = "none"
+		if c.AuthToken != "" || c.AuthTokensFile != "" {
+			c.AuthMode = "token"
+		}
+	}
+}
+
+// finishConfig applies environment overrides and then command-line
+// overrides on top of the file values, and validates the result
+func finishConfig(config *Config, overrides map[string]string) (*Config, error) {
+	if err := config.ApplyEnvOverrides(); err != nil {
+		return nil, err
+	}
+
+	for key, value := range overrides {
+		name := "-" + strings.ReplaceAll(key, "_", "-")
+		if err := config.setFrom(key, value, "flag "+name); err != nil {
+			return nil, fmt.Errorf("flag %s: %w", name, err)
+		}
+	}
+	config.Overrides = overrides
+	if err := config.resolveSecrets(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	config.inferAuthMode()
+
+	// Validate configuration, naming where a bad value came from
+	if err := config.Validate(); err != nil {
+		var configErr *ConfigError
+		if errors.As(err, &configErr) {
+			return nil, fmt.Errorf("invalid configuration: %w (from %s)", err, config.SourceOf(configErr.Key))
+		}
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return config, nil
+}
+
+// Validate checks if the configuration is valid
+func (c *Config) Validate() error {
+	// Port 0 picks a free port, as tests do; Server.Addr returns it
+	if c.ListenPort < 0 || c.ListenPort > 65535 {
+		return invalidConfig("listen_port", "listen_port must be between 0 and 65535")
+	}
+
+	for _, spec := range c.ListenerSpecs() {
+		_, port, err := net.SplitHostPort(spec.Address)
+		if err != nil {
+			return invalidConfig("listeners", fmt.Sprintf("listeners entry %q must be addr:port", spec.Address))
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return invalidConfig("listeners", fmt.Sprintf("listeners entry %q has an invalid port", spec.Address))
+		}
+	}
+
+	if c.HasTLSListener() && (c.TLSCertFile == "" || c.TLSKeyFile == "") {
+		return invalidConfig("tls_cert_file", "tls_cert_file and tls_key_file are required for TLS listeners")
+	}
+
+	if (c.RunAsUser != "" || c.RunAsGroup != "") && !canDropPrivileges {
+		return invalidConfig("run_as_user", fmt.Sprintf("run_as_user and run_as_group are not supported on %s", runtime.GOOS))
+	}
+
+	if c.ConcurrencyModel != "thread_per_connection" && c.ConcurrencyModel != "thread_pool" {
+		return invalidConfig("concurrency_model", "concurrency_model must be 'thread_per_connection' or 'thread_pool'")
+	}
+
+	if c.ConcurrencyModel == "thread_pool" && c.ThreadPoolSize < 1 {
+		return invalidConfig("thread_pool_size", "thread_pool_size must be at least 1")
+	}
+
+	if c.MinWorkers < 0 || c.MaxWorkers < 0 {
+		return invalidConfig("min_workers", "min_workers and max_workers must not be negative")
+	}
+
+	if min, max := c.PoolWorkerRange(); c.ConcurrencyModel == "thread_pool" && (min < 1 || max < min) {
+		return invalidConfig("max_workers", fmt.Sprintf("worker pool needs 1 <= min_workers <= max_workers, got %d and %d", min, max))
+	}
+
+	if c.WorkerIdleTimeout <= 0 {
+		return invalidConfig("worker_idle_timeout", "worker_idle_timeout must be greater than 0")
+	}
+
+	if c.QueueSize < 0 {
+		return invalidConfig("queue_size", "queue_size must not be negative")
+	}
+
+	if c.QueueOverflow != "drop" && c.QueueOverflow != "reject" && c.QueueOverflow != "block" {
+		return invalidConfig("queue_overflow", "queue_overflow must be 'drop', 'reject' or 'block'")
+	}
+
+	if c.QueueOverflow == "block" && c.QueueWaitTimeout <= 0 {
+		return invalidConfig("queue_wait_timeout", "queue_wait_timeout must be greater than 0")
+	}
+
+	if c.QueueMaxWait < 0 {
+		return invalidConfig("queue_max_wait", "queue_max_wait must not be negative")
+	}
+
+	switch c.AuthMode {
+	case "none":
+	case "token":
+		if c.AuthToken == "" && c.AuthTokensFile == "" {
+			return invalidConfig("auth_tokens_file", "auth_mode 'token' requires auth_tokens_file or authentication_token")
+		}
+	case "basic":
+		if c.AuthUsersFile == "" {
+			return invalidConfig("auth_users_file", "auth_mode 'basic' requires auth_users_file")
+		}
+	default:
+		return invalidConfig("auth_mode", "auth_mode must be 'none', 'token' or 'basic'")
+	}
+
+	if c.AuthFailureLimit < 0 {
+		return invalidConfig("auth_failure_limit", "auth_failure_limit must not be negative")
+	}
+
+	if c.DefaultPolicy != "" && c.PoliciesFile == "" {
+		return invalidConfig("default_policy", "default_policy requires policies_file")
+	}
+
+	if c.AuthHookURL != "" {
+		if u, err := url.Parse(c.AuthHookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return invalidConfig("auth_hook_url", "auth_hook_url must be an http or https URL")
+		}
+	}
+
+	if c.AuthHookTimeout <= 0 {
+		return invalidConfig("auth_hook_timeout", "auth_hook_timeout must be greater than 0")
+	}
+
+	if c.AuthHookCacheTTL < 0 {
+		return invalidConfig("auth_hook_cache_ttl", "auth_hook_cache_ttl must not be negative")
+	}
+
+	if c.AuthHookCacheSize < 0 {
+		return invalidConfig("auth_hook_cache_size", "auth_hook_cache_size must not be negative")
+	}
+
+	if c.PolicyExecTimeout <= 0 {
+		return invalidConfig("policy_exec_timeout", "policy_exec_timeout must be greater than 0")
+	}
+
+	if c.PolicyExecCacheTTL < 0 {
+		return invalidConfig("policy_exec_cache_ttl", "policy_exec_cache_ttl must not be negative")
+	}
+
+	if c.PolicyExecCacheSize < 0 {
+		return invalidConfig("policy_exec_cache_size", "policy_exec_cache_size must not be negative")
+	}
+
+	if c.PolicyExecWorkers < 1 {
+		return invalidConfig("policy_exec_workers", "policy_exec_workers must be at least 1")
+	}
+
+	if c.RewriteMaxPasses < 1 {
+		return invalidConfig("rewrite_max_passes", "rewrite_max_passes must be at least 1")
+	}
+
+	if c.ScanICAPURL != "" {
+		if u, err := url.Parse(c.ScanICAPURL); err != nil || u.Scheme != "icap" || u.Host == "" {
+			return invalidConfig("scan_icap_url", "scan_icap_url must be an icap://host[:port]/service URL")
+		}
+	}
+
+	if c.ScanCommand != "" && len(strings.Fields(c.ScanCommand)) == 0 {
+		return invalidConfig("scan_command", "scan_command must name a program")
+	}
+
+	if c.ScanICAPURL != "" && c.ScanCommand != "" {
+		return invalidConfig("scan_command", "scan_icap_url and scan_command are mutually exclusive")
+	}
+
+	for _, ext := range c.ScanExtensions {
+		if ext == "" || strings.ContainsAny(ext, "./\\ ") {
+			return invalidConfig("scan_extensions", fmt.Sprintf("scan_extensions: invalid extension %q", ext))
+		}
+	}
+
+	if c.ScanMaxBytes <= 0 {
+		return invalidConfig("scan_max_bytes", "scan_max_bytes must be greater than 0")
+	}
+
+	if c.ScanTimeout <= 0 {
+		return invalidConfig("scan_timeout", "scan_timeout must be greater than 0")
+	}
+
+	if c.RecordMaxBodyBytes < 0 {
+		return invalidConfig("record_max_body_bytes", "record_max_body_bytes must not be negative")
+	}
+
+	switch c.ReplayMode {
+	case replayOff, replayHybrid, replayStrict:
+	default:
+		return invalidConfig("replay_mode", "replay_mode must be 'off', 'hybrid' or 'strict'")
+	}
+	if c.ReplayMode != replayOff && c.RecordDir == "" {
+		return invalidConfig("replay_mode", "replay_mode requires record_dir")
+	}
+
+	if c.ClientIdleTimeout < 0 {
+		return invalidConfig("client_idle_timeout", "client_idle_timeout must not be negative")
+	}
+
+	if c.ClientHeaderTimeout < 0 {
+		return invalidConfig("client_header_timeout", "client_header_timeout must not be negative")
+	}
+
+	if c.ClientReadTimeout < 0 {
+		return invalidConfig("client_read_timeout", "client_read_timeout must not be negative")
+	}
+
+	if c.UpstreamConnectTimeout <= 0 {
+		return invalidConfig("upstream_connect_timeout", "upstream_connect_timeout must be greater than 0")
+	}
+
+	if c.UpstreamIOTimeout < 0 {
+		return invalidConfig("upstream_io_timeout", "upstream_io_timeout must not be negative")
+	}
+
+	if c.UpstreamResponseHeaderTimeout < 0 {
+		return invalidConfig("upstream_response_header_timeout", "upstream_response_header_timeout must not be negative")
+	}
+
+	if c.MaxRequestDuration < 0 {
+		return invalidConfig("max_request_duration", "max_request_duration must not be negative")
+	}
+
+	// An idle timeout longer than the whole request may take never fires
+	if c.MaxRequestDuration > 0 && c.UpstreamIOTimeout > c.MaxRequestDuration {
+		return invalidConfig("upstream_io_timeout", fmt.Sprintf("upstream_io_timeout (%s) must not exceed max_request_duration (%s)", c.UpstreamIOTimeout, c.MaxRequestDuration))
+	}
+
+	if c.MaxRequestDuration > 0 && c.UpstreamConnectTimeout > c.MaxRequestDuration {
+		return invalidConfig("upstream_connect_timeout", fmt.Sprintf("upstream_connect_timeout (%s) must not exceed max_request_duration (%s)", c.UpstreamConnectTimeout, c.MaxRequestDuration))
+	}
+
+	if c.SNISniffTimeout <= 0 {
+		return invalidConfig("sni_sniff_timeout", "sni_sniff_timeout must be greater than 0")
+	}
+
+	if c.ShutdownGracePeriod < 0 {
+		return invalidConfig("shutdown_grace_period", "shutdown_grace_period must not be negative")
+	}
+
+	if c.ReadBufferSize < 512 {
+		return invalidConfig("read_buffer_size", "read_buffer_size must be at least 512")
+	}
+
+	if c.MaxUploadBytes < 0 {
+		return invalidConfig("max_upload_bytes", "max_upload_bytes must not be negative")
+	}
+
+	if c.MinUploadRate < 0 {
+		return invalidConfig("min_upload_rate", "min_upload_rate must not be negative")
+	}
+
+	if c.MinUploadRateGrace < 0 {
+		return invalidConfig("min_upload_rate_grace", "min_upload_rate_grace must not be negative")
+	}
+
+	if _, err := parseCIDRList(c.AllowedClientCIDRs); err != nil {
+		return invalidConfig("allowed_client_cidrs", fmt.Sprintf("allowed_client_cidrs: %v", err))
+	}
+
+	if c.MaxConnections < 0 {
+		return invalidConfig("max_connections", "max_connections must not be negative")
+	}
+
+	if c.ConnectionLimitMode != "reject" && c.ConnectionLimitMode != "block" {
+		return invalidConfig("connection_limit_mode", "connection_limit_mode must be 'reject' or 'block'")
+	}
+
+	if c.MaxConnectionsPerIP < 0 {
+		return invalidConfig("max_connections_per_ip", "max_connections_per_ip must not be negative")
+	}
+
+	if c.IPv6LimitPrefix < 1 || c.IPv6LimitPrefix > 128 {
+		return invalidConfig("ipv6_limit_prefix", "ipv6_limit_prefix must be between 1 and 128")
+	}
+
+	if c.MaxConnectionsPerUpstream < 0 {
+		return invalidConfig("max_connections_per_upstream", "max_connections_per_upstream must not be negative")
+	}
+
+	if c.UpstreamLimitWait < 0 {
+		return invalidConfig("upstream_limit_wait", "upstream_limit_wait must not be negative")
+	}
+
+	if c.ShedQueueDepth < 0 {
+		return invalidConfig("shed_queue_depth", "shed_queue_depth must not be negative")
+	}
+
+	if c.ShedActiveConnections < 0 {
+		return invalidConfig("shed_active_connections", "shed_active_connections must not be negative")
+	}
+
+	if c.ShedGoroutines < 0 {
+		return invalidConfig("shed_goroutines", "shed_goroutines must not be negative")
+	}
+
+	if c.ShedLatency < 0 {
+		return invalidConfig("shed_latency", "shed_latency must not be negative")
+	}
+
+	if c.ShedRetryAfter < time.Second {
+		return invalidConfig("shed_retry_after", "shed_retry_after must be at least 1s")
+	}
+
+	if c.RateLimitRPS < 0 {
+		return invalidConfig("rate_limit_rps", "rate_limit_rps must not be negative")
+	}
+
+	if c.RateLimitRPS > 0 && c.RateLimitBurst < 1 {
+		return invalidConfig("rate_limit_burst", "rate_limit_burst must be at least 1")
+	}
+
+	if _, err := parseBlocklistCategories(c.BlocklistCategories); err != nil {
+		return invalidConfig("blocklist_categories", err.Error())
+	}
+
+	if _, err := parseSafeSearchHosts(c.SafeSearchHosts); err != nil {
+		return invalidConfig("safesearch_hosts", fmt.Sprintf("safesearch_hosts: %v", err))
+	}
+
+	if c.HTTPSUpgradeMode != upgradeRedirect && c.HTTPSUpgradeMode != upgradeRewrite {
+		return invalidConfig("https_upgrade_mode", "https_upgrade_mode must be 'redirect' or 'rewrite'")
+	}
+	for _, domain := range c.HTTPSUpgradeDomains {
+		name := strings.TrimPrefix(domain, "*.")
+		if name == "" || strings.ContainsAny(name, "*/: ") {
+			return invalidConfig("https_upgrade_domains", fmt.Sprintf("https_upgrade_domains: invalid pattern %q (want a host or *.suffix)", domain))
+		}
+	}
+
+	for _, ext := range c.BlockedExtensions {
+		if ext == "" || strings.ContainsAny(ext, "./\\ ") {
+			return invalidConfig("blocked_extensions", fmt.Sprintf("blocked_extensions: invalid extension %q", ext))
+		}
+	}
+
+	if _, err := parseCIDRList(c.RateLimitExemptCIDRs); err != nil {
+		return invalidConfig("rate_limit_exempt_cidrs", fmt.Sprintf("rate_limit_exempt_cidrs: %v", err))
+	}
+
+	if c.AdminListen != "" {
+		if _, _, err := net.SplitHostPort(c.AdminListen); err != nil {
+			return invalidConfig("admin_listen", fmt.Sprintf("admin_listen %q must be addr:port", c.AdminListen))
+		}
+	}
+
+	if c.AdminListen != "" && c.AdminToken == "" && !isLoopbackListen(c.AdminListen) {
+		return invalidConfig("admin_token", fmt.Sprintf("admin_token is required when admin_listen %q is not a loopback address", c.AdminListen))
+	}
+
+	if _, err := parseCIDRList(c.AdminAllowedCIDRs); err != nil {
+		return invalidConfig("admin_allowed_cidrs", fmt.Sprintf("admin_allowed_cidrs: %v", err))
+	}
+
+	if c.StatsRetention != 0 && (c.StatsRetention < timeseriesInterval || c.StatsRetention > maxStatsRetention) {
+		return invalidConfig("stats_retention", fmt.Sprintf("stats_retention must be 0 or between %s and %s", timeseriesInterval, maxStatsRetention))
+	}
+
+	if c.StatsdAddress != "" {
+		if _, _, err := net.SplitHostPort(c.StatsdAddress); err != nil {
+			return invalidConfig("statsd_address", fmt.Sprintf("statsd_address %q must be host:port", c.StatsdAddress))
+		}
+	}
+
+	if strings.ContainsAny(c.StatsdPrefix, ":|@#, \t") {
+		return invalidConfig("statsd_prefix", fmt.Sprintf("statsd_prefix %q must not contain spaces or any of :|@#,", c.StatsdPrefix))
+	}
+
+	if c.StatsdSampleRate <= 0 || c.StatsdSampleRate > 1 {
+		return invalidConfig("statsd_sample_rate", "statsd_sample_rate must be greater than 0 and at most 1")
+	}
+
+	if c.HealthCheckPath != "" && !strings.HasPrefix(c.HealthCheckPath, "/") {
+		return invalidConfig("health_check_path", "health_check_path must start with /")
+	}
+
+	if c.ReadinessCanary != "" {
+		if _, _, err := net.SplitHostPort(c.ReadinessCanary); err != nil {
+			return invalidConfig("readiness_canary", fmt.Sprintf("readiness_canary %q must be host:port", c.ReadinessCanary))
+		}
+	}
+
+	if c.ReadinessCanaryTimeout <= 0 {
+		return invalidConfig("readiness_canary_timeout", "readiness_canary_timeout must be greater than 0")
+	}
+
+	if c.PACFilePath != "" && c.PACAuto {
+		return invalidConfig("pac_auto", "pac_file_path and pac_auto are mutually exclusive")
+	}
+
+	if len(c.MITMDomains) > 0 && (c.CACertFile == "" || c.CAKeyFile == "") {
+		return invalidConfig("mitm_domains", "ca_cert_file and ca_key_file are required for mitm_domains")
+	}
+
+	if c.LogMaxSizeMB < 0 {
+		return invalidConfig("log_max_size_mb", "log_max_size_mb must be 0 (disabled) or greater")
+	}
+
+	if c.LogFormat != "default" && c.LogFormat != "clf" && c.LogFormat != "combined" && c.LogFormat != "combined_id" && c.LogFormat != "json" {
+		return invalidConfig("log_format", "log_format must be 'default', 'clf', 'combined', 'combined_id' or 'json'")
+	}
+
+	if c.LogFailurePolicy != "degrade" && c.LogFailurePolicy != "block" && c.LogFailurePolicy != "drop" {
+		return invalidConfig("log_failure_policy", "log_failure_policy must be 'degrade', 'block' or 'drop'")
+	}
+
+	if c.LogShipURL != "" {
+		if u, err := url.Parse(c.LogShipURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return invalidConfig("log_ship_url", fmt.Sprintf("log_ship_url %q must be an http:// or https:// URL", c.LogShipURL))
+		}
+	}
+
+	if c.LogShipInterval <= 0 {
+		return invalidConfig("log_ship_interval", "log_ship_interval must be greater than 0")
+	}
+
+	if c.LogShipBatchSize < 1 {
+		return invalidConfig("log_ship_batch_size", "log_ship_batch_size must be at least 1")
+	}
+
+	if c.LogShipSpoolMaxMB < 1 {
+		return invalidConfig("log_ship_spool_max_mb", "log_ship_spool_max_mb must be at least 1")
+	}
+
+	if c.LogBackend != "file" && c.LogBackend != "sqlite" && c.LogBackend != "both" {
+		return invalidConfig("log_backend", "log_backend must be 'file', 'sqlite' or 'both'")
+	}
+
+	if c.LogBackend != "file" && c.LogDBPath == "" {
+		return invalidConfig("log_db_path", "log_db_path is required when log_backend is sqlite or both")
+	}
+
+	if c.LogDBRetentionDays < 0 {
+		return invalidConfig("log_db_retention_days", "log_db_retention_days must be 0 (keep everything) or greater")
+	}
+
+	if c.LogGeoIPMaxConnections < 0 {
+		return invalidConfig("log_geoip_max_connections", "log_geoip_max_connections must be 0 (never skip) or greater")
+	}
+
+	if len(c.ReverseProxyListeners) > 0 && c.ReverseProxyFile == "" {
+		return invalidConfig("reverse_proxy_file", "reverse_proxy_file is required for reverse_proxy_listeners")
+	}
+
+	// Only listeners entries have labels to name
+	labels := make(map[string]bool)
+	if len(c.Listeners) > 0 {
+		for _, spec := range c.ListenerSpecs() {
+			labels[spec.Label] = true
+		}
+	}
+	for _, label := range c.ReverseProxyListeners {
+		if !labels[label] {
+			return invalidConfig("reverse_proxy_listeners", fmt.Sprintf("reverse_proxy_listeners entry %q is not the label of a listeners entry", label))
+		}
+	}
+
+	// Fault injection must be switched on and pointed at listeners by name
+	if c.EnableFaultInjection {
+		if c.FaultInjectionFile == "" {
+			return invalidConfig("fault_injection_file", "fault_injection_file is required for enable_fault_injection")
+		}
+		if len(c.FaultInjectionListeners) == 0 {
+			return invalidConfig("fault_injection_listeners", "fault_injection_listeners must name the listeners faults apply on")
+		}
+		for _, label := range c.FaultInjectionListeners {
+			if !labels[label] {
+				return invalidConfig("fault_injection_listeners", fmt.Sprintf("fault_injection_listeners entry %q is not the label of a listeners entry", label))
+			}
+		}
+	}
+
+	if c.ReverseProxyUnknownHost != "404" {
+		if u, err := url.Parse(c.ReverseProxyUnknownHost); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return invalidConfig("reverse_proxy_unknown_host", "reverse_proxy_unknown_host must be 404 or an http:// or https:// URL to redirect to")
+		}
+	}
+
+	if c.FilterFailurePolicy != "open" && c.FilterFailurePolicy != "closed" {
+		return invalidConfig("filter_failure_policy", "filter_failure_policy must be 'open' or 'closed'")
+	}
+
+	if _, err := parseRoute(c.DefaultRoute); err != nil {
+		return invalidConfig("default_route", fmt.Sprintf("default_route: %v", err))
+	}
+
+	if c.ParentCheckInterval <= 0 {
+		return invalidConfig("parent_check_interval", "parent_check_interval must be greater than 0")
+	}
+
+	if c.ParentProbeHost != "" {
+		if _, port, err := net.SplitHostPort(c.ParentProbeHost); err != nil || port == "" {
+			return invalidConfig("parent_probe_host", "parent_probe_host must be host:port")
+		}
+	}
+
+	if c.ParentFailThreshold < 1 {
+		return invalidConfig("parent_fail_threshold", "parent_fail_threshold must be at least 1")
+	}
+
+	if c.UpstreamIPSelection != "round_robin" && c.UpstreamIPSelection != "random" && c.UpstreamIPSelection != "first" {
+		return invalidConfig("upstream_ip_selection", "upstream_ip_selection must be 'round_robin', 'random' or 'first'")
+	}
+
+	if c.UpstreamIPCooldown < 0 {
+		return invalidConfig("upstream_ip_cooldown", "upstream_ip_cooldown must not be negative")
+	}
+
+	if _, err := parseCIDRList(c.TimingDebugClients); err != nil {
+		return invalidConfig("timing_debug_clients", fmt.Sprintf("timing_debug_clients: %v", err))
+	}
+	if c.TimingDebugHeader != "" && (strings.ContainsAny(c.TimingDebugHeader, ": \t") || framingHeaders[strings.ToLower(c.TimingDebugHeader)]) {
+		return invalidConfig("timing_debug_header", fmt.Sprintf("timing_debug_header %q is not a usable header name", c.TimingDebugHeader))
+	}
+
+	if c.Anonymity != "transparent" && c.Anonymity != "anonymous" && c.Anonymity != "elite" {
+		return invalidConfig("anonymity", "anonymity must be 'transparent', 'anonymous' or 'elite'")
+	}
+
+	for _, name := range c.ExtraStripHeaders {
+		if framingHeaders[strings.ToLower(name)] {
+			return invalidConfig("anonymity_strip_headers", fmt.Sprintf("anonymity_strip_headers may not include %s", name))
+		}
+	}
+
+	if c.LogAnonymizeIPs != "none" && c.LogAnonymizeIPs != "truncate" && c.LogAnonymizeIPs != "hash" {
+		return invalidConfig("log_anonymize_ips", "log_anonymize_ips must be 'none', 'truncate' or 'hash'")
+	}
+
+	if _, err := ParseLogLevel(c.LogLevel); err != nil {
+		return invalidConfig("log_level", "log_level must be 'debug', 'info', 'warn' or 'error'")
+	}
+
+	if c.EnableCaching && c.CacheMaxEntries < 1 {
+		return invalidConfig("cache_max_entries", "cache_max_entries must be at least 1 when caching is enabled")
+	}
+	if c.EnableCaching && c.CacheMaxSizeMB < 1 {
+		return invalidConfig("cache_max_size_mb", "cache_max_size_mb must be at least 1 when caching is enabled")
+	}
+	if c.EnableCaching && c.CacheDefaultTTL <= 0 {
+		return invalidConfig("cache_default_ttl", "cache_default_ttl must be positive when caching is enabled")
+	}
+	if c.CacheBackend != "memory" && c.CacheBackend != "redis" {
+		return invalidConfig("cache_backend", "cache_backend must be 'memory' or 'redis'")
+	}
+	if c.CacheBackend == "redis" {
+		if _, _, err := net.SplitHostPort(c.RedisAddress); err != nil {
+			return invalidConfig("redis_address", fmt.Sprintf("redis_address %q must be host:port when cache_backend is redis", c.RedisAddress))
+		}
+	}
+	if c.RedisDB < 0 {
+		return invalidConfig("redis_db", "redis_db must not be negative")
+	}
+
+	return nil
+}
+
+// LoadConfigFromINI loads configuration from a simple INI-like format
+// Format: key=value (one per line, # for comments), plus "include <glob>"
+// lines that load the matching files in lexical order at that point, so
+// later values override earlier ones. Relative globs are resolved against
+// the including file's directory.
+// Malformed lines, unknown keys and unparseable values are returned as
+// warnings with their line numbers; unparseable values keep their defaults.
+// Include errors, such as cycles or unreadable files, are fatal.
+func LoadConfigFromINI(path string, overrides map[string]string) (*Config, []string, error) {
+	config := DefaultConfig()
+
+	var warnings []string
+	if err := config.loadINIFile(path, nil, &warnings); err != nil {
+		if os.IsNotExist(err) {
+			// Use the default config if file doesn't exist
+			config, err := finishConfig(config, overrides)
+			return config, nil, err
+		}
+		return nil, warnings, err
+	}
+
+	config, err := finishConfig(config, overrides)
+	return config, warnings, err
+}
+
+// loadINIFile applies the settings in path, following includes; including
+// holds the files whose includes led here, to detect cycles
+func (c *Config) loadINIFile(path string, including []string, warnings *[]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if len(including) == 0 && os.IsNotExist(err) {
+			return err
+		}
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	c.Files = append(c.Files, path)
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	including = append(including, abs)
+
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if fields := strings.Fields(line); fields[0] == "include" && !strings.Contains(line, "=") {
+			if len(fields) != 2 {
+				return fmt.Errorf("%s:%d: expected include <glob>, got %q", path, i+1, line)
+			}
+			if err := c.includeINIFiles(fields[1], path, i+1, including, warnings); err != nil {
+				return err
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			*warnings = append(*warnings, fmt.Sprintf("%s:%d: expected key=value, got %q", path, i+1, line))
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		if warning := c.setFromFile(key, value, path, i+1); warning != "" {
+			*warnings = append(*warnings, warning)
+		}
+	}
+	return nil
+}
+
+// includeINIFiles loads the files matching pattern, included from line of
+// path. A pattern without wildcards must name an existing file; a wildcard
+// pattern may match nothing, such as an empty conf.d directory.
+func (c *Config) includeINIFiles(pattern, path string, line int, including []string, warnings *[]string) error {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(path), pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("%s:%d: invalid include pattern %q: %w", path, line, pattern, err)
+	}
+	if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return fmt.Errorf("%s:%d: included file %s does not exist", path, line, pattern)
+	}
+
+	for _, match := range matches {
+		abs, err := filepath.Abs(match)
+		if err != nil {
+			abs = match
+		}
+		for i, parent := range including {
+			if parent == abs {
+				cycle := append(including[i:], abs)
+				return fmt.Errorf("%s:%d: include cycle: %s", path, line, strings.Join(cycle, " -> "))
+			}
+		}
+		if err := c.loadINIFile(match, including, warnings); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	return nil
+}
+
+// ListenerSpec is one address the proxy accepts connections on
+type ListenerSpec struct {
+	Label   string // empty for the single listen_address/listen_port listener
+	Address string
+	TLS     bool // clients connect over TLS before speaking HTTP
+}
+
+// PoolWorkerRange returns the minimum and maximum worker pool sizes; unset
+// bounds default to thread_pool_size, giving a fixed-size pool
+func (c *Config) PoolWorkerRange() (int, int) {
+	min, max := c.MinWorkers, c.MaxWorkers
+	if min == 0 {
+		min = c.ThreadPoolSize
+	}
+	if max == 0 {
+		max = c.ThreadPoolSize
+		if max < min {
+			max = min
+		}
+	}
+	return min, max
+}
+
+// PoolQueueSize returns the worker pool queue length, defaulting to twice
+// the pool size
+func (c *Config) PoolQueueSize() int {
+	if c.QueueSize > 0 {
+		return c.QueueSize
+	}
+	return c.ThreadPoolSize * 2
+}
+
+// CacheMaxSizeBytes returns cache_max_size_mb in bytes
+func (c *Config) CacheMaxSizeBytes() int64 {
+	return int64(c.CacheMaxSizeMB) * 1024 * 1024
+}
+
+// ListenerSpecs returns the configured listeners: the listeners entries if
+// any (labelled "label=addr:port", or by their address, and prefixed with
+// "tls://" for TLS), otherwise listen_address:listen_port, which uses TLS if
+// tls_listen is set
+func (c *Config) ListenerSpecs() []ListenerSpec {
+	if len(c.Listeners) == 0 {
+		return []ListenerSpec{{Address: net.JoinHostPort(c.ListenAddress, strconv.Itoa(c.ListenPort)), TLS: c.TLSListen}}
+	}
+
+	specs := make([]ListenerSpec, 0, len(c.Listeners))
+	for _, entry := range c.Listeners {
+		label, addr := "", entry
+		if idx := strings.Index(entry, "="); idx >= 0 {
+			label, addr = strings.TrimSpace(entry[:idx]), strings.TrimSpace(entry[idx+1:])
+		}
+		spec := ListenerSpec{Label: label, Address: addr}
+		if strings.HasPrefix(addr, "tls://") {
+			spec.Address = strings.TrimPrefix(addr, "tls://")
+			spec.TLS = true
+		}
+		if spec.Label == "" {
+			spec.Label = addr
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// HasTLSListener reports whether any listener uses TLS
+func (c *Config) HasTLSListener() bool {
+	for _, spec := range c.ListenerSpecs() {
+		if spec.TLS {
+			return true
+		}
+	}
+	return false
+}
+
+// errUnknownConfigKey is returned by Set for keys that don't name a Config field
+var errUnknownConfigKey = errors.New("unknown configuration key")
+
+// Set assigns a configuration value given as a string, using the INI key
+// names (which match the JSON field names)
+func (c *Config) Set(key, value string) error {
+	switch key {
+	case "listen_address":
+		c.ListenAddress = value
+	case "listen_port":
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.ListenPort = port
+	case "listeners":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		c.Listeners = list
+	case "tls_listen":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.TLSListen = enabled
+	case "tls_cert_file":
+		c.TLSCertFile = cleanPath(value)
+	case "tls_key_file":
+		c.TLSKeyFile = cleanPath(value)
+	case "reuse_port":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.ReusePort = enabled
+	case "run_as_user":
+		c.RunAsUser = value
+	case "run_as_group":
+		c.RunAsGroup = value
+	case "concurrency_model":
+		c.ConcurrencyModel = value
+	case "thread_pool_size":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.ThreadPoolSize = size
+	case "min_workers":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.MinWorkers = n
+	case "max_workers":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.MaxWorkers = n
+	case "worker_idle_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.WorkerIdleTimeout = d
+	case "queue_size":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.QueueSize = size
+	case "queue_overflow":
+		c.QueueOverflow = strings.ToLower(value)
+	case "queue_wait_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.QueueWaitTimeout = d
+	case "queue_max_wait":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.QueueMaxWait = d
+	case "log_file_path":
+		c.LogFilePath = cleanPath(value)
+	case "log_max_size_mb":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.LogMaxSizeMB = size
+	case "log_format":
+		c.LogFormat = strings.ToLower(value)
+	case "log_failure_policy":
+		c.LogFailurePolicy = strings.ToLower(value)
+	case "log_ship_url":
+		c.LogShipURL = value
+	case "log_ship_interval":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.LogShipInterval = d
+	case "log_ship_batch_size":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.LogShipBatchSize = size
+	case "log_ship_spool_dir":
+		c.LogShipSpoolDir = cleanPath(value)
+	case "log_ship_spool_max_mb":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.LogShipSpoolMaxMB = size
+	case "log_backend":
+		c.LogBackend = strings.ToLower(value)
+	case "log_db_path":
+		c.LogDBPath = cleanPath(value)
+	case "log_db_retention_days":
+		days, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.LogDBRetentionDays = days
+	case "geoip_database":
+		c.GeoIPDatabase = cleanPath(value)
+	case "geoip_asn_database":
+		c.GeoIPASNDatabase = cleanPath(value)
+	case "log_geoip_max_connections":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.LogGeoIPMaxConnections = n
+	case "add_request_id_header":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.AddRequestIDHeader = enabled
+	case "error_pages_dir":
+		c.ErrorPagesDir = cleanPath(value)
+	case "debug_errors":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.DebugErrors = enabled
+	case "server_header":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.ServerHeader = enabled
+	case "log_headers":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		for i := range list {
+			list[i] = strings.ToLower(list[i])
+		}
+		c.LogHeaders = list
+	case "rewrite_rules_file":
+		c.RewriteRulesFile = cleanPath(value)
+	case "rewrite_max_passes":
+		passes, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.RewriteMaxPasses = passes
+	case "expression_rules_file":
+		c.ExpressionRulesFile = cleanPath(value)
+	case "routing_rules_file":
+		c.RoutingRulesFile = cleanPath(value)
+	case "reverse_proxy_file":
+		c.ReverseProxyFile = cleanPath(value)
+	case "reverse_proxy_listeners":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		c.ReverseProxyListeners = list
+	case "reverse_proxy_unknown_host":
+		c.ReverseProxyUnknownHost = value
+	case "default_route":
+		c.DefaultRoute = value
+	case "fallback_direct":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.FallbackDirect = enabled
+	case "failover_direct":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.FailoverDirect = enabled
+	case "parent_check_interval":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.ParentCheckInterval = d
+	case "parent_probe_host":
+		c.ParentProbeHost = value
+	case "parent_fail_threshold":
+		threshold, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.ParentFailThreshold = threshold
+	case "upstream_ip_selection":
+		c.UpstreamIPSelection = strings.ToLower(value)
+	case "upstream_ip_cooldown":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.UpstreamIPCooldown = d
+	case "anonymity":
+		c.Anonymity = strings.ToLower(value)
+	case "anonymity_strip_headers":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		c.ExtraStripHeaders = list
+	case "log_anonymize_ips":
+		c.LogAnonymizeIPs = strings.ToLower(value)
+	case "log_anonymize_key":
+		c.LogAnonymizeKey = value
+	case "log_level":
+		c.LogLevel = strings.ToLower(value)
+	case "error_log_path":
+		c.ErrorLogPath = cleanPath(value)
+	case "header_rules_file":
+		c.HeaderRulesFile = cleanPath(value)
+	case "blocked_domains_file":
+		c.BlockedDomainsFile = cleanPath(value)
+	case "filter_failure_policy":
+		c.FilterFailurePolicy = strings.ToLower(value)
+	case "strict_rules":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.StrictRules = enabled
+	case "blocklist_categories":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		c.BlocklistCategories = list
+	case "persist_runtime_rules":
+		c.PersistRuntimeRules = cleanPath(value)
+	case "filter_stats_file":
+		c.FilterStatsFile = cleanPath(value)
+	case "enforce_safesearch":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.EnforceSafeSearch = enabled
+	case "safesearch_hosts":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		c.SafeSearchHosts = list
+	case "https_upgrade_domains":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		for i := range list {
+			list[i] = strings.ToLower(list[i])
+		}
+		c.HTTPSUpgradeDomains = list
+	case "https_upgrade_mode":
+		c.HTTPSUpgradeMode = strings.ToLower(value)
+	case "blocked_extensions":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		for i := range list {
+			list[i] = strings.ToLower(strings.TrimPrefix(list[i], "."))
+		}
+		c.BlockedExtensions = list
+	case "enable_caching":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.EnableCaching = enabled
+	case "cache_max_entries":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.CacheMaxEntries = size
+	case "cache_max_size_mb":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.CacheMaxSizeMB = size
+	case "cache_default_ttl":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.CacheDefaultTTL = d
+	case "cache_backend":
+		c.CacheBackend = strings.ToLower(value)
+	case "redis_address":
+		c.RedisAddress = value
+	case "redis_password":
+		c.RedisPassword = value
+	case "redis_db":
+		db, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.RedisDB = db
+	case "enable_connect_tunneling":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.EnableConnectTunnel = enabled
+	case "inspect_sni":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.InspectSNI = enabled
+	case "inspect_sni_strict":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.InspectSNIStrict = enabled
+	case "sni_sniff_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.SNISniffTimeout = d
+	case "auth_mode":
+		c.AuthMode = strings.ToLower(value)
+	case "auth_users_file":
+		c.AuthUsersFile = cleanPath(value)
+	case "policies_file":
+		c.PoliciesFile = cleanPath(value)
+	case "default_policy":
+		c.DefaultPolicy = value
+	case "authentication_token":
+		c.AuthToken = value
+	case "auth_tokens_file":
+		c.AuthTokensFile = cleanPath(value)
+	case "auth_realm":
+		c.AuthRealm = value
+	case "auth_failure_limit":
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.AuthFailureLimit = limit
+	case "auth_hook_url":
+		c.AuthHookURL = value
+	case "auth_hook_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.AuthHookTimeout = d
+	case "auth_hook_cache_ttl":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.AuthHookCacheTTL = d
+	case "auth_hook_cache_size":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.AuthHookCacheSize = size
+	case "auth_hook_fail_open":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.AuthHookFailOpen = enabled
+	case "policy_exec":
+		c.PolicyExec = cleanPath(value)
+	case "policy_exec_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.PolicyExecTimeout = d
+	case "policy_exec_cache_ttl":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.PolicyExecCacheTTL = d
+	case "policy_exec_cache_size":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.PolicyExecCacheSize = size
+	case "policy_exec_workers":
+		workers, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.PolicyExecWorkers = workers
+	case "policy_exec_fail_open":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.PolicyExecFailOpen = enabled
+	case "scan_icap_url":
+		c.ScanICAPURL = value
+	case "scan_command":
+		c.ScanCommand = value
+	case "scan_content_types":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		for i := range list {
+			list[i] = strings.ToLower(list[i])
+		}
+		c.ScanContentTypes = list
+	case "scan_extensions":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		for i := range list {
+			list[i] = strings.ToLower(strings.TrimPrefix(list[i], "."))
+		}
+		c.ScanExtensions = list
+	case "scan_max_bytes":
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.ScanMaxBytes = size
+	case "scan_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.ScanTimeout = d
+	case "scan_fail_open":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.ScanFailOpen = enabled
+	case "record_dir":
+		c.RecordDir = cleanPath(value)
+	case "record_max_body_bytes":
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.RecordMaxBodyBytes = size
+	case "replay_mode":
+		c.ReplayMode = strings.ToLower(value)
+	case "enable_fault_injection":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.EnableFaultInjection = enabled
+	case "fault_injection_file":
+		c.FaultInjectionFile = cleanPath(value)
+	case "bandwidth_profiles_file":
+		c.BandwidthProfilesFile = cleanPath(value)
+	case "timing_debug_clients":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		c.TimingDebugClients = list
+	case "timing_debug_header":
+		c.TimingDebugHeader = value
+	case "timing_debug_response_header":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.TimingDebugResponseHeader = enabled
+	case "fault_injection_listeners":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		c.FaultInjectionListeners = list
+	case "client_idle_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.ClientIdleTimeout = d
+	case "client_header_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.ClientHeaderTimeout = d
+	case "client_read_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.ClientReadTimeout = d
+	case "upstream_connect_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.UpstreamConnectTimeout = d
+	case "upstream_io_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.UpstreamIOTimeout = d
+	case "upstream_response_header_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.UpstreamResponseHeaderTimeout = d
+	case "max_request_duration":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.MaxRequestDuration = d
+	case "shutdown_grace_period":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.ShutdownGracePeriod = d
+	case "read_buffer_size":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.ReadBufferSize = size
+	case "max_upload_bytes":
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.MaxUploadBytes = size
+	case "min_upload_rate":
+		rate, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.MinUploadRate = rate
+	case "min_upload_rate_grace":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.MinUploadRateGrace = d
+	case "allowed_client_cidrs":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		c.AllowedClientCIDRs = list
+	case "denied_client_403":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.DeniedClient403 = enabled
+	case "max_connections":
+		max, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.MaxConnections = max
+	case "connection_limit_mode":
+		c.ConnectionLimitMode = strings.ToLower(value)
+	case "max_connections_per_ip":
+		max, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.MaxConnectionsPerIP = max
+	case "ipv6_limit_prefix":
+		prefix, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.IPv6LimitPrefix = prefix
+	case "max_connections_per_upstream":
+		max, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.MaxConnectionsPerUpstream = max
+	case "upstream_limit_wait":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.UpstreamLimitWait = d
+	case "shed_queue_depth":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.ShedQueueDepth = n
+	case "shed_active_connections":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.ShedActiveConnections = n
+	case "shed_goroutines":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.ShedGoroutines = n
+	case "shed_latency":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.ShedLatency = d
+	case "shed_retry_after":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.ShedRetryAfter = d
+	case "rate_limit_rps":
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number for %s: %q", key, value)
+		}
+		c.RateLimitRPS = rate
+	case "rate_limit_burst":
+		burst, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer for %s: %q", key, value)
+		}
+		c.RateLimitBurst = burst
+	case "rate_limit_exempt_cidrs":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		c.RateLimitExemptCIDRs = list
+	case "admin_listen":
+		c.AdminListen = value
+	case "admin_token":
+		c.AdminToken = value
+	case "admin_allowed_cidrs":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		c.AdminAllowedCIDRs = list
+	case "stats_retention":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.StatsRetention = d
+	case "statsd_address":
+		c.StatsdAddress = value
+	case "statsd_prefix":
+		c.StatsdPrefix = value
+	case "statsd_tags":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.StatsdTags = enabled
+	case "statsd_sample_rate":
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number for %s: %q", key, value)
+		}
+		c.StatsdSampleRate = rate
+	case "health_check_path":
+		c.HealthCheckPath = value
+	case "readiness_canary":
+		c.ReadinessCanary = value
+	case "readiness_canary_timeout":
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %s: %q", key, value)
+		}
+		c.ReadinessCanaryTimeout = d
+	case "pac_file_path":
+		c.PACFilePath = cleanPath(value)
+	case "pac_auto":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.PACAuto = enabled
+	case "pac_direct_domains":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		for i := range list {
+			list[i] = strings.ToLower(list[i])
+		}
+		c.PACDirectDomains = list
+	case "mitm_domains":
+		list, err := parseList(value)
+		if err != nil {
+			return fmt.Errorf("invalid list for %s: %v", key, err)
+		}
+		for i := range list {
+			list[i] = strings.ToLower(list[i])
+		}
+		c.MITMDomains = list
+	case "ca_cert_file":
+		c.CACertFile = cleanPath(value)
+	case "ca_key_file":
+		c.CAKeyFile = cleanPath(value)
+	case "upstream_ca_file":
+		c.UpstreamCAFile = cleanPath(value)
+	case "upstream_insecure_skip_verify":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.UpstreamInsecureSkipVerify = enabled
+	case "strict_config":
+		enabled, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean for %s: %q", key, value)
+		}
+		c.StrictConfig = enabled
+	default:
+		return errUnknownConfigKey
+	}
+
+	return nil
+}
+
+// parseBool parses a boolean setting: true/false, yes/no, on/off or 1/0 in
+// any case. Anything else is an error rather than false, so a typo doesn't
+// silently turn a feature off.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a boolean", value)
+}
+
+// cleanPath normalizes a file path setting for the platform: separators
+// are converted, so config/blocked_domains.txt also works on Windows, and
+// redundant elements removed. Relative paths stay relative to the working
+// directory. An empty value stays empty.
+func cleanPath(value string) string {
+	if value == "" {
+		return ""
+	}
+	return filepath.Clean(filepath.FromSlash(value))
+}
+
+// parseList splits a comma-separated setting into trimmed elements. An
+// empty value is an empty list; an empty element (as in "a,,b" or a
+// trailing comma) is an error.
+func parseList(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	list := strings.Split(value, ",")
+	for i, entry := range list {
+		if list[i] = strings.TrimSpace(entry); list[i] == "" {
+			return nil, fmt.Errorf("empty element %d in %q", i+1, value)
+		}
+	}
+	return list, nil
+}
+
+// parseDuration parses a duration setting: a Go duration string such as
+// "500ms", "2m" or "1h30m", or a bare integer number of seconds as older
+// configs used
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds > int64(math.MaxInt64/time.Second) || seconds < int64(math.MinInt64/time.Second) {
+			return 0, fmt.Errorf("duration out of range: %s", value)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// setFromFile assigns a value read from line of a config file, returning a
+// warning if the key is unknown or the value can't be parsed
+func (c *Config) setFromFile(key, value, path string, line int) string {
+	err := c.setFrom(key, value, fmt.Sprintf("%s:%d", path, line))
+	if err == errUnknownConfigKey {
+		return fmt.Sprintf("%s:%d: unknown key %q", path, line, key)
+	}
+	if err != nil {
+		return fmt.Sprintf("%s:%d: %v (keeping %s=%s)", path, line, err, key, c.Get(key))
+	}
+	return ""
+}
+
+// setFrom assigns a value like Set and records where it came from
+func (c *Config) setFrom(key, value, source string) error {
+	if err := c.Set(key, value); err != nil {
+		return err
+	}
+	c.setSource(key, source)
+	return nil
+}
+
+func (c *Config) setSource(key, source string) {
+	if c.sources == nil {
+		c.sources = make(map[string]string)
+	}
+	c.sources[key] = source
+}
+
+// SourceOf describes where the value of key came from: a file and line,
+// an environment variable, a flag, or "default"
+func (c *Config) SourceOf(key string) string {
+	if source, ok := c.sources[key]; ok {
+		return source
+	}
+	return "default"
+}
+
+// Get returns the value of key formatted as it would be written in an INI
+// file (lists are comma-separated)
+func (c *Config) Get(key string) string {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] != key {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Slice {
+			items := make([]string, field.Len())
+			for j := range items {
+				items[j] = fmt.Sprint(field.Index(j).Interface())
+			}
+			return strings.Join(items, ",")
+		}
+		return fmt.Sprint(field.Interface())
+	}
+	return ""
+}
+
+// configKeys returns every configuration key, taken from the JSON field names
+func configKeys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("json"); tag != "" && tag != "-" {
+			keys = append(keys, strings.Split(tag, ",")[0])
+		}
+	}
+	return keys
+}
+
+// ConfigSetting is one effective configuration value and where it came from
+type ConfigSetting struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"` // secrets and URL passwords are redacted
+	Source string `json:"source"`
+}
+
+// Settings returns every configuration value with its source, as shown by
+// -print-config and the admin /config endpoint
+func (c *Config) Settings() []ConfigSetting {
+	keys := configKeys()
+	settings := make([]ConfigSetting, len(keys))
+	for i, key := range keys {
+		settings[i] = ConfigSetting{Key: key, Value: c.displayValue(key), Source: c.SourceOf(key)}
+	}
+	return settings
+}
+
+// PrintConfig writes the effective configuration in INI form, noting where
+// each value came from
+func PrintConfig(w io.Writer, config *Config) {
+	if config.Source != "" {
+		fmt.Fprintf(w, "# Effective configuration (file: %s)\n", config.Source)
+	}
+	if len(config.Files) > 1 {
+		fmt.Fprintf(w, "# Merged files: %s\n", strings.Join(config.Files, ", "))
+	}
+	for _, setting := range config.Settings() {
+		fmt.Fprintf(w, "%s=%s  # %s\n", setting.Key, setting.Value, setting.Source)
+	}
+}
+
+// ApplyEnvOverrides overrides configuration values from environment
+// variables named PROXY_<UPPERCASED_KEY>, e.g. PROXY_LISTEN_PORT
+func (c *Config) ApplyEnvOverrides() error {
+	for _, key := range configKeys() {
+		name := "PROXY_" + strings.ToUpper(key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := c.setFrom(key, strings.TrimSpace(value), "environment variable "+name); err != nil {
+			return fmt.Errorf("environment variable %s: %w", name, err)
+		}
+	}
+	return nil
+}
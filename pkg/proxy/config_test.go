@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes an INI configuration to a temporary file
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy.conf")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnvOverridesConfigFile(t *testing.T) {
+	path := writeConfigFile(t, "[server]\nlisten_port = 9000\n\n[cache]\nenable_caching = false\n")
+	t.Setenv("PROXY_LISTEN_PORT", "8080")
+	t.Setenv("PROXY_ENABLE_CACHING", "yes")
+	t.Setenv("PROXY_CLIENT_IDLE_TIMEOUT", "45s")
+	t.Setenv("PROXY_BLOCKED_EXTENSIONS", " exe, scr ")
+
+	config, _, err := LoadConfigFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenPort != 8080 {
+		t.Errorf("ListenPort = %d, want 8080", config.ListenPort)
+	}
+	if !config.EnableCaching {
+		t.Error("EnableCaching = false, want true")
+	}
+	if config.ClientIdleTimeout != 45*time.Second {
+		t.Errorf("ClientIdleTimeout = %v, want 45s", config.ClientIdleTimeout)
+	}
+	if want := []string{"exe", "scr"}; !reflect.DeepEqual(config.BlockedExtensions, want) {
+		t.Errorf("BlockedExtensions = %q, want %q", config.BlockedExtensions, want)
+	}
+	if source := config.SourceOf("listen_port"); source != "environment variable PROXY_LISTEN_PORT" {
+		t.Errorf("SourceOf(listen_port) = %q", source)
+	}
+}
+
+func TestFlagsOverrideEnv(t *testing.T) {
+	t.Setenv("PROXY_LISTEN_PORT", "8080")
+	config, _, err := LoadConfigFile(writeConfigFile(t, ""), map[string]string{"listen_port": "7070"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenPort != 7070 {
+		t.Errorf("ListenPort = %d, want the flag's 7070", config.ListenPort)
+	}
+}
+
+func TestEnvOverrideErrors(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		// Values that don't parse name the variable
+		{"PROXY_LISTEN_PORT", "eighty", "environment variable PROXY_LISTEN_PORT"},
+		{"PROXY_ENABLE_CACHING", "maybe", "environment variable PROXY_ENABLE_CACHING"},
+		{"PROXY_CLIENT_IDLE_TIMEOUT", "soon", "environment variable PROXY_CLIENT_IDLE_TIMEOUT"},
+		// Values that parse but aren't valid are caught by Validate
+		{"PROXY_LISTEN_PORT", "70000", "(from environment variable PROXY_LISTEN_PORT)"},
+		{"PROXY_LOG_FORMAT", "xml", "(from environment variable PROXY_LOG_FORMAT)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			_, _, err := LoadConfigFile(writeConfigFile(t, ""), nil)
+			if err == nil {
+				t.Fatalf("LoadConfigFile succeeded, want an error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q doesn't mention %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,496 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configValue is a single flattened key/value pair read from a config file.
+// Nested sections are joined with underscores, so cache.max_entries becomes
+// the cache_max_entries key.
+type configValue struct {
+	key   string
+	value string
+	line  int
+}
+
+// LoadConfigFile loads configuration from path, choosing the format from the
+// file extension: .yaml/.yml, .toml and .json are parsed here, and anything
+// else (.conf, .ini) uses LoadConfigFromINI. Environment
+// variables and then overrides (from command-line flags) are applied on top.
+// Warnings about unknown keys and unparseable values are returned alongside
+// the config; with strict_config enabled any warning is an error.
+func LoadConfigFile(path string, overrides map[string]string) (*Config, []string, error) {
+	config, warnings, err := loadConfigFile(path, overrides)
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	config.Source = path
+	if config.StrictConfig && len(warnings) > 0 {
+		return nil, warnings, fmt.Errorf("strict_config is enabled and %s has %d problem(s)", path, len(warnings))
+	}
+	return config, warnings, nil
+}
+
+func loadConfigFile(path string, overrides map[string]string) (*Config, []string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return loadParsedConfig(path, overrides, parseYAMLConfig)
+	case ".toml":
+		return loadParsedConfig(path, overrides, parseTOMLConfig)
+	case ".json":
+		return loadParsedConfig(path, overrides, parseJSONConfig)
+	default:
+		return LoadConfigFromINI(path, overrides)
+	}
+}
+
+// loadParsedConfig reads path with parse and applies the values through
+// Config.Set, so every format accepts the same value syntax
+func loadParsedConfig(path string, overrides map[string]string, parse func(string) ([]configValue, error)) (*Config, []string, error) {
+	config := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			config, err := finishConfig(config, overrides)
+			return config, nil, err
+		}
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	config.Files = []string{path}
+
+	values, err := parse(string(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file: %s:%w", path, err)
+	}
+
+	var warnings []string
+	for _, v := range values {
+		if warning := config.setFromFile(v.key, v.value, path, v.line); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	config, err = finishConfig(config, overrides)
+	return config, warnings, err
+}
+
+// parseJSONConfig parses a JSON object into key/value pairs. Nested objects
+// are flattened like YAML mappings, arrays of scalars become comma-separated
+// lists and numbers keep their literal text, so a duration given as 30
+// means 30 seconds as it does in an INI file.
+func parseJSONConfig(data string) ([]configValue, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	lineAt := func() int {
+		return strings.Count(data[:dec.InputOffset()], "\n") + 1
+	}
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("%d: expected a JSON object", lineAt())
+	}
+
+	var values []configValue
+	var parseObject func(prefix string) error
+	parseObject = func(prefix string) error {
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return fmt.Errorf("%d: %w", lineAt(), err)
+			}
+			key := prefix + tok.(string)
+			line := lineAt()
+
+			tok, err = dec.Token()
+			if err != nil {
+				return fmt.Errorf("%d: %w", line, err)
+			}
+			switch tok {
+			case json.Delim('{'):
+				if err := parseObject(key + "_"); err != nil {
+					return err
+				}
+			case json.Delim('['):
+				var items []string
+				for dec.More() {
+					item, err := dec.Token()
+					if err != nil {
+						return fmt.Errorf("%d: %w", lineAt(), err)
+					}
+					value, ok := jsonScalar(item)
+					if !ok {
+						return fmt.Errorf("%d: %s: arrays may only hold scalars", lineAt(), key)
+					}
+					items = append(items, value)
+				}
+				if _, err := dec.Token(); err != nil {
+					return fmt.Errorf("%d: %w", lineAt(), err)
+				}
+				values = append(values, configValue{key: key, value: strings.Join(items, ","), line: line})
+			default:
+				value, _ := jsonScalar(tok)
+				values = append(values, configValue{key: key, value: value, line: line})
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("%d: %w", lineAt(), err)
+		}
+		return nil
+	}
+
+	if err := parseObject(""); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%d: unexpected data after the JSON object", lineAt())
+	}
+	return values, nil
+}
+
+// jsonScalar converts a JSON scalar token to the string form accepted by
+// Config.Set; null becomes the empty string
+func jsonScalar(tok json.Token) (string, bool) {
+	switch v := tok.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case nil:
+		return "", true
+	}
+	return "", false
+}
+
+// parseYAMLConfig parses the subset of YAML used for configuration: nested
+// mappings, scalars, and block or flow sequences of scalars
+func parseYAMLConfig(data string) ([]configValue, error) {
+	type level struct {
+		indent int
+		prefix string
+	}
+
+	var values []configValue
+	stack := []level{{indent: 0}}
+
+	// A "key:" line with no value opens either a nested mapping or a sequence
+	var pendingKey string
+	var pendingIndent, pendingLine int
+	var listItems []string
+	listIndent := -1
+
+	flushList := func() {
+		if listIndent >= 0 {
+			values = append(values, configValue{key: pendingKey, value: strings.Join(listItems, ","), line: pendingLine})
+			pendingKey, listItems, listIndent = "", nil, -1
+		}
+	}
+
+	for i, raw := range strings.Split(data, "\n") {
+		lineNum := i + 1
+		line := strings.TrimRight(stripYAMLComment(raw), " \t\r")
+		content := strings.TrimSpace(line)
+		if content == "" || content == "---" {
+			continue
+		}
+		if strings.Contains(line[:len(line)-len(strings.TrimLeft(line, " \t"))], "\t") {
+			return nil, fmt.Errorf("%d: tabs are not allowed for indentation", lineNum)
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		isItem := content == "-" || strings.HasPrefix(content, "- ")
+
+		if pendingKey != "" && listIndent < 0 {
+			switch {
+			case isItem && indent >= pendingIndent:
+				listIndent = indent
+			case indent > pendingIndent:
+				stack = append(stack, level{indent: indent, prefix: pendingKey + "_"})
+				pendingKey = ""
+			default:
+				values = append(values, configValue{key: pendingKey, line: pendingLine})
+				pendingKey = ""
+			}
+		}
+
+		if listIndent >= 0 {
+			if isItem && indent == listIndent {
+				item, err := unquoteConfigScalar(strings.TrimSpace(strings.TrimPrefix(content, "-")))
+				if err != nil {
+					return nil, fmt.Errorf("%d: %w", lineNum, err)
+				}
+				listItems = append(listItems, item)
+				continue
+			}
+			flushList()
+		}
+		if isItem {
+			return nil, fmt.Errorf("%d: unexpected sequence item", lineNum)
+		}
+
+		// Pop back to the enclosing mapping
+		for len(stack) > 1 && indent < stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		if indent != stack[len(stack)-1].indent {
+			return nil, fmt.Errorf("%d: inconsistent indentation", lineNum)
+		}
+
+		idx := strings.Index(content, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("%d: expected \"key: value\"", lineNum)
+		}
+		key := stack[len(stack)-1].prefix + strings.TrimSpace(content[:idx])
+		rest := strings.TrimSpace(content[idx+1:])
+
+		if rest == "" {
+			pendingKey, pendingIndent, pendingLine = key, indent, lineNum
+			continue
+		}
+
+		value, err := parseFlowValue(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", lineNum, err)
+		}
+		values = append(values, configValue{key: key, value: value, line: lineNum})
+	}
+
+	flushList()
+	if pendingKey != "" {
+		values = append(values, configValue{key: pendingKey, line: pendingLine})
+	}
+
+	return values, nil
+}
+
+// stripYAMLComment removes a trailing # comment that isn't inside quotes
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseTOMLConfig parses the subset of TOML used for configuration: tables,
+// dotted keys, strings, integers, booleans and single-line arrays
+func parseTOMLConfig(data string) ([]configValue, error) {
+	var values []configValue
+	prefix := ""
+
+	for i, raw := range strings.Split(data, "\n") {
+		lineNum := i + 1
+		line := strings.TrimSpace(stripYAMLComment(raw))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("%d: invalid table header", lineNum)
+			}
+			table := strings.TrimSpace(line[1 : len(line)-1])
+			if table == "" {
+				return nil, fmt.Errorf("%d: empty table name", lineNum)
+			}
+			prefix = strings.ReplaceAll(table, ".", "_") + "_"
+			continue
+		}
+
+		idx := strings.Index(line, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("%d: expected \"key = value\"", lineNum)
+		}
+		key := strings.ReplaceAll(strings.TrimSpace(line[:idx]), ".", "_")
+		value, err := parseFlowValue(strings.TrimSpace(line[idx+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", lineNum, err)
+		}
+		values = append(values, configValue{key: prefix + key, value: value, line: lineNum})
+	}
+
+	return values, nil
+}
+
+// parseFlowValue converts a scalar or [a, b] array into the string form
+// accepted by Config.Set (arrays become comma-separated lists)
+func parseFlowValue(raw string) (string, error) {
+	if !strings.HasPrefix(raw, "[") {
+		return unquoteConfigScalar(raw)
+	}
+	if !strings.HasSuffix(raw, "]") {
+		return "", fmt.Errorf("unterminated array")
+	}
+
+	var items []string
+	for _, item := range strings.Split(raw[1:len(raw)-1], ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		value, err := unquoteConfigScalar(item)
+		if err != nil {
+			return "", err
+		}
+		items = append(items, value)
+	}
+	return strings.Join(items, ","), nil
+}
+
+// unquoteConfigScalar strips single or double quotes from a scalar value
+func unquoteConfigScalar(raw string) (string, error) {
+	if len(raw) >= 2 && raw[0] == '"' && raw[len(raw)-1] == '"' {
+		value, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted string %s", raw)
+		}
+		return value, nil
+	}
+	if len(raw) >= 2 && raw[0] == '\'' && raw[len(raw)-1] == '\'' {
+		return raw[1 : len(raw)-1], nil
+	}
+	if strings.HasPrefix(raw, "\"") || strings.HasPrefix(raw, "'") {
+		return "", fmt.Errorf("unterminated string %s", raw)
+	}
+	return raw, nil
+}
+
+// CheckConfigFiles verifies that the files the configuration refers to can
+// be used: the blocklist must be readable, the header rules valid and the
+// log directories writable
+func CheckConfigFiles(config *Config) []string {
+	var problems []string
+
+	if file, err := os.Open(config.BlockedDomainsFile); err != nil {
+		problems = append(problems, fmt.Sprintf("blocked_domains_file: %v", err))
+	} else {
+		file.Close()
+		if _, err := NewFilter(nil).LoadRules(config.BlockedDomainsFile, config.StrictRules); err != nil {
+			problems = append(problems, fmt.Sprintf("blocked_domains_file: %v", err))
+		}
+	}
+
+	if _, err := NewFilter(nil).LoadCategories(config.BlocklistCategories, config.StrictRules); err != nil {
+		problems = append(problems, fmt.Sprintf("blocklist_categories: %v", err))
+	}
+
+	if rules, err := LoadHeaderRules(config.HeaderRulesFile); err != nil {
+		problems = append(problems, fmt.Sprintf("header_rules_file: %v", err))
+	} else if err := checkAnonymityRules(config, rules); err != nil {
+		problems = append(problems, fmt.Sprintf("header_rules_file: %v", err))
+	}
+
+	if config.PolicyExec != "" {
+		if info, err := os.Stat(config.PolicyExec); err != nil {
+			problems = append(problems, fmt.Sprintf("policy_exec: %v", err))
+		} else if info.IsDir() {
+			problems = append(problems, fmt.Sprintf("policy_exec: %s is a directory", config.PolicyExec))
+		}
+	}
+
+	if config.PACFilePath != "" {
+		if file, err := os.Open(config.PACFilePath); err != nil {
+			problems = append(problems, fmt.Sprintf("pac_file_path: %v", err))
+		} else {
+			file.Close()
+		}
+	}
+
+	_, pageProblems := loadErrorPages(config.ErrorPagesDir)
+	for _, problem := range pageProblems {
+		problems = append(problems, fmt.Sprintf("error_pages_dir: %s", problem))
+	}
+
+	if _, err := LoadRoutingRules(config.RoutingRulesFile, config.DefaultRoute); err != nil {
+		problems = append(problems, fmt.Sprintf("routing_rules_file: %v", err))
+	}
+
+	if _, err := LoadExprRules(config.ExpressionRulesFile); err != nil {
+		problems = append(problems, fmt.Sprintf("expression_rules_file: %v", err))
+	}
+
+	if _, err := LoadRewriteRules(config.RewriteRulesFile); err != nil {
+		problems = append(problems, fmt.Sprintf("rewrite_rules_file: %v", err))
+	}
+
+	if _, err := LoadFaultRules(config.faultRulesFile()); err != nil {
+		problems = append(problems, fmt.Sprintf("fault_injection_file: %v", err))
+	}
+
+	if _, err := LoadBandwidthProfiles(config.BandwidthProfilesFile); err != nil {
+		problems = append(problems, fmt.Sprintf("bandwidth_profiles_file: %v", err))
+	}
+
+	if _, err := LoadReverseRoutes(config.ReverseProxyFile); err != nil {
+		problems = append(problems, fmt.Sprintf("reverse_proxy_file: %v", err))
+	}
+
+	if _, err := LoadPolicies(config.PoliciesFile, config.DefaultPolicy, config.StrictRules, nil); err != nil {
+		problems = append(problems, fmt.Sprintf("policies_file: %v", err))
+	}
+
+	if len(config.MITMDomains) > 0 {
+		if _, _, err := loadCA(config.CACertFile, config.CAKeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("ca_cert_file: %v", err))
+		}
+	}
+
+	if _, err := loadUpstreamCAs(config.UpstreamCAFile); err != nil {
+		problems = append(problems, fmt.Sprintf("upstream_ca_file: %v", err))
+	}
+
+	for _, key := range []string{"geoip_database", "geoip_asn_database"} {
+		if db, err := openGeoDB(key, config.Get(key)); err != nil {
+			problems = append(problems, err.Error())
+		} else if db != nil {
+			db.Close()
+		}
+	}
+
+	for _, key := range []string{"log_file_path", "error_log_path"} {
+		path := config.Get(key)
+		if path == "" {
+			continue
+		}
+		if err := checkWritableDir(filepath.Dir(path)); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+
+	return problems
+}
+
+// checkWritableDir checks that files can be created in dir
+func checkWritableDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	file, err := os.CreateTemp(dir, ".proxy-check-*")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", dir, err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return nil
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConnectionInfo describes a client connection, as listed by the admin
+// /connections endpoint. The byte counts are as of the listing, including
+// any request still in flight.
+type ConnectionInfo struct {
+	ID              uint64    `json:"id"`
+	Client          string    `json:"client"`
+	Listener        string    `json:"listener,omitempty"`
+	Started         time.Time `json:"started"`
+	BytesUpstream   int64     `json:"bytes_upstream"`   // read from the client
+	BytesDownstream int64     `json:"bytes_downstream"` // written to the client
+	RequestID       string    `json:"request_id,omitempty"`
+	Method          string    `json:"method,omitempty"`
+	Destination     string    `json:"destination,omitempty"`
+	Tunnel          bool      `json:"tunnel,omitempty"`
+}
+
+// connActivity is what a connection is busy with, copied from its request
+// so the admin API can read it while the handler changes the request
+type connActivity struct {
+	requestID   string
+	method      string
+	destination string
+	tunnel      bool
+}
+
+// beginRequest records req as the request c is serving. A nil c, for a
+// connection that isn't tracked, records nothing.
+func (c *labeledConn) beginRequest(req *HTTPRequest) {
+	if c == nil {
+		return
+	}
+	activity := &connActivity{
+		requestID:   req.ID,
+		method:      req.Method,
+		destination: net.JoinHostPort(req.Host, strconv.Itoa(req.Port)),
+		tunnel:      req.IsConnect,
+	}
+	c.mu.Lock()
+	c.activity = activity
+	c.mu.Unlock()
+}
+
+// endRequest clears the request c is serving as it is logged, returning who
+// terminated the connection if that cut the request short
+func (c *labeledConn) endRequest() string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	terminated := ""
+	if c.activity != nil {
+		terminated = c.terminated
+	}
+	c.activity = nil
+	return terminated
+}
+
+// terminate closes c on behalf of by, reporting whether it was between
+// requests. A request in flight is logged as ADMIN_TERMINATED by its
+// handler; an idle connection has no one else to log it.
+func (c *labeledConn) terminate(by string) bool {
+	c.mu.Lock()
+	c.terminated = by
+	idle := c.activity == nil
+	c.mu.Unlock()
+	c.Close()
+	return idle
+}
+
+// info describes c as of now
+func (c *labeledConn) info() ConnectionInfo {
+	info := ConnectionInfo{
+		ID:              c.id,
+		Client:          c.RemoteAddr().String(),
+		Listener:        c.label,
+		Started:         c.started,
+		BytesUpstream:   c.bytesIn.Load(),
+		BytesDownstream: c.bytesOut.Load(),
+	}
+	c.mu.Lock()
+	if a := c.activity; a != nil {
+		info.RequestID = a.requestID
+		info.Method = a.method
+		info.Destination = a.destination
+		info.Tunnel = a.tunnel
+	}
+	c.mu.Unlock()
+	return info
+}
+
+// trackedConns returns the tracked connections that match, oldest first.
+// The registry is only locked while it is copied, so a long listing doesn't
+// hold up the accept loop.
+func (s *Server) trackedConns(match func(*labeledConn) bool) []*labeledConn {
+	s.connsMu.Lock()
+	all := make([]*labeledConn, 0, len(s.conns))
+	for lc := range s.conns {
+		all = append(all, lc)
+	}
+	s.connsMu.Unlock()
+
+	conns := all[:0]
+	for _, lc := range all {
+		if match == nil || match(lc) {
+			conns = append(conns, lc)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+// Connections lists the client connections currently open, oldest first
+func (s *Server) Connections() []ConnectionInfo {
+	return connectionInfos(s.trackedConns(nil))
+}
+
+// connectionInfos describes conns
+func connectionInfos(conns []*labeledConn) []ConnectionInfo {
+	infos := make([]ConnectionInfo, len(conns))
+	for i, lc := range conns {
+		infos[i] = lc.info()
+	}
+	return infos
+}
+
+// terminateConns closes conns on behalf of by, logging those that were
+// between requests, since no handler will
+func (s *Server) terminateConns(conns []*labeledConn, by string) {
+	for _, lc := range conns {
+		if lc.terminate(by) {
+			req := &HTTPRequest{Method: "UNKNOWN", ID: newRequestID()}
+			s.logRequest(lc, req, "ADMIN_TERMINATED", 0, lc.bytesIn.Load(), lc.bytesOut.Load(), "terminated by admin "+by)
+		}
+	}
+}
+
+// clientIPMatcher returns a filter for connections from ip, or an error if
+// ip isn't an IP address
+func clientIPMatcher(ip string) (func(*labeledConn) bool, error) {
+	want := net.ParseIP(ip)
+	if want == nil {
+		return nil, fmt.Errorf("invalid client_ip %q", ip)
+	}
+	return func(lc *labeledConn) bool {
+		return want.Equal(net.ParseIP(GetClientIP(lc)))
+	}, nil
+}
+
+// handleConnections serves /connections: GET lists the open connections,
+// and DELETE with ?client_ip= closes every connection from that client.
+// GET takes client_ip too, to list only that client's connections.
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	var match func(*labeledConn) bool
+	if ip := r.URL.Query().Get("client_ip"); ip != "" {
+		var err error
+		if match, err = clientIPMatcher(ip); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(connectionInfos(s.trackedConns(match)))
+	case http.MethodDelete:
+		// Closing every connection at once is what restarting is for
+		if match == nil {
+			http.Error(w, "client_ip is required", http.StatusBadRequest)
+			return
+		}
+		conns := s.trackedConns(match)
+		s.terminateConns(conns, "from "+adminCaller(r))
+		s.diag.Infof("Terminated %d connections from %s for %s", len(conns), r.URL.Query().Get("client_ip"), adminCaller(r))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Terminated int `json:"terminated"`
+		}{len(conns)})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTerminateConnection serves DELETE /connections/{id}, closing one
+// connection
+func (s *Server) handleTerminateConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/connections/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection ID", http.StatusBadRequest)
+		return
+	}
+	conns := s.trackedConns(func(lc *labeledConn) bool { return lc.id == id })
+	if len(conns) == 0 {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	s.terminateConns(conns, "from "+adminCaller(r))
+	s.diag.Infof("Connection %d from %s terminated by %s", id, conns[0].RemoteAddr(), adminCaller(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// labeledConn carries the label of the listener that accepted it, and
+// releases the connection's slot in the active count the first time it is
+// closed, whether by the handler, the worker pool, a tunnel or Shutdown. It
+// counts the bytes through it so /connections can show them mid-flight.
+type labeledConn struct {
+	net.Conn
+	label   string
+	ipKey   string
+	once    sync.Once
+	release func()
+
+	id         uint64    // registry ID, 0 for connections that aren't tracked
+	started    time.Time // when the connection was accepted
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	mu         sync.Mutex    // guards activity and terminated
+	activity   *connActivity // the request being served, nil between requests
+	terminated string        // who terminated the connection through the admin API
+
+	profiles *BandwidthProfiles     // bandwidth_profiles_file as loaded when the connection was accepted
+	shape    atomic.Pointer[shaper] // pacing for the current request's bandwidth profile, if any
+
+	queueWait time.Duration // time spent waiting for a worker, until the first request's trace takes it
+}
+
+// Read reads from the client, counting the bytes
+func (c *labeledConn) Read(b []byte) (int, error) {
+	var n int
+	var err error
+	if sh := c.shape.Load(); sh != nil {
+		n, err = sh.read(c.Conn, b)
+	} else {
+		n, err = c.Conn.Read(b)
+	}
+	c.bytesIn.Add(int64(n))
+	return n, err
+}
+
+// Write writes to the client, counting the bytes
+func (c *labeledConn) Write(b []byte) (int, error) {
+	var n int
+	var err error
+	if sh := c.shape.Load(); sh != nil {
+		n, err = sh.write(c.Conn, b)
+	} else {
+		n, err = c.Conn.Write(b)
+	}
+	c.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// Close closes the connection and releases its slot
+func (c *labeledConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// trackConn counts conn as active until it is closed, along with its
+// client's per-IP count when ipKey is set, and registers it so Shutdown
+// can close it and /connections can list it
+func (s *Server) trackConn(conn net.Conn, label, ipKey string) *labeledConn {
+	lc := &labeledConn{Conn: conn, label: label, ipKey: ipKey, id: s.connIDs.Add(1), started: time.Now(), profiles: s.bandwidth.Load()}
+	lc.release = func() { s.releaseConn(lc) }
+
+	s.connsMu.Lock()
+	s.conns[lc] = struct{}{}
+	s.connsMu.Unlock()
+
+	s.activeConns.Add(1)
+	return lc
+}
+
+// releaseConn drops the active counts and wakes an accept loop waiting for
+// a free slot
+func (s *Server) releaseConn(lc *labeledConn) {
+	s.connsMu.Lock()
+	delete(s.conns, lc)
+	if lc.ipKey != "" {
+		if s.ipConns[lc.ipKey]--; s.ipConns[lc.ipKey] <= 0 {
+			delete(s.ipConns, lc.ipKey)
+		}
+	}
+	s.connsMu.Unlock()
+
+	s.activeConns.Add(-1)
+	select {
+	case s.connFreed <- struct{}{}:
+	default:
+	}
+}
+
+// ActiveConnections returns the number of client connections currently
+// being handled or queued for a worker
+func (s *Server) ActiveConnections() int64 {
+	return s.activeConns.Load()
+}
+
+// closeAllConns closes every tracked connection, returning how many there
+// were
+func (s *Server) closeAllConns() int {
+	s.connsMu.Lock()
+	conns := make([]*labeledConn, 0, len(s.conns))
+	for lc := range s.conns {
+		conns = append(conns, lc)
+	}
+	s.connsMu.Unlock()
+
+	for _, lc := range conns {
+		lc.Close()
+	}
+	return len(conns)
+}
+
+// atConnLimit reports whether max_connections is set and reached
+func (s *Server) atConnLimit(config *Config) bool {
+	return config.MaxConnections > 0 && s.activeConns.Load() >= int64(config.MaxConnections)
+}
+
+// waitForConnSlot stops an accept loop from accepting while the server is
+// at max_connections in block mode. It returns false if the server shuts
+// down while waiting.
+func (s *Server) waitForConnSlot() bool {
+	for {
+		config := s.config.Load()
+		if config.ConnectionLimitMode != "block" || !s.atConnLimit(config) {
+			return true
+		}
+		select {
+		case <-s.shutdown:
+			return false
+		case <-s.connFreed:
+		case <-time.After(1 * time.Second): // pick up a reloaded limit
+		}
+	}
+}
+
+// acquireIPSlot counts a new connection against its client's
+// max_connections_per_ip, returning false if the client is at the limit
+func (s *Server) acquireIPSlot(ipKey string, max int) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.ipConns[ipKey] >= max {
+		return false
+	}
+	s.ipConns[ipKey]++
+	return true
+}
+
+// connLimitKey returns the key a client's connections are counted under:
+// its IPv4 address, or its IPv6 address masked to ipv6Prefix bits so a host
+// can't evade the limit by rotating through its /64
+func connLimitKey(addr net.Addr, ipv6Prefix int) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String()
+	}
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return tcpAddr.IP.Mask(net.CIDRMask(ipv6Prefix, 128)).String()
+}
+
+// rejectOverloaded answers a connection the server has no room for with
+// 503 and closes it, without reading the request; reason names the limit
+// that was hit
+func (s *Server) rejectOverloaded(conn net.Conn, label, reason string) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	conn = &labeledConn{Conn: conn, label: label, release: func() {}}
+	req := &HTTPRequest{Method: "UNKNOWN", ID: newRequestID()}
+	s.sendErrorResponseHeaders(conn, req, 503, "Service Unavailable", []string{"Retry-After: 1"})
+	s.logRequest(conn, req, "OVERLOADED", 503, 0, 0, reason)
+}
+
+// rejectQueueTimeout answers a connection that waited longer than
+// queue_max_wait for a worker with 503 and closes it, without reading the
+// request its client has likely given up on
+func (s *Server) rejectQueueTimeout(conn net.Conn, waited, limit time.Duration) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	req := &HTTPRequest{Method: "UNKNOWN", ID: newRequestID()}
+	s.sendErrorResponseHeaders(conn, req, 503, "Service Unavailable", []string{"Retry-After: 1"})
+	s.logRequest(conn, req, "QUEUE_TIMEOUT", 503, 0, 0, fmt.Sprintf("queued for %s (queue_max_wait %s)", waited.Round(time.Millisecond), limit))
+}
+
+// rejectRateLimited answers a connection over max_connections_per_ip with
+// 429 and closes it, without reading the request
+func (s *Server) rejectRateLimited(conn net.Conn, label string) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	conn = &labeledConn{Conn: conn, label: label, release: func() {}}
+	req := &HTTPRequest{Method: "UNKNOWN", ID: newRequestID()}
+	s.sendErrorResponse(conn, req, 429, "Too Many Requests")
+	s.logRequest(conn, req, "RATE_LIMITED", 429, 0, 0, "max_connections_per_ip")
+}
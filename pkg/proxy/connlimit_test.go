@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMaxConnectionsReject(t *testing.T) {
+	const limit, extra = 3, 2
+	config := testConfig(t)
+	config.MaxConnections = limit
+	s, addr := startServer(t, config)
+
+	for i := 0; i < limit; i++ {
+		dialProxy(t, addr)
+	}
+	waitFor(t, func() bool { return s.ActiveConnections() == limit })
+
+	// Every connection over the limit is answered 503 and closed
+	for i := 0; i < extra; i++ {
+		conn := dialProxy(t, addr)
+		resp := readResponse(t, conn, 5*time.Second)
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("connection %d over the limit got %d, want 503", i+1, resp.StatusCode)
+		}
+		if resp.Header.Get("Retry-After") == "" {
+			t.Errorf("connection %d over the limit got no Retry-After", i+1)
+		}
+		if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("connection %d over the limit left open: read %d, %v", i+1, n, err)
+		}
+	}
+	if got := s.ActiveConnections(); got != limit {
+		t.Errorf("ActiveConnections() = %d, want %d", got, limit)
+	}
+}
+
+func TestMaxConnectionsBlock(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	const limit = 2
+	config := testConfig(t)
+	config.MaxConnections = limit
+	config.ConnectionLimitMode = "block"
+	s, addr := startServer(t, config)
+
+	held := dialProxy(t, addr)
+	for i := 1; i < limit; i++ {
+		dialProxy(t, addr)
+	}
+	waitFor(t, func() bool { return s.ActiveConnections() == limit })
+
+	// The connection over the limit waits, unanswered, for a slot
+	waiting := dialProxy(t, addr)
+	if _, err := waiting.Write([]byte("GET " + origin.URL + "/ HTTP/1.1\r\nHost: " + hostOf(origin.URL) + "\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	waiting.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, err := waiting.Read(make([]byte, 1)); err == nil || n > 0 {
+		t.Fatal("connection over the limit was answered before a slot freed")
+	}
+
+	held.Close()
+	if resp := readResponse(t, waiting, 5*time.Second); resp.StatusCode != http.StatusOK {
+		t.Errorf("connection given a freed slot got %d, want 200", resp.StatusCode)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after 5 seconds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardPath is where the admin listener serves the dashboard. The page
+// holds no data, so guardAdmin lets it load without the admin token; it
+// asks for the token before fetching /stats/timeseries.
+const dashboardPath = "/dashboard"
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// handleDashboard serves the single-page dashboard over /stats/timeseries
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if s.config.Load().StatsRetention == 0 {
+		http.Error(w, "stats_retention is 0", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write(dashboardHTML)
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Diagnostic log levels, in increasing order of severity
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// DiagLogger writes leveled operational messages (as opposed to the access
+// log written by Logger). A nil *DiagLogger discards everything.
+type DiagLogger struct {
+	out   io.Writer
+	file  *os.File
+	level atomic.Int32
+	mu    sync.Mutex
+}
+
+// ParseLogLevel converts a level name (debug, info, warn, error) to its value
+func ParseLogLevel(name string) (int, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return i, nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return LevelWarn, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %s", name)
+}
+
+// NewDiagLogger creates a diagnostic logger writing to path, or to stderr
+// if path is empty
+func NewDiagLogger(path string, levelName string) (*DiagLogger, error) {
+	level, err := ParseLogLevel(levelName)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DiagLogger{out: os.Stderr}
+	d.level.Store(int32(level))
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open error log file: %w", err)
+		}
+		d.out = file
+		d.file = file
+	}
+
+	return d, nil
+}
+
+// Enabled reports whether messages at level would be written
+func (d *DiagLogger) Enabled(level int) bool {
+	return d != nil && int32(level) >= d.level.Load()
+}
+
+// SetLevel changes the minimum level written
+func (d *DiagLogger) SetLevel(level int) {
+	if d != nil {
+		d.level.Store(int32(level))
+	}
+}
+
+func (d *DiagLogger) logf(level int, format string, args ...interface{}) {
+	if !d.Enabled(level) {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintf(d.out, "%s [%s] %s\n", timestamp, levelNames[level], msg)
+}
+
+// Debugf logs a debug message, such as a per-request decision trace
+func (d *DiagLogger) Debugf(format string, args ...interface{}) {
+	d.logf(LevelDebug, format, args...)
+}
+
+// Infof logs an informational message
+func (d *DiagLogger) Infof(format string, args ...interface{}) {
+	d.logf(LevelInfo, format, args...)
+}
+
+// Warnf logs a warning
+func (d *DiagLogger) Warnf(format string, args ...interface{}) {
+	d.logf(LevelWarn, format, args...)
+}
+
+// Errorf logs an error
+func (d *DiagLogger) Errorf(format string, args ...interface{}) {
+	d.logf(LevelError, format, args...)
+}
+
+// Write writes p unformatted to the diagnostic log's destination, so
+// multi-line reports such as the stats dump go where the log goes
+func (d *DiagLogger) Write(p []byte) (int, error) {
+	if d == nil {
+		return os.Stderr.Write(p)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.out.Write(p)
+}
+
+// Close closes the error log file, if one was opened
+func (d *DiagLogger) Close() error {
+	if d == nil || d.file == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
@@ -0,0 +1,47 @@
+// Package proxy implements the forward HTTP/HTTPS proxy server run by
+// cmd/proxy, for embedding in other programs.
+//
+// The stable API is:
+//
+//   - Config, DefaultConfig, LoadConfig, LoadConfigFile, CheckConfigFiles
+//     and PrintConfig, for building and checking a configuration
+//   - Server, NewServer and its options WithFilter, WithFilterEngine,
+//     WithLogger, WithCache and WithAuthenticator, with the methods Start,
+//     Listen, Serve, Addr, Shutdown, ForceShutdown, ReloadConfig, Stats,
+//     DumpStats, LogStats and ActiveConnections
+//   - the hooks registered with Server.OnRequest, OnConnect and
+//     OnResponse: RequestHook, ResponseHook, ConnInfo, HookResult and
+//     ResponseMeta
+//   - FilterEngine, FilterMatch and FilterStats, for supplying the blocking
+//     decisions, with NewFileFilter and StaticFilter
+//   - Authenticator, for checking proxy credentials with WithAuthenticator,
+//     with NoAuth, TokenAuth, BasicAuth and NewAuthenticator
+//   - StatsSnapshot, as returned by Server.Stats
+//   - Filter, NewFilter, Cache, NewCache, Logger, NewLogger and LogEntry,
+//     the components that can be supplied to NewServer
+//   - CacheBackend, CacheEntry and CacheStats, for supplying the response
+//     cache, with RedisCache and NewRedisCache
+//   - DiagLogger and NewDiagLogger; a nil *DiagLogger discards messages, so
+//     components can be built without one
+//   - HTTPRequest and Forwarder, as used by the above
+//   - Version, Commit, BuildDate, Build, BuildInfo, Product and
+//     VersionString, describing the build
+//
+// Other exported identifiers are used between the package's files and may
+// change without notice.
+//
+// A minimal embedding:
+//
+//	config := proxy.DefaultConfig()
+//	config.ListenPort = 3128
+//	server, err := proxy.NewServer(config, proxy.WithFilter(myFilter))
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	go server.Start()
+//	defer server.Shutdown()
+//
+// Start is Listen followed by Serve(nil). A test can set listen_port to 0,
+// call Listen and read the port it got from Addr before calling Serve, and
+// Serve also takes a listener of the caller's own.
+package proxy
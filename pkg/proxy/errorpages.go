@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrorPages renders the bodies of proxy-generated error responses: HTML
+// templates from error_pages_dir for browsers, a JSON object for clients
+// that prefer application/json, and plain text otherwise or when a
+// template is missing or fails
+type ErrorPages struct {
+	templates atomic.Pointer[map[string]*template.Template] // by file name, e.g. "403.html" or "4xx.html"
+	diag      *DiagLogger
+}
+
+// errorPageData is what error page templates and JSON errors are given
+type errorPageData struct {
+	Status    int    `json:"status"`
+	Message   string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Proxy     string `json:"proxy"`
+	Detail    string `json:"detail,omitempty"` // the underlying error, only with debug_errors
+}
+
+// NewErrorPages loads the templates in config's error_pages_dir
+func NewErrorPages(config *Config, diag *DiagLogger) *ErrorPages {
+	p := &ErrorPages{diag: diag}
+	p.Reconfigure(config)
+	return p
+}
+
+// Reconfigure reloads the templates. Templates that can't be parsed are
+// logged and skipped, so their statuses fall back to plain text.
+func (p *ErrorPages) Reconfigure(config *Config) {
+	templates, problems := loadErrorPages(config.ErrorPagesDir)
+	for _, problem := range problems {
+		p.diag.Warnf("Error page %s; using plain text instead", problem)
+	}
+	p.templates.Store(&templates)
+}
+
+// loadErrorPages parses the <status>.html and <class>xx.html templates in
+// dir, returning problems with any that can't be used
+func loadErrorPages(dir string) (map[string]*template.Template, []string) {
+	templates := make(map[string]*template.Template)
+	if dir == "" {
+		return templates, nil
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		return templates, []string{err.Error()}
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return templates, []string{err.Error()}
+	}
+
+	var problems []string
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if !isErrorPageName(name) {
+			continue
+		}
+		tmpl, err := template.ParseFiles(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		templates[name] = tmpl
+	}
+	return templates, problems
+}
+
+// isErrorPageName reports whether name is a status ("404.html") or status
+// class ("4xx.html") template name
+func isErrorPageName(name string) bool {
+	base := strings.TrimSuffix(name, ".html")
+	if len(base) != 3 || base[0] < '4' || base[0] > '5' {
+		return false
+	}
+	if base[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(base)
+	return err == nil
+}
+
+// render returns the content type and body of an error response for req
+func (p *ErrorPages) render(req *HTTPRequest, data errorPageData) (string, []byte) {
+	switch preferredErrorFormat(req.Headers["accept"]) {
+	case "json":
+		body, _ := json.Marshal(data)
+		return "application/json", append(body, '\n')
+	case "html":
+		templates := *p.templates.Load()
+		tmpl, ok := templates[strconv.Itoa(data.Status)+".html"]
+		if !ok {
+			tmpl, ok = templates[strconv.Itoa(data.Status/100)+"xx.html"]
+		}
+		if ok {
+			var body bytes.Buffer
+			err := tmpl.Execute(&body, data)
+			if err == nil {
+				return "text/html; charset=utf-8", body.Bytes()
+			}
+			p.diag.Warnf("Error page %s failed: %v", tmpl.Name(), err)
+		}
+	}
+
+	body := fmt.Sprintf("%d %s", data.Status, data.Message)
+	if data.Detail != "" {
+		body += "\n" + data.Detail
+	}
+	return "text/plain", []byte(body)
+}
+
+// preferredErrorFormat picks "json" when accept ranks application/json
+// above text/html, and "html" otherwise
+func preferredErrorFormat(accept string) string {
+	jsonQ, htmlQ := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch mediaType {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case "text/html":
+			htmlQ = max(htmlQ, q)
+		case "*/*", "text/*":
+			htmlQ = max(htmlQ, q/2) // wildcards rank below an explicit JSON preference
+		}
+	}
+	if jsonQ > htmlQ {
+		return "json"
+	}
+	return "html"
+}
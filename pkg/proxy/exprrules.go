@@ -0,0 +1,824 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expression rule actions
+const (
+	exprAllow     = "allow"
+	exprBlock     = "block"
+	exprRoute     = "route"
+	exprRateLimit = "rate_limit"
+)
+
+// ExprInput is the request an expression rule is evaluated against
+type ExprInput struct {
+	ClientIP net.IP
+	User     string // empty for unauthenticated requests
+	Host     string
+	Port     int
+	Path     string // without the query; empty for CONNECT
+	Method   string
+	Category string // blocklist category of the host, if any
+	Time     time.Time
+}
+
+// ExprMatch is the expression rule a request matched
+type ExprMatch struct {
+	Rule   string // the rule as written, logged as the matched rule
+	File   string
+	Line   int
+	Action string // allow, block, route or rate_limit
+	Route  *Route // where a route rule sends the request
+	Rate   float64
+
+	limiter *RateLimiter // the rate_limit rule's per-client buckets
+}
+
+// Allow applies a rate_limit rule's limit to the client at addr, as
+// RateLimiter.Allow does. Other rules, and rules loaded outside a server,
+// allow every request.
+func (m *ExprMatch) Allow(addr net.Addr) (bool, time.Duration) {
+	if m.limiter == nil {
+		return true, 0
+	}
+	return m.limiter.Allow(addr)
+}
+
+// exprCond is a compiled condition
+type exprCond func(in *ExprInput) bool
+
+// exprRule is one line of the expression rules file
+type exprRule struct {
+	match ExprMatch
+	cond  exprCond // nil matches every request
+}
+
+// ExprRules is an ordered list of expression rules; the first rule whose
+// condition holds decides the request
+type ExprRules struct {
+	rules []*exprRule
+}
+
+// LoadExprRules loads expression rules from a file, one per line:
+//
+//	action [if condition]
+//
+// for example "block if client_ip in 10.20.0.0/16 and category == social".
+// An empty path loads no rules. Syntax errors are reported with the file,
+// line and column.
+func LoadExprRules(path string) (*ExprRules, error) {
+	er := &ExprRules{}
+	if path == "" {
+		return er, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open expression rules file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		rule, err := parseExprRule(scanner.Text())
+		if err != nil {
+			if perr, ok := err.(*exprError); ok {
+				return nil, fmt.Errorf("%s:%d:%d: %s", path, lineNum, perr.col, perr.msg)
+			}
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		if rule == nil {
+			continue
+		}
+		rule.match.File, rule.match.Line = path, lineNum
+		er.rules = append(er.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read expression rules file: %w", err)
+	}
+
+	return er, nil
+}
+
+// Len returns the number of rules
+func (er *ExprRules) Len() int {
+	return len(er.rules)
+}
+
+// Match returns the first rule whose condition holds for in
+func (er *ExprRules) Match(in ExprInput) (ExprMatch, bool) {
+	for _, rule := range er.rules {
+		if rule.cond == nil || rule.cond(&in) {
+			return rule.match, true
+		}
+	}
+	return ExprMatch{}, false
+}
+
+// startLimiters gives the rate_limit rules their limiters, taking over
+// those of identical rules in previous (which may be nil) so clients keep
+// their buckets across a reload
+func (er *ExprRules) startLimiters(previous *ExprRules, config *Config) {
+	old := make(map[string]*RateLimiter)
+	if previous != nil {
+		for _, rule := range previous.rules {
+			if rule.match.limiter != nil {
+				old[rule.match.Rule] = rule.match.limiter
+			}
+		}
+	}
+	for _, rule := range er.rules {
+		if rule.match.Action != exprRateLimit {
+			continue
+		}
+		limits := *config
+		limits.RateLimitRPS = rule.match.Rate
+		limits.RateLimitBurst = int(math.Max(1, math.Ceil(rule.match.Rate)))
+		limits.RateLimitExemptCIDRs = nil
+		if limiter, ok := old[rule.match.Rule]; ok {
+			limiter.Reconfigure(&limits)
+			rule.match.limiter = limiter
+			delete(old, rule.match.Rule)
+			continue
+		}
+		rule.match.limiter = NewRateLimiter(&limits)
+	}
+}
+
+// exprError is a syntax error at a column of a rule line
+type exprError struct {
+	col int
+	msg string
+}
+
+func (e *exprError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.col, e.msg)
+}
+
+// Token kinds; the punctuation kinds are in the order tokenizeExpr expects
+const (
+	tokEOF = iota
+	tokWord
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+)
+
+// exprToken is a token and the column, counted from 1, it starts at
+type exprToken struct {
+	kind int
+	text string
+	col  int
+}
+
+// tokenizeExpr splits a rule line into tokens, stopping at a # outside
+// quotes, and returns the line without its comment
+func tokenizeExpr(line string) ([]exprToken, string, error) {
+	var tokens []exprToken
+	i := 0
+	for i < len(line) {
+		c := line[i]
+		col := i + 1
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			return append(tokens, exprToken{kind: tokEOF, col: col}), line[:i], nil
+		case c == '(' || c == ')' || c == '[' || c == ']' || c == ',':
+			kind := tokLParen + strings.IndexByte("()[],", c)
+			tokens = append(tokens, exprToken{kind: kind, text: string(c), col: col})
+			i++
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			op := string(c)
+			if i+1 < len(line) && line[i+1] == '=' {
+				op += "="
+			}
+			if op == "=" || op == "!" {
+				return nil, "", &exprError{col, fmt.Sprintf("unexpected %q (comparisons use == and !=)", op)}
+			}
+			tokens = append(tokens, exprToken{kind: tokOp, text: op, col: col})
+			i += len(op)
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(line) && line[j] != c; j++ {
+				if line[j] == '\\' && j+1 < len(line) {
+					j++
+				}
+				b.WriteByte(line[j])
+			}
+			if j >= len(line) {
+				return nil, "", &exprError{col, "unterminated string"}
+			}
+			tokens = append(tokens, exprToken{kind: tokString, text: b.String(), col: col})
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && !strings.ContainsRune(" \t\r#()[],=!<>\"'", rune(line[j])) {
+				j++
+			}
+			tokens = append(tokens, exprToken{kind: tokWord, text: line[i:j], col: col})
+			i = j
+		}
+	}
+	return append(tokens, exprToken{kind: tokEOF, col: len(line) + 1}), line, nil
+}
+
+// parseExprRule parses a single rule line, returning nil for a blank or
+// comment line
+func parseExprRule(line string) (*exprRule, error) {
+	tokens, text, err := tokenizeExpr(line)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, nil
+	}
+
+	rule := &exprRule{match: ExprMatch{Rule: strings.TrimSpace(text)}}
+	action := p.next()
+	if action.kind != tokWord {
+		return nil, p.errorf(action, "expected an action, found %s", action.describe())
+	}
+	if err := parseExprAction(action, &rule.match); err != nil {
+		return nil, err
+	}
+
+	if tok := p.next(); tok.kind == tokEOF {
+		return rule, nil
+	} else if tok.kind != tokWord || strings.ToLower(tok.text) != "if" {
+		return nil, p.errorf(tok, "expected \"if\" after the action, found %s", tok.describe())
+	}
+	if rule.cond, err = p.parseOr(); err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %s", tok.describe())
+	}
+	return rule, nil
+}
+
+// parseExprAction parses allow, block, route:<upstream> or rate_limit:<n>
+// into match. An upstream is "direct", a parent HTTP proxy's host:port
+// (optionally as http://host:port) or socks5://host:port.
+func parseExprAction(tok exprToken, match *ExprMatch) error {
+	name, arg, hasArg := strings.Cut(tok.text, ":")
+	argErr := func(format string, args ...any) error {
+		return &exprError{tok.col + len(name) + 1, fmt.Sprintf(format, args...)}
+	}
+	match.Action = strings.ToLower(name)
+	switch match.Action {
+	case exprAllow, exprBlock:
+		if hasArg {
+			return argErr("%s takes no argument", match.Action)
+		}
+	case exprRoute:
+		if arg == "" {
+			return argErr("route needs an upstream: direct, host:port or socks5://host:port")
+		}
+		spec := "PROXY " + strings.TrimPrefix(arg, "http://")
+		if strings.EqualFold(arg, "direct") {
+			spec = routeDirect
+		} else if addr, ok := strings.CutPrefix(arg, "socks5://"); ok {
+			spec = routeSOCKS5 + " " + addr
+		}
+		route, err := parseRoute(spec)
+		if err != nil || len(route.Addrs) > 1 {
+			return argErr("invalid upstream %q (want direct, host:port or socks5://host:port)", arg)
+		}
+		match.Route = &route
+	case exprRateLimit:
+		rate, err := strconv.ParseFloat(arg, 64)
+		if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+			return argErr("rate_limit needs a positive number of requests per second, not %q", arg)
+		}
+		match.Rate = rate
+	default:
+		return &exprError{tok.col, fmt.Sprintf("unknown action %q (want allow, block, route:<upstream> or rate_limit:<n>)", tok.text)}
+	}
+	return nil
+}
+
+// exprParser is a recursive descent parser over a rule's tokens:
+//
+//	or      = and { "or" and }
+//	and     = unary { "and" unary }
+//	unary   = "not" unary | "(" or ")" | field op value
+//	op      = "==" | "!=" | "<" | "<=" | ">" | ">=" | ["not"] "in" | ["not"] "matches"
+//	value   = word | string | "[" value { "," value } "]"
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// keyword reports whether the next token is the word kw, consuming it if so
+func (p *exprParser) keyword(kw string) bool {
+	tok := p.peek()
+	if tok.kind == tokWord && strings.ToLower(tok.text) == kw {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) errorf(tok exprToken, format string, args ...any) error {
+	return &exprError{tok.col, fmt.Sprintf(format, args...)}
+}
+
+// describe names a token for an error message
+func (t exprToken) describe() string {
+	if t.kind == tokEOF {
+		return "end of rule"
+	}
+	return strconv.Quote(t.text)
+}
+
+func (p *exprParser) parseOr() (exprCond, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(in *ExprInput) bool { return l(in) || right(in) }
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprCond, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(in *ExprInput) bool { return l(in) && right(in) }
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprCond, error) {
+	if p.keyword("not") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(in *ExprInput) bool { return !x(in) }, nil
+	}
+	if tok := p.peek(); tok.kind == tokLParen {
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, p.errorf(closing, "expected \")\" to close the \"(\" at column %d, found %s", tok.col, closing.describe())
+		}
+		return x, nil
+	}
+	return p.parseComparison()
+}
+
+// exprFields are the request fields a condition can test
+var exprFields = map[string]bool{
+	"client_ip": true, "user": true, "host": true, "port": true,
+	"path": true, "method": true, "category": true, "time": true,
+}
+
+func (p *exprParser) parseComparison() (exprCond, error) {
+	field := p.next()
+	if field.kind != tokWord {
+		return nil, p.errorf(field, "expected a field, found %s", field.describe())
+	}
+	name := strings.ToLower(field.text)
+	if !exprFields[name] {
+		return nil, p.errorf(field, "unknown field %q (want client_ip, user, host, port, path, method, category or time)", field.text)
+	}
+
+	opTok := p.peek()
+	negate := p.keyword("not")
+	var op string
+	switch tok := p.next(); {
+	case tok.kind == tokOp && !negate:
+		op = tok.text
+	case tok.kind == tokWord && (strings.ToLower(tok.text) == "in" || strings.ToLower(tok.text) == "matches"):
+		op = strings.ToLower(tok.text)
+	default:
+		return nil, p.errorf(tok, "expected an operator after %s, found %s", field.text, tok.describe())
+	}
+
+	values, err := p.parseValues(op == "in")
+	if err != nil {
+		return nil, err
+	}
+	cond, err := compileComparison(name, op, values)
+	if err != nil {
+		if perr, ok := err.(*exprError); ok {
+			return nil, perr
+		}
+		return nil, p.errorf(opTok, "%v", err)
+	}
+	if negate {
+		return func(in *ExprInput) bool { return !cond(in) }, nil
+	}
+	return cond, nil
+}
+
+// parseValues parses a single value or, where list is true, also a
+// bracketed list of them
+func (p *exprParser) parseValues(list bool) ([]exprToken, error) {
+	tok := p.next()
+	if tok.kind == tokWord || tok.kind == tokString {
+		return []exprToken{tok}, nil
+	}
+	if tok.kind != tokLBracket || !list {
+		return nil, p.errorf(tok, "expected a value, found %s", tok.describe())
+	}
+	var values []exprToken
+	for {
+		value := p.next()
+		if value.kind != tokWord && value.kind != tokString {
+			return nil, p.errorf(value, "expected a value, found %s", value.describe())
+		}
+		values = append(values, value)
+		switch sep := p.next(); sep.kind {
+		case tokComma:
+		case tokRBracket:
+			return values, nil
+		default:
+			return nil, p.errorf(sep, "expected \",\" or \"]\" in the list opened at column %d, found %s", tok.col, sep.describe())
+		}
+	}
+}
+
+// compileComparison builds the test of one field against values. Errors
+// about a value are reported at its column.
+func compileComparison(field, op string, values []exprToken) (exprCond, error) {
+	valueErr := func(tok exprToken, format string, args ...any) error {
+		return &exprError{tok.col, fmt.Sprintf(format, args...)}
+	}
+	ordering := op == "<" || op == "<=" || op == ">" || op == ">="
+
+	switch field {
+	case "client_ip":
+		switch {
+		case op == "matches":
+			pattern := values[0].text
+			return func(in *ExprInput) bool { return globMatch(pattern, in.ClientIP.String()) }, nil
+		case op == "in":
+			var networks []*net.IPNet
+			for _, value := range values {
+				parsed, err := parseCIDRList([]string{value.text})
+				if err != nil {
+					return nil, valueErr(value, "%v", err)
+				}
+				networks = append(networks, parsed...)
+			}
+			return func(in *ExprInput) bool {
+				for _, network := range networks {
+					if in.ClientIP != nil && network.Contains(in.ClientIP) {
+						return true
+					}
+				}
+				return false
+			}, nil
+		case !ordering:
+			ip := net.ParseIP(values[0].text)
+			if ip == nil {
+				return nil, valueErr(values[0], "invalid IP address %q", values[0].text)
+			}
+			equal := op == "=="
+			return func(in *ExprInput) bool { return ip.Equal(in.ClientIP) == equal }, nil
+		}
+
+	case "port":
+		if op == "matches" {
+			break
+		}
+		var ranges [][2]int
+		for _, value := range values {
+			lo, hi, isRange := strings.Cut(value.text, "-")
+			if isRange && op != "in" {
+				return nil, valueErr(value, "port ranges can only be used with in")
+			}
+			if !isRange {
+				hi = lo
+			}
+			first, err1 := strconv.Atoi(lo)
+			last, err2 := strconv.Atoi(hi)
+			if err1 != nil || err2 != nil || first < 0 || last > 65535 || first > last {
+				return nil, valueErr(value, "invalid port %q", value.text)
+			}
+			ranges = append(ranges, [2]int{first, last})
+		}
+		if op == "in" {
+			return func(in *ExprInput) bool {
+				for _, r := range ranges {
+					if in.Port >= r[0] && in.Port <= r[1] {
+						return true
+					}
+				}
+				return false
+			}, nil
+		}
+		port := ranges[0][0]
+		return func(in *ExprInput) bool { return compareInts(in.Port, op, port) }, nil
+
+	case "time":
+		switch {
+		case op == "in":
+			var windows []timeWindow
+			for _, value := range values {
+				window, err := parseTimeWindow(value.text)
+				if err != nil {
+					return nil, valueErr(value, "%v", err)
+				}
+				windows = append(windows, window)
+			}
+			return func(in *ExprInput) bool {
+				for _, window := range windows {
+					if window.contains(in.Time) {
+						return true
+					}
+				}
+				return false
+			}, nil
+		case ordering:
+			minute, err := parseClock(values[0].text)
+			if err != nil {
+				return nil, valueErr(values[0], "%v", err)
+			}
+			return func(in *ExprInput) bool {
+				return compareInts(in.Time.Hour()*60+in.Time.Minute(), op, minute)
+			}, nil
+		}
+		return nil, fmt.Errorf("time can only be used with in, <, <=, > or >=")
+
+	default:
+		// user, host, path, method and category compare as strings, all
+		// but user and path ignoring case
+		fold := field != "user" && field != "path"
+		get := map[string]func(*ExprInput) string{
+			"user":     func(in *ExprInput) string { return in.User },
+			"host":     func(in *ExprInput) string { return in.Host },
+			"path":     func(in *ExprInput) string { return in.Path },
+			"method":   func(in *ExprInput) string { return in.Method },
+			"category": func(in *ExprInput) string { return in.Category },
+		}[field]
+		var texts []string
+		for _, value := range values {
+			text := value.text
+			if fold {
+				text = strings.ToLower(text)
+			}
+			texts = append(texts, text)
+		}
+		value := func(in *ExprInput) string {
+			if fold {
+				return strings.ToLower(get(in))
+			}
+			return get(in)
+		}
+		switch {
+		case op == "matches":
+			return func(in *ExprInput) bool { return globMatch(texts[0], value(in)) }, nil
+		case op == "in":
+			return func(in *ExprInput) bool {
+				v := value(in)
+				for _, text := range texts {
+					if v == text {
+						return true
+					}
+				}
+				return false
+			}, nil
+		case !ordering:
+			equal := op == "=="
+			return func(in *ExprInput) bool { return (value(in) == texts[0]) == equal }, nil
+		}
+	}
+	return nil, fmt.Errorf("%s can't be used with %s", field, op)
+}
+
+// compareInts applies a comparison operator
+func compareInts(a int, op string, b int) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// globMatch reports whether s matches pattern, in which * matches any run
+// of characters, including none, and ? any single character
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star >= 0:
+			// Let the last * take one more character and retry
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// weekdays maps day names to time.Weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// timeWindow is a set of weekdays and a time of day range, in minutes
+// since midnight, local time
+type timeWindow struct {
+	days       [7]bool
+	start, end int // end is exclusive; a range with end <= start wraps past midnight
+}
+
+// parseTimeWindow parses days, a time range, or both, such as
+// "mon-fri 09:00-17:00", "sat,sun" or "22:00-06:00"
+func parseTimeWindow(s string) (timeWindow, error) {
+	w := timeWindow{start: 0, end: 24 * 60}
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("invalid time window %q (want e.g. \"mon-fri 09:00-17:00\")", s)
+	}
+
+	haveDays := false
+	for _, field := range fields {
+		if strings.Contains(field, ":") {
+			from, to, ok := strings.Cut(field, "-")
+			if !ok {
+				return w, fmt.Errorf("invalid time range %q (want HH:MM-HH:MM)", field)
+			}
+			var err error
+			if w.start, err = parseClock(from); err != nil {
+				return w, err
+			}
+			if w.end, err = parseClock(to); err != nil {
+				return w, err
+			}
+			continue
+		}
+		if haveDays {
+			return w, fmt.Errorf("invalid time window %q", s)
+		}
+		haveDays = true
+		for _, part := range strings.Split(field, ",") {
+			from, to, isRange := strings.Cut(part, "-")
+			if !isRange {
+				to = from
+			}
+			first, ok1 := weekdays[from]
+			last, ok2 := weekdays[to]
+			if !ok1 || !ok2 {
+				return w, fmt.Errorf("invalid days %q (want e.g. mon-fri or sat,sun)", part)
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+	if !haveDays {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	return w, nil
+}
+
+// contains reports whether t falls in the window
+func (w timeWindow) contains(t time.Time) bool {
+	if !w.days[t.Weekday()] {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if w.end > w.start {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// parseClock parses HH:MM into minutes since midnight; 24:00 is allowed as
+// the end of the day
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		if s == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid time of day %q (want HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// applyExprRules evaluates expression_rules_file against req, whose host
+// matched filterMatch in the blocklists, answering and logging it if a
+// block rule matches or a rate_limit rule's limit is exceeded. It reports
+// whether the request was answered, and whether an allow rule exempts it
+// from the blocklists.
+func (s *Server) applyExprRules(conn net.Conn, req *HTTPRequest, filterMatch FilterMatch) (answered, allowed bool) {
+	rules := s.exprRules.Load()
+	if rules.Len() == 0 {
+		return false, false
+	}
+
+	path := ""
+	if !req.IsConnect {
+		path, _, _ = strings.Cut(requestPath(req.RequestTarget), "?")
+	}
+	match, ok := rules.Match(ExprInput{
+		ClientIP: net.ParseIP(GetClientIP(conn)),
+		User:     req.Username,
+		Host:     req.Host,
+		Port:     req.Port,
+		Path:     path,
+		Method:   req.Method,
+		Category: filterMatch.Category,
+		Time:     time.Now(),
+	})
+	if !ok {
+		return false, false
+	}
+	s.diag.Debugf("Request %s: expression rule %s:%d matched: %s", req.ID, match.File, match.Line, match.Rule)
+	req.RuleMatch = &match
+
+	switch match.Action {
+	case exprAllow:
+		return false, true
+	case exprBlock:
+		s.sendErrorResponse(conn, req, 403, "Forbidden")
+		s.logRequest(conn, req, "BLOCKED", 403, 0, 0, match.Rule)
+		return true, false
+	case exprRateLimit:
+		if ok, wait := match.Allow(conn.RemoteAddr()); !ok {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			s.sendErrorResponseHeaders(conn, req, 429, "Too Many Requests", []string{fmt.Sprintf("Retry-After: %d", retryAfter)})
+			s.logRequest(conn, req, "RATE_LIMITED", 429, 0, 0, match.Rule)
+			return true, false
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// BlockedExtensionError reports a response stopped because its
+// Content-Disposition names a file with one of the blocked_extensions
+type BlockedExtensionError struct {
+	FileName  string
+	Extension string
+}
+
+func (e *BlockedExtensionError) Error() string {
+	return fmt.Sprintf(".%s in Content-Disposition filename %q", e.Extension, e.FileName)
+}
+
+// matchExtension returns the extension of file name if it is one of
+// extensions, which are lowercase and without the dot. Trailing dots and
+// spaces, which Windows ignores, don't hide an extension.
+func matchExtension(extensions []string, name string) (string, bool) {
+	if len(extensions) == 0 {
+		return "", false
+	}
+	ext := strings.TrimPrefix(path.Ext(strings.TrimRight(name, ". ")), ".")
+	if ext == "" {
+		return "", false
+	}
+	ext = strings.ToLower(ext)
+	for _, blocked := range extensions {
+		if ext == blocked {
+			return ext, true
+		}
+	}
+	return "", false
+}
+
+// requestFileName returns the last segment of the decoded path of a request
+// target, without the query. A directory-style path ending in / has none.
+func requestFileName(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || strings.HasSuffix(u.Path, "/") {
+		return ""
+	}
+	return path.Base(path.Clean("/" + u.Path))
+}
+
+// contentDispositionFileName returns the filename a Content-Disposition
+// value gives, decoding filename* if present. A value too malformed to
+// parse is searched for filename= anyway, as browsers are lenient.
+func contentDispositionFileName(value string) string {
+	if _, params, err := mime.ParseMediaType(value); err == nil {
+		return params["filename"]
+	}
+	idx := strings.LastIndex(strings.ToLower(value), "filename=")
+	if idx < 0 {
+		return ""
+	}
+	name, _, _ := strings.Cut(value[idx+len("filename="):], ";")
+	return strings.Trim(strings.TrimSpace(name), `"'`)
+}
+
+// checkResponseFileName fails a response whose Content-Disposition header
+// names a file with a blocked extension, so a download can't escape
+// blocked_extensions behind a URL without one
+func checkResponseFileName(config *Config, headers []string) error {
+	for _, line := range headers {
+		name, value, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(strings.TrimSpace(name), "content-disposition") {
+			continue
+		}
+		filename := contentDispositionFileName(strings.TrimSpace(value))
+		if ext, ok := matchExtension(config.BlockedExtensions, filename); ok {
+			return &BlockedExtensionError{FileName: filename, Extension: ext}
+		}
+	}
+	return nil
+}
+
+// applyExtensionFilter answers a request for a file with one of the
+// blocked_extensions with a 403, reporting whether it did
+func (s *Server) applyExtensionFilter(conn net.Conn, req *HTTPRequest, config *Config) bool {
+	ext, ok := matchExtension(config.BlockedExtensions, requestFileName(req.RequestTarget))
+	if !ok {
+		return false
+	}
+	s.sendErrorResponse(conn, req, 403, "Forbidden")
+	s.logRequest(conn, req, "BLOCKED_EXTENSION", 403, 0, 0, "."+ext+" in request path")
+	return true
+}
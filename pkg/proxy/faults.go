@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errFaultDropped ends a response whose drop_after fault fired; the
+// client's connection is then reset
+var errFaultDropped = errors.New("connection dropped by fault injection")
+
+// FaultRule is one line of the fault injection file: the faults given to
+// requests matching its host and path patterns
+type FaultRule struct {
+	Rule string // the line as written, for the access log
+	Line int
+
+	hostPattern string  // exact host, *.suffix or * for every host
+	pathPattern string  // glob the path must match; empty matches any, and CONNECT
+	probability float64 // percent of matching requests affected
+	latency     time.Duration
+	jitter      time.Duration
+	status      int     // answered by the proxy instead of forwarding, if set
+	dropAfter   int64   // response body bytes relayed before a reset, or -1
+	truncate    int64   // response body bytes relayed before a clean close, or -1
+	corrupt     float64 // fraction of response body bytes altered
+}
+
+// FaultRules holds ordered fault injection rules; the first that matches
+// a request applies
+type FaultRules struct {
+	rules []*FaultRule
+}
+
+// LoadFaultRules loads fault injection rules from a file, one per line:
+//
+//	host-pattern[/path-pattern] [latency=d] [jitter=d] [status=n] [drop_after=n] [truncate=n] [corrupt=f] [probability=p%]
+//
+// An empty path loads no rules.
+func LoadFaultRules(path string) (*FaultRules, error) {
+	fr := &FaultRules{}
+	if path == "" {
+		return fr, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open fault injection file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if line == "" {
+			continue
+		}
+
+		rule, err := parseFaultRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		rule.Line = lineNum
+		fr.rules = append(fr.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read fault injection file: %w", err)
+	}
+
+	return fr, nil
+}
+
+// parseFaultRule parses a single rule line
+func parseFaultRule(line string) (*FaultRule, error) {
+	rule := &FaultRule{Rule: line, probability: 100, dropAfter: -1, truncate: -1}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected \"host-pattern[/path] fault...\"")
+	}
+	pattern, path, hasPath := strings.Cut(fields[0], "/")
+	rule.hostPattern = strings.ToLower(pattern)
+	if hasPath {
+		rule.pathPattern = "/" + path
+	}
+	if rule.hostPattern == "" {
+		return nil, fmt.Errorf("missing host pattern in %q", fields[0])
+	}
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", field)
+		}
+		switch key {
+		case "latency", "jitter":
+			d, err := parseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid duration for %s: %q", key, value)
+			}
+			if key == "latency" {
+				rule.latency = d
+			} else {
+				rule.jitter = d
+			}
+		case "status":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 200 || n > 599 {
+				return nil, fmt.Errorf("invalid status %q (want 200-599)", value)
+			}
+			rule.status = n
+		case "drop_after", "truncate":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid byte count for %s: %q", key, value)
+			}
+			if key == "drop_after" {
+				rule.dropAfter = n
+			} else {
+				rule.truncate = n
+			}
+		case "corrupt":
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f <= 0 || f > 1 {
+				return nil, fmt.Errorf("invalid corrupt fraction %q (want more than 0, up to 1)", value)
+			}
+			rule.corrupt = f
+		case "probability":
+			f, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if err != nil || f <= 0 || f > 100 {
+				return nil, fmt.Errorf("invalid probability %q (want a percentage above 0, up to 100)", value)
+			}
+			rule.probability = f
+		default:
+			return nil, fmt.Errorf("unknown fault %q", key)
+		}
+	}
+
+	bodyFaults := rule.dropAfter >= 0 || rule.truncate >= 0 || rule.corrupt > 0
+	if rule.status != 0 && bodyFaults {
+		return nil, fmt.Errorf("status can't be combined with drop_after, truncate or corrupt")
+	}
+	if rule.latency == 0 && rule.status == 0 && !bodyFaults {
+		return nil, fmt.Errorf("no fault given")
+	}
+	if rule.jitter > rule.latency {
+		return nil, fmt.Errorf("jitter must not exceed latency")
+	}
+	return rule, nil
+}
+
+// Len returns the number of rules
+func (fr *FaultRules) Len() int {
+	return len(fr.rules)
+}
+
+// Match returns the first rule for a request for host and path, or nil; a
+// rule with a path pattern never matches a CONNECT
+func (fr *FaultRules) Match(host, path string, connect bool) *FaultRule {
+	host = strings.ToLower(host)
+	for _, rule := range fr.rules {
+		if rule.pathPattern != "" && (connect || !globMatch(rule.pathPattern, path)) {
+			continue
+		}
+		if rule.hostPattern == "*" || host == rule.hostPattern {
+			return rule
+		}
+		if suffix, ok := strings.CutPrefix(rule.hostPattern, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// delay returns the latency to add to one request, spread evenly over
+// latency±jitter
+func (r *FaultRule) delay() time.Duration {
+	if r.jitter == 0 {
+		return r.latency
+	}
+	return r.latency - r.jitter + time.Duration(rand.Int63n(int64(2*r.jitter)+1))
+}
+
+// wrapBody applies the rule's body faults to a response body on its way
+// to the client
+func (r *FaultRule) wrapBody(body io.Reader) io.Reader {
+	if r.corrupt > 0 {
+		body = &corruptReader{reader: body, fraction: r.corrupt}
+	}
+	if r.truncate >= 0 {
+		body = io.LimitReader(body, r.truncate)
+	}
+	if r.dropAfter >= 0 {
+		body = &dropReader{reader: body, left: r.dropAfter}
+	}
+	return body
+}
+
+// corruptReader flips a bit in a random fraction of the bytes read
+type corruptReader struct {
+	reader   io.Reader
+	fraction float64
+}
+
+func (c *corruptReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	for i := 0; i < n; i++ {
+		if rand.Float64() < c.fraction {
+			p[i] ^= 1 << rand.Intn(8)
+		}
+	}
+	return n, err
+}
+
+// dropReader fails with errFaultDropped once left bytes have been read,
+// unless the body ends first
+type dropReader struct {
+	reader io.Reader
+	left   int64
+}
+
+func (d *dropReader) Read(p []byte) (int, error) {
+	if d.left <= 0 {
+		return 0, errFaultDropped
+	}
+	if int64(len(p)) > d.left {
+		p = p[:d.left]
+	}
+	n, err := d.reader.Read(p)
+	d.left -= int64(n)
+	return n, err
+}
+
+// isFaultListener reports whether faults may be injected into requests on
+// the listener labelled label: enable_fault_injection must be set and the
+// label named in fault_injection_listeners
+func (c *Config) isFaultListener(label string) bool {
+	if !c.EnableFaultInjection {
+		return false
+	}
+	for _, l := range c.FaultInjectionListeners {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// faultRulesFile returns the fault injection file to load, which is none
+// unless enable_fault_injection is set
+func (c *Config) faultRulesFile() string {
+	if !c.EnableFaultInjection {
+		return ""
+	}
+	return c.FaultInjectionFile
+}
+
+// applyFault picks the fault_injection_file rule for req, if it arrived on
+// one of fault_injection_listeners, and rolls its probability. An affected
+// request is delayed by the rule's latency, then answered with its status
+// if it has one; body faults are applied as the response is relayed (see
+// FaultRule.wrapBody). It reports whether the request was answered.
+func (s *Server) applyFault(ctx context.Context, conn net.Conn, req *HTTPRequest, config *Config) bool {
+	if !config.isFaultListener(listenerLabel(conn)) {
+		return false
+	}
+	path := ""
+	if u := requestURL(req); u != nil {
+		path = u.Path
+	}
+	rule := s.faults.Load().Match(req.Host, path, req.IsConnect)
+	if rule == nil || rand.Float64()*100 >= rule.probability {
+		return false
+	}
+	req.Fault = rule
+	s.diag.Debugf("Request %s: injecting faults from line %d: %s", req.ID, rule.Line, rule.Rule)
+
+	if delay := rule.delay(); delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			s.sendCancelled(ctx, conn, req, false, 0, 0)
+			return true
+		}
+	}
+
+	if rule.status != 0 {
+		message := http.StatusText(rule.status)
+		if message == "" {
+			message = "Injected Fault"
+		}
+		s.sendErrorResponse(conn, req, rule.status, message)
+		s.logRequest(conn, req, "FAULT_INJECTED", rule.status, 0, 0, rule.Rule)
+		return true
+	}
+	return false
+}
+
+// warnFaultInjection logs where fault injection is active, so it isn't
+// left on unnoticed
+func (s *Server) warnFaultInjection(config *Config) {
+	if config.EnableFaultInjection {
+		s.diag.Warnf("Fault injection is active on listeners %s (%d rules from %s)",
+			strings.Join(config.FaultInjectionListeners, ", "), s.faults.Load().Len(), config.FaultInjectionFile)
+	}
+}
@@ -0,0 +1,602 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ruleSource is where a rule was loaded from: a line of the rules file, or
+// the admin API for runtime rules
+type ruleSource struct {
+	file    string // empty for runtime rules
+	line    int
+	expires time.Time // zero for rules that don't expire
+	addedBy string
+	labels  []string // for infix wildcard rules, the pattern's labels; see infixLabels
+	hits    *ruleHits
+}
+
+// expired reports whether a runtime rule's TTL has passed
+func (s ruleSource) expired(now time.Time) bool {
+	return !s.expires.IsZero() && !now.Before(s.expires)
+}
+
+// Filter manages blocked domains and IPs
+type Filter struct {
+	blockedDomains map[string]ruleSource
+	blockedIPs     map[string]ruleSource
+	runtimeRules   map[string]ruleSource // added with AddRule; merged back in by LoadRules
+	categories     []*categorySet        // from LoadCategories, in match order
+	mu             sync.RWMutex
+	diag           *DiagLogger
+	loaded         atomic.Bool // set once LoadRules has succeeded
+	read           atomic.Bool // set once a rules file has been read
+	healthy        atomic.Bool // the last load of the rules succeeded
+	blockAll       atomic.Bool // filter_failure_policy is closed and no rules could be loaded
+
+	configured atomic.Pointer[Config] // last given to LoadConfigured, for Reload
+}
+
+// NewFilter creates a new filter instance
+func NewFilter(diag *DiagLogger) *Filter {
+	return &Filter{
+		blockedDomains: make(map[string]ruleSource),
+		blockedIPs:     make(map[string]ruleSource),
+		runtimeRules:   make(map[string]ruleSource),
+		diag:           diag,
+	}
+}
+
+// LoadRules loads blocking rules from a file, returning a report of the
+// entries accepted and skipped. With strict, an invalid entry is an error
+// and the current rules are kept.
+func (f *Filter) LoadRules(filePath string, strict bool) (*RuleReport, error) {
+	domains, ips, report, err := f.readRulesFile(filePath, strict)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// File doesn't exist, start with empty rules
+			f.diag.Warnf("Filter file %s not found, no blocking rules loaded", filePath)
+			f.loaded.Store(true)
+			return &RuleReport{File: filePath}, nil
+		}
+		return report, err
+	}
+	f.setRules(filePath, domains, ips, report)
+	return report, nil
+}
+
+// readRulesFile reads the rules in filePath without applying them, carrying
+// over the hit counts of rules already loaded. A file that can't be opened
+// is returned as the error from os.Open.
+func (f *Filter) readRulesFile(filePath string, strict bool) (domains, ips map[string]ruleSource, report *RuleReport, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil, err
+		}
+		return nil, nil, nil, fmt.Errorf("failed to open filter file: %w", err)
+	}
+	defer file.Close()
+
+	f.mu.RLock()
+	domains, ips, report, err = readRules(file, filePath, f.blockedDomains, f.blockedIPs)
+	f.mu.RUnlock()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if strict {
+		if err := report.InvalidErr(); err != nil {
+			return nil, nil, report, err
+		}
+	}
+	return domains, ips, report, nil
+}
+
+// setRules replaces the rules with those read from filePath
+func (f *Filter) setRules(filePath string, domains, ips map[string]ruleSource, report *RuleReport) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blockedDomains, f.blockedIPs = domains, ips
+
+	f.diag.Infof("Loaded %d domain and %d IP rules from %s%s", len(f.blockedDomains), len(f.blockedIPs), filePath, report.skippedSummary())
+	report.warnSkipped(f.diag)
+	f.mergeRuntimeRules()
+	f.loaded.Store(true)
+	f.read.Store(true)
+	f.healthy.Store(true)
+}
+
+// LoadConfigured loads blocked_domains_file and blocklist_categories, at
+// startup and on every reload, handling a failure per
+// filter_failure_policy. Under "open" a missing rules file loads no rules
+// and other failures are returned, as they always have been. Under
+// "closed" a missing file is a failure too; the rules already loaded are
+// kept, or every request is blocked if none ever were, and the failure is
+// only returned at startup, so the proxy refuses to start. Either way it
+// is logged as an error and Healthy reports false until a load succeeds.
+func (f *Filter) LoadConfigured(config *Config, startup bool) error {
+	load, err := f.prepareConfigured(config, startup)
+	if err != nil {
+		return err
+	}
+	load.commit()
+	return nil
+}
+
+// filterLoad is a load of the configured rules that has been read but not
+// applied, so a reload can fail on a later file without changing the rules.
+// commit applies it, including a failure kept under filter_failure_policy.
+type filterLoad struct {
+	f          *Filter
+	config     *Config
+	domains    map[string]ruleSource // nil when the rules file wasn't read
+	ips        map[string]ruleSource
+	report     *RuleReport
+	categories []*categorySet // nil when the categories weren't read
+	err        error          // the failure commit logs, if the policy kept one
+	missing    bool           // the failure is a missing file
+}
+
+// prepareConfigured reads the files LoadConfigured loads, returning the
+// failures filter_failure_policy doesn't absorb without changing anything
+// but Healthy
+func (f *Filter) prepareConfigured(config *Config, startup bool) (*filterLoad, error) {
+	load := &filterLoad{f: f, config: config}
+	closed := config.FilterFailurePolicy == "closed"
+	var err error
+	if _, statErr := os.Stat(config.BlockedDomainsFile); os.IsNotExist(statErr) {
+		load.missing = true
+		err = fmt.Errorf("filter file %s not found", config.BlockedDomainsFile)
+	} else if load.domains, load.ips, load.report, err = f.readRulesFile(config.BlockedDomainsFile, config.StrictRules); err != nil {
+		err = fmt.Errorf("failed to load filter rules: %w", err)
+	}
+	if err == nil || (load.missing && !closed) {
+		sets, catErr := f.readCategories(config.BlocklistCategories, config.StrictRules)
+		if catErr != nil {
+			err, load.missing = catErr, false
+		} else {
+			load.categories = sets
+		}
+	}
+	load.err = err
+
+	switch {
+	case err == nil, !closed && load.missing:
+		return load, nil
+	case !closed || startup:
+		f.healthy.Store(false)
+		return nil, err
+	}
+	// Under closed a failure is applied by commit, keeping the rules
+	// already loaded or blocking everything
+	load.domains, load.categories = nil, nil
+	return load, nil
+}
+
+// commit applies the rules read by prepareConfigured
+func (l *filterLoad) commit() {
+	f, config := l.f, l.config
+	f.configured.Store(config)
+	if l.domains != nil {
+		f.setRules(config.BlockedDomainsFile, l.domains, l.ips, l.report)
+	}
+	closed := config.FilterFailurePolicy == "closed"
+	if l.missing && !closed {
+		f.diag.Errorf("Filter file %s not found, no rules loaded from it (filter_failure_policy=open)", config.BlockedDomainsFile)
+		f.mu.Lock()
+		f.blockedDomains, f.blockedIPs = make(map[string]ruleSource), make(map[string]ruleSource)
+		f.mergeRuntimeRules()
+		f.mu.Unlock()
+		f.loaded.Store(true)
+	}
+	if l.categories != nil {
+		f.setCategories(l.categories)
+	}
+
+	f.healthy.Store(l.err == nil)
+	switch {
+	case l.err == nil:
+		if f.blockAll.Swap(false) {
+			f.diag.Infof("Filter rules loaded, no longer blocking all traffic")
+		}
+	case !closed && l.missing:
+	case f.read.Load():
+		f.diag.Errorf("Filter rules failed to load, keeping the previous rules (filter_failure_policy=closed): %v", l.err)
+	default:
+		f.blockAll.Store(true)
+		f.diag.Errorf("Filter rules failed to load and none were loaded before, blocking all traffic (filter_failure_policy=closed): %v", l.err)
+	}
+}
+
+// Healthy reports whether the configured rules last loaded without error
+func (f *Filter) Healthy() bool {
+	return f.healthy.Load()
+}
+
+// ruleIssueLogLimit caps the skipped entries of a file logged at load; the
+// rest are counted, and check-host -lint lists them all
+const ruleIssueLogLimit = 10
+
+// RuleIssue is an entry of a rules file that wasn't loaded, and why
+type RuleIssue struct {
+	Line   int
+	Entry  string
+	Reason string
+}
+
+// RuleReport describes the load of one rules file: how many entries were
+// accepted, and which were skipped as invalid or as duplicates of an
+// earlier line
+type RuleReport struct {
+	File       string
+	Accepted   int
+	Invalid    []RuleIssue
+	Duplicates []RuleIssue
+}
+
+// InvalidErr returns an error naming the first invalid entry, or nil if
+// there are none
+func (r *RuleReport) InvalidErr() error {
+	if len(r.Invalid) == 0 {
+		return nil
+	}
+	issue := r.Invalid[0]
+	err := fmt.Errorf("%s:%d: invalid rule %q: %s", r.File, issue.Line, issue.Entry, issue.Reason)
+	if n := len(r.Invalid) - 1; n > 0 {
+		err = fmt.Errorf("%w (and %d more invalid entries)", err, n)
+	}
+	return err
+}
+
+// skippedSummary returns ", skipped ..." counting the skipped entries, or
+// "" if none were, to end a load message
+func (r *RuleReport) skippedSummary() string {
+	if len(r.Invalid) == 0 && len(r.Duplicates) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", skipped %d invalid and %d duplicate entries", len(r.Invalid), len(r.Duplicates))
+}
+
+// Skipped returns the invalid and duplicate entries in line order
+func (r *RuleReport) Skipped() []RuleIssue {
+	issues := append(append([]RuleIssue(nil), r.Invalid...), r.Duplicates...)
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Line < issues[j].Line })
+	return issues
+}
+
+// warnSkipped logs the first ruleIssueLogLimit skipped entries
+func (r *RuleReport) warnSkipped(diag *DiagLogger) {
+	issues := r.Skipped()
+	for i, issue := range issues {
+		if i == ruleIssueLogLimit {
+			diag.Warnf("%s: %d more skipped entries not shown; run check-host -lint to list them", r.File, len(issues)-i)
+			return
+		}
+		diag.Warnf("%s:%d: skipped %q: %s", r.File, issue.Line, issue.Entry, issue.Reason)
+	}
+}
+
+// readRules reads a rules file of domains, *.suffix patterns and IPs, one
+// per line. Rules also in previous keep their hit counts. Entries that
+// could never match a host, and repeats of an earlier entry, are skipped
+// and listed in the report.
+func readRules(file io.Reader, filePath string, previous ...map[string]ruleSource) (domains, ips map[string]ruleSource, report *RuleReport, err error) {
+	domains = make(map[string]ruleSource)
+	ips = make(map[string]ruleSource)
+	report = &RuleReport{File: filePath}
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Remove inline comments
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+
+		// Canonicalize: lowercase and trim
+		line = strings.ToLower(strings.TrimSpace(line))
+		if err := checkRule(line); err != nil {
+			report.Invalid = append(report.Invalid, RuleIssue{Line: lineNum, Entry: line, Reason: err.Error()})
+			continue
+		}
+
+		// Check if it's an IP address; a repeated rule keeps its first line
+		source := ruleSource{file: filePath, line: lineNum, hits: &ruleHits{}, labels: infixLabels(line)}
+		for _, rules := range previous {
+			if old, ok := rules[line]; ok {
+				source.hits = old.hits
+			}
+		}
+		rules := domains
+		if host, _ := splitRulePort(line); net.ParseIP(host) != nil {
+			rules = ips
+		}
+		if first, ok := rules[line]; ok {
+			report.Duplicates = append(report.Duplicates, RuleIssue{Line: lineNum, Entry: line, Reason: fmt.Sprintf("duplicate of line %d", first.line)})
+			continue
+		}
+		rules[line] = source
+		report.Accepted++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	return domains, ips, report, nil
+}
+
+// checkRule reports why rule, lowercased and trimmed, isn't a domain,
+// *.domain or IP address with an optional :port, and so could never match
+// a host
+func checkRule(rule string) error {
+	if net.ParseIP(rule) != nil {
+		return nil
+	}
+	switch {
+	case strings.Contains(rule, "://"):
+		return errors.New("rules are hosts, not URLs; remove the scheme and path")
+	case strings.ContainsAny(rule, " \t"):
+		return errors.New("contains whitespace")
+	case strings.Contains(rule, "/"):
+		return errors.New("rules are hosts; paths and CIDR ranges aren't supported")
+	}
+
+	host, port := splitRulePort(rule)
+	if port == 0 && strings.Contains(rule, ":") {
+		return errors.New("port must be a number from 1 to 65535, and an IPv6 address with a port bracketed as [::1]:8443")
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if len(host) > 253 {
+		return errors.New("longer than 253 characters")
+	}
+	wildcardOnly := true
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			return errors.New("empty label (leading, trailing or doubled dot)")
+		}
+		if label == "*" {
+			continue
+		}
+		wildcardOnly = false
+		if strings.Contains(label, "*") {
+			return fmt.Errorf("label %q mixes * with other characters; * stands for whole labels", label)
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("label %q is longer than 63 characters", label)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("label %q starts or ends with a hyphen", label)
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return fmt.Errorf("label %q contains %q", label, c)
+			}
+		}
+	}
+	if wildcardOnly {
+		return errors.New("needs a label other than *")
+	}
+	return nil
+}
+
+// infixLabels returns the labels of rule, without any port, if it has a *
+// other than a leading "*.", or nil otherwise. Such a rule is matched
+// label by label, each * standing for one or more whole labels: so
+// metrics.*.vendor.com matches metrics.eu.vendor.com and
+// metrics.eu.west.vendor.com, but not metrics.vendor.com.
+func infixLabels(rule string) []string {
+	host, _ := splitRulePort(rule)
+	if !strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return nil
+	}
+	return strings.Split(host, ".")
+}
+
+// matchLabels reports whether the labels of a host match those of an
+// infix wildcard rule
+func matchLabels(pattern, host []string) bool {
+	if len(pattern) == 0 {
+		return len(host) == 0
+	}
+	if pattern[0] != "*" {
+		return len(host) > 0 && pattern[0] == host[0] && matchLabels(pattern[1:], host[1:])
+	}
+	// The rest of the pattern needs at least one host label per label
+	for n := 1; n <= len(host)-(len(pattern)-1); n++ {
+		if matchLabels(pattern[1:], host[n:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitRulePort splits a rule into its host pattern and port, 0 if it has
+// none or it isn't valid. An IPv6 address with a port is bracketed, as in
+// [::1]:8443.
+func splitRulePort(rule string) (string, int) {
+	if net.ParseIP(rule) != nil {
+		return rule, 0
+	}
+	host, portStr, err := net.SplitHostPort(rule)
+	if err != nil {
+		return rule, 0
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return rule, 0
+	}
+	return host, port
+}
+
+// rulesFor returns the map rule belongs in: IPs or domains
+func (f *Filter) rulesFor(rule string) map[string]ruleSource {
+	if host, _ := splitRulePort(rule); net.ParseIP(host) != nil {
+		return f.blockedIPs
+	}
+	return f.blockedDomains
+}
+
+// Loaded reports whether rules have been loaded successfully
+func (f *Filter) Loaded() bool {
+	return f.loaded.Load()
+}
+
+// IsBlocked checks if a hostname or IP is blocked on port. Rules in
+// log_only and max_bytes categories don't block; see Match.
+func (f *Filter) IsBlocked(host string, port int) (bool, string) {
+	match, ok := f.Match(host, port)
+	if !ok || !match.Blocks() {
+		return false, ""
+	}
+	return true, match.Rule
+}
+
+// Match finds the rule host matches: in blocked_domains_file or the runtime
+// rules first, then in each category in order. A category that blocks wins
+// over a log_only or max_bytes one listed before it, and a max_bytes one
+// over a log_only one. Rules without a port match every port; those with
+// one only match port, so none do when it is 0.
+func (f *Filter) Match(host string, port int) (FilterMatch, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	// Canonicalize hostname
+	host = strings.ToLower(strings.TrimSpace(host))
+	now := time.Now()
+
+	if f.blockAll.Load() {
+		return FilterMatch{Rule: "filter_failure_policy=closed", Action: actionBlock}, true
+	}
+	if rule, ok := matchRules(f.blockedDomains, f.blockedIPs, host, port, now); ok {
+		return FilterMatch{Rule: rule, Action: actionBlock}, true
+	}
+
+	var logged FilterMatch
+	found := false
+	for _, set := range f.categories {
+		rule, ok := matchRules(set.domains, set.ips, host, port, now)
+		if !ok {
+			continue
+		}
+		match := FilterMatch{Rule: rule, Category: set.Name, Action: set.Action, MaxBytes: set.MaxBytes, page: set.page}
+		if match.Blocks() {
+			return match, true
+		}
+		if !found || (logged.MaxBytes == 0 && match.MaxBytes > 0) {
+			logged, found = match, true
+		}
+	}
+	return logged, found
+}
+
+// matchRules returns the rule in domains or ips that host matches on port,
+// counting the hit. An exact rule wins over a *.suffix one, which wins over
+// an infix wildcard one; a rule for the port wins over one for the same
+// host without one.
+func matchRules(domains, ips map[string]ruleSource, host string, port int, now time.Time) (string, bool) {
+	keys := []string{host}
+	if port != 0 {
+		keys = []string{net.JoinHostPort(host, strconv.Itoa(port)), host}
+	}
+	for _, key := range keys {
+		// Check exact domain match
+		if source, ok := domains[key]; ok && !source.expired(now) {
+			source.hits.record(now)
+			return key, true
+		}
+
+		// Check IP match
+		if source, ok := ips[key]; ok && !source.expired(now) {
+			source.hits.record(now)
+			return key, true
+		}
+	}
+
+	// Check suffix matching (e.g., *.example.com or *.example.com:8080)
+	for domain, source := range domains {
+		if strings.HasPrefix(domain, "*.") && source.labels == nil && !source.expired(now) {
+			pattern, rulePort := splitRulePort(domain)
+			if rulePort != 0 && rulePort != port {
+				continue
+			}
+			suffix := pattern[2:] // Remove "*."
+			if strings.HasSuffix(host, "."+suffix) || host == suffix {
+				source.hits.record(now)
+				return domain, true
+			}
+		}
+	}
+
+	// Check infix wildcard matching (e.g., metrics.*.vendor.com)
+	var hostLabels []string
+	for domain, source := range domains {
+		if source.labels == nil || source.expired(now) {
+			continue
+		}
+		if _, rulePort := splitRulePort(domain); rulePort != 0 && rulePort != port {
+			continue
+		}
+		if hostLabels == nil {
+			hostLabels = strings.Split(host, ".")
+		}
+		if matchLabels(source.labels, hostLabels) {
+			source.hits.record(now)
+			return domain, true
+		}
+	}
+
+	return "", false
+}
+
+// RuleSource returns the file and line a rule returned by IsBlocked was
+// loaded from; ok is false for runtime rules
+func (f *Filter) RuleSource(rule string) (file string, line int, ok bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	source, ok := f.blockedDomains[rule]
+	if !ok {
+		source, ok = f.blockedIPs[rule]
+	}
+	for _, set := range f.categories {
+		if !ok {
+			source, ok = set.domains[rule]
+		}
+		if !ok {
+			source, ok = set.ips[rule]
+		}
+	}
+	return source.file, source.line, ok && source.file != ""
+}
+
+// GetBlockedCount returns the number of domain and IP rules, including
+// those in categories
+func (f *Filter) GetBlockedCount() (int, int) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	domains, ips := len(f.blockedDomains), len(f.blockedIPs)
+	for _, set := range f.categories {
+		domains += len(set.domains)
+		ips += len(set.ips)
+	}
+	return domains, ips
+}
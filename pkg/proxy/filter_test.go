@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// filterConfig returns a configuration whose rules file blocks
+// blocked.example, under policy
+func filterConfig(t *testing.T, policy string) *Config {
+	t.Helper()
+	config := testConfig(t)
+	config.FilterFailurePolicy = policy
+	if err := os.WriteFile(config.BlockedDomainsFile, []byte("blocked.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// breakRulesFile makes loading config's rules file fail: by removing it,
+// or by putting a directory in its place, which can't be read
+func breakRulesFile(t *testing.T, config *Config, missing bool) {
+	t.Helper()
+	if err := os.Remove(config.BlockedDomainsFile); err != nil {
+		t.Fatal(err)
+	}
+	if !missing {
+		if err := os.Mkdir(config.BlockedDomainsFile, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFilterFirstLoadFailure(t *testing.T) {
+	tests := []struct {
+		policy      string
+		missing     bool
+		startup     bool
+		wantErr     bool
+		wantBlocked bool // an unlisted host is blocked
+	}{
+		// Under open, a missing file loads no rules and other failures
+		// are errors
+		{"open", true, true, false, false},
+		{"open", false, true, true, false},
+		// Under closed, any failure stops the proxy starting; at runtime,
+		// with no rules ever loaded, everything is blocked
+		{"closed", true, true, true, false},
+		{"closed", false, true, true, false},
+		{"closed", true, false, false, true},
+		{"closed", false, false, false, true},
+	}
+	for _, tt := range tests {
+		config := filterConfig(t, tt.policy)
+		breakRulesFile(t, config, tt.missing)
+		f := NewFilter(nil)
+		err := f.LoadConfigured(config, tt.startup)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s, missing=%t, startup=%t: LoadConfigured returned %v", tt.policy, tt.missing, tt.startup, err)
+		}
+		if f.Healthy() {
+			t.Errorf("%s, missing=%t, startup=%t: filter reports healthy after a failed load", tt.policy, tt.missing, tt.startup)
+		}
+		if blocked, _ := f.IsBlocked("allowed.example", 80); blocked != tt.wantBlocked {
+			t.Errorf("%s, missing=%t, startup=%t: unlisted host blocked=%t, want %t", tt.policy, tt.missing, tt.startup, blocked, tt.wantBlocked)
+		}
+	}
+}
+
+func TestFilterReloadFailure(t *testing.T) {
+	tests := []struct {
+		policy   string
+		missing  bool
+		wantErr  bool
+		wantKept bool // blocked.example is still blocked
+	}{
+		// Under open, a missing file drops the rules; a file that can't be
+		// read is an error that leaves them alone
+		{"open", true, false, false},
+		{"open", false, true, true},
+		// Under closed, the previous rules are kept either way
+		{"closed", true, false, true},
+		{"closed", false, false, true},
+	}
+	for _, tt := range tests {
+		config := filterConfig(t, tt.policy)
+		f := NewFilter(nil)
+		if err := f.LoadConfigured(config, true); err != nil || !f.Healthy() {
+			t.Fatalf("first load failed: %v", err)
+		}
+
+		breakRulesFile(t, config, tt.missing)
+		err := f.LoadConfigured(config, false)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s, missing=%t: reload returned %v", tt.policy, tt.missing, err)
+		}
+		if f.Healthy() {
+			t.Errorf("%s, missing=%t: filter reports healthy after a failed reload", tt.policy, tt.missing)
+		}
+		if blocked, _ := f.IsBlocked("blocked.example", 80); blocked != tt.wantKept {
+			t.Errorf("%s, missing=%t: blocked.example blocked=%t, want %t", tt.policy, tt.missing, blocked, tt.wantKept)
+		}
+		if blocked, _ := f.IsBlocked("allowed.example", 80); blocked {
+			t.Errorf("%s, missing=%t: unlisted host blocked after a failed reload", tt.policy, tt.missing)
+		}
+
+		// Fixing the file and reloading recovers
+		os.Remove(config.BlockedDomainsFile)
+		os.WriteFile(config.BlockedDomainsFile, []byte("blocked.example\n"), 0644)
+		if err := f.LoadConfigured(config, false); err != nil || !f.Healthy() {
+			t.Errorf("%s, missing=%t: reload of the fixed file returned %v", tt.policy, tt.missing, err)
+		}
+	}
+}
+
+func TestFilterClosedRefusesToStart(t *testing.T) {
+	config := filterConfig(t, "closed")
+	breakRulesFile(t, config, true)
+	if _, err := NewServer(config); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("NewServer with a missing rules file under closed returned %v, want it refused", err)
+	}
+
+	config = filterConfig(t, "open")
+	breakRulesFile(t, config, true)
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer with a missing rules file under open returned %v", err)
+	}
+	defer s.Shutdown()
+	if s.Stats().FilterHealthy {
+		t.Error("stats report the filter healthy with its rules file missing")
+	}
+}
+
+// loadFilter returns a filter with rules loaded strictly from a file
+func loadFilter(t *testing.T, rules ...string) *Filter {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "blocked.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(rules, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := NewFilter(nil)
+	if _, err := f.LoadRules(path, true); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFilterPortRules(t *testing.T) {
+	f := loadFilter(t,
+		"example.com:8443",
+		"*.wild.example:8080",
+		"exact.wild.example",
+		"*.any.example",
+		"api.any.example:9000",
+	)
+	tests := []struct {
+		host     string
+		port     int
+		wantRule string // "" if the host isn't blocked
+	}{
+		// A rule with a port matches only that port
+		{"example.com", 8443, "example.com:8443"},
+		{"example.com", 443, ""},
+		{"example.com", 0, ""},
+		// So does a wildcard one, for the domain and its subdomains
+		{"a.wild.example", 8080, "*.wild.example:8080"},
+		{"a.b.wild.example", 8080, "*.wild.example:8080"},
+		{"wild.example", 8080, "*.wild.example:8080"},
+		{"a.wild.example", 80, ""},
+		{"notwild.example", 8080, ""},
+		// An exact rule without a port wins over a wildcard with one
+		{"exact.wild.example", 8080, "exact.wild.example"},
+		{"exact.wild.example", 80, "exact.wild.example"},
+		// A wildcard without a port matches every port, and an exact rule
+		// for the port wins over it
+		{"web.any.example", 443, "*.any.example"},
+		{"api.any.example", 9000, "api.any.example:9000"},
+		{"api.any.example", 443, "*.any.example"},
+	}
+	for _, tt := range tests {
+		blocked, rule := f.IsBlocked(tt.host, tt.port)
+		if blocked != (tt.wantRule != "") || rule != tt.wantRule {
+			t.Errorf("IsBlocked(%q, %d) = %t, %q; want rule %q", tt.host, tt.port, blocked, rule, tt.wantRule)
+		}
+	}
+}
+
+// TestBlockRulePortRequests checks that plain HTTP requests and CONNECTs
+// are blocked by a wildcard rule for one port, and not on another, and
+// that the log names the rule with its port
+func TestBlockRulePortRequests(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "ok") })
+	blockedOrigin := httptest.NewServer(handler)
+	defer blockedOrigin.Close()
+	allowedOrigin := httptest.NewServer(handler)
+	defer allowedOrigin.Close()
+	localPort := func(origin *httptest.Server) string {
+		_, port, _ := strings.Cut(hostOf(origin.URL), ":")
+		return port
+	}
+	blockedPort, allowedPort := localPort(blockedOrigin), localPort(allowedOrigin)
+	rule := "*.localhost:" + blockedPort
+
+	config := testConfig(t)
+	config.EnableConnectTunnel = true
+	if err := os.WriteFile(config.BlockedDomainsFile, []byte(rule+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, addr := startServer(t, config)
+
+	for port, want := range map[string]int{blockedPort: http.StatusForbidden, allowedPort: http.StatusOK} {
+		if resp := proxyGet(t, dialProxy(t, addr), "http://localhost:"+port+"/", 5*time.Second); resp.StatusCode != want {
+			t.Errorf("GET to localhost:%s got %d, want %d", port, resp.StatusCode, want)
+		}
+
+		conn := dialProxy(t, addr)
+		fmt.Fprintf(conn, "CONNECT localhost:%s HTTP/1.1\r\nHost: localhost:%s\r\n\r\n", port, port)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		status, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading CONNECT response: %v", err)
+		}
+		if !strings.HasPrefix(status, "HTTP/1.1 "+strconv.Itoa(want)+" ") {
+			t.Errorf("CONNECT to localhost:%s got %q, want %d", port, status, want)
+		}
+		conn.Close()
+	}
+
+	waitFor(t, func() bool { return s.Stats().TotalRequests == 4 })
+	s.Shutdown()
+	log, err := os.ReadFile(config.LogFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(log), " [BLOCKED: "+rule+"]"); n != 2 {
+		t.Errorf("log names the rule %q on %d lines, want 2:\n%s", rule, n, log)
+	}
+}
+
+func TestFilterInfixWildcards(t *testing.T) {
+	f := loadFilter(t,
+		"metrics.*.vendor.com",
+		"*.cdn.*.net",
+		"edge.*.*.example",
+		"exact.metrics.eu.vendor.com",
+		"*.eu.vendor.com",
+	)
+	tests := []struct {
+		host     string
+		wantRule string // "" if the host isn't blocked
+	}{
+		// A * stands for one or more whole labels
+		{"metrics.us.vendor.com", "metrics.*.vendor.com"},
+		{"metrics.us.west.vendor.com", "metrics.*.vendor.com"},
+		{"metrics.vendor.com", ""},
+		{"xmetrics.us.vendor.com", ""},
+		{"metrics.us.vendor.com.evil", ""},
+		{"metrics.us.notvendor.com", ""},
+		{"a.b.metrics.us.vendor.com", ""},
+		// Never part of a label
+		{"metricsus.vendor.com", ""},
+		{"metrics.usvendor.com", ""},
+		// Leading and infix together, and one label per *
+		{"img.cdn.eu.net", "*.cdn.*.net"},
+		{"a.b.cdn.eu.west.net", "*.cdn.*.net"},
+		{"cdn.eu.net", ""},
+		{"edge.a.b.example", "edge.*.*.example"},
+		{"edge.a.b.c.example", "edge.*.*.example"},
+		{"edge.a.example", ""},
+		// An exact rule wins over a suffix wildcard, which wins over an
+		// infix one
+		{"exact.metrics.eu.vendor.com", "exact.metrics.eu.vendor.com"},
+		{"metrics.eu.vendor.com", "*.eu.vendor.com"},
+	}
+	for _, tt := range tests {
+		blocked, rule := f.IsBlocked(tt.host, 443)
+		if blocked != (tt.wantRule != "") || rule != tt.wantRule {
+			t.Errorf("IsBlocked(%q) = %t, %q; want rule %q", tt.host, blocked, rule, tt.wantRule)
+		}
+	}
+}
+
+func TestFilterRejectsPartialLabelWildcards(t *testing.T) {
+	for _, rule := range []string{"ad*.com", "metrics.*vendor.com", "*ads.example", "a.b*c.example", "*.*"} {
+		path := filepath.Join(t.TempDir(), "blocked.txt")
+		if err := os.WriteFile(path, []byte(rule+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f := NewFilter(nil)
+		if _, err := f.LoadRules(path, true); err == nil {
+			t.Errorf("strict load of %q succeeded, want it rejected", rule)
+		}
+		report, err := f.LoadRules(path, false)
+		if err != nil || report.Accepted != 0 || len(report.Invalid) != 1 {
+			t.Errorf("load of %q accepted %v, want it skipped as invalid", rule, report)
+		}
+		if _, err := f.AddRule(rule, 0, "test"); err == nil {
+			t.Errorf("AddRule(%q) succeeded, want it rejected", rule)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import "net/url"
+
+// FilterEngine makes the blocking decisions for a Server. The built-in
+// *Filter, loaded from blocked_domains_file and blocklist_categories, is
+// one; WithFilterEngine supplies another, such as a client of a central
+// decision service.
+type FilterEngine interface {
+	// Decide returns the rule a destination matches, if any. path is the
+	// request's path and query, empty for CONNECT. The addresses a host
+	// name resolves to are checked too, as the host. The FilterMatch's
+	// Action decides what happens: "block" (or empty) answers 403,
+	// "log_only" lets the request through with the rule logged, and
+	// "max_bytes" cuts the response off after MaxBytes. Rule and Category
+	// are logged.
+	Decide(host string, port int, path string) (FilterMatch, bool)
+
+	// Reload re-reads the engine's rules; ReloadConfig calls it on SIGHUP
+	// and fails the reload if it returns an error
+	Reload() error
+
+	// Stats describes the rules for /stats and /readyz
+	Stats() FilterStats
+}
+
+// FilterStats describes a FilterEngine's rules
+type FilterStats struct {
+	Domains int  // domain rules
+	IPs     int  // IP and CIDR rules
+	Loaded  bool // rules are in place; /readyz fails until they are
+	Healthy bool // the last load succeeded
+}
+
+// NewFileFilter creates the built-in filter and loads the rules config
+// names, as NewServer does when no filter is supplied
+func NewFileFilter(config *Config, diag *DiagLogger) (*Filter, error) {
+	filter := NewFilter(diag)
+	if err := filter.LoadConfigured(config, true); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// Decide matches host against the rules; the built-in filter doesn't use
+// the path
+func (f *Filter) Decide(host string, port int, path string) (FilterMatch, bool) {
+	return f.Match(host, port)
+}
+
+// Reload re-reads the files of the configuration last given to
+// LoadConfigured, under its filter_failure_policy. A filter only loaded
+// with LoadRules has nothing to reload.
+func (f *Filter) Reload() error {
+	config := f.configured.Load()
+	if config == nil {
+		return nil
+	}
+	return f.LoadConfigured(config, false)
+}
+
+// Stats returns the rule counts, including those in categories
+func (f *Filter) Stats() FilterStats {
+	domains, ips := f.GetBlockedCount()
+	return FilterStats{Domains: domains, IPs: ips, Loaded: f.Loaded(), Healthy: f.Healthy()}
+}
+
+// StaticFilter is a FilterEngine giving every destination the same answer:
+// with Block set each is refused with Rule logged, otherwise each is let
+// through. It stands in for a real engine in tests, or turns filtering off.
+type StaticFilter struct {
+	Block bool
+	Rule  string // logged for blocked requests; empty logs "static filter"
+}
+
+// Decide blocks every destination if Block is set
+func (sf *StaticFilter) Decide(host string, port int, path string) (FilterMatch, bool) {
+	if !sf.Block {
+		return FilterMatch{}, false
+	}
+	rule := sf.Rule
+	if rule == "" {
+		rule = "static filter"
+	}
+	return FilterMatch{Rule: rule, Action: actionBlock}, true
+}
+
+// Reload does nothing, as there are no rules to read
+func (sf *StaticFilter) Reload() error {
+	return nil
+}
+
+// Stats reports no rules, always loaded
+func (sf *StaticFilter) Stats() FilterStats {
+	return FilterStats{Loaded: true, Healthy: true}
+}
+
+// requestPath returns the path and query of a request target in absolute
+// or origin form
+func requestPath(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return u.RequestURI()
+}
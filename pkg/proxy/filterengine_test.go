@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingEngine is a FilterEngine that logs, without blocking, every
+// destination it is asked about, and counts its reloads
+type recordingEngine struct {
+	mu        sync.Mutex
+	decisions []string
+	reloads   int
+	reloadErr error
+}
+
+func (e *recordingEngine) Decide(host string, port int, path string) (FilterMatch, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.decisions = append(e.decisions, fmt.Sprintf("%s:%d%s", host, port, path))
+	return FilterMatch{Rule: "recorded", Category: "audit", Action: actionLogOnly}, true
+}
+
+func (e *recordingEngine) Reload() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reloads++
+	return e.reloadErr
+}
+
+func (e *recordingEngine) Stats() FilterStats {
+	return FilterStats{Domains: 7, IPs: 3, Loaded: true, Healthy: true}
+}
+
+// engineRequests sends a GET for url and a CONNECT to its host through the
+// proxy at addr, returning their statuses
+func engineRequests(t *testing.T, addr, url string) (get, connect int) {
+	t.Helper()
+	get = proxyGet(t, dialProxy(t, addr), url, 5*time.Second).StatusCode
+
+	conn := dialProxy(t, addr)
+	target := hostOf(url)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading CONNECT response: %v", err)
+	}
+	if _, err := fmt.Sscanf(status, "HTTP/1.1 %d", &connect); err != nil {
+		t.Fatalf("CONNECT response %q: %v", status, err)
+	}
+	conn.Close()
+	return get, connect
+}
+
+func TestStaticFilterEngine(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		name   string
+		engine *StaticFilter
+		want   int
+		logged string
+	}{
+		{"deny all", &StaticFilter{Block: true, Rule: "deny all"}, http.StatusForbidden, " [BLOCKED: deny all]"},
+		{"deny all unnamed", &StaticFilter{Block: true}, http.StatusForbidden, " [BLOCKED: static filter]"},
+		// The rules file blocks the origin, but isn't loaded with an engine
+		// supplied
+		{"allow all", &StaticFilter{}, http.StatusOK, "ALLOWED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t)
+			config.EnableConnectTunnel = true
+			if err := os.WriteFile(config.BlockedDomainsFile, []byte("127.0.0.1\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s, addr := startServer(t, config, WithFilterEngine(tt.engine))
+			if s.filter != nil {
+				t.Error("server kept a built-in filter beside the supplied engine")
+			}
+
+			get, connect := engineRequests(t, addr, origin.URL+"/")
+			if get != tt.want || connect != tt.want {
+				t.Errorf("GET got %d and CONNECT %d, want %d", get, connect, tt.want)
+			}
+			if stats := s.Stats(); !stats.FilterHealthy || stats.FilterDomains != 0 {
+				t.Errorf("stats report the filter healthy=%t with %d domains, want the engine's", stats.FilterHealthy, stats.FilterDomains)
+			}
+
+			waitFor(t, func() bool { return s.Stats().TotalRequests == 2 })
+			s.Shutdown()
+			log, err := os.ReadFile(config.LogFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := strings.Count(string(log), tt.logged); n != 2 {
+				t.Errorf("%q on %d log lines, want 2:\n%s", tt.logged, n, log)
+			}
+		})
+	}
+}
+
+func TestFilterEngineDecisions(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	config, _, err := LoadConfigFile(writeReloadConfig(t, dir, "unused.example", ""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.EnableConnectTunnel = true
+	engine := &recordingEngine{}
+	s, addr := startServer(t, config, WithFilterEngine(engine))
+
+	// A log_only answer lets requests through, with the rule logged
+	get, connect := engineRequests(t, addr, origin.URL+"/page?q=1")
+	if get != http.StatusOK || connect != http.StatusOK {
+		t.Errorf("GET got %d and CONNECT %d, want both let through", get, connect)
+	}
+	target := hostOf(origin.URL)
+	engine.mu.Lock()
+	decisions := strings.Join(engine.decisions, " ")
+	engine.mu.Unlock()
+	if want := target + "/page?q=1 " + target; decisions != want {
+		t.Errorf("engine asked about %q, want %q", decisions, want)
+	}
+	if stats := s.Stats(); stats.FilterDomains != 7 || stats.FilterIPs != 3 {
+		t.Errorf("stats report %d domains and %d IPs, want the engine's 7 and 3", stats.FilterDomains, stats.FilterIPs)
+	}
+
+	// A reload reloads the engine, and fails if it does
+	if err := s.ReloadConfig(); err != nil || engine.reloads != 1 {
+		t.Errorf("ReloadConfig returned %v with %d engine reloads, want 1", err, engine.reloads)
+	}
+	engine.reloadErr = errors.New("decision service unavailable")
+	if err := s.ReloadConfig(); !errors.Is(err, engine.reloadErr) {
+		t.Errorf("ReloadConfig with the engine failing returned %v", err)
+	}
+
+	waitFor(t, func() bool { return s.Stats().TotalRequests == 2 })
+	s.Shutdown()
+	log, err := os.ReadFile(filepath.Join(dir, "access.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(log), " [MATCHED: recorded]"); n != 2 {
+		t.Errorf("matched rule on %d log lines, want 2:\n%s", n, log)
+	}
+}
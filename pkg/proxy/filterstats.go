@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ruleHits counts the requests a rule has blocked. It is updated under the
+// filter's read lock, so lookups never contend for the write lock.
+type ruleHits struct {
+	count   atomic.Int64
+	lastHit atomic.Int64 // unix nanoseconds; 0 if never hit
+}
+
+func (h *ruleHits) record(now time.Time) {
+	h.count.Add(1)
+	h.lastHit.Store(now.UnixNano())
+}
+
+// RuleStat is a rule's hit count, as returned by RuleStats
+type RuleStat struct {
+	Rule     string     `json:"rule"`
+	Category string     `json:"category,omitempty"`
+	Source   string     `json:"source"` // "file" or "runtime"
+	Hits     int64      `json:"hits"`
+	LastHit  *time.Time `json:"last_hit,omitempty"`
+}
+
+// RuleStats returns how often each rule, including those in categories, has
+// matched, most hits first, rules never hit last. Counts survive reloads
+// for rules still in the file.
+func (f *Filter) RuleStats() []RuleStat {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	now := time.Now()
+	var stats []RuleStat
+	add := func(rules map[string]ruleSource, category string) {
+		for rule, source := range rules {
+			if source.expired(now) {
+				continue
+			}
+			stat := RuleStat{Rule: rule, Category: category, Source: "file", Hits: source.hits.count.Load()}
+			if source.file == "" {
+				stat.Source = "runtime"
+			}
+			if last := source.hits.lastHit.Load(); last != 0 {
+				lastHit := time.Unix(0, last)
+				stat.LastHit = &lastHit
+			}
+			stats = append(stats, stat)
+		}
+	}
+	add(f.blockedDomains, "")
+	add(f.blockedIPs, "")
+	for _, set := range f.categories {
+		add(set.domains, set.Name)
+		add(set.ips, set.Name)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Hits != stats[j].Hits {
+			return stats[i].Hits > stats[j].Hits
+		}
+		return stats[i].Rule < stats[j].Rule
+	})
+	if stats == nil {
+		stats = []RuleStat{}
+	}
+	return stats
+}
+
+// WriteRuleStats writes RuleStats to path as JSON
+func (f *Filter) WriteRuleStats(path string) error {
+	data, err := json.MarshalIndent(f.RuleStats(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write filter stats: %w", err)
+	}
+	return nil
+}
+
+// handleFilterStats serves /filter/stats: the rule hit counts as JSON, the
+// top N only with ?top=N
+func (s *Server) handleFilterStats(w http.ResponseWriter, r *http.Request) {
+	if !s.hasBuiltinFilter(w) {
+		return
+	}
+	stats := s.filter.RuleStats()
+	if value := r.URL.Query().Get("top"); value != "" {
+		top, err := strconv.Atoi(value)
+		if err != nil || top < 0 {
+			http.Error(w, fmt.Sprintf("invalid top %q", value), http.StatusBadRequest)
+			return
+		}
+		stats = stats[:min(top, len(stats))]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
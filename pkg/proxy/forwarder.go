@@ -0,0 +1,741 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errResponseHeaderTimeout fails a request whose upstream took longer than
+// upstream_response_header_timeout to start responding
+var errResponseHeaderTimeout = errors.New("no response head within upstream_response_header_timeout")
+
+// errMaxBytes stops a response body at the max_bytes of its category
+var errMaxBytes = errors.New("response body exceeds max_bytes")
+
+// TruncatedError reports a response cut off at the max_bytes of the
+// blocklist category its host matched, after its head had been relayed
+type TruncatedError struct {
+	Match FilterMatch
+	Bytes int64 // body bytes relayed
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("response body cut off at %d bytes by max_bytes of category %s (rule %s)", e.Bytes, e.Match.Category, e.Match.Rule)
+}
+
+// ClientAbortError reports a response or tunnel cut short because the
+// client's side of the connection failed, typically a cancelled download,
+// rather than the upstream
+type ClientAbortError struct {
+	Err error
+}
+
+func (e *ClientAbortError) Error() string {
+	return "client connection failed: " + e.Err.Error()
+}
+
+func (e *ClientAbortError) Unwrap() error {
+	return e.Err
+}
+
+// clientAbortReader marks a failed read from the client as a client abort
+type clientAbortReader struct {
+	r io.Reader
+}
+
+func (c clientAbortReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &ClientAbortError{Err: err}
+	}
+	return n, err
+}
+
+// clientAbortWriter marks a failed write to the client as a client abort
+type clientAbortWriter struct {
+	w io.Writer
+}
+
+func (c clientAbortWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		err = &ClientAbortError{Err: err}
+	}
+	return n, err
+}
+
+// Forwarder handles forwarding requests to upstream servers
+type Forwarder struct {
+	config   atomic.Pointer[Config]
+	rules    atomic.Pointer[HeaderRules]
+	routes   atomic.Pointer[RoutingRules]
+	roots    atomic.Pointer[x509.CertPool]
+	parents  *ParentHealth
+	balancer *AddrBalancer
+	limiter  *UpstreamLimiter
+	diag     *DiagLogger
+
+	// checkAddr vets each address a host name resolves to before it is
+	// dialed; see SetAddrCheck
+	checkAddr func(req *HTTPRequest, ip net.IP) (rule string, blocked bool)
+
+	// onResponse may change the headers of a response before they are
+	// relayed; see SetResponseHook
+	onResponse func(req *HTTPRequest, statusCode int, headers []string) []string
+
+	// resolver and dialAddr look up and connect to direct destinations;
+	// see SetResolver and SetDialer
+	resolver Resolver
+	dialAddr func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error)
+}
+
+// Resolver looks up the addresses of a host name, as *net.Resolver does
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// dialTCP connects to address, giving up after timeout if it isn't 0
+func dialTCP(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// NewForwarder creates a new forwarder instance
+func NewForwarder(config *Config, diag *DiagLogger) *Forwarder {
+	f := &Forwarder{
+		parents:  NewParentHealth(diag),
+		balancer: NewAddrBalancer(),
+		limiter:  NewUpstreamLimiter(),
+		diag:     diag,
+		resolver: net.DefaultResolver,
+		dialAddr: dialTCP,
+	}
+	f.config.Store(config)
+	f.rules.Store(&HeaderRules{})
+	f.routes.Store(&RoutingRules{defaultRoute: Route{Kind: routeDirect}})
+	return f
+}
+
+// SetConfig replaces the configuration used for new requests
+func (f *Forwarder) SetConfig(config *Config) {
+	f.config.Store(config)
+}
+
+// SetHeaderRules replaces the header rules used for new requests
+func (f *Forwarder) SetHeaderRules(rules *HeaderRules) {
+	f.rules.Store(rules)
+}
+
+// SetAddrCheck sets the check applied to the addresses a destination's
+// name resolves to. Only addresses it passes are dialed, and they are
+// dialed as the literal that was checked, so a second lookup can't swap in
+// another.
+func (f *Forwarder) SetAddrCheck(check func(req *HTTPRequest, ip net.IP) (rule string, blocked bool)) {
+	f.checkAddr = check
+}
+
+// SetResponseHook sets a function given the headers of each response,
+// after the header rules, returning the headers to relay
+func (f *Forwarder) SetResponseHook(hook func(req *HTTPRequest, statusCode int, headers []string) []string) {
+	f.onResponse = hook
+}
+
+// SetResolver sets the resolver direct destinations are looked up with,
+// net.DefaultResolver unless set
+func (f *Forwarder) SetResolver(resolver Resolver) {
+	f.resolver = resolver
+}
+
+// SetDialer sets the function direct destinations are connected with. It
+// is given the address as an IP literal and port, or for a destination
+// given as an IP, the destination itself.
+func (f *Forwarder) SetDialer(dial func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error)) {
+	f.dialAddr = dial
+}
+
+// SetRoutingRules replaces the routing rules used for new requests
+func (f *Forwarder) SetRoutingRules(routes *RoutingRules) {
+	f.routes.Store(routes)
+	f.parents.SetParents(routes.Parents())
+}
+
+// dial connects to req's destination, within max_connections_per_upstream:
+// the connection holds one of the destination's slots until it is closed.
+// See dialRoute.
+func (f *Forwarder) dial(ctx context.Context, req *HTTPRequest, config *Config, tunnel bool) (net.Conn, Route, error) {
+	release, err := f.limiter.Acquire(ctx, net.JoinHostPort(req.Host, strconv.Itoa(req.Port)), config)
+	if err != nil {
+		return nil, Route{}, err
+	}
+	conn, route, err := f.dialRoute(ctx, req, config, tunnel)
+	if err != nil {
+		release()
+		return nil, route, err
+	}
+	return &limitedConn{Conn: conn, release: release}, route, nil
+}
+
+// dialRoute connects to req's destination over the route its host maps to,
+// recording the route used in req.Route. A route's parents are tried in
+// order, skipping those marked down. If none can be used the dial fails,
+// unless fallback_direct (or failover_direct, when every parent is marked
+// down) allows connecting directly instead. Cancelling ctx abandons the
+// dial.
+func (f *Forwarder) dialRoute(ctx context.Context, req *HTTPRequest, config *Config, tunnel bool) (net.Conn, Route, error) {
+	upstreamAddr := net.JoinHostPort(req.Host, strconv.Itoa(req.Port))
+	route := f.routes.Load().Match(req.Host)
+	if m := req.RuleMatch; m != nil && m.Route != nil {
+		route = *m.Route
+	}
+
+	var err error
+	if route.Kind != routeDirect {
+		req.Trace.begin(phaseConnect)
+		for _, parent := range route.Addrs {
+			if !f.parents.Up(parent) {
+				continue
+			}
+			var conn net.Conn
+			conn, err = dialParent(ctx, route.Kind, parent, upstreamAddr, config.UpstreamConnectTimeout, tunnel)
+			if ctx.Err() != nil {
+				return nil, route, err
+			}
+			if err == nil {
+				f.parents.ReportSuccess(parent)
+				used := Route{Kind: route.Kind, Addrs: []string{parent}}
+				req.Route = used.String()
+				return conn, used, nil
+			}
+			f.parents.ReportFailure(parent, err, config.ParentFailThreshold)
+		}
+
+		fallback := config.FallbackDirect
+		if err == nil {
+			err = fmt.Errorf("route %s: all parents are down", route)
+			fallback = fallback || config.FailoverDirect
+		}
+		if !fallback {
+			req.Route = route.String()
+			f.diag.Warnf("Upstream dial to %s failed: %v", upstreamAddr, err)
+			return nil, route, err
+		}
+		f.diag.Warnf("Upstream dial to %s failed, falling back to DIRECT: %v", upstreamAddr, err)
+		route = Route{Kind: routeDirect}
+	}
+
+	req.Route = routeDirect
+	conn, err := f.dialDirect(ctx, req, config)
+	if err != nil {
+		f.diag.Warnf("Upstream dial to %s failed: %v", upstreamAddr, err)
+		return nil, route, err
+	}
+	return conn, route, nil
+}
+
+// DialTunnel connects to the destination of a CONNECT request over its
+// route; the connection reaches the destination itself even through a
+// parent proxy
+func (f *Forwarder) DialTunnel(ctx context.Context, req *HTTPRequest) (net.Conn, error) {
+	conn, _, err := f.dial(ctx, req, f.config.Load(), true)
+	return conn, err
+}
+
+// ForwardRequest forwards an HTTP request to the upstream server.
+// Cancelling ctx stops the exchange wherever it is.
+func (f *Forwarder) ForwardRequest(ctx context.Context, req *HTTPRequest, clientConn net.Conn) (int, int64, int64, error) {
+	config := f.config.Load()
+
+	// Connect to upstream server
+	upstreamConn, route, err := f.dial(ctx, req, config, false)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to connect to upstream: %w", err)
+	}
+
+	// An https:// target is spoken to over TLS, unless a parent proxy is
+	// forwarding the request and does that itself
+	if strings.HasPrefix(req.RequestTarget, "https://") && route.Kind != routeProxy {
+		upstreamConn, err = f.handshakeUpstream(ctx, req, upstreamConn, config)
+		if err != nil {
+			f.diag.Warnf("Request %s: %v", req.ID, err)
+			return 0, 0, 0, err
+		}
+	}
+	defer upstreamConn.Close()
+
+	return f.forward(ctx, req, clientConn, upstreamConn, route.Kind == routeProxy)
+}
+
+// ForwardRequestTo forwards an HTTP request over an established upstream
+// connection; the caller closes upstreamConn
+func (f *Forwarder) ForwardRequestTo(ctx context.Context, req *HTTPRequest, clientConn net.Conn, upstreamConn net.Conn) (int, int64, int64, error) {
+	return f.forward(ctx, req, clientConn, upstreamConn, false)
+}
+
+// forward sends req over upstreamConn and relays the response; toParent
+// sends it in the absolute form a parent proxy expects. Cancelling ctx
+// closes upstreamConn and times out writes to the client, so blocked reads
+// and writes on either side return.
+func (f *Forwarder) forward(ctx context.Context, req *HTTPRequest, clientConn net.Conn, upstreamConn net.Conn, toParent bool) (int, int64, int64, error) {
+	config := f.config.Load()
+	rules := f.rules.Load()
+
+	stop := context.AfterFunc(ctx, func() {
+		upstreamConn.Close()
+		clientConn.SetWriteDeadline(time.Now())
+	})
+	defer stop()
+
+	// Set timeouts; the deadline is pushed back as data flows
+	f.extendDeadline(upstreamConn, config)
+
+	// Serialize and send request. Each upstream connection carries one
+	// request, so the origin is asked to close it after the response.
+	rules.ApplyRequest(req, GetClientIP(clientConn))
+	applyAnonymity(config, req)
+	keepAlive := clientKeepsAlive(req)
+	req.Headers["connection"] = "close"
+	requestBytes := req.SerializeRequest()
+	if toParent {
+		requestBytes = req.SerializeProxyRequest()
+	}
+	sent := time.Now()
+	req.Trace.begin(phaseWrite)
+	bytesUpstream, err := f.writeAll(upstreamConn, requestBytes)
+	if err != nil {
+		return 0, bytesUpstream, 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	req.Trace.begin(phaseWait)
+
+	// The body is streamed while the response is read. The response head
+	// is timed from the end of the request, which for a body is when the
+	// upload finishes.
+	f.extendDeadline(upstreamConn, config)
+	head := &headDeadline{conn: upstreamConn, timeout: config.UpstreamResponseHeaderTimeout, sent: sent}
+	var body *upload
+	if req.Body != nil {
+		body = f.startUpload(req, clientConn, upstreamConn, config, head.start)
+	} else {
+		head.start()
+	}
+
+	// Read response from upstream
+	statusCode, bytesDownstream, err := f.forwardResponse(ctx, req, upstreamConn, clientConn, config, rules, keepAlive, head)
+
+	if body != nil {
+		sent, complete, uploadErr := body.finish()
+		bytesUpstream += sent
+		// The rest of an unfinished body is still on its way from the client
+		if !complete {
+			req.Persistent = false
+		}
+		// A failed upload explains a failed response; after a response
+		// it only means the origin didn't want the rest
+		if err != nil && uploadErr != nil {
+			return statusCode, bytesUpstream, bytesDownstream, uploadErr
+		}
+		if uploadErr != nil {
+			f.diag.Debugf("Request %s: upload stopped after the response: %v", req.ID, uploadErr)
+		}
+	}
+	if err != nil {
+		return statusCode, bytesUpstream, bytesDownstream, fmt.Errorf("failed to forward response: %w", err)
+	}
+
+	return statusCode, bytesUpstream, bytesDownstream, nil
+}
+
+// forwardResponse reads response from upstream and forwards to client.
+// keepAlive says the client would reuse the connection; req.Persistent is
+// set if the response leaves it usable, see frameResponse.
+func (f *Forwarder) forwardResponse(ctx context.Context, req *HTTPRequest, upstreamConn net.Conn, clientConn net.Conn, config *Config, rules *HeaderRules, keepAlive bool, head *headDeadline) (int, int64, error) {
+	reader := bufio.NewReader(upstreamConn)
+
+	// Read status line
+	statusLine, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read status line: %w", head.wrap(err))
+	}
+
+	// Parse status code; the response goes to the client as HTTP/1.1, the
+	// proxy's own version
+	parts := strings.SplitN(strings.TrimSpace(statusLine), " ", 3)
+	statusCode, statusText := 0, ""
+	if len(parts) >= 2 {
+		if code, err := strconv.Atoi(parts[1]); err == nil {
+			statusCode = code
+		}
+	}
+	if len(parts) == 3 {
+		statusText = parts[2]
+	}
+	if strings.HasPrefix(parts[0], "HTTP/1.") {
+		statusLine = "HTTP/1.1" + strings.TrimPrefix(statusLine, parts[0])
+	}
+
+	// Read headers, apply the response rules, then forward them
+	var headers []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return statusCode, 0, fmt.Errorf("failed to read headers: %w", head.wrap(err))
+		}
+
+		// Check for end of headers
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		headers = append(headers, line)
+	}
+	// From here on, upstream_io_timeout applies to the body
+	head.received()
+	req.UpstreamTTFB = time.Since(head.sent)
+	req.Trace.begin(phaseTransfer)
+	f.extendDeadline(upstreamConn, config)
+
+	// A download named in Content-Disposition is refused before anything
+	// is relayed
+	if err := checkResponseFileName(config, headers); err != nil {
+		return statusCode, 0, err
+	}
+
+	headers = rules.ApplyResponse(headers, req, GetClientIP(clientConn))
+	if f.onResponse != nil {
+		headers = f.onResponse(req, statusCode, headers)
+	}
+	length, persistent, headers := frameResponse(req, statusCode, headers, keepAlive)
+	// The cache is given a copy of the response, unless a fault damages it
+	capture := req.CacheCapture
+	if req.Fault != nil || statusCode/100 == 1 {
+		capture = nil
+	}
+	if capture != nil {
+		capture.response(statusText, headers, length)
+	}
+	if req.Trace.Verbose && config.TimingDebugResponseHeader {
+		headers = append(headers, "X-Proxy-Timing: "+req.Trace.header())
+	}
+
+	// A known length is relayed exactly, so a slow origin close doesn't
+	// hold up a pipelined request; otherwise up to EOF
+	var body io.Reader = reader
+	if length >= 0 {
+		body = io.LimitReader(reader, length)
+	}
+
+	// A body to scan is held back until the scanner has passed it
+	if statusCode/100 != 1 && length != 0 && length <= config.ScanMaxBytes && wantsScan(config, req, headers) {
+		scanned, err := f.scanResponse(ctx, req, statusLine, headers, body, upstreamConn, config)
+		if err != nil {
+			return statusCode, 0, err
+		}
+		body = io.MultiReader(bytes.NewReader(scanned), body)
+	}
+
+	// Injected body faults apply before anything below sees the body
+	if fault := req.Fault; fault != nil && statusCode/100 != 1 {
+		body = fault.wrapBody(body)
+	}
+
+	// A recording gets a copy of what the client is sent
+	rec := req.Recording
+	if rec != nil && statusCode/100 != 1 {
+		rec.response(statusLine, headers)
+		body = io.TeeReader(body, rec)
+	}
+	if capture != nil {
+		body = io.TeeReader(body, capture)
+	}
+
+	var block strings.Builder
+	block.WriteString(statusLine)
+	for _, line := range headers {
+		block.WriteString(line + "\r\n")
+	}
+	block.WriteString("\r\n")
+	bytesWritten, err := f.writeAll(clientConn, []byte(block.String()))
+	if err != nil {
+		return statusCode, bytesWritten, &ClientAbortError{Err: err}
+	}
+
+	// Stream body
+	var maxBytes int64
+	if req.FilterMatch != nil {
+		maxBytes = req.FilterMatch.MaxBytes
+	}
+	bodyBytes, err := f.streamBody(body, upstreamConn, clientConn, config, maxBytes)
+	bytesWritten += bodyBytes
+	if err == errMaxBytes {
+		return statusCode, bytesWritten, &TruncatedError{Match: *req.FilterMatch, Bytes: bodyBytes}
+	}
+	if err != nil && err != io.EOF {
+		return statusCode, bytesWritten, err
+	}
+
+	// A short body leaves the client waiting for the rest
+	complete := length < 0 || bodyBytes == length
+	req.Persistent = persistent && complete
+	if rec != nil {
+		rec.complete = complete
+	}
+	return statusCode, bytesWritten, nil
+}
+
+// clientKeepsAlive reports whether the client would reuse its connection
+// after the response to req
+func clientKeepsAlive(req *HTTPRequest) bool {
+	if req.Version != "HTTP/1.1" {
+		return false
+	}
+	for _, name := range []string{"connection", "proxy-connection"} {
+		if headerHasToken(req.Headers[name], "close") {
+			return false
+		}
+	}
+	return true
+}
+
+// frameResponse decides how the client finds the end of a response. One
+// with no body, a Content-Length or chunked encoding is self-delimiting and
+// leaves the connection usable for a pipelined request (persistent) if the
+// client allows that; any other response ends when the connection closes,
+// which it then announces with Connection: close. The origin's Connection
+// and Keep-Alive headers are hop-by-hop and replaced: its Connection: close
+// only answers the one the proxy sent it.
+// length is the number of body bytes to relay, or -1 to relay until EOF.
+func frameResponse(req *HTTPRequest, statusCode int, headers []string, keepAlive bool) (length int64, persistent bool, out []string) {
+	// An interim response is relayed with whatever follows it, as before
+	if statusCode/100 == 1 {
+		return -1, false, headers
+	}
+
+	length = -1
+	chunked := false
+	out = make([]string, 0, len(headers)+1)
+	for _, line := range headers {
+		name, value, _ := strings.Cut(line, ":")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "content-length":
+			if n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil && n >= 0 {
+				length = n
+			}
+		case "transfer-encoding":
+			chunked = headerHasToken(value, "chunked")
+		case "connection", "keep-alive":
+			continue
+		}
+		out = append(out, line)
+	}
+
+	noBody := req.Method == "HEAD" || statusCode == 204 || statusCode == 304
+	switch {
+	case noBody:
+		length = 0
+	case chunked:
+		length = -1
+	}
+	framed := noBody || chunked || length >= 0
+
+	persistent = framed && keepAlive
+	if !persistent {
+		out = append(out, "Connection: close")
+	}
+	return length, persistent, out
+}
+
+// headerHasToken reports whether a comma-separated header value contains
+// token, ignoring case
+func headerHasToken(value, token string) bool {
+	for _, item := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(item), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamBody streams the response body from upstream to client. A body
+// longer than maxBytes, if not 0, is stopped at that many bytes with
+// errMaxBytes. A failed write to the client is a ClientAbortError.
+func (f *Forwarder) streamBody(reader io.Reader, upstreamConn net.Conn, clientConn net.Conn, config *Config, maxBytes int64) (int64, error) {
+	var totalBytes int64
+	buffer := make([]byte, config.ReadBufferSize)
+
+	for {
+		f.extendDeadline(upstreamConn, config)
+		n, err := reader.Read(buffer)
+		if maxBytes > 0 && totalBytes+int64(n) > maxBytes {
+			written, _ := f.writeAll(clientConn, buffer[:maxBytes-totalBytes])
+			return totalBytes + written, errMaxBytes
+		}
+		if n > 0 {
+			written, writeErr := f.writeAll(clientConn, buffer[:n])
+			totalBytes += written
+			if writeErr != nil {
+				return totalBytes, &ClientAbortError{Err: writeErr}
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return totalBytes, nil
+			}
+			return totalBytes, err
+		}
+	}
+}
+
+// extendDeadline pushes the upstream deadline upstream_io_timeout into the
+// future, so the timeout applies to idle periods rather than the whole
+// transfer; zero means no timeout
+func (f *Forwarder) extendDeadline(conn net.Conn, config *Config) {
+	if config.UpstreamIOTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.UpstreamIOTimeout))
+	}
+}
+
+// headDeadline times the arrival of a response head against
+// upstream_response_header_timeout, once started
+type headDeadline struct {
+	conn    net.Conn
+	timeout time.Duration
+	sent    time.Time // when the request went out, for the upstream TTFB
+
+	mu      sync.Mutex
+	started bool
+	arrived bool
+}
+
+// start sets the read deadline for the response head, unless it has
+// already arrived or there is no timeout
+func (h *headDeadline) start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.timeout > 0 && !h.arrived {
+		h.started = true
+		h.conn.SetReadDeadline(time.Now().Add(h.timeout))
+	}
+}
+
+// received records that the response head has arrived
+func (h *headDeadline) received() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.arrived = true
+}
+
+// wrap marks a read timeout as errResponseHeaderTimeout if the head's
+// deadline was the one that expired
+func (h *headDeadline) wrap(err error) error {
+	h.mu.Lock()
+	started := h.started
+	h.mu.Unlock()
+
+	var netErr net.Error
+	if started && errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w (%s): %w", errResponseHeaderTimeout, h.timeout, err)
+	}
+	return err
+}
+
+// writeAll writes all bytes, handling partial writes
+func (f *Forwarder) writeAll(conn net.Conn, data []byte) (int64, error) {
+	var totalWritten int64
+	for totalWritten < int64(len(data)) {
+		n, err := conn.Write(data[totalWritten:])
+		if err != nil {
+			return totalWritten, err
+		}
+		totalWritten += int64(n)
+	}
+	return totalWritten, nil
+}
+
+// HandleCONNECT handles CONNECT tunneling for HTTPS. clientReader holds
+// anything the client sent after the CONNECT request. If checkSNI is set,
+// the server name of a TLS ClientHello at the start of the tunnel is passed
+// to it, and the tunnel is torn down if it returns an error. Cancelling ctx
+// tears the tunnel down too; no 502 is sent for a cancelled dial.
+func (f *Forwarder) HandleCONNECT(ctx context.Context, req *HTTPRequest, clientConn net.Conn, clientReader *bufio.Reader, checkSNI func(string) error) error {
+	config := f.config.Load()
+
+	// Connect to upstream
+	upstreamConn, _, err := f.dial(ctx, req, config, true)
+	if err != nil {
+		if ctx.Err() == nil {
+			response := "HTTP/1.1 502 Bad Gateway\r\n"
+			var blockedErr *ResolvedAddrBlockedError
+			if errors.Is(err, errUpstreamLimit) {
+				response = "HTTP/1.1 503 Service Unavailable\r\n"
+			} else if errors.As(err, &blockedErr) {
+				response = "HTTP/1.1 403 Forbidden\r\n"
+			}
+			if config.ServerHeader {
+				response += "Server: " + Product() + "\r\n"
+			}
+			clientConn.Write([]byte(response + "\r\n"))
+		}
+		return fmt.Errorf("failed to connect to upstream: %w", err)
+	}
+	defer upstreamConn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		upstreamConn.Close()
+		clientConn.Close()
+	})
+	defer stop()
+
+	// Send success response
+	response := "HTTP/1.1 200 Connection Established\r\n\r\n"
+	if _, err := clientConn.Write([]byte(response)); err != nil {
+		return fmt.Errorf("failed to send CONNECT response: %w", err)
+	}
+	req.Trace.begin(phaseTransfer)
+
+	// Tunnels may idle for long periods, so drop the request read deadline
+	clientConn.SetReadDeadline(time.Time{})
+
+	// Peek at the ClientHello without consuming it from the relay
+	if checkSNI != nil {
+		clientReader = bufio.NewReaderSize(clientReader, maxTLSRecord)
+		serverName := sniffSNI(clientConn, clientReader, config.SNISniffTimeout)
+		f.diag.Debugf("Request %s: CONNECT %s TLS server name %q", req.ID, req.Host, serverName)
+		if err := checkSNI(serverName); err != nil {
+			return err
+		}
+	}
+
+	// Bidirectional forwarding; errors on the client's side are client
+	// aborts
+	done := make(chan error, 2)
+
+	// Forward client -> upstream
+	go func() {
+		_, err := io.Copy(upstreamConn, clientAbortReader{clientReader})
+		done <- err
+	}()
+
+	// Forward upstream -> client
+	go func() {
+		_, err := io.Copy(clientAbortWriter{clientConn}, upstreamConn)
+		done <- err
+	}()
+
+	// Wait for one direction to close
+	err = <-done
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
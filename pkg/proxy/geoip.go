@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoCountryRecord is the part of a GeoIP2/GeoLite2 Country or City record,
+// or a DB-IP one, that is logged
+type geoCountryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// geoASNRecord is the part of a GeoLite2 ASN record that is logged
+type geoASNRecord struct {
+	Number uint `maxminddb:"autonomous_system_number"`
+}
+
+// GeoIP looks up the country and autonomous system of an address in the
+// MaxMind DB files at geoip_database and geoip_asn_database. Either may be
+// unset, in which case its lookups miss. The files are reopened on every
+// reload, so replacing them and sending SIGHUP picks up new data.
+type GeoIP struct {
+	mu      sync.RWMutex
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// NewGeoIP opens the configured databases
+func NewGeoIP(config *Config) (*GeoIP, error) {
+	g := &GeoIP{}
+	if err := g.Reconfigure(config); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reconfigure reopens the databases; on error the current ones are kept
+func (g *GeoIP) Reconfigure(config *Config) error {
+	country, asn, err := openGeoDBs(config)
+	if err != nil {
+		return err
+	}
+	g.swap(country, asn)
+	return nil
+}
+
+// openGeoDBs opens the configured databases, either of which may be nil
+func openGeoDBs(config *Config) (country, asn *maxminddb.Reader, err error) {
+	country, err = openGeoDB("geoip_database", config.GeoIPDatabase)
+	if err != nil {
+		return nil, nil, err
+	}
+	asn, err = openGeoDB("geoip_asn_database", config.GeoIPASNDatabase)
+	if err != nil {
+		closeGeoDBs(country, nil)
+		return nil, nil, err
+	}
+	return country, asn, nil
+}
+
+// closeGeoDBs closes databases opened by openGeoDBs
+func closeGeoDBs(country, asn *maxminddb.Reader) {
+	if country != nil {
+		country.Close()
+	}
+	if asn != nil {
+		asn.Close()
+	}
+}
+
+// swap puts databases opened by openGeoDBs in place of the current ones,
+// which are closed
+func (g *GeoIP) swap(country, asn *maxminddb.Reader) {
+	g.mu.Lock()
+	oldCountry, oldASN := g.country, g.asn
+	g.country, g.asn = country, asn
+	g.mu.Unlock()
+	closeGeoDBs(oldCountry, oldASN)
+}
+
+// openGeoDB opens the database at path, or returns nil when it is empty
+func openGeoDB(key, path string) (*maxminddb.Reader, error) {
+	if path == "" {
+		return nil, nil
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", key, err)
+	}
+	return db, nil
+}
+
+// Enabled reports whether either database is loaded
+func (g *GeoIP) Enabled() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.country != nil || g.asn != nil
+}
+
+// Lookup returns the ISO country code and AS number of ip, empty and 0
+// where a database isn't loaded or has no entry. ip must be an address;
+// names are never resolved here.
+func (g *GeoIP) Lookup(ip string) (country string, asn uint) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", 0
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.country != nil {
+		var record geoCountryRecord
+		if g.country.Lookup(addr, &record) == nil {
+			country = record.Country.ISOCode
+			if country == "" {
+				country = record.RegisteredCountry.ISOCode
+			}
+		}
+	}
+	if g.asn != nil {
+		var record geoASNRecord
+		if g.asn.Lookup(addr, &record) == nil {
+			asn = record.Number
+		}
+	}
+	return country, asn
+}
+
+// Close closes the databases
+func (g *GeoIP) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.country != nil {
+		g.country.Close()
+		g.country = nil
+	}
+	if g.asn != nil {
+		g.asn.Close()
+		g.asn = nil
+	}
+}
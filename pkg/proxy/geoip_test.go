@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mmdbNetwork is a network in a test database and the record stored for it
+type mmdbNetwork struct {
+	cidr   string
+	record map[string]any
+}
+
+// writeTestMMDB writes a tiny IPv4 MaxMind DB holding networks to a
+// temporary file, returning its path. Records may hold maps, strings and
+// unsigned integers.
+func writeTestMMDB(t *testing.T, networks []mmdbNetwork) string {
+	t.Helper()
+
+	// The search tree: each node has a record per bit value, which is
+	// another node, a record in the data section or nothing
+	type record struct {
+		node, data int // node index, or data offset + 1
+	}
+	nodes := [][2]record{{}}
+	var data bytes.Buffer
+	for _, network := range networks {
+		_, ipnet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := data.Len()
+		encodeMMDB(&data, network.record)
+
+		ones, _ := ipnet.Mask.Size()
+		ip := ipnet.IP.To4()
+		current := 0
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == ones-1 {
+				nodes[current][bit] = record{data: offset + 1}
+				break
+			}
+			if nodes[current][bit].node == 0 {
+				nodes = append(nodes, [2]record{})
+				nodes[current][bit] = record{node: len(nodes) - 1}
+			}
+			current = nodes[current][bit].node
+		}
+	}
+
+	// 24 bit records: a node index, the node count for nothing, or past it
+	// for data, which follows 16 bytes of separator
+	var db bytes.Buffer
+	for _, node := range nodes {
+		for _, r := range node {
+			value := len(nodes)
+			switch {
+			case r.data > 0:
+				value = len(nodes) + 16 + r.data - 1
+			case r.node > 0:
+				value = r.node
+			}
+			db.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	encodeMMDB(&db, map[string]any{
+		"binary_format_major_version": uint(2),
+		"binary_format_minor_version": uint(0),
+		"build_epoch":                 uint(1700000000),
+		"database_type":               "Test",
+		"description":                 map[string]any{"en": "test database"},
+		"ip_version":                  uint(4),
+		"languages":                   []string{"en"},
+		"node_count":                  uint(len(nodes)),
+		"record_size":                 uint(24),
+	})
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, db.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// encodeMMDB appends value to buf in the MaxMind DB data format
+func encodeMMDB(buf *bytes.Buffer, value any) {
+	control := func(kind, size int) {
+		if size >= 29 {
+			panic("encodeMMDB: value too large for a test database")
+		}
+		if kind <= 7 {
+			buf.WriteByte(byte(kind<<5 | size))
+		} else {
+			buf.Write([]byte{byte(size), byte(kind - 7)})
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case uint:
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(v))
+		control(6, 4)
+		buf.Write(b[:])
+	case []string:
+		control(11, len(v))
+		for _, s := range v {
+			encodeMMDB(buf, s)
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		control(7, len(keys))
+		for _, key := range keys {
+			encodeMMDB(buf, key)
+			encodeMMDB(buf, v[key])
+		}
+	default:
+		panic("encodeMMDB: unsupported type")
+	}
+}
+
+// testGeoDBs writes a country and an ASN database covering a few
+// documentation networks and loopback
+func testGeoDBs(t *testing.T) (country, asn string) {
+	t.Helper()
+	country = writeTestMMDB(t, []mmdbNetwork{
+		{"192.0.2.0/24", map[string]any{"country": map[string]any{"iso_code": "DE"}}},
+		{"198.51.100.0/24", map[string]any{"registered_country": map[string]any{"iso_code": "FR"}}},
+		{"127.0.0.0/8", map[string]any{"country": map[string]any{"iso_code": "ZZ"}}},
+	})
+	asn = writeTestMMDB(t, []mmdbNetwork{
+		{"192.0.2.0/25", map[string]any{"autonomous_system_number": uint(64500)}},
+		{"127.0.0.0/8", map[string]any{"autonomous_system_number": uint(64511)}},
+	})
+	return country, asn
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	config := DefaultConfig()
+	config.GeoIPDatabase, config.GeoIPASNDatabase = testGeoDBs(t)
+	g, err := NewGeoIP(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	tests := []struct {
+		ip      string
+		country string
+		asn     uint
+	}{
+		{"192.0.2.7", "DE", 64500},
+		{"192.0.2.200", "DE", 0},  // outside the ASN database's /25
+		{"198.51.100.1", "FR", 0}, // only a registered country
+		{"203.0.113.1", "", 0},    // in neither
+		{"2001:db8::1", "", 0},    // IPv6 in IPv4-only databases
+		{"example.com", "", 0},    // names aren't resolved
+		{"::ffff:192.0.2.7", "DE", 64500},
+	}
+	for _, tt := range tests {
+		country, asn := g.Lookup(tt.ip)
+		if country != tt.country || asn != tt.asn {
+			t.Errorf("Lookup(%q) = %q, %d; want %q, %d", tt.ip, country, asn, tt.country, tt.asn)
+		}
+	}
+
+	// Without databases every lookup misses
+	empty, err := NewGeoIP(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if country, asn := empty.Lookup("192.0.2.7"); country != "" || asn != 0 || empty.Enabled() {
+		t.Errorf("Lookup without databases = %q, %d", country, asn)
+	}
+}
+
+func TestLogGeoIPEnrichment(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+	country, asn := testGeoDBs(t)
+
+	tests := []struct {
+		name  string
+		setup func(config *Config)
+		held  int  // idle connections held open during the request
+		want  bool // the entry carries the origin's country and AS
+	}{
+		{"enriched", func(config *Config) { config.GeoIPDatabase, config.GeoIPASNDatabase = country, asn }, 0, true},
+		{"no databases", func(config *Config) {}, 0, false},
+		{"skipped under load", func(config *Config) {
+			config.GeoIPDatabase, config.GeoIPASNDatabase = country, asn
+			config.LogGeoIPMaxConnections = 1
+		}, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t)
+			tt.setup(config)
+			s, addr := startServer(t, config)
+			var held []net.Conn
+			for i := 0; i < tt.held; i++ {
+				held = append(held, dialProxy(t, addr))
+			}
+			waitFor(t, func() bool { return s.ActiveConnections() == int64(tt.held) })
+
+			if resp := proxyGet(t, dialProxy(t, addr), origin.URL+"/", 5*time.Second); resp.StatusCode != http.StatusOK {
+				t.Fatalf("request got %d", resp.StatusCode)
+			}
+			waitFor(t, func() bool { return s.Stats().TotalRequests == 1 })
+			for _, conn := range held {
+				conn.Close()
+			}
+			s.Shutdown()
+			log, err := os.ReadFile(config.LogFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, token := range []string{" [COUNTRY: ZZ]", " [ASN: AS64511]"} {
+				if got := strings.Contains(string(log), token); got != tt.want {
+					t.Errorf("log line has %q: %t, want %t:\n%s", token, got, tt.want, log)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// headerRule is one line of the header rules file
+type headerRule struct {
+	hostPattern string // empty matches every host
+	response    bool   // applies to responses rather than requests
+	action      string // set, add or remove
+	name        string // lowercase header name
+	value       string // may contain ${client_ip}, ${request_id} and ${host}
+}
+
+// HeaderRules holds ordered rules that add, replace or remove headers on
+// requests sent upstream and responses relayed to clients
+type HeaderRules struct {
+	rules []headerRule
+}
+
+// framingHeaders can't be touched by rules, since changing them would
+// corrupt message framing
+var framingHeaders = map[string]bool{
+	"content-length":    true,
+	"transfer-encoding": true,
+}
+
+// LoadHeaderRules loads header rules from a file, one per line:
+//
+//	[host-pattern] request|response set|add|remove Header-Name [value]
+//
+// An empty path loads no rules. Malformed rules, and rules for framing
+// headers, are errors.
+func LoadHeaderRules(path string) (*HeaderRules, error) {
+	hr := &HeaderRules{}
+	if path == "" {
+		return hr, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open header rules file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseHeaderRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		hr.rules = append(hr.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read header rules file: %w", err)
+	}
+
+	return hr, nil
+}
+
+// parseHeaderRule parses a single rule line
+func parseHeaderRule(line string) (headerRule, error) {
+	var rule headerRule
+
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] != "request" && fields[0] != "response" {
+		rule.hostPattern = strings.ToLower(fields[0])
+		fields = fields[1:]
+	}
+	if len(fields) < 3 {
+		return rule, fmt.Errorf("expected \"[host] request|response set|add|remove Name [value]\"")
+	}
+
+	rule.response = fields[0] == "response"
+	if fields[0] != "request" && !rule.response {
+		return rule, fmt.Errorf("unknown direction %q", fields[0])
+	}
+
+	rule.action = fields[1]
+	rule.name = strings.ToLower(fields[2])
+	if framingHeaders[rule.name] {
+		return rule, fmt.Errorf("rules may not change the %s header", fields[2])
+	}
+
+	// The value is the rest of the line, keeping its inner spacing
+	skip := 3
+	if rule.hostPattern != "" {
+		skip++
+	}
+	value := skipFields(line, skip)
+
+	switch rule.action {
+	case "set", "add":
+		if value == "" {
+			return rule, fmt.Errorf("%s needs a value", rule.action)
+		}
+		rule.value = value
+	case "remove":
+		if value != "" {
+			return rule, fmt.Errorf("remove takes no value")
+		}
+	default:
+		return rule, fmt.Errorf("unknown action %q", rule.action)
+	}
+
+	return rule, nil
+}
+
+// skipFields returns s without its first n whitespace-separated fields
+func skipFields(s string, n int) string {
+	for i := 0; i < n; i++ {
+		s = strings.TrimSpace(s)
+		idx := strings.IndexAny(s, " \t")
+		if idx < 0 {
+			return ""
+		}
+		s = s[idx:]
+	}
+	return strings.TrimSpace(s)
+}
+
+// matchesHost reports whether the rule applies to requests for host; a
+// *.example.com pattern matches example.com and its subdomains
+func (r headerRule) matchesHost(host string) bool {
+	if r.hostPattern == "" {
+		return true
+	}
+	host = strings.ToLower(host)
+	if strings.HasPrefix(r.hostPattern, "*.") {
+		suffix := r.hostPattern[2:]
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}
+	return host == r.hostPattern
+}
+
+// expandHeaderValue substitutes request details into a rule value
+func expandHeaderValue(value string, req *HTTPRequest, clientIP string) string {
+	return strings.NewReplacer(
+		"${client_ip}", clientIP,
+		"${request_id}", req.ID,
+		"${host}", req.Host,
+	).Replace(value)
+}
+
+// ApplyRequest applies the request rules to req's headers
+func (hr *HeaderRules) ApplyRequest(req *HTTPRequest, clientIP string) {
+	for _, rule := range hr.rules {
+		if rule.response || !rule.matchesHost(req.Host) {
+			continue
+		}
+		switch rule.action {
+		case "set":
+			req.Headers[rule.name] = expandHeaderValue(rule.value, req, clientIP)
+		case "add":
+			value := expandHeaderValue(rule.value, req, clientIP)
+			if existing, ok := req.Headers[rule.name]; ok {
+				value = existing + ", " + value
+			}
+			req.Headers[rule.name] = value
+		case "remove":
+			delete(req.Headers, rule.name)
+		}
+	}
+}
+
+// ApplyResponse applies the response rules for req to raw "Name: value"
+// response header lines, returning the rewritten lines
+func (hr *HeaderRules) ApplyResponse(lines []string, req *HTTPRequest, clientIP string) []string {
+	for _, rule := range hr.rules {
+		if !rule.response || !rule.matchesHost(req.Host) {
+			continue
+		}
+		if rule.action == "set" || rule.action == "remove" {
+			kept := lines[:0]
+			for _, line := range lines {
+				name, _, _ := strings.Cut(line, ":")
+				if strings.ToLower(strings.TrimSpace(name)) != rule.name {
+					kept = append(kept, line)
+				}
+			}
+			lines = kept
+		}
+		if rule.action == "set" || rule.action == "add" {
+			lines = append(lines, capitalizeHeader(rule.name)+": "+expandHeaderValue(rule.value, req, clientIP))
+		}
+	}
+	return lines
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RequestHook decides on a request, and may change it before it goes on.
+// A nil result, or one with no Status, lets the request through to the
+// next hook; any other result answers the request and stops it.
+type RequestHook func(req *HTTPRequest, conn ConnInfo) *HookResult
+
+// ResponseHook may change the head of an upstream response before it is
+// relayed to the client
+type ResponseHook func(req *HTTPRequest, resp *ResponseMeta)
+
+// ConnInfo describes the client connection a request arrived on
+type ConnInfo struct {
+	ClientIP   string   // as logged, before log_anonymize_ips
+	RemoteAddr net.Addr // the client's address and port
+	Listener   string   // label of the listener, empty if it has none
+	TLS        bool     // the client connected over TLS
+}
+
+// HookResult is a RequestHook's answer to a request it stops
+type HookResult struct {
+	Status      int      // status to answer with; 0 lets the request through
+	Body        string   // response body; empty uses the error page for Status
+	ContentType string   // type of Body; empty is text/plain
+	Headers     []string // extra "Name: value" header lines
+	Reason      string   // why, for the access log
+}
+
+// ResponseMeta is the head of an upstream response. Hooks may change the
+// headers, which are "Name: value" lines; the framing headers
+// (Content-Length, Transfer-Encoding and Connection) are set by the proxy
+// afterwards and changes to them are not relayed.
+type ResponseMeta struct {
+	StatusCode int
+	Headers    []string
+}
+
+// Get returns the first value of the header name, or ""
+func (m *ResponseMeta) Get(name string) string {
+	for _, line := range m.Headers {
+		key, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(strings.TrimSpace(key), name) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// Add adds a header line
+func (m *ResponseMeta) Add(name, value string) {
+	m.Headers = append(m.Headers, name+": "+value)
+}
+
+// Set replaces every value of the header name with value
+func (m *ResponseMeta) Set(name, value string) {
+	m.Del(name)
+	m.Add(name, value)
+}
+
+// Del removes every value of the header name
+func (m *ResponseMeta) Del(name string) {
+	kept := m.Headers[:0]
+	for _, line := range m.Headers {
+		key, _, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(strings.TrimSpace(key), name) {
+			kept = append(kept, line)
+		}
+	}
+	m.Headers = kept
+}
+
+// hookChains holds the hooks registered on a Server. It is replaced whole
+// on registration, so requests in flight keep the hooks they started with.
+type hookChains struct {
+	request  []RequestHook
+	connect  []RequestHook
+	response []ResponseHook
+}
+
+// addHook registers a hook through add, which appends it to a copy of the
+// registered hooks
+func (s *Server) addHook(add func(chains *hookChains)) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	current := s.loadHooks()
+	chains := hookChains{
+		request:  append([]RequestHook(nil), current.request...),
+		connect:  append([]RequestHook(nil), current.connect...),
+		response: append([]ResponseHook(nil), current.response...),
+	}
+	add(&chains)
+	s.hooks.Store(&chains)
+}
+
+// loadHooks returns the registered hooks
+func (s *Server) loadHooks() *hookChains {
+	if chains := s.hooks.Load(); chains != nil {
+		return chains
+	}
+	return &hookChains{}
+}
+
+// OnRequest registers a hook run for each request other than CONNECT,
+// including those decrypted from mitm_domains tunnels. Request hooks run in
+// registration order after authentication, policies and auth_hook_url, so
+// req.Username is set, and before the filter, SafeSearch, the extension and
+// upload checks, the cache and forwarding. Changes a hook makes to req,
+// such as its headers (whose keys are lowercase) or its destination, are
+// seen by the hooks after it and by those later stages; the filter checks
+// the destination as changed. The first hook to return a Status answers
+// the request and no later hook runs. A hook that panics is logged and the
+// request answered with 500.
+func (s *Server) OnRequest(hook RequestHook) {
+	s.addHook(func(c *hookChains) { c.request = append(c.request, hook) })
+}
+
+// OnConnect registers a hook run for each CONNECT request once the tunnel
+// is allowed by enable_connect_tunnel, in registration order and before
+// the filter, with the same semantics as OnRequest. Requests decrypted from
+// an intercepted tunnel then go through the OnRequest hooks.
+func (s *Server) OnConnect(hook RequestHook) {
+	s.addHook(func(c *hookChains) { c.connect = append(c.connect, hook) })
+}
+
+// OnResponse registers a hook run on the head of each upstream response,
+// in registration order, after response_header rules and before the head
+// is relayed. Interim (1xx) responses and responses from the cache don't
+// go through the hooks. A hook that panics is logged and the response
+// relayed without its changes.
+func (s *Server) OnResponse(hook ResponseHook) {
+	s.addHook(func(c *hookChains) { c.response = append(c.response, hook) })
+}
+
+// connInfo describes conn for the hooks and the Authenticator
+func connInfo(conn net.Conn) ConnInfo {
+	info := ConnInfo{ClientIP: GetClientIP(conn), RemoteAddr: conn.RemoteAddr(), Listener: listenerLabel(conn)}
+	if lc := clientConn(conn); lc != nil {
+		_, info.TLS = lc.Conn.(*tls.Conn)
+	}
+	return info
+}
+
+// runRequestHooks runs hooks on req, answering and logging it if one stops
+// it, and reports whether one did
+func (s *Server) runRequestHooks(conn net.Conn, req *HTTPRequest, hooks []RequestHook) bool {
+	if len(hooks) == 0 {
+		return false
+	}
+	info := connInfo(conn)
+	for i, hook := range hooks {
+		result := s.callRequestHook(hook, i, req, info)
+		if result == nil || result.Status == 0 {
+			continue
+		}
+
+		reason := result.Reason
+		if reason == "" {
+			reason = "request hook"
+		}
+		message := http.StatusText(result.Status)
+		if result.Body == "" {
+			s.sendErrorResponseHeaders(conn, req, result.Status, message, result.Headers)
+		} else {
+			contentType := result.ContentType
+			if contentType == "" {
+				contentType = "text/plain; charset=utf-8"
+			}
+			s.writeResponse(conn, req, result.Status, message, contentType, []byte(result.Body), result.Headers)
+		}
+		s.logRequest(conn, req, "HOOK_BLOCKED", result.Status, 0, 0, reason)
+		return true
+	}
+	return false
+}
+
+// callRequestHook calls the i'th request hook, turning a panic into a 500
+func (s *Server) callRequestHook(hook RequestHook, i int, req *HTTPRequest, info ConnInfo) (result *HookResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.diag.Errorf("Request %s: request hook %d panicked: %v", req.ID, i, r)
+			result = &HookResult{Status: 500, Reason: "request hook panicked"}
+		}
+	}()
+	return hook(req, info)
+}
+
+// runResponseHooks runs the response hooks on the head of req's response,
+// returning its headers as they leave it
+func (s *Server) runResponseHooks(req *HTTPRequest, statusCode int, headers []string) []string {
+	hooks := s.loadHooks().response
+	if len(hooks) == 0 || statusCode/100 == 1 {
+		return headers
+	}
+	meta := &ResponseMeta{StatusCode: statusCode, Headers: headers}
+	for i, hook := range hooks {
+		before := append([]string(nil), meta.Headers...)
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					s.diag.Errorf("Request %s: response hook %d panicked: %v", req.ID, i, r)
+					meta.Headers = before
+				}
+			}()
+			hook(req, meta)
+		}()
+	}
+	return meta.Headers
+}
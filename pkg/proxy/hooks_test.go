@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hookOrigin answers every request with its X-Hooked header, counting them
+func hookOrigin(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var hits atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("X-Secret", "internal")
+		io.WriteString(w, r.Header.Get("X-Hooked"))
+	}))
+	t.Cleanup(origin.Close)
+	return origin, &hits
+}
+
+// hookLog records the hooks that ran, in order
+type hookLog struct {
+	mu  sync.Mutex
+	ran []string
+}
+
+func (l *hookLog) record(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ran = append(l.ran, name)
+}
+
+func (l *hookLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.ran, ",")
+}
+
+func TestRequestHookShortCircuit(t *testing.T) {
+	origin, hits := hookOrigin(t)
+	tests := []struct {
+		name       string
+		stopAt     string // the hook that answers the request, if any
+		panicAt    string // the hook that panics, if any
+		wantRan    string
+		wantStatus int
+		wantBody   string
+	}{
+		// Every hook runs, in order, and the request goes on changed
+		{"all pass", "", "", "first,second,third", http.StatusOK, "first,second,third"},
+		// The first hook to answer stops the rest and the request
+		{"second answers", "second", "", "first,second", http.StatusUnavailableForLegalReasons, "stopped by second"},
+		{"first answers", "first", "", "first", http.StatusUnavailableForLegalReasons, "stopped by first"},
+		// A panic answers with 500 and stops the rest too
+		{"second panics", "", "second", "first,second", http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t)
+			s, addr := startServer(t, config)
+			ran := &hookLog{}
+			for _, name := range []string{"first", "second", "third"} {
+				name := name
+				s.OnRequest(func(req *HTTPRequest, conn ConnInfo) *HookResult {
+					ran.record(name)
+					if conn.ClientIP != "127.0.0.1" {
+						t.Errorf("hook %s got client IP %q", name, conn.ClientIP)
+					}
+					if name == tt.panicAt {
+						panic("hook failed")
+					}
+					if name == tt.stopAt {
+						return &HookResult{Status: http.StatusUnavailableForLegalReasons, Body: "stopped by " + name,
+							Headers: []string{"X-Stopped-By: " + name}, Reason: name + " said no"}
+					}
+					if hooked := req.Headers["x-hooked"]; hooked == "" {
+						req.Headers["x-hooked"] = name
+					} else {
+						req.Headers["x-hooked"] = hooked + "," + name
+					}
+					return nil
+				})
+			}
+			before := hits.Load()
+			resp := proxyGet(t, dialProxy(t, addr), origin.URL+"/", 5*time.Second)
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus || (tt.wantBody != "" && string(body) != tt.wantBody) {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, tt.wantStatus, tt.wantBody)
+			}
+			if got := ran.String(); got != tt.wantRan {
+				t.Errorf("hooks ran: %s, want %s", got, tt.wantRan)
+			}
+			forwarded := hits.Load() - before
+			if want := map[bool]int64{true: 1, false: 0}[tt.wantStatus == http.StatusOK]; forwarded != want {
+				t.Errorf("origin got %d requests, want %d", forwarded, want)
+			}
+			if tt.stopAt != "" && resp.Header.Get("X-Stopped-By") != tt.stopAt {
+				t.Errorf("answer has X-Stopped-By %q, want %q", resp.Header.Get("X-Stopped-By"), tt.stopAt)
+			}
+			waitFor(t, func() bool { return s.Stats().TotalRequests == 1 })
+			s.Shutdown()
+
+			log, err := os.ReadFile(config.LogFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.stopAt != "" && !strings.Contains(string(log), tt.stopAt+" said no") {
+				t.Errorf("log doesn't give the hook's reason:\n%s", log)
+			}
+		})
+	}
+}
+
+func TestConnectHookShortCircuit(t *testing.T) {
+	origin, hits := hookOrigin(t)
+	config := testConfig(t)
+	config.EnableConnectTunnel = true
+	s, addr := startServer(t, config)
+	ran := &hookLog{}
+	s.OnConnect(func(req *HTTPRequest, conn ConnInfo) *HookResult {
+		ran.record("connect " + req.RequestTarget)
+		return &HookResult{Status: http.StatusForbidden, Reason: "no tunnels"}
+	})
+	s.OnConnect(func(req *HTTPRequest, conn ConnInfo) *HookResult {
+		ran.record("second")
+		return nil
+	})
+	s.OnRequest(func(req *HTTPRequest, conn ConnInfo) *HookResult {
+		ran.record("request")
+		return nil
+	})
+
+	target := hostOf(origin.URL)
+	conn := dialProxy(t, addr)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading CONNECT response: %v", err)
+	}
+	if !strings.HasPrefix(status, "HTTP/1.1 403 ") {
+		t.Errorf("CONNECT got %q, want 403", status)
+	}
+	if got, want := ran.String(), "connect "+target; got != want {
+		t.Errorf("hooks ran: %s, want %s", got, want)
+	}
+	if hits.Load() != 0 {
+		t.Error("origin reached through a tunnel the hook refused")
+	}
+}
+
+func TestResponseHooks(t *testing.T) {
+	origin, _ := hookOrigin(t)
+	s, addr := startServer(t, testConfig(t))
+	ran := &hookLog{}
+	s.OnResponse(func(req *HTTPRequest, resp *ResponseMeta) {
+		ran.record("first")
+		resp.Del("X-Secret")
+		resp.Add("X-Added", "first")
+	})
+	// A panic drops only the panicking hook's changes
+	s.OnResponse(func(req *HTTPRequest, resp *ResponseMeta) {
+		ran.record("second")
+		resp.Set("X-Added", "second")
+		panic("hook failed")
+	})
+	s.OnResponse(func(req *HTTPRequest, resp *ResponseMeta) {
+		ran.record("third")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("response hook got status %d", resp.StatusCode)
+		}
+		resp.Add("X-Third", resp.Get("X-Added"))
+	})
+
+	resp := proxyGet(t, dialProxy(t, addr), origin.URL+"/", 5*time.Second)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("request got %d", resp.StatusCode)
+	}
+	if got := ran.String(); got != "first,second,third" {
+		t.Errorf("hooks ran: %s, want first,second,third", got)
+	}
+	if got := resp.Header.Get("X-Secret"); got != "" {
+		t.Errorf("header removed by a hook relayed as %q", got)
+	}
+	if added, third := resp.Header.Values("X-Added"), resp.Header.Get("X-Third"); len(added) != 1 || added[0] != "first" || third != "first" {
+		t.Errorf("X-Added %q and X-Third %q, want only the first hook's value", added, third)
+	}
+}
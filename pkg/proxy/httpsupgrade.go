@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+)
+
+// https_upgrade_mode values
+const (
+	upgradeRedirect = "redirect"
+	upgradeRewrite  = "rewrite"
+)
+
+// matchesUpgradeDomain reports whether plain HTTP requests for host are
+// upgraded. Patterns are exact names or *.suffix, which also matches the
+// suffix itself.
+func matchesUpgradeDomain(domains []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range domains {
+		if domain == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// httpsLocation returns the https:// URL for an http:// request target,
+// on the default port and with the path and query exactly as sent
+func httpsLocation(target, host string) string {
+	rest := strings.TrimPrefix(target, "http://")
+	pathAndQuery := "/"
+	if i := strings.IndexAny(rest, "/?"); i >= 0 {
+		pathAndQuery = rest[i:]
+		if pathAndQuery[0] == '?' {
+			pathAndQuery = "/" + pathAndQuery
+		}
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + pathAndQuery
+}
+
+// applyHTTPSUpgrade upgrades a plain HTTP request for one of the
+// https_upgrade_domains: in redirect mode the client is sent a 308 to the
+// https:// URL, and in rewrite mode the proxy fetches it over TLS itself.
+// It reports whether the request was answered.
+func (s *Server) applyHTTPSUpgrade(conn net.Conn, req *HTTPRequest, config *Config) bool {
+	if len(config.HTTPSUpgradeDomains) == 0 || req.IsConnect || req.ReverseRoute != "" ||
+		!strings.HasPrefix(req.RequestTarget, "http://") || !matchesUpgradeDomain(config.HTTPSUpgradeDomains, req.Host) {
+		return false
+	}
+
+	location := httpsLocation(req.RequestTarget, req.Host)
+	req.HTTPSUpgrade = config.HTTPSUpgradeMode
+	s.diag.Debugf("Request %s: upgrading %s to %s (%s)", req.ID, req.RequestTarget, location, config.HTTPSUpgradeMode)
+
+	if config.HTTPSUpgradeMode == upgradeRedirect {
+		s.sendErrorResponseHeaders(conn, req, 308, "Permanent Redirect", []string{"Location: " + location})
+		s.logRequest(conn, req, "HTTPS_REDIRECT", 308, 0, 0, "")
+		return true
+	}
+
+	req.RequestTarget = location
+	retarget(req, req.Host, 443)
+	return false
+}
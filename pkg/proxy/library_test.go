@@ -0,0 +1,93 @@
+package proxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"custom-proxy/pkg/proxy"
+)
+
+// These tests use only the package's exported API, as an embedder would
+
+func TestEmbeddedServer(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+
+	config := proxy.DefaultConfig()
+	config.LogFilePath = filepath.Join(t.TempDir(), "access.log")
+	config.LogLevel = "error"
+
+	filter := proxy.NewFilter(nil)
+	if _, err := filter.AddRule("blocked.example", 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	cache := proxy.NewCache(100, 1<<20, nil)
+	logger, err := proxy.NewLogger(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := proxy.NewServer(config, proxy.WithFilter(filter), proxy.WithCache(cache), proxy.WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+	defer func() {
+		s.Shutdown()
+		<-served
+	}()
+
+	get := func(url string) (int, string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		host := strings.TrimPrefix(url, "http://")
+		host = strings.SplitN(host, "/", 2)[0]
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", url, host)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	for i := 0; i < 2; i++ {
+		if status, body := get(origin.URL + "/"); status != http.StatusOK || body != "hello" {
+			t.Fatalf("GET %d through the proxy got %d %q", i+1, status, body)
+		}
+		// The response is stored once the request has finished
+		for deadline := time.Now().Add(5 * time.Second); s.Stats().TotalRequests < int64(i+1); {
+			if time.Now().After(deadline) {
+				t.Fatal("request never finished")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if status, _ := get("http://blocked.example/"); status != http.StatusForbidden {
+		t.Errorf("request blocked by the supplied filter got %d, want 403", status)
+	}
+	if stats := cache.Stats(); stats.Hits != 1 {
+		t.Errorf("supplied cache counted %d hits, want the second GET served from it", stats.Hits)
+	}
+}
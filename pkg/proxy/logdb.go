@@ -0,0 +1,366 @@
+package proxy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// logDBQueueSize caps the entries waiting to be inserted; more are dropped,
+// so a slow disk can't hold up logging or grow memory
+const logDBQueueSize = 10000
+
+// logDBBatchSize is the most entries inserted in one transaction
+const logDBBatchSize = 500
+
+// logDBFlushInterval is how long a partial batch waits to be inserted
+const logDBFlushInterval = time.Second
+
+// logDBPruneInterval is how often entries past log_db_retention_days are
+// deleted
+const logDBPruneInterval = time.Hour
+
+// logDBSchema creates the access_log table. ts is the entry's time in Unix
+// milliseconds; headers holds the log_headers values as a JSON object.
+const logDBSchema = `
+CREATE TABLE IF NOT EXISTS access_log (
+	id INTEGER PRIMARY KEY,
+	ts INTEGER NOT NULL,
+	request_id TEXT,
+	listener TEXT,
+	client_ip TEXT,
+	client_port INTEGER,
+	destination_host TEXT,
+	destination_port INTEGER,
+	destination_ip TEXT,
+	method TEXT,
+	request_target TEXT,
+	action TEXT,
+	upstream_status INTEGER,
+	bytes_upstream INTEGER,
+	bytes_downstream INTEGER,
+	blocked_rule TEXT,
+	matched_rule TEXT,
+	category TEXT,
+	username TEXT,
+	policy TEXT,
+	route TEXT,
+	referer TEXT,
+	user_agent TEXT,
+	headers TEXT,
+	dest_country TEXT,
+	dest_asn INTEGER
+);
+CREATE INDEX IF NOT EXISTS access_log_ts ON access_log (ts);
+CREATE INDEX IF NOT EXISTS access_log_client_ip ON access_log (client_ip, ts);
+CREATE INDEX IF NOT EXISTS access_log_destination_host ON access_log (destination_host, ts);
+CREATE INDEX IF NOT EXISTS access_log_action ON access_log (action, ts);
+`
+
+// logDBInsert adds one entry, in the column order of logDBSchema
+const logDBInsert = `INSERT INTO access_log (ts, request_id, listener, client_ip, client_port,
+	destination_host, destination_port, destination_ip, method, request_target, action,
+	upstream_status, bytes_upstream, bytes_downstream, blocked_rule, matched_rule, category,
+	username, policy, route, referer, user_agent, headers, dest_country, dest_asn)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// logDBAddedColumns are columns added to access_log after it was first
+// released, which databases created before them lack
+var logDBAddedColumns = []string{"dest_country TEXT", "dest_asn INTEGER"}
+
+// LogDB writes access log entries to a SQLite database at log_db_path.
+// Entries are handed over without blocking and inserted by a background
+// goroutine, up to logDBBatchSize per transaction; entries past
+// log_db_retention_days are pruned every logDBPruneInterval. A nil LogDB
+// writes nothing.
+type LogDB struct {
+	db        *sql.DB
+	path      string
+	retention time.Duration
+	diag      *DiagLogger
+
+	entries chan LogEntry
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+
+	failed   atomic.Int64 // entries dropped for a full queue or a failed insert
+	lastWarn time.Time
+}
+
+// OpenLogDB opens or creates the database at log_db_path and starts
+// writing to it, returning nil when log_backend is file
+func OpenLogDB(config *Config, diag *DiagLogger) (*LogDB, error) {
+	if config.LogBackend == "file" {
+		return nil, nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+config.LogDBPath+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log_db_path: %w", err)
+	}
+	// One connection serializes the writer and pruning
+	db.SetMaxOpenConns(1)
+	if err := setupLogDB(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set up log_db_path %s: %w", config.LogDBPath, err)
+	}
+	ldb := &LogDB{
+		db:        db,
+		path:      config.LogDBPath,
+		retention: time.Duration(config.LogDBRetentionDays) * 24 * time.Hour,
+		diag:      diag,
+		entries:   make(chan LogEntry, logDBQueueSize),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go ldb.run()
+	return ldb, nil
+}
+
+// setupLogDB creates the access_log table, or adds the columns an older
+// one lacks
+func setupLogDB(db *sql.DB) error {
+	if _, err := db.Exec(logDBSchema); err != nil {
+		return err
+	}
+	for _, column := range logDBAddedColumns {
+		_, err := db.Exec("ALTER TABLE access_log ADD COLUMN " + column)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return err
+		}
+	}
+	return nil
+}
+
+// Insert queues entry for the database, dropping it if the queue is full
+func (ldb *LogDB) Insert(entry LogEntry) {
+	if ldb == nil {
+		return
+	}
+	select {
+	case ldb.entries <- entry:
+	default:
+		ldb.failed.Add(1)
+	}
+}
+
+// Close inserts the queued entries and closes the database
+func (ldb *LogDB) Close() {
+	if ldb == nil {
+		return
+	}
+	ldb.once.Do(func() {
+		close(ldb.stop)
+		<-ldb.stopped
+		ldb.db.Close()
+	})
+}
+
+// Failed returns the entries that were dropped or couldn't be inserted
+func (ldb *LogDB) Failed() int64 {
+	if ldb == nil {
+		return 0
+	}
+	return ldb.failed.Load()
+}
+
+// run inserts batches and prunes until Close
+func (ldb *LogDB) run() {
+	defer close(ldb.stopped)
+	ticker := time.NewTicker(logDBFlushInterval)
+	defer ticker.Stop()
+	lastPrune := time.Time{}
+
+	batch := make([]LogEntry, 0, logDBBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := ldb.insert(batch); err != nil {
+			ldb.failed.Add(int64(len(batch)))
+			ldb.warnf("Access log database %s can't be written, dropped %d entries: %v", ldb.path, len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case entry := <-ldb.entries:
+			if batch = append(batch, entry); len(batch) >= logDBBatchSize {
+				flush()
+			}
+		case now := <-ticker.C:
+			flush()
+			if ldb.retention > 0 && now.Sub(lastPrune) >= logDBPruneInterval {
+				lastPrune = now
+				ldb.prune(now)
+			}
+		case <-ldb.stop:
+			for {
+				select {
+				case entry := <-ldb.entries:
+					if batch = append(batch, entry); len(batch) >= logDBBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// insert writes entries in one transaction
+func (ldb *LogDB) insert(entries []LogEntry) error {
+	tx, err := ldb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(logDBInsert)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		var headers any
+		if len(e.Headers) > 0 {
+			data, _ := json.Marshal(e.Headers)
+			headers = string(data)
+		}
+		_, err := stmt.Exec(e.Timestamp.UnixMilli(), e.RequestID, e.Listener, e.ClientIP, e.ClientPort,
+			e.DestinationHost, e.DestinationPort, e.DestinationIP, e.Method, e.RequestTarget, e.Action,
+			e.UpstreamStatus, e.BytesUpstream, e.BytesDownstream, e.BlockedRule, e.MatchedRule, e.Category,
+			e.Username, e.Policy, e.Route, e.Referer, e.UserAgent, headers, nullString(e.DestCountry), nullInt(int64(e.DestASN)))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// nullString stores an empty string as NULL
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullInt stores 0 as NULL
+func nullInt(n int64) any {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// prune deletes the entries older than the retention
+func (ldb *LogDB) prune(now time.Time) {
+	res, err := ldb.db.Exec("DELETE FROM access_log WHERE ts < ?", now.Add(-ldb.retention).UnixMilli())
+	if err != nil {
+		ldb.warnf("Access log database %s can't be pruned: %v", ldb.path, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 && ldb.diag != nil {
+		ldb.diag.Debugf("Pruned %d access log entries older than %s from %s", n, ldb.retention, ldb.path)
+	}
+}
+
+// warnf reports a database problem at most every logWarnInterval
+func (ldb *LogDB) warnf(format string, args ...any) {
+	if ldb.diag == nil || time.Since(ldb.lastWarn) < logWarnInterval {
+		return
+	}
+	ldb.lastWarn = time.Now()
+	ldb.diag.Warnf(format, args...)
+}
+
+// LogReports names the canned reports of QueryLogDB
+var LogReports = []string{"top-hosts", "top-clients", "blocked"}
+
+// LogQuery selects the entries a report covers
+type LogQuery struct {
+	Report string
+	Since  time.Time // entries from this time on; zero for all
+	Client string    // client_ip to restrict the report to, as logged
+	Limit  int       // rows to return
+}
+
+// LogReport is the result of a report: a header row and the rows under it
+type LogReport struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// QueryLogDB runs one of the LogReports against the database at path,
+// opened read-only so it can run while the proxy writes to it
+func QueryLogDB(path string, q LogQuery) (*LogReport, error) {
+	var columns []string
+	var query string
+	switch q.Report {
+	case "top-hosts":
+		columns = []string{"HOST", "REQUESTS", "BYTES_DOWN"}
+		query = "SELECT destination_host, COUNT(*) AS n, SUM(bytes_downstream) FROM access_log WHERE %s GROUP BY destination_host ORDER BY n DESC, destination_host LIMIT ?"
+	case "top-clients":
+		columns = []string{"CLIENT", "REQUESTS", "BYTES_DOWN"}
+		query = "SELECT client_ip, COUNT(*) AS n, SUM(bytes_downstream) FROM access_log WHERE %s GROUP BY client_ip ORDER BY n DESC, client_ip LIMIT ?"
+	case "blocked":
+		columns = []string{"HOST", "RULE", "CATEGORY", "BLOCKED"}
+		query = "SELECT destination_host, COALESCE(blocked_rule, ''), COALESCE(category, ''), COUNT(*) AS n FROM access_log WHERE %s AND action LIKE '%%BLOCKED%%' GROUP BY destination_host, blocked_rule, category ORDER BY n DESC, destination_host LIMIT ?"
+	default:
+		return nil, fmt.Errorf("unknown report %q (want %s)", q.Report, strings.Join(LogReports, ", "))
+	}
+
+	where := []string{"1 = 1"}
+	var args []any
+	if !q.Since.IsZero() {
+		where = append(where, "ts >= ?")
+		args = append(args, q.Since.UnixMilli())
+	}
+	if q.Client != "" {
+		where = append(where, "client_ip = ?")
+		args = append(args, q.Client)
+	}
+	args = append(args, q.Limit)
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(fmt.Sprintf(query, strings.Join(where, " AND ")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &LogReport{Columns: columns}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]any, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(columns))
+		for i, v := range values {
+			row[i] = v.String
+			if row[i] == "" {
+				row[i] = "-"
+			}
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	return report, rows.Err()
+}
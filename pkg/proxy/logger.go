@@ -0,0 +1,571 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogEntry represents a single log entry
+type LogEntry struct {
+	Timestamp       time.Time         `json:"timestamp"`
+	RequestID       string            `json:"request_id,omitempty"`
+	Listener        string            `json:"listener,omitempty"` // Label of the accepting listener
+	ClientIP        string            `json:"client_ip"`
+	ClientPort      int               `json:"client_port"`
+	DestinationHost string            `json:"destination_host"`
+	DestinationPort int               `json:"destination_port"`
+	DestinationIP   string            `json:"destination_ip,omitempty"` // Address connected to, when the host is a name
+	Method          string            `json:"method"`
+	RequestTarget   string            `json:"request_target"`
+	Action          string            `json:"action"` // ALLOWED or BLOCKED
+	UpstreamStatus  int               `json:"upstream_status"`
+	BytesUpstream   int64             `json:"bytes_upstream"`
+	BytesDownstream int64             `json:"bytes_downstream"`
+	BlockedRule     string            `json:"blocked_rule,omitempty"`      // Rule that caused block, if any
+	MatchedRule     string            `json:"matched_rule,omitempty"`      // log_only category rule the request matched
+	Category        string            `json:"category,omitempty"`          // Blocklist category of the blocked or matched rule
+	Username        string            `json:"username,omitempty"`          // Authenticated proxy user, if any
+	Policy          string            `json:"policy,omitempty"`            // Policy applied to the user, if any
+	SafeSearch      string            `json:"safesearch,omitempty"`        // Search engine host rewritten to DestinationHost
+	Rewrite         string            `json:"rewrite,omitempty"`           // "original → rewritten" target, if a rewrite rule applied
+	HTTPSUpgrade    string            `json:"https_upgrade,omitempty"`     // redirect or rewrite, if the request was upgraded to HTTPS
+	Bandwidth       string            `json:"bandwidth_profile,omitempty"` // Bandwidth profile the connection was paced to, if any
+	Route           string            `json:"route,omitempty"`             // DIRECT or the parent proxy used
+	DestCountry     string            `json:"dest_country,omitempty"`      // ISO code of DestinationIP's country, from geoip_database
+	DestASN         uint              `json:"dest_asn,omitempty"`          // DestinationIP's AS number, from geoip_asn_database
+	Referer         string            `json:"referer"`
+	UserAgent       string            `json:"user_agent"`
+	Headers         map[string]string `json:"headers,omitempty"` // Extra headers selected by log_headers
+}
+
+// Intervals at which a failing log file is retried and the failure warned
+// about again
+const (
+	logRetryInterval = 10 * time.Second
+	logWarnInterval  = time.Minute
+)
+
+// Logger provides thread-safe logging. When the file can't be written, or
+// can't be reopened after rotation, entries are handled by the
+// log_failure_policy (see Log) and the file is reopened every
+// logRetryInterval until writes succeed again. With log_backend=sqlite
+// there is no file and entries only go to the database.
+type Logger struct {
+	file        *os.File // nil with log_backend=sqlite
+	backend     string
+	mu          sync.Mutex
+	maxSizeMB   int
+	currentSize int64
+	filePath    string
+	format      string
+	anonymizer  *IPAnonymizer
+	lastErr     error // most recent write error, cleared by a reopen
+	policy      string
+	fallback    io.Writer // where degraded entries go, standard error
+	diag        *DiagLogger
+	lastRetry   time.Time
+	lastWarn    time.Time
+	writeErrors atomic.Int64
+	shipper     *LogShipper // also sent every entry, when log_ship_url is set
+	db          *LogDB      // also given every entry, unless log_backend is file
+}
+
+// NewLogger creates a new logger instance
+func NewLogger(config *Config) (*Logger, error) {
+	l := &Logger{
+		backend:    config.LogBackend,
+		maxSizeMB:  config.LogMaxSizeMB,
+		filePath:   config.LogFilePath,
+		format:     config.LogFormat,
+		anonymizer: NewIPAnonymizer(config.LogAnonymizeIPs, config.LogAnonymizeKey),
+		policy:     config.LogFailurePolicy,
+		fallback:   os.Stderr,
+	}
+	if l.backend == "sqlite" {
+		return l, nil
+	}
+
+	file, err := os.OpenFile(l.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	// Get current file size
+	if info, err := file.Stat(); err == nil {
+		l.currentSize = info.Size()
+	}
+	l.file = file
+	return l, nil
+}
+
+// Log writes a log entry. An entry that can't be written to the file is
+// written to standard error instead under the degrade policy, and
+// discarded under drop and block.
+func (l *Logger) Log(entry LogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Shipping and the database don't wait for, or depend on, the file
+	entry.ClientIP = l.anonymizer.Anonymize(entry.ClientIP)
+	l.shipper.Ship(entry)
+	l.db.Insert(entry)
+	if l.file == nil {
+		return
+	}
+
+	// Check if rotation is needed (0 leaves rotation to external tools)
+	maxSizeBytes := int64(l.maxSizeMB) * 1024 * 1024
+	if l.lastErr == nil && l.maxSizeMB > 0 && l.currentSize >= maxSizeBytes {
+		if err := l.rotate(); err != nil {
+			l.lastErr = err
+			l.lastRetry = time.Now()
+		}
+	}
+	l.retry()
+
+	// Format log line
+	line := l.formatLogEntry(entry)
+
+	// Write to file, syncing so the entry is on disk at once
+	err := l.lastErr
+	if err == nil {
+		_, err = fmt.Fprintln(l.file, line)
+		if err == nil {
+			err = l.file.Sync()
+		}
+		if err != nil {
+			l.lastErr = err
+			l.lastRetry = time.Now()
+		}
+	}
+	if err == nil {
+		l.currentSize += int64(len(line) + 1) // +1 for newline
+		return
+	}
+
+	l.writeErrors.Add(1)
+	if time.Since(l.lastWarn) >= logWarnInterval {
+		l.lastWarn = time.Now()
+		l.warnf("Access log %s can't be written (%v); log_failure_policy=%s", l.filePath, err, l.policy)
+	}
+	if l.policy == "degrade" {
+		fmt.Fprintln(l.fallback, line)
+	}
+}
+
+// retry reopens a failing log file, at most every logRetryInterval; the
+// caller must hold l.mu
+func (l *Logger) retry() {
+	if l.lastErr == nil || time.Since(l.lastRetry) < logRetryInterval {
+		return
+	}
+	l.lastRetry = time.Now()
+	if err := l.reopen(); err != nil {
+		return
+	}
+	l.lastWarn = time.Time{}
+	if l.diag != nil {
+		l.diag.Infof("Access log %s is writable again", l.filePath)
+	}
+}
+
+// Available reports whether entries are being written to the log file,
+// retrying a failing one first if it is due. The block log_failure_policy
+// refuses requests while it is false.
+func (l *Logger) Available() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.retry()
+	return l.lastErr == nil
+}
+
+// SetShipper sends entries to ls as well as the file from now on,
+// returning the shipper it replaces
+func (l *Logger) SetShipper(ls *LogShipper) *LogShipper {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.shipper
+	l.shipper = ls
+	return old
+}
+
+// SetDB inserts entries into ldb from now on, returning the database it
+// replaces
+func (l *Logger) SetDB(ldb *LogDB) *LogDB {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.db
+	l.db = ldb
+	return old
+}
+
+// ShipStats returns the counts of the current log shipper
+func (l *Logger) ShipStats() LogShipStats {
+	l.mu.Lock()
+	ls := l.shipper
+	l.mu.Unlock()
+	return ls.Stats()
+}
+
+// WriteErrors returns the number of entries that couldn't be written to
+// the log file or the database
+func (l *Logger) WriteErrors() int64 {
+	l.mu.Lock()
+	ldb := l.db
+	l.mu.Unlock()
+	return l.writeErrors.Load() + ldb.Failed()
+}
+
+// warnf reports a logging problem to the diagnostic log, or to standard
+// error when there is none
+func (l *Logger) warnf(format string, args ...any) {
+	if l.diag != nil {
+		l.diag.Warnf(format, args...)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "WARN "+format+"\n", args...)
+}
+
+// formatLogEntry formats a log entry as a single line
+func (l *Logger) formatLogEntry(entry LogEntry) string {
+	switch l.format {
+	case "clf":
+		return formatCommonLogEntry(entry)
+	case "combined":
+		return formatCombinedLogEntry(entry)
+	case "combined_id":
+		// Apache's LogFormat "%h %l %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-Agent}i\" \"%{X-Request-Id}i\""
+		return formatCombinedLogEntry(entry) + fmt.Sprintf(" \"%s\"", clfField(entry.RequestID))
+	case "json":
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Sprintf("{\"error\":%q}", err.Error())
+		}
+		return string(data)
+	}
+
+	timestamp := entry.Timestamp.UTC().Format(time.RFC3339)
+	clientAddr := fmt.Sprintf("%s:%d", entry.ClientIP, entry.ClientPort)
+	destAddr := fmt.Sprintf("%s:%d", entry.DestinationHost, entry.DestinationPort)
+	if entry.DestinationIP != "" && entry.DestinationIP != entry.DestinationHost {
+		destAddr = fmt.Sprintf("%s/%s", entry.DestinationHost, net.JoinHostPort(entry.DestinationIP, strconv.Itoa(entry.DestinationPort)))
+	}
+	requestLine := fmt.Sprintf("%s %s HTTP/1.1", entry.Method, entry.RequestTarget)
+
+	var statusCode string
+	if entry.UpstreamStatus > 0 {
+		statusCode = fmt.Sprintf("%d", entry.UpstreamStatus)
+	} else {
+		statusCode = "-"
+	}
+
+	line := fmt.Sprintf("%s %s -> %s \"%s\" %s %s %d %d \"%s\" \"%s\"",
+		timestamp,
+		clientAddr,
+		destAddr,
+		requestLine,
+		entry.Action,
+		statusCode,
+		entry.BytesUpstream,
+		entry.BytesDownstream,
+		clfField(entry.UserAgent),
+		clfField(entry.Referer),
+	)
+
+	// Extra headers in a stable order
+	names := make([]string, 0, len(entry.Headers))
+	for name := range entry.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		line += fmt.Sprintf(" %s=\"%s\"", name, clfField(entry.Headers[name]))
+	}
+
+	if entry.RequestID != "" {
+		line += fmt.Sprintf(" [ID: %s]", entry.RequestID)
+	}
+
+	if entry.Username != "" {
+		line += fmt.Sprintf(" [USER: %s]", clfField(entry.Username))
+	}
+
+	if entry.Policy != "" {
+		line += fmt.Sprintf(" [POLICY: %s]", entry.Policy)
+	}
+
+	if entry.Listener != "" {
+		line += fmt.Sprintf(" [LISTENER: %s]", entry.Listener)
+	}
+
+	if entry.Route != "" && entry.Route != routeDirect {
+		line += fmt.Sprintf(" [ROUTE: %s]", entry.Route)
+	}
+
+	if entry.BlockedRule != "" {
+		line += fmt.Sprintf(" [BLOCKED: %s]", entry.BlockedRule)
+	}
+
+	if entry.MatchedRule != "" {
+		line += fmt.Sprintf(" [MATCHED: %s]", entry.MatchedRule)
+	}
+
+	if entry.Category != "" {
+		line += fmt.Sprintf(" [CATEGORY: %s]", entry.Category)
+	}
+
+	if entry.SafeSearch != "" {
+		line += fmt.Sprintf(" [SAFESEARCH: %s]", entry.SafeSearch)
+	}
+
+	if entry.Rewrite != "" {
+		line += fmt.Sprintf(" [REWRITE: %s]", clfField(entry.Rewrite))
+	}
+
+	if entry.HTTPSUpgrade != "" {
+		line += fmt.Sprintf(" [HTTPS_UPGRADE: %s]", entry.HTTPSUpgrade)
+	}
+
+	if entry.Bandwidth != "" {
+		line += fmt.Sprintf(" [BANDWIDTH: %s]", entry.Bandwidth)
+	}
+
+	if entry.DestCountry != "" {
+		line += fmt.Sprintf(" [COUNTRY: %s]", entry.DestCountry)
+	}
+
+	if entry.DestASN != 0 {
+		line += fmt.Sprintf(" [ASN: AS%d]", entry.DestASN)
+	}
+
+	return line
+}
+
+// formatCommonLogEntry formats a log entry in Apache Common Log Format:
+// client - user [date] "METHOD target HTTP/1.1" status bytes
+func formatCommonLogEntry(entry LogEntry) string {
+	timestamp := entry.Timestamp.Format("02/Jan/2006:15:04:05 -0700")
+
+	status := "-"
+	if entry.UpstreamStatus > 0 {
+		status = fmt.Sprintf("%d", entry.UpstreamStatus)
+	}
+
+	bytes := "-"
+	if entry.BytesDownstream > 0 {
+		bytes = fmt.Sprintf("%d", entry.BytesDownstream)
+	}
+
+	// A request line that couldn't be parsed is "-", as Apache logs it
+	requestLine := "-"
+	if entry.RequestTarget != "" {
+		requestLine = fmt.Sprintf("%s %s HTTP/1.1", entry.Method, entry.RequestTarget)
+	}
+
+	return fmt.Sprintf("%s - %s [%s] \"%s\" %s %s",
+		clfField(entry.ClientIP),
+		clfField(entry.Username),
+		timestamp,
+		requestLine,
+		status,
+		bytes,
+	)
+}
+
+// formatCombinedLogEntry formats a log entry in Apache Combined Log Format,
+// which is the common format followed by the quoted referer and user agent
+func formatCombinedLogEntry(entry LogEntry) string {
+	return fmt.Sprintf("%s \"%s\" \"%s\"",
+		formatCommonLogEntry(entry),
+		clfField(entry.Referer),
+		clfField(entry.UserAgent),
+	)
+}
+
+// clfField returns "-" for empty values, and strips CR/LF and escapes
+// quotes so a client-supplied value can't forge log lines or break out of
+// its quoted section
+func clfField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+	return strings.ReplaceAll(value, "\"", "\\\"")
+}
+
+// renameLog renames a log file aside on rotation; tests replace it to fail
+// as a rename of a file held open does on Windows
+var renameLog = os.Rename
+
+// rotate renames the current log file aside and opens a new one. The file
+// is closed first, as Windows can't rename an open file. If the rename
+// still fails, for instance because another process holds the file open,
+// its contents are copied aside and it is truncated instead; if that fails
+// too the current file is kept. If the new file can't be opened the error
+// is returned and writes fail until a retry reopens it.
+func (l *Logger) rotate() error {
+	// Rename old file with timestamp
+	timestamp := time.Now().Format("20060102-150405")
+	oldPath := fmt.Sprintf("%s.%s", l.filePath, timestamp)
+	l.file.Close()
+
+	flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	rotated := true
+	if err := renameLog(l.filePath, oldPath); err != nil {
+		if copyErr := copyLogFile(l.filePath, oldPath); copyErr == nil {
+			flags |= os.O_TRUNC
+		} else {
+			rotated = false
+			if time.Since(l.lastWarn) >= logWarnInterval {
+				l.lastWarn = time.Now()
+				l.warnf("Access log %s can't be rotated, writing on: %v", l.filePath, err)
+			}
+		}
+	}
+
+	// Open new file, or the current one again
+	file, err := os.OpenFile(l.filePath, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open rotated log file: %w", err)
+	}
+	l.file = file
+	if rotated {
+		l.currentSize = 0
+	}
+	return nil
+}
+
+// copyLogFile copies the log file at src to a new file at dst
+func copyLogFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// Reopen closes and reopens the log file at its configured path, so that
+// entries go to the new file after an external tool such as logrotate has
+// moved the old one
+func (l *Logger) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reopen()
+}
+
+// Reconfigure applies reloaded log settings and reopens the log file, which
+// may now be at a different path
+func (l *Logger) Reconfigure(config *Config) error {
+	file, size, err := openConfiguredLog(config)
+	if err != nil {
+		return err
+	}
+	l.apply(config, file, size)
+	return nil
+}
+
+// openConfiguredLog opens config's log file for apply, returning a nil file
+// with log_backend=sqlite
+func openConfiguredLog(config *Config) (*os.File, int64, error) {
+	if config.LogBackend == "sqlite" {
+		return nil, 0, nil
+	}
+	file, size, err := openLogFile(config.LogFilePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to reopen log file: %w", err)
+	}
+	return file, size, nil
+}
+
+// apply applies reloaded log settings, writing to a file opened by
+// openConfiguredLog from now on
+func (l *Logger) apply(config *Config, file *os.File, size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.filePath, l.backend = config.LogFilePath, config.LogBackend
+	l.setFile(file, size)
+	l.maxSizeMB = config.LogMaxSizeMB
+	l.format = config.LogFormat
+	l.policy = config.LogFailurePolicy
+	if l.anonymizer.mode != config.LogAnonymizeIPs || (config.LogAnonymizeKey != "" && string(l.anonymizer.key) != config.LogAnonymizeKey) {
+		l.anonymizer = NewIPAnonymizer(config.LogAnonymizeIPs, config.LogAnonymizeKey)
+	}
+}
+
+// reopen opens filePath and swaps it in for the current file, or closes
+// the file with log_backend=sqlite; the caller must hold l.mu
+func (l *Logger) reopen() error {
+	if l.backend == "sqlite" {
+		l.setFile(nil, 0)
+		return nil
+	}
+
+	file, size, err := openLogFile(l.filePath)
+	if err != nil {
+		return fmt.Errorf("failed to reopen log file: %w", err)
+	}
+	l.setFile(file, size)
+	return nil
+}
+
+// openLogFile opens the log file at path for appending, returning its size
+func openLogFile(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	return file, size, nil
+}
+
+// setFile closes the current file and writes to file, which may be nil,
+// from now on; the caller must hold l.mu
+func (l *Logger) setFile(file *os.File, size int64) {
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	l.currentSize = size
+	l.lastErr = nil
+}
+
+// Err returns the error from the most recent log write, if it failed
+func (l *Logger) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastErr
+}
+
+// Close closes the log file
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// logEntries are the requests the golden files show: an allowed GET, a
+// blocked CONNECT, an authenticated POST with headers that need escaping,
+// and a failure with no status or body
+func logEntries() []LogEntry {
+	at := time.Date(2025, time.January, 1, 10, 12, 34, 0, time.FixedZone("", 2*60*60))
+	return []LogEntry{
+		{
+			Timestamp: at, RequestID: "3f9a1c0e5b7d2468", ClientIP: "192.0.2.10", ClientPort: 51234,
+			DestinationHost: "example.com", DestinationPort: 80, DestinationIP: "93.184.216.34",
+			Method: "GET", RequestTarget: "http://example.com/", Action: "ALLOWED", UpstreamStatus: 200,
+			BytesUpstream: 78, BytesDownstream: 8192, UserAgent: "curl/8.4.0",
+		},
+		{
+			Timestamp: at, RequestID: "0a1b2c3d4e5f6071", ClientIP: "192.0.2.11", ClientPort: 40000,
+			DestinationHost: "ads.example.net", DestinationPort: 443,
+			Method: "CONNECT", RequestTarget: "ads.example.net:443", Action: "BLOCKED", UpstreamStatus: 403,
+			BlockedRule: "*.example.net", BytesDownstream: 112, UserAgent: "Mozilla/5.0",
+		},
+		{
+			Timestamp: at, RequestID: "fedcba9876543210", ClientIP: "2001:db8::7", ClientPort: 6000,
+			DestinationHost: "api.example.org", DestinationPort: 8080,
+			Method: "POST", RequestTarget: "http://api.example.org:8080/v1/items?id=1", Action: "ALLOWED",
+			UpstreamStatus: 201, BytesUpstream: 2048, BytesDownstream: 15, Username: "alice",
+			Referer: "http://app.example.org/\r\nforged", UserAgent: "agent \"quoted\"",
+		},
+		{
+			Timestamp: at, ClientIP: "198.51.100.4", ClientPort: 1234,
+			Method: "UNKNOWN", Action: "ERROR",
+		},
+	}
+}
+
+// TestLogFormatGolden compares each log format's lines with the known-good
+// ones in testdata; run with -update to rewrite them after a deliberate
+// change
+func TestLogFormatGolden(t *testing.T) {
+	for _, format := range []string{"clf", "combined", "combined_id", "json"} {
+		t.Run(format, func(t *testing.T) {
+			l := &Logger{format: format}
+			var got strings.Builder
+			for _, entry := range logEntries() {
+				got.WriteString(l.formatLogEntry(entry) + "\n")
+			}
+
+			golden := filepath.Join("testdata", "log_"+format+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got.String()), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != string(want) {
+				t.Errorf("%s output differs from %s\ngot:\n%s\nwant:\n%s", format, golden, got.String(), want)
+			}
+		})
+	}
+}
+
+// makeReadOnly stops files being created in dir until the returned
+// function is called. Permission bits don't stop root, so if dir is still
+// writable after a chmod a regular file is put in its place instead.
+func makeReadOnly(t *testing.T, dir string) (restore func()) {
+	t.Helper()
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	probe := filepath.Join(dir, "probe")
+	if err := os.WriteFile(probe, nil, 0644); err != nil {
+		restore = func() { os.Chmod(dir, 0755) }
+		t.Cleanup(restore)
+		return restore
+	}
+	os.Remove(probe)
+	os.Chmod(dir, 0755)
+	aside := dir + ".aside"
+	if err := os.Rename(dir, aside); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	restore = func() {
+		if os.Remove(dir) == nil {
+			os.Rename(aside, dir)
+		}
+	}
+	t.Cleanup(restore)
+	return restore
+}
+
+// breakLog deletes config's log file and makes its directory read-only,
+// then makes the logger's next entry rotate, which can't reopen the file
+func breakLog(t *testing.T, l *Logger, config *Config) (restore func()) {
+	t.Helper()
+	if err := os.Remove(config.LogFilePath); err != nil {
+		t.Fatal(err)
+	}
+	restore = makeReadOnly(t, filepath.Dir(config.LogFilePath))
+	l.mu.Lock()
+	l.maxSizeMB, l.currentSize = 1, 1<<20
+	l.mu.Unlock()
+	return restore
+}
+
+// readOnlyLogConfig returns a configuration logging to a file in its own
+// directory, so that the directory can be made read-only
+func readOnlyLogConfig(t *testing.T) *Config {
+	t.Helper()
+	config := testConfig(t)
+	dir := filepath.Join(t.TempDir(), "logs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	config.LogFilePath = filepath.Join(dir, "access.log")
+	return config
+}
+
+func TestLoggerReadOnlyDirectory(t *testing.T) {
+	for _, policy := range []string{"degrade", "drop"} {
+		t.Run(policy, func(t *testing.T) {
+			config := readOnlyLogConfig(t)
+			config.LogFailurePolicy = policy
+			l, err := NewLogger(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			var fallback strings.Builder
+			l.fallback = &fallback
+			l.diag = &DiagLogger{out: io.Discard}
+			entry := logEntries()[0]
+
+			restore := breakLog(t, l, config)
+			for i := 0; i < 2; i++ {
+				l.Log(entry)
+			}
+			if l.Err() == nil || l.Available() {
+				t.Error("logger doesn't report the failure")
+			}
+			if n := l.WriteErrors(); n != 2 {
+				t.Errorf("%d write errors counted, want 2", n)
+			}
+			lines := strings.Count(fallback.String(), "\n")
+			if want := map[string]int{"degrade": 2, "drop": 0}[policy]; lines != want {
+				t.Errorf("%d entries written to standard error, want %d:\n%s", lines, want, fallback.String())
+			}
+
+			// Once the directory is writable again, the next retry reopens
+			// the file
+			restore()
+			l.mu.Lock()
+			l.lastRetry = time.Now().Add(-logRetryInterval)
+			l.mu.Unlock()
+			l.Log(entry)
+			if err := l.Err(); err != nil {
+				t.Fatalf("logger still failing after the directory was restored: %v", err)
+			}
+			if data, err := os.ReadFile(config.LogFilePath); err != nil || strings.Count(string(data), "\n") != 1 {
+				t.Errorf("log file after the retry holds %q (%v), want the one entry", data, err)
+			}
+		})
+	}
+}
+
+func TestLogFailurePolicyBlock(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	config := readOnlyLogConfig(t)
+	config.LogFailurePolicy = "block"
+	s, addr := startServer(t, config)
+	breakLog(t, s.logger, config)
+
+	// The first request is served, but its entry can't be written; after
+	// that requests are refused until the log works again
+	if resp := proxyGet(t, dialProxy(t, addr), origin.URL+"/", 5*time.Second); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first request got %d", resp.StatusCode)
+	}
+	waitFor(t, func() bool { return s.logger.Err() != nil })
+	if resp := proxyGet(t, dialProxy(t, addr), origin.URL+"/", 5*time.Second); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("request with the log unavailable got %d, want 503", resp.StatusCode)
+	}
+	waitFor(t, func() bool { return s.Stats().RequestsByAction["LOG_UNAVAILABLE"] == 1 })
+}
+
+// rotatedLogs returns the contents of the files config's log was rotated to
+func rotatedLogs(t *testing.T, config *Config) []string {
+	t.Helper()
+	paths, err := filepath.Glob(config.LogFilePath + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(data))
+	}
+	return contents
+}
+
+func TestLoggerRotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		rename      func(oldPath, newPath string) error
+		wantRotated bool // the first entry was moved aside
+	}{
+		{"rename", os.Rename, true},
+		// As on Windows when another process holds the file open: it is
+		// copied aside and truncated
+		{"copy and truncate", func(oldPath, newPath string) error {
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrPermission}
+		}, true},
+		// When it can't be copied aside either, it is written on
+		{"kept", func(oldPath, newPath string) error {
+			os.Mkdir(newPath, 0755)
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrPermission}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(rename func(string, string) error) { renameLog = rename }(renameLog)
+			renameLog = tt.rename
+
+			config := readOnlyLogConfig(t)
+			config.LogMaxSizeMB = 1
+			l, err := NewLogger(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			l.diag = &DiagLogger{out: io.Discard}
+			first, second := logEntries()[0], logEntries()[1]
+
+			l.Log(first)
+			l.mu.Lock()
+			l.currentSize = 1 << 20
+			l.mu.Unlock()
+			l.Log(second)
+			if err := l.Err(); err != nil {
+				t.Fatalf("logger failing after the rotation: %v", err)
+			}
+
+			data, err := os.ReadFile(config.LogFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			current := string(data)
+			if !strings.Contains(current, second.RequestTarget) {
+				t.Errorf("log file lacks the entry written after the rotation:\n%s", current)
+			}
+			if tt.wantRotated {
+				rotated := rotatedLogs(t, config)
+				if len(rotated) != 1 || strings.Count(rotated[0], "\n") != 1 || !strings.Contains(rotated[0], first.RequestTarget) {
+					t.Errorf("rotated files hold %q, want the first entry", rotated)
+				}
+				if strings.Count(current, "\n") != 1 {
+					t.Errorf("log file after the rotation holds %q, want only the second entry", current)
+				}
+			} else if strings.Count(current, "\n") != 2 {
+				t.Errorf("log file that couldn't be rotated holds %q, want both entries", current)
+			}
+		})
+	}
+}
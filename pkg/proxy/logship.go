@@ -0,0 +1,418 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logShipQueueSize caps the entries waiting to be batched; more are dropped,
+// so a stalled shipper can't hold up logging or grow memory
+const logShipQueueSize = 10000
+
+// logShipTimeout bounds one POST to the collector
+const logShipTimeout = 30 * time.Second
+
+// Retries of an unreachable collector back off from logShipMinBackoff to
+// logShipMaxBackoff
+const (
+	logShipMinBackoff = time.Second
+	logShipMaxBackoff = 5 * time.Minute
+)
+
+// LogShipper POSTs access log entries to log_ship_url as gzipped NDJSON,
+// in batches of log_ship_batch_size or every log_ship_interval. Batches the
+// collector doesn't accept are spooled, to log_ship_spool_dir if set and in
+// memory otherwise, up to log_ship_spool_max_mb, dropping the oldest past
+// that, and resent oldest first once it answers again. Entries are handed
+// over without blocking, so the shipper never holds up requests or the
+// local log. A nil LogShipper ships nothing.
+type LogShipper struct {
+	url       string
+	batchSize int
+	interval  time.Duration
+	client    *http.Client
+	diag      *DiagLogger
+	spool     *logSpool
+
+	entries chan LogEntry
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+
+	shipped atomic.Int64 // entries the collector accepted
+	dropped atomic.Int64 // entries lost to a full queue or spool
+}
+
+// NewLogShipper starts shipping to log_ship_url, returning nil when it
+// isn't set. Batches left in the spool directory by an earlier run are
+// sent first.
+func NewLogShipper(config *Config, diag *DiagLogger) (*LogShipper, error) {
+	if config.LogShipURL == "" {
+		return nil, nil
+	}
+	spool, err := openLogSpool(config.LogShipSpoolDir, int64(config.LogShipSpoolMaxMB)*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	ls := &LogShipper{
+		url:       config.LogShipURL,
+		batchSize: config.LogShipBatchSize,
+		interval:  config.LogShipInterval,
+		client:    &http.Client{Timeout: logShipTimeout},
+		diag:      diag,
+		spool:     spool,
+		entries:   make(chan LogEntry, logShipQueueSize),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	if n := spool.Entries(); n > 0 {
+		diag.Infof("Log shipping: %d spooled entries to resend to %s", n, ls.url)
+	}
+	go ls.run()
+	return ls, nil
+}
+
+// Ship queues entry for the collector, dropping it if the queue is full
+func (ls *LogShipper) Ship(entry LogEntry) {
+	if ls == nil {
+		return
+	}
+	select {
+	case ls.entries <- entry:
+	default:
+		ls.dropped.Add(1)
+	}
+}
+
+// Close ships or spools the queued entries and stops shipping
+func (ls *LogShipper) Close() {
+	if ls == nil {
+		return
+	}
+	ls.once.Do(func() {
+		close(ls.stop)
+		<-ls.stopped
+	})
+}
+
+// LogShipStats counts the entries a LogShipper has handled
+type LogShipStats struct {
+	Shipped int64 // accepted by the collector
+	Spooled int64 // waiting in the spool
+	Dropped int64 // lost to a full queue or spool
+}
+
+// Stats returns the shipper's counts
+func (ls *LogShipper) Stats() LogShipStats {
+	if ls == nil {
+		return LogShipStats{}
+	}
+	return LogShipStats{
+		Shipped: ls.shipped.Load(),
+		Spooled: ls.spool.Entries(),
+		Dropped: ls.dropped.Load() + ls.spool.Dropped(),
+	}
+}
+
+// run batches entries until Close. Sends happen on this goroutine, so a
+// slow collector only fills the queue.
+func (ls *LogShipper) run() {
+	defer close(ls.stopped)
+	ticker := time.NewTicker(ls.interval)
+	defer ticker.Stop()
+
+	var batch bytes.Buffer
+	count := 0
+	var backoff time.Duration
+	var retryAt time.Time
+	closing := false
+
+	// flush sends the batch, or spools it while the collector is failing.
+	// At shutdown a batch that can be spooled to disk is, so a slow
+	// collector doesn't hold up the exit; it is sent on the next start.
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		data := gzipBytes(batch.Bytes())
+		n := count
+		batch.Reset()
+		count = 0
+
+		if backoff == 0 && !(closing && ls.spool.dir != "") {
+			err := ls.post(data)
+			if err == nil {
+				ls.shipped.Add(int64(n))
+				return
+			}
+			backoff = logShipMinBackoff
+			retryAt = time.Now().Add(backoff)
+			ls.diag.Warnf("Log shipping to %s failed, spooling and retrying in %s: %v", ls.url, backoff, err)
+		}
+		if err := ls.spool.Add(data, n); err != nil {
+			ls.dropped.Add(int64(n))
+			ls.diag.Warnf("Log shipping: failed to spool %d entries: %v", n, err)
+		}
+	}
+
+	// resend sends spooled batches, oldest first, until one fails
+	resend := func() {
+		for backoff == 0 || !time.Now().Before(retryAt) {
+			data, n, ok := ls.spool.Oldest()
+			if !ok {
+				return
+			}
+			if err := ls.post(data); err != nil {
+				backoff = min(max(backoff*2, logShipMinBackoff), logShipMaxBackoff)
+				retryAt = time.Now().Add(backoff)
+				ls.diag.Debugf("Log shipping to %s still failing, retrying in %s: %v", ls.url, backoff, err)
+				return
+			}
+			if backoff > 0 {
+				ls.diag.Infof("Log shipping to %s recovered", ls.url)
+				backoff = 0
+			}
+			ls.spool.RemoveOldest()
+			ls.shipped.Add(int64(n))
+		}
+	}
+
+	add := func(entry LogEntry) {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			ls.dropped.Add(1)
+			return
+		}
+		batch.Write(data)
+		batch.WriteByte('\n')
+		if count++; count >= ls.batchSize {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case entry := <-ls.entries:
+			add(entry)
+		case <-ticker.C:
+			resend()
+			flush()
+		case <-ls.stop:
+			closing = true
+			for {
+				select {
+				case entry := <-ls.entries:
+					add(entry)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// post sends one gzipped NDJSON batch; anything but a 2xx is a failure
+func (ls *LogShipper) post(data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, ls.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("User-Agent", VersionString())
+	resp, err := ls.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// gzipBytes compresses data
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// logSpool holds batches the collector hasn't accepted, oldest first, in a
+// directory or in memory, within maxBytes
+type logSpool struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	batches []spooledBatch
+	size    int64
+	entries int64
+	dropped int64
+	seq     int64
+}
+
+// spooledBatch is a gzipped batch of entries: in memory as data, or in the
+// spool directory under name
+type spooledBatch struct {
+	name    string
+	data    []byte
+	size    int64
+	entries int
+}
+
+// logSpoolSuffix names batch files in the spool directory, which are
+// <sequence>-<entries>.ndjson.gz
+const logSpoolSuffix = ".ndjson.gz"
+
+// openLogSpool opens a spool in dir, creating it and picking up the batches
+// it holds, or in memory if dir is empty
+func openLogSpool(dir string, maxBytes int64) (*logSpool, error) {
+	s := &logSpool{dir: dir, maxBytes: maxBytes}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create log_ship_spool_dir: %w", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log_ship_spool_dir: %w", err)
+	}
+	for _, file := range files {
+		name := file.Name()
+		seq, entries, ok := parseSpoolName(name)
+		info, err := file.Info()
+		if !ok || err != nil {
+			continue
+		}
+		s.batches = append(s.batches, spooledBatch{name: name, size: info.Size(), entries: entries})
+		s.size += info.Size()
+		s.entries += int64(entries)
+		s.seq = max(s.seq, seq)
+	}
+	sort.Slice(s.batches, func(i, j int) bool {
+		a, _, _ := parseSpoolName(s.batches[i].name)
+		b, _, _ := parseSpoolName(s.batches[j].name)
+		return a < b
+	})
+	s.trim()
+	return s, nil
+}
+
+// parseSpoolName reads the sequence number and entry count from a batch
+// file name
+func parseSpoolName(name string) (int64, int, bool) {
+	base, ok := strings.CutSuffix(name, logSpoolSuffix)
+	if !ok {
+		return 0, 0, false
+	}
+	seqPart, countPart, ok := strings.Cut(base, "-")
+	seq, err1 := strconv.ParseInt(seqPart, 10, 64)
+	count, err2 := strconv.Atoi(countPart)
+	return seq, count, ok && err1 == nil && err2 == nil
+}
+
+// Add spools a batch of n entries, dropping the oldest batches if the spool
+// grows past its limit
+func (s *logSpool) Add(data []byte, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := spooledBatch{size: int64(len(data)), entries: n}
+	if s.dir == "" {
+		batch.data = data
+	} else {
+		s.seq++
+		batch.name = fmt.Sprintf("%d-%d%s", s.seq, n, logSpoolSuffix)
+		if err := os.WriteFile(filepath.Join(s.dir, batch.name), data, 0600); err != nil {
+			return err
+		}
+	}
+	s.batches = append(s.batches, batch)
+	s.size += batch.size
+	s.entries += int64(n)
+	s.trim()
+	return nil
+}
+
+// trim drops the oldest batches while the spool is over its limit; the
+// caller must hold s.mu
+func (s *logSpool) trim() {
+	for s.size > s.maxBytes && len(s.batches) > 0 {
+		s.dropped += int64(s.batches[0].entries)
+		s.removeOldest()
+	}
+}
+
+// Oldest returns the oldest batch and its entry count. A batch file that
+// can't be read is discarded.
+func (s *logSpool) Oldest() ([]byte, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.batches) > 0 {
+		batch := s.batches[0]
+		if s.dir == "" {
+			return batch.data, batch.entries, true
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, batch.name))
+		if err == nil {
+			return data, batch.entries, true
+		}
+		s.dropped += int64(batch.entries)
+		s.removeOldest()
+	}
+	return nil, 0, false
+}
+
+// RemoveOldest drops the oldest batch once it has been sent
+func (s *logSpool) RemoveOldest() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeOldest()
+}
+
+// removeOldest drops the oldest batch; the caller must hold s.mu
+func (s *logSpool) removeOldest() {
+	if len(s.batches) == 0 {
+		return
+	}
+	batch := s.batches[0]
+	s.batches = s.batches[1:]
+	s.entries -= int64(batch.entries)
+	s.size -= batch.size
+	if s.dir != "" {
+		os.Remove(filepath.Join(s.dir, batch.name))
+	}
+}
+
+// Entries returns the entries waiting in the spool
+func (s *logSpool) Entries() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries
+}
+
+// Dropped returns the entries the spool has had to discard
+func (s *logSpool) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyCollector accepts gzipped NDJSON batches, failing the POSTs whose
+// numbers (from 1) are in fail, and records the request IDs it accepted
+type flakyCollector struct {
+	mu       sync.Mutex
+	posts    int
+	fail     map[int]bool
+	accepted []string
+}
+
+func (c *flakyCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.posts++
+	if c.fail[c.posts] {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "gzip" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := gzip.NewReader(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.accepted = append(c.accepted, entry.RequestID)
+	}
+}
+
+func (c *flakyCollector) Accepted() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.accepted...)
+}
+
+func TestLogShipperIntermittentCollector(t *testing.T) {
+	// The first batch fails, and so does the first resend of the second,
+	// so both wait in the spool through a backoff
+	collector := &flakyCollector{fail: map[int]bool{1: true, 3: true}}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	config := DefaultConfig()
+	config.LogShipURL = server.URL
+	config.LogShipBatchSize = 10
+	config.LogShipInterval = 50 * time.Millisecond
+	config.LogShipSpoolDir = filepath.Join(t.TempDir(), "spool")
+	ls, err := NewLogShipper(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("req-%02d", i)
+		want = append(want, id)
+		ls.Ship(LogEntry{RequestID: id})
+	}
+	waitFor(t, func() bool { return ls.Stats().Spooled == 20 })
+	waitFor(t, func() bool { return ls.Stats().Shipped == 20 })
+
+	// Every entry arrived once, oldest first, and none were lost
+	if got := collector.Accepted(); !reflect.DeepEqual(got, want) {
+		t.Errorf("collector accepted %q, want %q", got, want)
+	}
+	if stats := ls.Stats(); stats.Spooled != 0 || stats.Dropped != 0 {
+		t.Errorf("%d entries left spooled and %d dropped, want none", stats.Spooled, stats.Dropped)
+	}
+}
+
+func TestLogSpoolDropsOldest(t *testing.T) {
+	spool, err := openLogSpool("", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		spool.Add(bytes.Repeat([]byte{byte('a' + i)}, 60), 5)
+	}
+	if spool.Entries() != 5 || spool.Dropped() != 10 {
+		t.Errorf("spool holds %d entries and dropped %d, want 5 and 10", spool.Entries(), spool.Dropped())
+	}
+	if data, n, ok := spool.Oldest(); !ok || n != 5 || data[0] != 'c' {
+		t.Errorf("oldest batch left is %q of %d entries, want the newest", data, n)
+	}
+}
+
+func TestLogSpoolSurvivesRestart(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	spool, err := openLogSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.Add([]byte("first"), 2)
+	spool.Add([]byte("second"), 3)
+
+	reopened, err := openLogSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := reopened.Entries(); n != 5 {
+		t.Errorf("reopened spool holds %d entries, want 5", n)
+	}
+	for _, want := range []string{"first", "second"} {
+		data, _, ok := reopened.Oldest()
+		if !ok || string(data) != want {
+			t.Fatalf("reopened spool gave %q, want %q", data, want)
+		}
+		reopened.RemoveOldest()
+	}
+}
@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxMITMCerts bounds the leaf certificate cache; it is emptied when full
+const maxMITMCerts = 1000
+
+// MITM intercepts CONNECT tunnels to mitm_domains, terminating the client's
+// TLS with leaf certificates minted from the configured CA
+type MITM struct {
+	mu      sync.Mutex
+	domains []string
+	ca      *x509.Certificate
+	caKey   crypto.Signer
+	certs   map[string]*mitmCert // leaf certificates by host
+}
+
+// mitmCert is a cached leaf certificate; mu is held while it is minted so
+// concurrent tunnels to a host share one certificate
+type mitmCert struct {
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+// NewMITM creates an interceptor that matches no hosts until configured
+func NewMITM() *MITM {
+	return &MITM{certs: make(map[string]*mitmCert)}
+}
+
+// Reconfigure loads the CA and mitm_domains from config; on failure the
+// previous settings stay in use. Cached certificates are kept unless the CA
+// changed.
+func (m *MITM) Reconfigure(config *Config) error {
+	ca, caKey, err := loadConfiguredCA(config)
+	if err != nil {
+		return err
+	}
+	m.set(config, ca, caKey)
+	return nil
+}
+
+// loadConfiguredCA loads the interception CA when mitm_domains is set, and
+// returns nils when it isn't
+func loadConfiguredCA(config *Config) (*x509.Certificate, crypto.Signer, error) {
+	if len(config.MITMDomains) == 0 {
+		return nil, nil, nil
+	}
+	return loadCA(config.CACertFile, config.CAKeyFile)
+}
+
+// set applies mitm_domains and a CA loaded by loadConfiguredCA
+func (m *MITM) set(config *Config, ca *x509.Certificate, caKey crypto.Signer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ca == nil || m.ca == nil || !ca.Equal(m.ca) {
+		m.certs = make(map[string]*mitmCert)
+	}
+	m.domains = config.MITMDomains
+	m.ca = ca
+	m.caKey = caKey
+}
+
+// loadCA reads the interception CA certificate and its private key
+func loadCA(certFile, keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load CA certificate: %w", err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	if !ca.IsCA {
+		return nil, nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported CA key type in %s", keyFile)
+	}
+	return ca, signer, nil
+}
+
+// Matches reports whether tunnels to host are intercepted. Patterns are
+// exact names or *.suffix, which also matches the suffix itself.
+func (m *MITM) Matches(host string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	host = strings.ToLower(host)
+	for _, domain := range m.domains {
+		if domain == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// certFor returns a leaf certificate for host carrying the names of the
+// origin's certificate, minting and caching it on first use
+func (m *MITM) certFor(host string, origin *x509.Certificate) (*tls.Certificate, error) {
+	m.mu.Lock()
+	if m.ca == nil {
+		m.mu.Unlock()
+		return nil, errors.New("no interception CA loaded")
+	}
+	entry, ok := m.certs[host]
+	if !ok {
+		if len(m.certs) >= maxMITMCerts {
+			m.certs = make(map[string]*mitmCert)
+		}
+		entry = &mitmCert{}
+		m.certs[host] = entry
+	}
+	ca, caKey := m.ca, m.caKey
+	m.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.cert != nil && time.Now().Before(entry.cert.Leaf.NotAfter) {
+		return entry.cert, nil
+	}
+
+	cert, err := mintCert(host, origin, ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+	entry.cert = cert
+	return cert, nil
+}
+
+// mintCert signs a leaf certificate for host with the origin's subject
+// alternative names, valid no longer than the origin's or the CA's
+func mintCert(host string, origin *x509.Certificate, ca *x509.Certificate, caKey crypto.Signer) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key for %s: %w", host, err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial for %s: %w", host, err)
+	}
+
+	notAfter := origin.NotAfter
+	if ca.NotAfter.Before(notAfter) {
+		notAfter = ca.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     origin.DNSNames,
+		IPAddresses:  origin.IPAddresses,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if len(template.DNSNames) == 0 && len(template.IPAddresses) == 0 {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = []net.IP{ip}
+		} else {
+			template.DNSNames = []string{host}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate for %s: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// bufferedConn reads through reader, so bytes it has already buffered from
+// the connection aren't lost
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// interceptCONNECT answers a CONNECT to an intercepted host. It connects to
+// the origin over verified TLS first, so certificate errors fail closed
+// with a 502, then completes the client's handshake with a minted
+// certificate and runs the decrypted request through the usual pipeline.
+// As with plain proxied connections, a tunnel carries one request.
+func (s *Server) interceptCONNECT(ctx context.Context, conn net.Conn, reader *bufio.Reader, connectReq *HTTPRequest, config *Config) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	upstreamAddr := net.JoinHostPort(connectReq.Host, strconv.Itoa(connectReq.Port))
+	raw, err := s.forwarder.DialTunnel(ctx, connectReq)
+	if err != nil && ctx.Err() != nil {
+		s.logRequest(conn, connectReq, "CANCELLED", 0, 0, 0, context.Cause(ctx).Error())
+		return
+	}
+	if errors.Is(err, errUpstreamLimit) {
+		s.sendUpstreamLimited(conn, connectReq)
+		return
+	}
+	if err != nil {
+		s.stats.RecordUpstreamError(err)
+		s.sendErrorDetail(conn, connectReq, 502, "Bad Gateway", err)
+		s.logRequest(conn, connectReq, "ERROR", 502, 0, 0, err.Error())
+		return
+	}
+	upstream := tls.Client(raw, s.forwarder.upstreamTLSConfig(connectReq.Host, config))
+	if config.UpstreamConnectTimeout > 0 {
+		raw.SetDeadline(time.Now().Add(config.UpstreamConnectTimeout))
+	}
+	err = upstream.Handshake()
+	raw.SetDeadline(time.Time{})
+	if err != nil {
+		raw.Close()
+		s.stats.RecordUpstreamError(err)
+		s.diag.Warnf("Upstream TLS connection to %s for interception failed: %v", upstreamAddr, err)
+		s.sendErrorDetail(conn, connectReq, 502, "Bad Gateway", err)
+		s.logRequest(conn, connectReq, "ERROR", 502, 0, 0, err.Error())
+		return
+	}
+	defer upstream.Close()
+
+	cert, err := s.mitm.certFor(connectReq.Host, upstream.ConnectionState().PeerCertificates[0])
+	if err != nil {
+		s.diag.Errorf("Request %s: %v", connectReq.ID, err)
+		s.sendErrorDetail(conn, connectReq, 502, "Bad Gateway", err)
+		s.logRequest(conn, connectReq, "ERROR", 502, 0, 0, err.Error())
+		return
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		s.logRequest(conn, connectReq, "ERROR", 0, 0, 0, err.Error())
+		return
+	}
+
+	// The handshake and the request must arrive within client_read_timeout
+	if config.ClientReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(config.ClientReadTimeout))
+	}
+	client := tls.Server(&bufferedConn{Conn: conn, reader: reader}, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"http/1.1"},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err := client.Handshake(); err != nil {
+		s.logRequest(conn, connectReq, "ERROR", 200, 0, 0, fmt.Sprintf("client TLS handshake: %v", err))
+		return
+	}
+
+	clientReader := bufio.NewReader(client)
+	req, err := ParseRequestHead(clientReader)
+	if err != nil {
+		req = &HTTPRequest{Method: "UNKNOWN", ID: newRequestID()}
+		if isTimeout(err) {
+			s.sendSlowClient(client, req, 0, "client_read_timeout")
+			return
+		}
+		s.sendErrorDetail(client, req, 400, "Bad Request", err)
+		s.logRequest(client, req, "ERROR", 400, 0, 0, err.Error())
+		return
+	}
+
+	// Requests inside the tunnel are origin-form; make the target absolute
+	// so the host, filter and cache key come from the CONNECT
+	if !strings.HasPrefix(req.RequestTarget, "/") {
+		req.ID = newRequestID()
+		s.sendErrorResponse(client, req, 400, "Bad Request")
+		s.logRequest(client, req, "ERROR", 400, 0, 0, "request target is not origin-form")
+		return
+	}
+	origin := connectReq.Host
+	if connectReq.Port != 443 {
+		origin = upstreamAddr
+	}
+	req.RequestTarget = "https://" + origin + req.RequestTarget
+
+	if err := req.CompleteRequest(clientReader); err != nil {
+		req.ID = newRequestID()
+		s.sendErrorDetail(client, req, 400, "Bad Request", err)
+		s.logRequest(client, req, "ERROR", 400, 0, 0, err.Error())
+		return
+	}
+	assignRequestID(config, req)
+	clientConn(client).beginRequest(req)
+	s.startTrace(client, req, config)
+	req.Username = connectReq.Username
+	req.Policy = connectReq.Policy
+	req.Route = connectReq.Route
+	req.Headers["connection"] = "close"
+
+	watchAfterRequest(conn, clientReader, req, cancel)
+	s.serveRequest(ctx, client, req, upstream)
+}
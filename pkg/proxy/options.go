@@ -0,0 +1,51 @@
+package proxy
+
+// Option customizes a Server created by NewServer
+type Option func(*serverOptions)
+
+// serverOptions holds components supplied by the embedder in place of the
+// ones NewServer would build from the configuration
+type serverOptions struct {
+	engine FilterEngine
+	filter *Filter // engine, when it is the built-in filter
+	logger *Logger
+	cache  CacheBackend
+	auth   Authenticator
+}
+
+// WithFilter uses filter for blocking decisions instead of loading
+// blocked_domains_file. ReloadConfig leaves its rules alone.
+func WithFilter(filter *Filter) Option {
+	return func(o *serverOptions) { o.engine, o.filter = filter, filter }
+}
+
+// WithFilterEngine makes blocking decisions with engine instead of the
+// built-in filter. ReloadConfig calls its Reload, unless it is a *Filter,
+// which is treated as by WithFilter. The /filter/rules and /filter/stats
+// admin endpoints need the built-in filter and answer 501 without it.
+func WithFilterEngine(engine FilterEngine) Option {
+	return func(o *serverOptions) {
+		o.engine = engine
+		o.filter, _ = engine.(*Filter)
+	}
+}
+
+// WithLogger writes the access log to logger instead of opening
+// log_file_path. ReloadConfig doesn't reconfigure it; Shutdown closes it.
+func WithLogger(logger *Logger) Option {
+	return func(o *serverOptions) { o.logger = logger }
+}
+
+// WithAuthenticator checks proxy credentials with auth in place of the
+// built-in authentication auth_mode selects, on every listener but the
+// reverse proxy ones. auth_failure_limit still applies to its failures.
+func WithAuthenticator(auth Authenticator) Option {
+	return func(o *serverOptions) { o.auth = auth }
+}
+
+// WithCache caches responses in cache, whether or not enable_caching is
+// set, in place of the backend cache_backend names. ReloadConfig doesn't
+// change its limits.
+func WithCache(cache CacheBackend) Option {
+	return func(o *serverOptions) { o.cache = cache }
+}
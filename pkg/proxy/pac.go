@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pacContentType is the MIME type browsers expect for PAC scripts
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// pacMaxAge is how long clients may cache the PAC script, in seconds
+const pacMaxAge = 300
+
+// isPACRequest reports whether req asks the proxy itself for its PAC
+// script. Only origin-form targets match, so proxied requests for a
+// /wpad.dat elsewhere are still forwarded.
+func isPACRequest(config *Config, req *HTTPRequest) bool {
+	if config.PACFilePath == "" && !config.PACAuto {
+		return false
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	path, _, _ := strings.Cut(req.RequestTarget, "?")
+	return path == "/proxy.pac" || path == "/wpad.dat"
+}
+
+// pacScript returns the configured PAC script, or generates one sending
+// traffic to proxy, a directive such as "PROXY 10.0.0.1:8080"
+func pacScript(config *Config, proxy string) ([]byte, error) {
+	if config.PACFilePath != "" {
+		return os.ReadFile(config.PACFilePath)
+	}
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tif (isPlainHostName(host)")
+	for _, domain := range config.PACDirectDomains {
+		if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+			fmt.Fprintf(&b, " ||\n\t    host == %q || dnsDomainIs(host, %q)", suffix, "."+suffix)
+		} else {
+			fmt.Fprintf(&b, " ||\n\t    host == %q", domain)
+		}
+	}
+	b.WriteString(")\n\t\treturn \"DIRECT\";\n\n")
+
+	// Private (RFC 1918) and loopback destinations bypass the proxy
+	b.WriteString("\tvar ip = dnsResolve(host);\n")
+	b.WriteString("\tif (ip && (isInNet(ip, \"10.0.0.0\", \"255.0.0.0\") ||\n")
+	b.WriteString("\t    isInNet(ip, \"172.16.0.0\", \"255.240.0.0\") ||\n")
+	b.WriteString("\t    isInNet(ip, \"192.168.0.0\", \"255.255.0.0\") ||\n")
+	b.WriteString("\t    isInNet(ip, \"127.0.0.0\", \"255.0.0.0\")))\n")
+	b.WriteString("\t\treturn \"DIRECT\";\n\n")
+	fmt.Fprintf(&b, "\treturn %q;\n}\n", proxy)
+	return []byte(b.String()), nil
+}
+
+// pacDirective returns the PAC directive for a proxy listener at addr. An
+// unspecified listen IP is replaced by local, the address the client
+// reached us on, so the script names an address clients can connect to.
+func pacDirective(addr net.Addr, secure bool, local net.Addr) string {
+	host, port, _ := net.SplitHostPort(addr.String())
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		if localTCP, ok := local.(*net.TCPAddr); ok {
+			host = localTCP.IP.String()
+		}
+	}
+
+	keyword := "PROXY"
+	if secure {
+		keyword = "HTTPS"
+	}
+	return keyword + " " + net.JoinHostPort(host, port)
+}
+
+// isTLSConn reports whether conn was accepted on a TLS listener
+func isTLSConn(conn net.Conn) bool {
+	if lc, ok := conn.(*labeledConn); ok {
+		conn = lc.Conn
+	}
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
+
+// sendPACResponse answers a PAC request on the proxy port, pointing the
+// script at the listener the request arrived on
+func (s *Server) sendPACResponse(conn net.Conn, req *HTTPRequest, config *Config) {
+	proxy := pacDirective(conn.LocalAddr(), isTLSConn(conn), conn.LocalAddr())
+	script, err := pacScript(config, proxy)
+	if err != nil {
+		s.diag.Errorf("Failed to read PAC file: %v", err)
+		s.sendErrorResponse(conn, req, 500, "Internal Server Error")
+		return
+	}
+	s.diag.Debugf("Serving PAC script to %s", conn.RemoteAddr())
+
+	response := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: %s\r\nContent-Length: %d\r\nCache-Control: public, max-age=%d\r\nConnection: close\r\n\r\n",
+		pacContentType, len(script), pacMaxAge)
+	if req.Method == "HEAD" {
+		conn.Write([]byte(response))
+		return
+	}
+	conn.Write(append([]byte(response), script...))
+}
+
+// handlePAC serves the PAC script on the admin listener, pointing it at the
+// first proxy listener
+func (s *Server) handlePAC(w http.ResponseWriter, r *http.Request) {
+	config := s.config.Load()
+	if config.PACFilePath == "" && !config.PACAuto {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	var first *proxyListener
+	if len(s.listeners) > 0 {
+		first = s.listeners[0]
+	}
+	s.mu.Unlock()
+	if first == nil {
+		http.Error(w, "listener not bound", http.StatusServiceUnavailable)
+		return
+	}
+
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	script, err := pacScript(config, pacDirective(first.Addr(), first.tls, local))
+	if err != nil {
+		s.diag.Errorf("Failed to read PAC file: %v", err)
+		http.Error(w, "PAC file unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", pacContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(script)))
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", pacMaxAge))
+	w.Write(script)
+}
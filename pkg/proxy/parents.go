@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxParentProbeBackoff caps the wait between probes of a down parent
+const maxParentProbeBackoff = 5 * time.Minute
+
+// parentState is the health of one parent proxy
+type parentState struct {
+	kind      string // PROXY or SOCKS5
+	up        bool
+	failures  int           // consecutive failed dials
+	backoff   time.Duration // probe interval while down
+	nextProbe time.Time
+	probing   bool
+}
+
+// ParentHealth tracks which parent proxies are up. Failed request dials
+// and periodic probes mark parents down; probes of a down parent back off
+// exponentially and reinstate it once one succeeds.
+type ParentHealth struct {
+	mu          sync.Mutex
+	parents     map[string]*parentState
+	diag        *DiagLogger
+	transitions atomic.Int64 // up/down changes, for the stats
+}
+
+// NewParentHealth creates a tracker with no parents
+func NewParentHealth(diag *DiagLogger) *ParentHealth {
+	return &ParentHealth{
+		parents: make(map[string]*parentState),
+		diag:    diag,
+	}
+}
+
+// SetParents tracks the given parents, keyed by address with their kind.
+// Parents already tracked keep their state; new ones start up.
+func (ph *ParentHealth) SetParents(parents map[string]string) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	for addr := range ph.parents {
+		if _, ok := parents[addr]; !ok {
+			delete(ph.parents, addr)
+		}
+	}
+	for addr, kind := range parents {
+		if state, ok := ph.parents[addr]; ok {
+			state.kind = kind
+			continue
+		}
+		ph.parents[addr] = &parentState{kind: kind, up: true}
+	}
+}
+
+// Up reports whether a parent may be used; untracked parents count as up
+func (ph *ParentHealth) Up(addr string) bool {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	state, ok := ph.parents[addr]
+	return !ok || state.up
+}
+
+// ReportSuccess records a successful dial through a parent
+func (ph *ParentHealth) ReportSuccess(addr string) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	if state, ok := ph.parents[addr]; ok {
+		state.failures = 0
+		ph.markUp(addr, state)
+	}
+}
+
+// ReportFailure records a failed dial through a parent, marking it down
+// after threshold consecutive failures
+func (ph *ParentHealth) ReportFailure(addr string, err error, threshold int) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	state, ok := ph.parents[addr]
+	if !ok {
+		return
+	}
+	state.failures++
+	if state.up && state.failures >= threshold {
+		ph.markDown(addr, state, err)
+	}
+}
+
+// markUp reinstates a down parent; the caller must hold ph.mu
+func (ph *ParentHealth) markUp(addr string, state *parentState) {
+	if state.up {
+		return
+	}
+	state.up = true
+	state.backoff = 0
+	ph.transitions.Add(1)
+	ph.diag.Infof("Parent proxy %s is up", addr)
+}
+
+// markDown takes a parent out of use until a probe succeeds; the caller
+// must hold ph.mu
+func (ph *ParentHealth) markDown(addr string, state *parentState, err error) {
+	state.up = false
+	state.backoff = 0
+	state.nextProbe = time.Time{}
+	ph.transitions.Add(1)
+	ph.diag.Warnf("Parent proxy %s is down: %v", addr, err)
+}
+
+// Run probes parents until stop is closed: up parents every
+// parent_check_interval, down ones at a backoff starting there and
+// doubling up to maxParentProbeBackoff. A probe connects to the parent,
+// and with parent_probe_host set also opens a tunnel through it.
+func (ph *ParentHealth) Run(config func() *Config, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			cfg := config()
+			ph.mu.Lock()
+			for addr, state := range ph.parents {
+				if state.probing || now.Before(state.nextProbe) {
+					continue
+				}
+				state.probing = true
+				go ph.probe(addr, state.kind, cfg)
+			}
+			ph.mu.Unlock()
+		}
+	}
+}
+
+// probe checks one parent and schedules its next probe
+func (ph *ParentHealth) probe(addr, kind string, config *Config) {
+	var conn net.Conn
+	var err error
+	if config.ParentProbeHost != "" {
+		conn, err = dialParent(context.Background(), kind, addr, config.ParentProbeHost, config.UpstreamConnectTimeout, true)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, config.UpstreamConnectTimeout)
+	}
+	if err == nil {
+		conn.Close()
+	}
+
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	state, ok := ph.parents[addr]
+	if !ok {
+		return
+	}
+	state.probing = false
+
+	switch {
+	case err == nil:
+		state.failures = 0
+		ph.markUp(addr, state)
+		state.nextProbe = time.Now().Add(config.ParentCheckInterval)
+	case state.up:
+		ph.markDown(addr, state, err)
+		fallthrough
+	default:
+		if state.backoff == 0 {
+			state.backoff = config.ParentCheckInterval
+		} else {
+			state.backoff = min(state.backoff*2, maxParentProbeBackoff)
+		}
+		state.nextProbe = time.Now().Add(state.backoff)
+	}
+}
+
+// States returns "up" or "down" for each parent, by address
+func (ph *ParentHealth) States() map[string]string {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	states := make(map[string]string, len(ph.parents))
+	for addr, state := range ph.parents {
+		if state.up {
+			states[addr] = "up"
+		} else {
+			states[addr] = "down"
+		}
+	}
+	return states
+}
+
+// sortedParents returns the addresses of states in order
+func sortedParents(states map[string]string) []string {
+	addrs := make([]string, 0, len(states))
+	for addr := range states {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
@@ -1,13 +1,15 @@
-package main
+package proxy
 
 import (
 	"bufio"
 	"fmt"
 	"io"
 	"net"
+	"net/http/httputil"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // HTTPRequest represents a parsed HTTP request
@@ -16,16 +18,77 @@ type HTTPRequest struct {
 	RequestTarget string
 	Version       string
 	Headers       map[string]string
-	Body          []byte
+	Body          io.Reader // Streams the body from the client; nil if there is none
+	ContentLength int64     // Length of Body, or -1 if it is chunked
 	Host          string
 	Port          int
 	IsConnect     bool
+	ID            string // Correlation ID for logs and X-Request-Id
+	Username      string // Authenticated proxy user, if any
+	Route         string // Route the request was sent over, see RoutingRules
+	UpstreamIP    string // Address a direct connection was made to, if Host is a name
+	Persistent    bool   // The response left the connection usable for a pipelined request
+	ReverseRoute  string // Host pattern that routed the request, on a reverse proxy listener
+
+	Received     time.Time     // When parsing of the request head began
+	UpstreamTTFB time.Duration // From sending the request to the response head, if one arrived
+
+	// Policy applied to the user's requests, if policies_file maps one
+	Policy *Policy
+
+	// Filter rule the request matched, if any; log_only matches are
+	// forwarded
+	FilterMatch *FilterMatch
+
+	// Expression rule the request matched, if any; a route rule's route
+	// replaces the one routing_rules_file gives
+	RuleMatch *ExprMatch
+
+	// "original → rewritten" target, or host:port for a CONNECT, if
+	// rewrite_rules_file changed the request
+	Rewrite string
+
+	// How a plain HTTP request for one of the https_upgrade_domains was
+	// upgraded: redirect or rewrite
+	HTTPSUpgrade string
+
+	// Host the request was for before enforce_safesearch sent it to an
+	// enforcement host, if it did
+	SafeSearchFrom string
+
+	// Exchange being recorded under record_dir, if any
+	Recording *Recording
+
+	// Response being copied for the cache, if it may be stored
+	CacheCapture *CacheCapture
+
+	// Fault injection rule applied to the request, if any
+	Fault *FaultRule
+
+	// Where the request's time went, see RequestTrace
+	Trace RequestTrace
 }
 
 // ParseHTTPRequest parses an HTTP request from a reader
 func ParseHTTPRequest(reader *bufio.Reader) (*HTTPRequest, error) {
+	req, err := ParseRequestHead(reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.CompleteRequest(reader); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ParseRequestHead parses the request line and headers, leaving the
+// destination and body to CompleteRequest
+func ParseRequestHead(reader *bufio.Reader) (*HTTPRequest, error) {
+	now := time.Now()
 	req := &HTTPRequest{
-		Headers: make(map[string]string),
+		Headers:  make(map[string]string),
+		Received: now,
+		Trace:    RequestTrace{since: now},
 	}
 
 	// Read request line
@@ -58,7 +121,6 @@ func ParseHTTPRequest(reader *bufio.Reader) (*HTTPRequest, error) {
 			return nil, fmt.Errorf("invalid port in CONNECT: %w", err)
 		}
 		req.Port = port
-		return req, nil
 	}
 
 	// Read headers until empty line
@@ -84,17 +146,25 @@ func ParseHTTPRequest(reader *bufio.Reader) (*HTTPRequest, error) {
 		req.Headers[key] = value
 	}
 
-	// Extract host and port from request
-	if err := req.extractHostAndPort(); err != nil {
-		return nil, err
+	return req, nil
+}
+
+// CompleteRequest extracts the destination and sets up the body of a
+// request whose head has been parsed. The body isn't read: Body streams it
+// from reader, which must not be used for anything else until Body returns
+// io.EOF.
+func (req *HTTPRequest) CompleteRequest(reader *bufio.Reader) error {
+	// CONNECT takes its destination from the request target and has no body
+	if req.IsConnect {
+		return nil
 	}
 
-	// Read body if present
-	if err := req.readBody(reader); err != nil {
-		return nil, err
+	// Extract host and port from request
+	if err := req.extractHostAndPort(); err != nil {
+		return err
 	}
 
-	return req, nil
+	return req.prepareBody(reader)
 }
 
 // extractHostAndPort extracts host and port from request target and headers
@@ -145,14 +215,27 @@ func (req *HTTPRequest) extractHostAndPort() error {
 	return nil
 }
 
-// readBody reads the request body if present
-func (req *HTTPRequest) readBody(reader *bufio.Reader) error {
+// prepareBody sets Body and ContentLength from the framing headers. A
+// chunked body is decoded here and re-encoded on the way upstream, and any
+// Content-Length sent with it is dropped, since the two disagreeing is how
+// requests are smuggled past a proxy.
+func (req *HTTPRequest) prepareBody(reader *bufio.Reader) error {
+	if encoding, ok := req.Headers["transfer-encoding"]; ok {
+		if !strings.EqualFold(strings.TrimSpace(encoding), "chunked") {
+			return fmt.Errorf("unsupported Transfer-Encoding: %s", encoding)
+		}
+		delete(req.Headers, "content-length")
+		req.Body = &chunkedBody{reader: reader, chunks: httputil.NewChunkedReader(reader)}
+		req.ContentLength = -1
+		return nil
+	}
+
 	contentLengthStr, ok := req.Headers["content-length"]
 	if !ok {
 		return nil // No body
 	}
 
-	contentLength, err := strconv.Atoi(contentLengthStr)
+	contentLength, err := strconv.ParseInt(contentLengthStr, 10, 64)
 	if err != nil {
 		return fmt.Errorf("invalid Content-Length: %w", err)
 	}
@@ -161,21 +244,62 @@ func (req *HTTPRequest) readBody(reader *bufio.Reader) error {
 		return fmt.Errorf("negative Content-Length")
 	}
 
-	if contentLength > 10*1024*1024 { // 10MB limit
-		return fmt.Errorf("Content-Length too large: %d", contentLength)
+	req.ContentLength = contentLength
+	if contentLength > 0 {
+		req.Body = io.LimitReader(reader, contentLength)
 	}
+	return nil
+}
 
-	req.Body = make([]byte, contentLength)
-	_, err = io.ReadFull(reader, req.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read body: %w", err)
+// chunkedBody reads a chunked request body, discarding any trailer fields
+// after the last chunk so that reader is left at the next request
+type chunkedBody struct {
+	reader *bufio.Reader
+	chunks io.Reader
+	done   bool
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
 	}
+	n, err := b.chunks.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	for {
+		line, err := b.reader.ReadString('\n')
+		if err != nil {
+			return n, fmt.Errorf("failed to read trailer: %w", err)
+		}
+		if strings.TrimRight(line, "\r\n") == "" {
+			b.done = true
+			return n, io.EOF
+		}
+	}
+}
 
-	return nil
+// SerializeProxyRequest serializes the request for a parent proxy, which
+// needs an absolute-form target
+func (req *HTTPRequest) SerializeProxyRequest() []byte {
+	target := req.RequestTarget
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		host := req.Host
+		if req.Port != 80 {
+			host = net.JoinHostPort(req.Host, strconv.Itoa(req.Port))
+		}
+		target = "http://" + host + target
+	}
+	return req.serialize(fmt.Sprintf("%s %s %s\r\n", req.Method, target, req.Version))
 }
 
 // SerializeRequest serializes the request for forwarding to upstream
 func (req *HTTPRequest) SerializeRequest() []byte {
+	return req.serialize(req.originRequestLine())
+}
+
+// originRequestLine returns the request line with an origin-form target
+func (req *HTTPRequest) originRequestLine() string {
 	var builder strings.Builder
 
 	// Request line
@@ -198,6 +322,15 @@ func (req *HTTPRequest) SerializeRequest() []byte {
 		builder.WriteString(fmt.Sprintf("%s %s %s\r\n", req.Method, req.RequestTarget, req.Version))
 	}
 
+	return builder.String()
+}
+
+// serialize writes requestLine followed by the headers; the body is
+// streamed separately
+func (req *HTTPRequest) serialize(requestLine string) []byte {
+	var builder strings.Builder
+	builder.WriteString(requestLine)
+
 	// Headers
 	for key, value := range req.Headers {
 		// Capitalize header name properly
@@ -206,11 +339,6 @@ func (req *HTTPRequest) SerializeRequest() []byte {
 	}
 	builder.WriteString("\r\n")
 
-	// Body
-	if len(req.Body) > 0 {
-		builder.Write(req.Body)
-	}
-
 	return []byte(builder.String())
 }
 
@@ -233,4 +361,3 @@ func GetClientIP(conn net.Conn) string {
 	}
 	return addr.String()
 }
-
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy is the filtering and limits applied to the requests of the users
+// mapped to it, in place of blocked_domains_file and rate_limit_rps
+type Policy struct {
+	Name      string
+	blocklist []*Filter    // none blocks nothing
+	ports     [][2]int     // allowed destination port ranges; nil allows any
+	rate      float64      // requests per second; 0 for no limit
+	burst     int          // burst allowed above rate
+	limiter   *RateLimiter // per-client buckets, when rate is set
+}
+
+// Match checks host and port against the policy's blocklists, as
+// Filter.Match does
+func (p *Policy) Match(host string, port int) (FilterMatch, bool) {
+	for _, filter := range p.blocklist {
+		if match, ok := filter.Match(host, port); ok {
+			return match, true
+		}
+	}
+	return FilterMatch{}, false
+}
+
+// AllowsPort reports whether the policy lets requests reach port
+func (p *Policy) AllowsPort(port int) bool {
+	if p.ports == nil {
+		return true
+	}
+	for _, r := range p.ports {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow applies the policy's rate limit to the client at addr, as
+// RateLimiter.Allow does
+func (p *Policy) Allow(addr net.Addr) (bool, time.Duration) {
+	if p.limiter == nil {
+		return true, 0
+	}
+	return p.limiter.Allow(addr)
+}
+
+// Policies maps proxy users to policies
+type Policies struct {
+	policies      map[string]*Policy
+	users         map[string]string // username to policy name
+	defaultPolicy string            // for unauthenticated and unmapped users; empty for none
+}
+
+// LoadPolicies loads the policies file, whose lines are:
+//
+//	policy name [blocklist=file,...] [ports=80,443,8000-8100] [rate=rps[/burst]]
+//	user username policy-name
+//
+// defaultPolicy, if not empty, must name one of the policies, and strict is
+// strict_rules, applied to the blocklists. An empty path loads no
+// policies, so every request gets the global filter and limits.
+func LoadPolicies(path string, defaultPolicy string, strict bool, diag *DiagLogger) (*Policies, error) {
+	p := &Policies{
+		policies:      make(map[string]*Policy),
+		users:         make(map[string]string),
+		defaultPolicy: defaultPolicy,
+	}
+	if path == "" {
+		return p, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open policies file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	userLines := make(map[string]int)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch strings.ToLower(fields[0]) {
+		case "policy":
+			policy, err := parsePolicy(fields[1:], strict, diag)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+			}
+			if _, ok := p.policies[policy.Name]; ok {
+				return nil, fmt.Errorf("%s:%d: policy %q defined twice", path, lineNum, policy.Name)
+			}
+			p.policies[policy.Name] = policy
+		case "user":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s:%d: want \"user username policy\"", path, lineNum)
+			}
+			p.users[fields[1]] = fields[2]
+			userLines[fields[1]] = lineNum
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown directive %q (want policy or user)", path, lineNum, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read policies file: %w", err)
+	}
+
+	for user, name := range p.users {
+		if _, ok := p.policies[name]; !ok {
+			return nil, fmt.Errorf("%s:%d: user %s has unknown policy %q", path, userLines[user], user, name)
+		}
+	}
+	if _, ok := p.policies[defaultPolicy]; defaultPolicy != "" && !ok {
+		return nil, fmt.Errorf("default_policy %q is not defined in %s", defaultPolicy, path)
+	}
+	return p, nil
+}
+
+// parsePolicy parses the name and settings of a policy line; strict is
+// strict_rules, for its blocklists
+func parsePolicy(fields []string, strict bool, diag *DiagLogger) (*Policy, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("policy needs a name")
+	}
+	policy := &Policy{Name: fields[0]}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid policy setting %q (want key=value)", field)
+		}
+		switch key {
+		case "blocklist":
+			for _, path := range strings.Split(value, ",") {
+				if path == "" {
+					continue
+				}
+				// Unlike blocked_domains_file, a missing list is an error
+				// rather than no rules
+				if _, err := os.Stat(path); err != nil {
+					return nil, fmt.Errorf("policy %s blocklist: %w", policy.Name, err)
+				}
+				filter := NewFilter(diag)
+				if _, err := filter.LoadRules(path, strict); err != nil {
+					return nil, fmt.Errorf("policy %s blocklist: %w", policy.Name, err)
+				}
+				policy.blocklist = append(policy.blocklist, filter)
+			}
+		case "ports":
+			ports, err := parsePortRanges(value)
+			if err != nil {
+				return nil, fmt.Errorf("policy %s ports: %w", policy.Name, err)
+			}
+			policy.ports = ports
+		case "rate":
+			rate, burst, hasBurst := strings.Cut(value, "/")
+			rps, err := strconv.ParseFloat(rate, 64)
+			if err != nil || rps <= 0 {
+				return nil, fmt.Errorf("policy %s: invalid rate %q", policy.Name, value)
+			}
+			policy.rate, policy.burst = rps, 1
+			if hasBurst {
+				if policy.burst, err = strconv.Atoi(burst); err != nil || policy.burst < 1 {
+					return nil, fmt.Errorf("policy %s: invalid rate burst %q", policy.Name, value)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("policy %s: unknown setting %q", policy.Name, key)
+		}
+	}
+	return policy, nil
+}
+
+// parsePortRanges parses comma-separated ports and low-high ranges
+func parsePortRanges(value string) ([][2]int, error) {
+	var ranges [][2]int
+	for _, part := range strings.Split(value, ",") {
+		if part == "" {
+			continue
+		}
+		low, high, isRange := strings.Cut(part, "-")
+		if !isRange {
+			high = low
+		}
+		from, err1 := strconv.Atoi(low)
+		to, err2 := strconv.Atoi(high)
+		if err1 != nil || err2 != nil || from < 1 || to > 65535 || from > to {
+			return nil, fmt.Errorf("invalid port or range %q", part)
+		}
+		ranges = append(ranges, [2]int{from, to})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no ports given")
+	}
+	return ranges, nil
+}
+
+// Resolve returns the policy for username, or the default policy for an
+// unauthenticated or unmapped user; nil means the global filter and limits
+func (p *Policies) Resolve(username string) *Policy {
+	name, ok := p.users[username]
+	if username == "" || !ok {
+		name = p.defaultPolicy
+	}
+	return p.policies[name]
+}
+
+// startLimiters gives the rate limited policies their limiters, taking over
+// those of same-named policies in previous (which may be nil) so clients
+// keep their buckets across a reload
+func (p *Policies) startLimiters(previous *Policies, config *Config) {
+	for name, policy := range p.policies {
+		if policy.rate <= 0 {
+			continue
+		}
+		limits := *config
+		limits.RateLimitRPS = policy.rate
+		limits.RateLimitBurst = policy.burst
+		limits.RateLimitExemptCIDRs = nil
+		if previous != nil {
+			if old, ok := previous.policies[name]; ok && old.limiter != nil {
+				policy.limiter = old.limiter
+				policy.limiter.Reconfigure(&limits)
+				continue
+			}
+		}
+		policy.limiter = NewRateLimiter(&limits)
+	}
+}
@@ -0,0 +1,331 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// policyExecWaitDelay is how long a timed-out program's output pipes are
+// waited for after it is killed, in case it left children holding them
+const policyExecWaitDelay = 100 * time.Millisecond
+
+// policyExecMaxOutput caps the stdout read from the program
+const policyExecMaxOutput = 64 * 1024
+
+// Verdict actions a policy_exec program may return
+const (
+	policyAllow   = "allow"
+	policyBlock   = "block"
+	policyRewrite = "rewrite"
+)
+
+// policyExecRequest is the document written to the program's stdin, the
+// same one auth_hook_url is sent
+type policyExecRequest = authHookRequest
+
+// PolicyVerdict is a policy_exec program's decision. Block may carry the
+// status code and message to send the client, defaulting to 403
+// Forbidden; rewrite sends the request to Host and Port instead, either
+// left empty keeping the original.
+type PolicyVerdict struct {
+	Action  string `json:"action"` // allow, block or rewrite; empty allows
+	Status  int    `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Port    int    `json:"port,omitempty"`
+}
+
+// cachedPolicyVerdict is a verdict and when it stops being used
+type cachedPolicyVerdict struct {
+	verdict PolicyVerdict
+	expires time.Time
+}
+
+// PolicyExec asks an external program whether a request may proceed, with
+// the request as JSON on its stdin. Exit status 0 allows the request
+// unless stdout holds a PolicyVerdict saying otherwise; 1 blocks it, with
+// stdout optionally giving the status and message. Any other exit, a crash
+// or running past policy_exec_timeout is a failure, and
+// policy_exec_fail_open decides. At most policy_exec_workers programs run
+// at once; requests wait for one within the timeout. Verdicts are cached
+// per client, user, method and destination for policy_exec_cache_ttl.
+type PolicyExec struct {
+	mu       sync.Mutex // guards the fields below; never held while a program runs
+	path     string
+	timeout  time.Duration
+	ttl      time.Duration
+	maxSize  int
+	slots    chan struct{} // one per running program, up to policy_exec_workers
+	verdicts map[string]cachedPolicyVerdict
+}
+
+// NewPolicyExec creates a policy program runner from the configuration
+func NewPolicyExec(config *Config) *PolicyExec {
+	pe := &PolicyExec{verdicts: make(map[string]cachedPolicyVerdict)}
+	pe.Reconfigure(config)
+	return pe
+}
+
+// Reconfigure applies reloaded policy_exec settings; cached verdicts are
+// dropped if the program changed. Programs already running finish under
+// the old worker limit.
+func (pe *PolicyExec) Reconfigure(config *Config) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if config.PolicyExec != pe.path {
+		pe.verdicts = make(map[string]cachedPolicyVerdict)
+	}
+	if pe.slots == nil || cap(pe.slots) != config.PolicyExecWorkers {
+		pe.slots = make(chan struct{}, config.PolicyExecWorkers)
+	}
+	pe.path = config.PolicyExec
+	pe.timeout = config.PolicyExecTimeout
+	pe.ttl = config.PolicyExecCacheTTL
+	pe.maxSize = config.PolicyExecCacheSize
+}
+
+// Enabled reports whether a policy program is configured
+func (pe *PolicyExec) Enabled() bool {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	return pe.path != ""
+}
+
+// Check returns the verdict for req from clientIP, from the cache or by
+// running the program, and whether it came from the cache. An error means
+// the program failed or gave an unusable answer; the caller applies
+// policy_exec_fail_open.
+func (pe *PolicyExec) Check(clientIP string, req *HTTPRequest) (PolicyVerdict, bool, error) {
+	key := clientIP + "|" + req.Username + "|" + req.Method + "|" + req.Host + ":" + strconv.Itoa(req.Port)
+
+	pe.mu.Lock()
+	path, timeout, slots := pe.path, pe.timeout, pe.slots
+	if cached, ok := pe.verdicts[key]; ok && time.Now().Before(cached.expires) {
+		pe.mu.Unlock()
+		return cached.verdict, true, nil
+	}
+	pe.mu.Unlock()
+
+	verdict, err := pe.run(path, timeout, slots, policyExecRequest{
+		ClientIP: clientIP,
+		Username: req.Username,
+		Host:     req.Host,
+		Port:     req.Port,
+		Method:   req.Method,
+		Target:   req.RequestTarget,
+	})
+	if err != nil {
+		return PolicyVerdict{}, false, err
+	}
+
+	pe.store(key, verdict)
+	return verdict, false, nil
+}
+
+// run waits for a free slot and runs the program once, both within timeout
+func (pe *PolicyExec) run(path string, timeout time.Duration, slots chan struct{}, body policyExecRequest) (PolicyVerdict, error) {
+	var verdict PolicyVerdict
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return verdict, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	select {
+	case slots <- struct{}{}:
+		defer func() { <-slots }()
+	case <-ctx.Done():
+		return verdict, fmt.Errorf("policy_exec: all %d workers busy for %s", cap(slots), timeout)
+	}
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(payload)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &limitedBuffer{buf: &stdout, limit: policyExecMaxOutput}
+	cmd.Stderr = &limitedBuffer{buf: &stderr, limit: 512}
+	cmd.WaitDelay = policyExecWaitDelay
+	err = cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		return verdict, fmt.Errorf("policy_exec timed out after %s", timeout)
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		verdict.Action = policyBlock
+	case err != nil:
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return verdict, fmt.Errorf("policy_exec failed: %v: %s", err, msg)
+		}
+		return verdict, fmt.Errorf("policy_exec failed: %w", err)
+	}
+
+	output := bytes.TrimSpace(stdout.Bytes())
+	if len(output) == 0 {
+		return verdict, nil
+	}
+	if verdict.Action == policyBlock {
+		// Exit status 1 blocks whatever the output says; it only gives
+		// the status and message, if it can be read
+		json.Unmarshal(output, &verdict)
+		verdict.Action = policyBlock
+		return verdict, nil
+	}
+	if err := json.Unmarshal(output, &verdict); err != nil {
+		return PolicyVerdict{}, fmt.Errorf("invalid policy_exec output: %w", err)
+	}
+	switch verdict.Action {
+	case "", policyAllow, policyBlock:
+	case policyRewrite:
+		if verdict.Host == "" && verdict.Port == 0 {
+			return PolicyVerdict{}, errors.New("invalid policy_exec output: rewrite without host or port")
+		}
+		if verdict.Port < 0 || verdict.Port > 65535 || strings.ContainsAny(verdict.Host, " /\r\n") {
+			return PolicyVerdict{}, fmt.Errorf("invalid policy_exec output: bad rewrite destination %q port %d", verdict.Host, verdict.Port)
+		}
+	default:
+		return PolicyVerdict{}, fmt.Errorf("invalid policy_exec output: unknown action %q", verdict.Action)
+	}
+	return verdict, nil
+}
+
+// store caches a verdict. When the cache is full, expired verdicts are
+// dropped first, then arbitrary ones, so it stays within
+// policy_exec_cache_size.
+func (pe *PolicyExec) store(key string, verdict PolicyVerdict) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	if pe.ttl <= 0 || pe.maxSize <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if len(pe.verdicts) >= pe.maxSize {
+		for k, cached := range pe.verdicts {
+			if now.After(cached.expires) {
+				delete(pe.verdicts, k)
+			}
+		}
+		for k := range pe.verdicts {
+			if len(pe.verdicts) < pe.maxSize {
+				break
+			}
+			delete(pe.verdicts, k)
+		}
+	}
+	pe.verdicts[key] = cachedPolicyVerdict{verdict: verdict, expires: now.Add(pe.ttl)}
+}
+
+// denial returns the status code and single-line message to send for a
+// blocking verdict
+func (v PolicyVerdict) denial() (int, string) {
+	return AuthVerdict{Status: v.Status, Message: v.Message}.denial()
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the
+// rest, so a chatty program can't use unbounded memory
+type limitedBuffer struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if room := lb.limit - lb.buf.Len(); room > 0 {
+		lb.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// applyPolicyExec asks the policy_exec program about req, answering and
+// logging it if it is blocked and sending it elsewhere if it is rewritten,
+// and reports whether the request was answered
+func (s *Server) applyPolicyExec(conn net.Conn, req *HTTPRequest, config *Config) bool {
+	if !s.policyExec.Enabled() {
+		return false
+	}
+
+	verdict, cached, err := s.policyExec.Check(GetClientIP(conn), req)
+	if err != nil {
+		s.diag.Warnf("Request %s: %v", req.ID, err)
+		if config.PolicyExecFailOpen {
+			return false
+		}
+		s.sendErrorResponse(conn, req, 503, "Service Unavailable")
+		s.logRequest(conn, req, "POLICY_ERROR", 503, 0, 0, err.Error())
+		return true
+	}
+	source := "exec"
+	if cached {
+		source = "cache"
+	}
+	s.diag.Debugf("Request %s: policy_exec verdict for %s:%d from %s: %+v", req.ID, req.Host, req.Port, source, verdict)
+
+	switch verdict.Action {
+	case policyBlock:
+		status, message := verdict.denial()
+		s.sendErrorResponse(conn, req, status, message)
+		s.logRequest(conn, req, "POLICY_DENIED", status, 0, 0, message+" ("+source+")")
+		return true
+	case policyRewrite:
+		host, port := verdict.Host, verdict.Port
+		if host == "" {
+			host = req.Host
+		}
+		if port == 0 {
+			port = req.Port
+		}
+		s.diag.Debugf("Request %s: policy_exec rewrites %s:%d to %s:%d", req.ID, req.Host, req.Port, host, port)
+		retarget(req, host, port)
+	}
+	return false
+}
+
+// retarget sends req to host and port. A CONNECT only has its destination
+// changed; a plain HTTP request also has its Host header and absolute
+// target rewritten, so a parent proxy goes there too.
+func retarget(req *HTTPRequest, host string, port int) {
+	oldPort := req.Port
+	req.Host, req.Port = host, port
+	if req.IsConnect {
+		return
+	}
+
+	hostPort := func(defaultPort int) string {
+		if port != defaultPort {
+			return net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	if _, ok := req.Headers["host"]; ok {
+		defaultPort := 80
+		if strings.HasPrefix(req.RequestTarget, "https://") || oldPort == 443 {
+			defaultPort = 443
+		}
+		req.Headers["host"] = hostPort(defaultPort)
+	}
+	if strings.HasPrefix(req.RequestTarget, "http://") || strings.HasPrefix(req.RequestTarget, "https://") {
+		if u, err := url.Parse(req.RequestTarget); err == nil {
+			defaultPort := 80
+			if u.Scheme == "https" {
+				defaultPort = 443
+			}
+			u.Host = hostPort(defaultPort)
+			req.RequestTarget = u.String()
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// dropPrivileges switches to run_as_user and run_as_group once the
+// listeners are bound, so ports below 1024 need root only at startup. The
+// log files are handed over to the new user and the access log reopened,
+// then the files the configuration refers to are checked again. A switch
+// that didn't take, or a file the new user can't use, is an error and the
+// proxy doesn't serve.
+func (s *Server) dropPrivileges(config *Config) error {
+	if config.RunAsUser == "" && config.RunAsGroup == "" {
+		return nil
+	}
+
+	uid, gid, err := lookupIdentity(config.RunAsUser, config.RunAsGroup)
+	if err != nil {
+		return err
+	}
+
+	// Problems that were already there aren't the new user's doing
+	before := make(map[string]bool)
+	for _, problem := range CheckConfigFiles(config) {
+		before[problem] = true
+	}
+
+	// The log files were opened as root, which may have created them; hand
+	// them over so they can be reopened when rotated
+	if s.options.logger == nil {
+		paths := []string{config.LogFilePath}
+		if config.LogBackend != "file" {
+			paths = append(paths, config.LogDBPath, config.LogDBPath+"-wal", config.LogDBPath+"-shm")
+		}
+		for _, path := range paths {
+			if err := os.Chown(path, uid, gid); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to hand %s over to uid %d: %w", path, uid, err)
+			}
+		}
+	}
+
+	if err := setIdentity(uid, gid); err != nil {
+		return fmt.Errorf("failed to switch to uid %d, gid %d: %w", uid, gid, err)
+	}
+	if os.Getuid() != uid || os.Geteuid() != uid || os.Getgid() != gid || os.Getegid() != gid {
+		return fmt.Errorf("failed to switch to uid %d, gid %d: still running as uid %d, gid %d", uid, gid, os.Geteuid(), os.Getegid())
+	}
+	s.diag.Infof("Dropped privileges to uid %d, gid %d", uid, gid)
+
+	var problems []string
+	if s.options.logger == nil {
+		if err := s.logger.Reopen(); err != nil {
+			problems = append(problems, fmt.Sprintf("log_file_path: %v", err))
+		}
+	}
+	for _, problem := range CheckConfigFiles(config) {
+		if !before[problem] {
+			problems = append(problems, problem)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("after dropping privileges: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// lookupIdentity resolves run_as_user and run_as_group, each a name or a
+// numeric id, to a uid and gid. An unset user keeps the current uid; an
+// unset group is the user's primary group.
+func lookupIdentity(userName, groupName string) (uid, gid int, err error) {
+	uid, gid = os.Getuid(), os.Getgid()
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return 0, 0, fmt.Errorf("run_as_user: unknown user %q", userName)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("run_as_group: unknown group %q", groupName)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// canDropPrivileges reports that run_as_user and run_as_group can't be
+// honoured on this platform
+const canDropPrivileges = false
+
+// setIdentity reports that switching users isn't available on this platform
+func setIdentity(uid, gid int) error {
+	return fmt.Errorf("switching users is not supported on %s", runtime.GOOS)
+}
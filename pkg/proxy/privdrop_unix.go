@@ -0,0 +1,24 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package proxy
+
+import (
+	"syscall"
+)
+
+// canDropPrivileges reports whether run_as_user and run_as_group can be
+// honoured on this platform
+const canDropPrivileges = true
+
+// setIdentity switches every thread of the process to uid and gid, with gid
+// as the only supplementary group. The group goes first, while the process
+// still may change it.
+func setIdentity(uid, gid int) error {
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
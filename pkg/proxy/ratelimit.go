@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitGCInterval is how often idle client buckets are swept
+const rateLimitGCInterval = 1 * time.Minute
+
+// tokenBucket holds one client's request allowance
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter applies a per-client token bucket to requests: each client
+// may make rate_limit_rps requests per second on average, with bursts of up
+// to rate_limit_burst
+type RateLimiter struct {
+	mu         sync.Mutex
+	buckets    map[string]*tokenBucket
+	rate       float64
+	burst      float64
+	ipv6Prefix int
+	exempt     []*net.IPNet
+	lastGC     time.Time
+}
+
+// NewRateLimiter creates a rate limiter from the configuration
+func NewRateLimiter(config *Config) *RateLimiter {
+	rl := &RateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		lastGC:  time.Now(),
+	}
+	rl.Reconfigure(config)
+	return rl
+}
+
+// Reconfigure applies reloaded rate limit settings; existing buckets keep
+// their tokens, capped at the new burst
+func (rl *RateLimiter) Reconfigure(config *Config) {
+	// Validate has already checked the CIDRs
+	exempt, _ := parseCIDRList(config.RateLimitExemptCIDRs)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.rate = config.RateLimitRPS
+	rl.burst = float64(config.RateLimitBurst)
+	rl.ipv6Prefix = config.IPv6LimitPrefix
+	rl.exempt = exempt
+}
+
+// Allow takes a token from the bucket of the client at addr. If the client
+// is over its rate it returns false and how long until a token is available.
+func (rl *RateLimiter) Allow(addr net.Addr) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.rate <= 0 {
+		return true, 0
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		for _, network := range rl.exempt {
+			if network.Contains(tcpAddr.IP) {
+				return true, 0
+			}
+		}
+	}
+
+	now := time.Now()
+	if now.Sub(rl.lastGC) >= rateLimitGCInterval {
+		rl.gc(now)
+	}
+
+	key := connLimitKey(addr, rl.ipv6Prefix)
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = bucket
+	}
+
+	// Refill for the time since the client's last request
+	bucket.tokens = math.Min(rl.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rl.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rl.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// gc drops buckets that have been idle long enough to refill completely,
+// since a full bucket behaves the same as a new one; the caller must hold
+// rl.mu
+func (rl *RateLimiter) gc(now time.Time) {
+	refill := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastGC = now
+}
+
+// parseCIDRList parses CIDR entries; a bare IP address matches only itself
+func parseCIDRList(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address or CIDR %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	config := DefaultConfig()
+	config.RateLimitRPS = 0.1
+	config.RateLimitBurst = 5
+	config.RateLimitExemptCIDRs = []string{"10.0.0.0/8"}
+	rl := NewRateLimiter(config)
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	allowed, denied := 0, 0
+	for i := 0; i < 20; i++ {
+		if ok, wait := rl.Allow(client); ok {
+			allowed++
+		} else {
+			denied++
+			if wait <= 0 {
+				t.Errorf("denied request %d with no wait", i)
+			}
+		}
+	}
+	if allowed != 5 || denied != 15 {
+		t.Errorf("allowed %d and denied %d of 20, want 5 and 15", allowed, denied)
+	}
+
+	// Other clients have their own buckets, and exempt ones have none
+	if ok, _ := rl.Allow(&net.TCPAddr{IP: net.ParseIP("192.0.2.2")}); !ok {
+		t.Error("a second client was denied its first request")
+	}
+	exempt := &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}
+	for i := 0; i < 20; i++ {
+		if ok, _ := rl.Allow(exempt); !ok {
+			t.Fatalf("exempt client denied request %d", i)
+		}
+	}
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	config := testConfig(t)
+	config.RateLimitRPS = 0.1
+	config.RateLimitBurst = 3
+	_, addr := startServer(t, config)
+
+	counts := map[int]int{}
+	for i := 0; i < 10; i++ {
+		resp := proxyGet(t, dialProxy(t, addr), origin.URL+"/", 5*time.Second)
+		counts[resp.StatusCode]++
+		if resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Errorf("429 for request %d has no Retry-After", i)
+		}
+	}
+	if counts[http.StatusOK] != 3 || counts[http.StatusTooManyRequests] != 7 {
+		t.Errorf("got status counts %v, want 3 200s and 7 429s", counts)
+	}
+}
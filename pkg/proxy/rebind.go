@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// listenerChange is a reload's change to the proxy and admin listeners. The
+// new addresses are bound by prepareListeners before anything else changes;
+// commit then starts accepting on them and only afterwards stops accepting
+// on the removed ones, whose connections are left to finish. Until commit,
+// abort closes whatever was bound, leaving the running listeners untouched.
+// A nil change does nothing.
+type listenerChange struct {
+	s         *Server
+	listeners []*proxyListener // the new set in configuration order, nil if unchanged
+	labels    []string         // the label of each of listeners
+	added     []*proxyListener // bound for this change
+	removed   []*proxyListener // running listeners the new set drops
+
+	adminChanged bool
+	adminAddr    string
+	admin        net.Listener // bound for the new admin_listen, nil when it is now unset
+
+	committed bool
+}
+
+// prepareListeners binds the listeners config adds to those old has, and a
+// changed admin_listen. A listener whose address and TLS setting are
+// unchanged stays bound, taking on its new label. On failure nothing is
+// left bound.
+func (s *Server) prepareListeners(old, config *Config) (*listenerChange, error) {
+	specs := config.ListenerSpecs()
+	specsChanged := !reflect.DeepEqual(old.ListenerSpecs(), specs)
+	adminChanged := config.AdminListen != old.AdminListen
+	if !specsChanged && !adminChanged {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	var current, injected []*proxyListener
+	for _, l := range s.listeners {
+		if l.injected {
+			injected = append(injected, l)
+		} else {
+			current = append(current, l)
+		}
+	}
+	configListeners := s.configListeners
+	s.mu.Unlock()
+	if len(current) == 0 && len(injected) == 0 {
+		// Not started yet; Start binds from the new config
+		return nil, nil
+	}
+	// Listeners passed to Serve stay as they are, and the configured ones
+	// are only bound by a server that was started with Listen
+	specsChanged = specsChanged && configListeners
+	if !specsChanged && !adminChanged {
+		return nil, nil
+	}
+
+	change := &listenerChange{s: s, adminChanged: adminChanged, adminAddr: config.AdminListen}
+	if specsChanged {
+		for _, spec := range specs {
+			if spec.TLS && s.certs.cert.Load() == nil {
+				if err := s.certs.Load(config.TLSCertFile, config.TLSKeyFile); err != nil {
+					change.abort()
+					return nil, err
+				}
+			}
+
+			var pl *proxyListener
+			for i, l := range current {
+				if l != nil && l.address == spec.Address && l.tls == spec.TLS {
+					pl, current[i] = l, nil
+					break
+				}
+			}
+			if pl == nil {
+				var err error
+				if pl, err = s.bindListener(spec, config.ReusePort); err != nil {
+					change.abort()
+					return nil, err
+				}
+				change.added = append(change.added, pl)
+			}
+			change.listeners = append(change.listeners, pl)
+			change.labels = append(change.labels, spec.Label)
+		}
+		for _, l := range current {
+			if l != nil {
+				change.removed = append(change.removed, l)
+			}
+		}
+		for _, l := range injected {
+			change.listeners = append(change.listeners, l)
+			change.labels = append(change.labels, l.Label())
+		}
+	}
+
+	if adminChanged && config.AdminListen != "" {
+		listener, err := net.Listen("tcp", config.AdminListen)
+		if err != nil {
+			change.abort()
+			return nil, fmt.Errorf("failed to listen on admin address %s: %w", config.AdminListen, err)
+		}
+		change.admin = listener
+	}
+	return change, nil
+}
+
+// abort closes what the change bound, unless it was committed
+func (c *listenerChange) abort() {
+	if c == nil || c.committed {
+		return
+	}
+	for _, l := range c.added {
+		l.Close()
+	}
+	if c.admin != nil {
+		c.admin.Close()
+	}
+}
+
+// commit swaps in the new listeners: accepting starts on the added ones,
+// then stops on the removed ones. A removed admin server finishes the
+// requests it is serving within shutdown_grace_period.
+func (c *listenerChange) commit() {
+	if c == nil {
+		return
+	}
+	s := c.s
+
+	// Shutdown closes s.listeners under s.mu after closing s.shutdown, so
+	// once the swap is made under the lock shutdown will close the new set
+	s.mu.Lock()
+	select {
+	case <-s.shutdown:
+		s.mu.Unlock()
+		c.abort()
+		return
+	default:
+	}
+	c.committed = true
+	if c.listeners != nil {
+		for i, l := range c.listeners {
+			l.setLabel(c.labels[i])
+		}
+		s.listeners = c.listeners
+	}
+	var oldAdmin *http.Server
+	if c.adminChanged {
+		oldAdmin = s.admin
+		s.admin = nil
+		if c.admin != nil {
+			s.admin = s.serveAdmin(c.admin)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, l := range c.added {
+		s.serveListener(l)
+		s.diag.Infof("Proxy server listening on %s", l.describe())
+	}
+	for _, l := range c.removed {
+		close(l.stop)
+		l.Close()
+		s.diag.Infof("Stopped listening on %s; its connections are left to finish", l.describe())
+	}
+	if c.listeners != nil {
+		s.diag.Infof("Listeners are now %s", describeListeners(s.Listeners()))
+	}
+
+	if c.adminChanged {
+		if c.admin != nil {
+			s.diag.Infof("Admin server listening on %s", c.adminAddr)
+		}
+		if oldAdmin != nil {
+			grace := s.config.Load().ShutdownGracePeriod
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), grace)
+				defer cancel()
+				if oldAdmin.Shutdown(ctx) != nil {
+					oldAdmin.Close()
+				}
+			}()
+			s.diag.Infof("Stopping the previous admin server once its requests finish")
+		}
+	}
+}
+
+// ListenerStatus describes a bound proxy listener
+type ListenerStatus struct {
+	Label   string `json:"label"`
+	Address string `json:"address"`
+	TLS     bool   `json:"tls"`
+}
+
+// Listeners returns the proxy listeners currently accepting connections
+func (s *Server) Listeners() []ListenerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]ListenerStatus, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		statuses = append(statuses, ListenerStatus{Label: l.Label(), Address: l.Addr().String(), TLS: l.tls})
+	}
+	return statuses
+}
+
+// String returns the listener's address, with its label when it has one of
+// its own and a mark when it uses TLS
+func (l ListenerStatus) String() string {
+	str := l.Address
+	if l.Label != "" && strings.TrimPrefix(l.Label, "tls://") != l.Address {
+		str = l.Label + "=" + str
+	}
+	if l.TLS {
+		str += " (TLS)"
+	}
+	return str
+}
+
+// describeListeners lists listeners for the diagnostic log
+func describeListeners(listeners []ListenerStatus) string {
+	described := make([]string, len(listeners))
+	for i, l := range listeners {
+		described[i] = l.String()
+	}
+	return strings.Join(described, ", ")
+}
@@ -0,0 +1,397 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replay_mode values
+const (
+	replayOff    = "off"
+	replayHybrid = "hybrid"
+	replayStrict = "strict"
+)
+
+// Recording captures one plain HTTP exchange for record_dir: the request
+// body is hashed as it is sent, and the response copied as it is relayed.
+// Bodies over record_max_body_bytes are hashed and counted but not kept.
+type Recording struct {
+	method  string
+	target  string
+	headers map[string]string
+	started time.Time
+	maxBody int64
+
+	bodyHash    hash.Hash
+	body        capture
+	bodyDone    bool // the whole request body was read
+	status      string
+	respHeaders []string
+	resp        capture
+	complete    bool // the whole response body was relayed
+}
+
+// capture keeps up to max bytes written to it, and counts all of them
+type capture struct {
+	max     int64
+	size    int64
+	data    []byte
+	skipped bool
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	if !c.skipped && c.size > c.max {
+		c.skipped, c.data = true, nil
+	}
+	if !c.skipped {
+		c.data = append(c.data, p...)
+	}
+	return len(p), nil
+}
+
+// recordingBody passes a request body through to the upstream, feeding it
+// to the recording
+type recordingBody struct {
+	reader io.Reader
+	rec    *Recording
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.rec.bodyHash.Write(p[:n])
+	b.rec.body.Write(p[:n])
+	if err == io.EOF {
+		b.rec.bodyDone = true
+	}
+	return n, err
+}
+
+// newRecording starts recording req, which must not have been forwarded yet
+func newRecording(req *HTTPRequest, config *Config) *Recording {
+	rec := &Recording{
+		method:   req.Method,
+		target:   req.RequestTarget,
+		headers:  req.Headers,
+		started:  time.Now(),
+		maxBody:  config.RecordMaxBodyBytes,
+		bodyHash: sha256.New(),
+		body:     capture{max: config.RecordMaxBodyBytes},
+		resp:     capture{max: config.RecordMaxBodyBytes},
+		bodyDone: req.Body == nil,
+	}
+	if req.Body != nil {
+		req.Body = &recordingBody{reader: req.Body, rec: rec}
+	}
+	return rec
+}
+
+// key identifies the exchange in record_dir: a hash of the method, target
+// and request body
+func (rec *Recording) key() string {
+	sum := sha256.Sum256([]byte(rec.method + " " + rec.target + "\n" + hex.EncodeToString(rec.bodyHash.Sum(nil))))
+	return hex.EncodeToString(sum[:16])
+}
+
+// response records the head of the response relayed to the client; its
+// body is then written to rec
+func (rec *Recording) response(statusLine string, headers []string) {
+	rec.status = strings.TrimRight(statusLine, "\r\n")
+	rec.respHeaders = headers
+}
+
+func (rec *Recording) Write(p []byte) (int, error) {
+	return rec.resp.Write(p)
+}
+
+// recordedExchange is the JSON file written for an exchange; headers keep
+// their order and repeats, as in a HAR file
+type recordedExchange struct {
+	Recorded time.Time        `json:"recorded"`
+	Key      string           `json:"key"`
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+	Timing   recordedTiming   `json:"timing"`
+}
+
+type recordedRequest struct {
+	Method      string           `json:"method"`
+	URL         string           `json:"url"`
+	Headers     []recordedHeader `json:"headers"`
+	BodySHA256  string           `json:"body_sha256"`
+	BodySize    int64            `json:"body_size"`
+	Body        []byte           `json:"body_base64,omitempty"`
+	BodySkipped bool             `json:"body_skipped,omitempty"` // larger than record_max_body_bytes
+}
+
+type recordedResponse struct {
+	Status      int              `json:"status"`
+	Reason      string           `json:"reason"`
+	Headers     []recordedHeader `json:"headers"`
+	BodySize    int64            `json:"body_size"` // without chunked encoding, unless the body was skipped
+	Body        []byte           `json:"body_base64,omitempty"`
+	BodySkipped bool             `json:"body_skipped,omitempty"` // larger than record_max_body_bytes
+}
+
+type recordedHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type recordedTiming struct {
+	TTFBMillis  float64 `json:"ttfb_ms"` // from sending the request to the response head
+	TotalMillis float64 `json:"total_ms"`
+}
+
+// recordingPath returns the file an exchange for host:port with key is
+// stored in: a directory per destination, a file per key
+func recordingPath(dir, host string, port int, key string) string {
+	name := strings.ToLower(host)
+	if port != 80 {
+		name += "_" + strconv.Itoa(port)
+	}
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	return filepath.Join(dir, name, key+".json")
+}
+
+// exchange builds the file for a recording whose response has been relayed
+// in full, or returns an error saying why it can't be saved
+func (rec *Recording) exchange(req *HTTPRequest) (*recordedExchange, error) {
+	if !rec.bodyDone {
+		return nil, errors.New("request body was not sent in full")
+	}
+	if !rec.complete {
+		return nil, errors.New("response body was not relayed in full")
+	}
+
+	ex := &recordedExchange{
+		Recorded: rec.started,
+		Key:      rec.key(),
+		Request: recordedRequest{
+			Method:      rec.method,
+			URL:         rec.target,
+			BodySHA256:  hex.EncodeToString(rec.bodyHash.Sum(nil)),
+			BodySize:    rec.body.size,
+			Body:        rec.body.data,
+			BodySkipped: rec.body.skipped,
+		},
+		Timing: recordedTiming{
+			TTFBMillis:  float64(req.UpstreamTTFB.Microseconds()) / 1000,
+			TotalMillis: float64(time.Since(rec.started).Microseconds()) / 1000,
+		},
+	}
+
+	names := make([]string, 0, len(rec.headers))
+	for name := range rec.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ex.Request.Headers = append(ex.Request.Headers, recordedHeader{Name: name, Value: rec.headers[name]})
+	}
+
+	parts := strings.SplitN(rec.status, " ", 3)
+	if len(parts) >= 2 {
+		ex.Response.Status, _ = strconv.Atoi(parts[1])
+	}
+	if len(parts) == 3 {
+		ex.Response.Reason = parts[2]
+	}
+	chunked := false
+	for _, line := range rec.respHeaders {
+		name, value, _ := strings.Cut(line, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if strings.EqualFold(name, "transfer-encoding") && headerHasToken(value, "chunked") {
+			chunked = true
+		}
+		ex.Response.Headers = append(ex.Response.Headers, recordedHeader{Name: name, Value: value})
+	}
+
+	ex.Response.BodySize, ex.Response.Body, ex.Response.BodySkipped = rec.resp.size, rec.resp.data, rec.resp.skipped
+	if chunked && !rec.resp.skipped {
+		body, err := io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(rec.resp.data)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode chunked response: %w", err)
+		}
+		ex.Response.BodySize, ex.Response.Body = int64(len(body)), body
+	}
+	return ex, nil
+}
+
+// saveRecording writes a successful exchange to record_dir, replacing any
+// earlier recording of it
+func (s *Server) saveRecording(req *HTTPRequest, statusCode int) {
+	rec := req.Recording
+	if rec == nil || statusCode < 200 {
+		return
+	}
+	config := s.config.Load()
+	ex, err := rec.exchange(req)
+	if err != nil {
+		s.diag.Debugf("Request %s: not recorded: %v", req.ID, err)
+		return
+	}
+	path := recordingPath(config.RecordDir, req.Host, req.Port, ex.Key)
+	if err := writeRecording(path, ex); err != nil {
+		s.diag.Warnf("Request %s: failed to record exchange: %v", req.ID, err)
+		return
+	}
+	s.diag.Debugf("Request %s: recorded %s %s in %s", req.ID, rec.method, rec.target, path)
+}
+
+// writeRecording writes ex to path through a temporary file, so a replay
+// never reads a partial recording
+func writeRecording(path string, ex *recordedExchange) error {
+	data, err := json.MarshalIndent(ex, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".recording-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// loadRecording reads the recording at path; a missing file is a miss,
+// reported as nil with no error
+func loadRecording(path string) (*recordedExchange, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ex recordedExchange
+	if err := json.Unmarshal(data, &ex); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &ex, nil
+}
+
+// applyRecording records a plain HTTP request and its response under
+// record_dir, or with replay_mode set, answers it from there first. A
+// request body is read before the lookup, as it is part of the key; one
+// that is chunked or larger than record_max_body_bytes can't be looked up
+// and is a miss. A strict miss is answered 404, a hybrid miss forwarded
+// and recorded. It reports whether the request was answered.
+func (s *Server) applyRecording(conn net.Conn, req *HTTPRequest, config *Config) bool {
+	if config.RecordDir == "" {
+		return false
+	}
+	rec := newRecording(req, config)
+	if config.ReplayMode == replayOff {
+		req.Recording = rec
+		return false
+	}
+
+	var ex *recordedExchange
+	key, reason := "", "request body is chunked or larger than record_max_body_bytes"
+	if req.ContentLength >= 0 && req.ContentLength <= config.RecordMaxBodyBytes {
+		if req.Body != nil {
+			setReadTimeout(conn, config.ClientReadTimeout)
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				s.sendErrorDetail(conn, req, 400, "Bad Request", err)
+				s.logRequest(conn, req, "ERROR", 400, 0, 0, fmt.Sprintf("failed to read request body: %v", err))
+				return true
+			}
+			req.Body = bytes.NewReader(body)
+		}
+		key, reason = rec.key(), "no recording"
+		var err error
+		ex, err = loadRecording(recordingPath(config.RecordDir, req.Host, req.Port, key))
+		if err != nil {
+			s.diag.Warnf("Request %s: failed to read recording: %v", req.ID, err)
+		}
+		if ex != nil && ex.Response.BodySkipped {
+			ex, reason = nil, "recorded without its body"
+		}
+	}
+	s.diag.Debugf("Request %s: replay lookup for %s %s key=%s hit=%t", req.ID, req.Method, req.RequestTarget, key, ex != nil)
+
+	if ex != nil {
+		n, err := s.writeReplay(conn, req, ex)
+		if err != nil {
+			s.stats.RecordClientAbort()
+			s.logRequest(conn, req, "CLIENT_ABORT", ex.Response.Status, 0, n, (&ClientAbortError{Err: err}).Error())
+			return true
+		}
+		s.logRequest(conn, req, "REPLAYED", ex.Response.Status, 0, n, "")
+		return true
+	}
+	if config.ReplayMode == replayStrict {
+		s.sendErrorResponse(conn, req, 404, "Not Found")
+		s.logRequest(conn, req, "REPLAY_MISS", 404, 0, 0, reason)
+		return true
+	}
+	req.Recording = rec
+	return false
+}
+
+// writeReplay sends a recorded response, framed by its Content-Length and
+// marked with X-Replayed, and closes the connection after it
+func (s *Server) writeReplay(conn net.Conn, req *HTTPRequest, ex *recordedExchange) (int64, error) {
+	var block strings.Builder
+	fmt.Fprintf(&block, "HTTP/1.1 %d %s\r\n", ex.Response.Status, ex.Response.Reason)
+	framed := req.Method == "HEAD" || ex.Response.Status == 204 || ex.Response.Status == 304
+	for _, header := range ex.Response.Headers {
+		switch strings.ToLower(header.Name) {
+		case "transfer-encoding", "connection", "keep-alive":
+			continue
+		case "content-length":
+			if framed {
+				break
+			}
+			// The body was stored without its chunked encoding
+			header.Value = strconv.Itoa(len(ex.Response.Body))
+			framed = true
+		}
+		block.WriteString(header.Name + ": " + header.Value + "\r\n")
+	}
+	if !framed {
+		fmt.Fprintf(&block, "Content-Length: %d\r\n", len(ex.Response.Body))
+	}
+	block.WriteString("X-Replayed: true\r\n")
+	block.WriteString("Connection: close\r\n\r\n")
+
+	req.Persistent = false
+	n, err := conn.Write(append([]byte(block.String()), ex.Response.Body...))
+	return int64(n), err
+}
@@ -0,0 +1,420 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// redisKeyPrefix namespaces the proxy's keys, so a shared Redis can hold
+// other data and Clear only removes responses
+const redisKeyPrefix = "proxy:cache:"
+
+// redisTimeout bounds each dial and command, so a slow Redis adds at most
+// this much to a request
+const redisTimeout = 250 * time.Millisecond
+
+// redisFailThreshold is how many consecutive failures take the cache out of
+// use, and redisCooldown how long it then stays out before one request
+// tries Redis again
+const (
+	redisFailThreshold = 3
+	redisCooldown      = 5 * time.Second
+)
+
+// redisMaxIdle caps the connections kept open between commands
+const redisMaxIdle = 16
+
+// errRedisUnavailable is returned without contacting Redis while it is out
+// of use after failing
+var errRedisUnavailable = errors.New("redis unavailable")
+
+// redisError is an error reply from the server. The connection is still
+// usable and Redis is up, so it doesn't count towards the breaker.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// RedisCache stores responses in Redis, so several proxies share one
+// cache. Every entry is stored with a TTL, cache_default_ttl if the
+// response doesn't give one, and the size limits are left to the server's
+// maxmemory and eviction policy (allkeys-lru suits a cache);
+// cache_max_entries and cache_max_size_mb don't apply. When Redis can't be
+// reached lookups are misses and stores are dropped, and after
+// redisFailThreshold failures in a row it isn't contacted for
+// redisCooldown, so a dead server doesn't slow every request.
+type RedisCache struct {
+	address    string
+	password   string
+	db         int
+	defaultTTL time.Duration // TTL of an entry stored without an Expires time
+	diag       *DiagLogger
+	idle       chan *redisConn
+
+	mu        sync.Mutex
+	failures  int       // consecutive failures
+	openUntil time.Time // Redis isn't contacted before this while failures >= redisFailThreshold
+
+	hits        atomic.Int64
+	misses      atomic.Int64
+	puts        atomic.Int64
+	bytesServed atomic.Int64
+}
+
+// redisEntry is a CacheEntry as stored in Redis
+type redisEntry struct {
+	StatusCode int               `json:"status"`
+	StatusText string            `json:"status_text,omitempty"`
+	Headers    map[string]string `json:"headers"`
+	Body       []byte            `json:"body"`
+	Expires    time.Time         `json:"expires"`
+}
+
+// NewRedisCache creates a cache in the Redis server at redis_address.
+// Redis isn't contacted until the first request, so the proxy starts
+// whether or not it is up.
+func NewRedisCache(config *Config, diag *DiagLogger) *RedisCache {
+	defaultTTL := config.CacheDefaultTTL
+	if defaultTTL <= 0 {
+		defaultTTL = defaultCacheTTL
+	}
+	return &RedisCache{
+		address:    config.RedisAddress,
+		password:   config.RedisPassword,
+		db:         config.RedisDB,
+		defaultTTL: defaultTTL,
+		diag:       diag,
+		idle:       make(chan *redisConn, redisMaxIdle),
+	}
+}
+
+// Get retrieves a cached response; any failure is a miss
+func (rc *RedisCache) Get(key string) (*CacheEntry, bool) {
+	reply, err := rc.do("GET", redisKeyPrefix+key)
+	data, _ := reply.([]byte)
+	if err != nil || data == nil {
+		if err != nil {
+			rc.diag.Debugf("Cache: Redis lookup of %s failed: %v", key, err)
+		}
+		rc.misses.Add(1)
+		return nil, false
+	}
+
+	var stored redisEntry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		rc.diag.Debugf("Cache: ignoring unreadable Redis entry for %s: %v", key, err)
+		rc.misses.Add(1)
+		return nil, false
+	}
+	entry := &CacheEntry{
+		Headers:      stored.Headers,
+		StatusCode:   stored.StatusCode,
+		StatusText:   stored.StatusText,
+		Body:         stored.Body,
+		Expires:      stored.Expires,
+		LastAccessed: time.Now(),
+		Size:         int64(len(data)),
+	}
+	if entry.expired(entry.LastAccessed) {
+		rc.misses.Add(1)
+		return nil, false
+	}
+	rc.hits.Add(1)
+	rc.bytesServed.Add(int64(len(entry.Body)))
+	return entry, true
+}
+
+// Put stores a response with a TTL running to its Expires time, or of
+// cache_default_ttl if it has none, so no entry outlives its TTL. An entry
+// that has already expired, or that can't be stored, reports false.
+func (rc *RedisCache) Put(key string, entry *CacheEntry) bool {
+	if entry.Expires.IsZero() {
+		entry.Expires = time.Now().Add(rc.defaultTTL)
+	}
+	ttl := time.Until(entry.Expires).Milliseconds()
+	if ttl <= 0 {
+		return false
+	}
+	data, err := json.Marshal(redisEntry{
+		StatusCode: entry.StatusCode,
+		StatusText: entry.StatusText,
+		Headers:    entry.Headers,
+		Body:       entry.Body,
+		Expires:    entry.Expires,
+	})
+	if err != nil {
+		return false
+	}
+	if _, err := rc.do("SET", redisKeyPrefix+key, string(data), "PX", strconv.FormatInt(ttl, 10)); err != nil {
+		rc.diag.Debugf("Cache: Redis store of %s failed: %v", key, err)
+		return false
+	}
+	entry.Size = int64(len(data))
+	rc.puts.Add(1)
+	return true
+}
+
+// Delete removes the response stored under key
+func (rc *RedisCache) Delete(key string) {
+	if _, err := rc.do("DEL", redisKeyPrefix+key); err != nil {
+		rc.diag.Debugf("Cache: Redis delete of %s failed: %v", key, err)
+	}
+}
+
+// Clear removes every response the proxy stored, leaving other keys alone
+func (rc *RedisCache) Clear() {
+	cursor := "0"
+	for {
+		reply, err := rc.do("SCAN", cursor, "MATCH", redisKeyPrefix+"*", "COUNT", "1000")
+		items, _ := reply.([]any)
+		if err != nil || len(items) != 2 {
+			if err != nil {
+				rc.diag.Warnf("Cache: clearing Redis failed: %v", err)
+			}
+			return
+		}
+		next, _ := items[0].([]byte)
+		keys, _ := items[1].([]any)
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, k := range keys {
+				if name, ok := k.([]byte); ok {
+					args = append(args, string(name))
+				}
+			}
+			if _, err := rc.do(args...); err != nil {
+				rc.diag.Warnf("Cache: clearing Redis failed: %v", err)
+				return
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return
+		}
+	}
+}
+
+// Stats returns the counters kept by this proxy, with the entry count,
+// memory use, maxmemory and evictions Redis reports. The database is
+// assumed to be the cache's own, so its size counts as entries; while
+// Redis is unreachable those are zero.
+func (rc *RedisCache) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:        rc.hits.Load(),
+		Misses:      rc.misses.Load(),
+		Puts:        rc.puts.Load(),
+		BytesServed: rc.bytesServed.Load(),
+	}
+	if reply, err := rc.do("DBSIZE"); err == nil {
+		if n, ok := reply.(int64); ok {
+			stats.Entries = int(n)
+		}
+	}
+	if reply, err := rc.do("INFO", "memory"); err == nil {
+		info := parseRedisInfo(reply)
+		stats.Bytes, _ = strconv.ParseInt(info["used_memory"], 10, 64)
+		stats.MaxBytes, _ = strconv.ParseInt(info["maxmemory"], 10, 64)
+	}
+	if reply, err := rc.do("INFO", "stats"); err == nil {
+		info := parseRedisInfo(reply)
+		stats.SizeEvictions, _ = strconv.ParseInt(info["evicted_keys"], 10, 64)
+		stats.ExpiredEvictions, _ = strconv.ParseInt(info["expired_keys"], 10, 64)
+	}
+	return stats
+}
+
+// Close closes the idle connections
+func (rc *RedisCache) Close() error {
+	for {
+		select {
+		case conn := <-rc.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do runs a command on an idle connection, or a new one, and returns its
+// reply: a string, an int64, a []byte (nil for a missing key) or a []any.
+// A failed connection is closed and counted towards the breaker; an error
+// reply leaves it open.
+func (rc *RedisCache) do(args ...string) (any, error) {
+	if !rc.allow() {
+		return nil, errRedisUnavailable
+	}
+
+	var conn *redisConn
+	select {
+	case conn = <-rc.idle:
+	default:
+		var err error
+		if conn, err = rc.dial(); err != nil {
+			rc.fail(err)
+			return nil, err
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	reply, err := conn.do(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		rc.fail(err)
+		return nil, err
+	}
+	select {
+	case rc.idle <- conn:
+	default:
+		conn.Close()
+	}
+	rc.succeed()
+	return reply, err
+}
+
+// dial connects to Redis, authenticating and selecting redis_db
+func (rc *RedisCache) dial() (*redisConn, error) {
+	c, err := net.DialTimeout("tcp", rc.address, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: c, r: bufio.NewReader(c)}
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	if rc.password != "" {
+		if _, err := conn.do("AUTH", rc.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis AUTH failed: %w", err)
+		}
+	}
+	if rc.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(rc.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis SELECT %d failed: %w", rc.db, err)
+		}
+	}
+	return conn, nil
+}
+
+// allow reports whether Redis may be contacted. Once the cooldown has
+// passed one caller is let through to try it, and the rest wait for
+// another cooldown unless it succeeds.
+func (rc *RedisCache) allow() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.failures < redisFailThreshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(rc.openUntil) {
+		return false
+	}
+	rc.openUntil = now.Add(redisCooldown)
+	return true
+}
+
+// fail counts a failure, taking Redis out of use at the threshold
+func (rc *RedisCache) fail(err error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.failures++
+	if rc.failures >= redisFailThreshold {
+		rc.openUntil = time.Now().Add(redisCooldown)
+	}
+	if rc.failures == redisFailThreshold {
+		rc.diag.Warnf("Cache: Redis at %s is unavailable, serving without the cache and retrying every %s: %v", rc.address, redisCooldown, err)
+	}
+}
+
+// succeed resets the failure count, putting Redis back in use
+func (rc *RedisCache) succeed() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.failures >= redisFailThreshold {
+		rc.diag.Infof("Cache: Redis at %s is available again", rc.address)
+	}
+	rc.failures = 0
+}
+
+// redisConn is a connection speaking RESP, the Redis protocol
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command as an array of bulk strings and reads its reply
+func (c *redisConn) do(args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply reads one reply, recursing into arrays
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return []byte(nil), err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return []any(nil), err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				var replyErr redisError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// parseRedisInfo splits an INFO reply into its fields
+func parseRedisInfo(reply any) map[string]string {
+	data, _ := reply.([]byte)
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\r\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, "#") {
+			fields[name] = value
+		}
+	}
+	return fields
+}
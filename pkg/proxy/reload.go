@@ -0,0 +1,334 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"os"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// ReloadConfig re-reads the configuration file and applies the settings that
+// can change at runtime: filter rules, expression rules, header rules,
+// rewrite rules, fault injection rules, bandwidth profiles (for new
+// connections), routing rules, per-user policies, SafeSearch enforcement,
+// StatsD output, log shipping, client allowlist, authentication and its
+// users and tokens files, the auth hook, TLS interception, rate limits,
+// cache limits, log settings and the proxy and admin listeners. Settings
+// that need a restart keep their running values. Everything the new file
+// names is read, opened, bound and checked before any of it is applied, so
+// a reload that fails anywhere leaves the running configuration untouched.
+func (s *Server) ReloadConfig() error {
+	old := s.config.Load()
+
+	config, warnings, err := LoadConfigFile(old.Source, old.Overrides)
+	for _, warning := range warnings {
+		s.diag.Warnf("%s", warning)
+	}
+	if err != nil {
+		s.diag.Errorf("Config reload failed, keeping running configuration: %v", err)
+		return err
+	}
+
+	s.keepRestartOnlySettings(old, config)
+
+	// Bind changed listeners first, so a busy address fails the reload
+	// before anything else changes
+	listeners, err := s.prepareListeners(old, config)
+	if err != nil {
+		s.diag.Errorf("Config reload failed, keeping the current listeners: %v", err)
+		return err
+	}
+	defer listeners.abort()
+
+	// What is opened or started for the new config is closed again if a
+	// later step fails
+	opened := &reloadResources{}
+	defer opened.abort()
+
+	var filterLoad *filterLoad
+	if s.options.engine == nil {
+		if filterLoad, err = s.filter.prepareConfigured(config, false); err != nil {
+			s.diag.Errorf("Config reload failed: %v", err)
+			return err
+		}
+	}
+
+	headerRules, err := LoadHeaderRules(config.HeaderRulesFile)
+	if err != nil {
+		s.diag.Errorf("Config reload failed to load header rules: %v", err)
+		return err
+	}
+	if err := checkAnonymityRules(config, headerRules); err != nil {
+		s.diag.Errorf("Config reload failed: %v", err)
+		return err
+	}
+
+	routes, err := LoadRoutingRules(config.RoutingRulesFile, config.DefaultRoute)
+	if err != nil {
+		s.diag.Errorf("Config reload failed to load routing rules: %v", err)
+		return err
+	}
+
+	rewrites, err := LoadRewriteRules(config.RewriteRulesFile)
+	if err != nil {
+		s.diag.Errorf("Config reload failed to load rewrite rules: %v", err)
+		return err
+	}
+
+	faults, err := LoadFaultRules(config.faultRulesFile())
+	if err != nil {
+		s.diag.Errorf("Config reload failed to load fault injection rules: %v", err)
+		return err
+	}
+
+	bandwidth, err := LoadBandwidthProfiles(config.BandwidthProfilesFile)
+	if err != nil {
+		s.diag.Errorf("Config reload failed to load bandwidth profiles: %v", err)
+		return err
+	}
+
+	reverseRoutes, err := LoadReverseRoutes(config.ReverseProxyFile)
+	if err != nil {
+		s.diag.Errorf("Config reload failed to load reverse proxy routes: %v", err)
+		return err
+	}
+
+	upstreamCAs, err := loadUpstreamCAs(config.UpstreamCAFile)
+	if err != nil {
+		s.diag.Errorf("Config reload failed to load upstream CAs: %v", err)
+		return err
+	}
+
+	policies, err := LoadPolicies(config.PoliciesFile, config.DefaultPolicy, config.StrictRules, s.diag)
+	if err != nil {
+		s.diag.Errorf("Config reload failed to load policies: %v", err)
+		return err
+	}
+
+	exprRules, err := LoadExprRules(config.ExpressionRulesFile)
+	if err != nil {
+		s.diag.Errorf("Config reload failed to load expression rules: %v", err)
+		return err
+	}
+
+	safeSearch, err := NewSafeSearch(config)
+	if err != nil {
+		s.diag.Errorf("Config reload failed to load safesearch_hosts: %v", err)
+		return err
+	}
+
+	var users map[string][]byte
+	if config.AuthMode == "basic" {
+		if users, err = s.users.read(config.AuthUsersFile); err != nil {
+			s.diag.Errorf("Config reload failed to load users: %v", err)
+			return err
+		}
+	}
+
+	var tokens map[string][sha256.Size]byte
+	if config.AuthMode == "token" && config.AuthTokensFile != "" {
+		if tokens, err = s.tokens.read(config.AuthTokensFile); err != nil {
+			s.diag.Errorf("Config reload failed to load tokens: %v", err)
+			return err
+		}
+	}
+
+	ca, caKey, err := loadConfiguredCA(config)
+	if err != nil {
+		s.diag.Errorf("Config reload failed to load the interception CA: %v", err)
+		return err
+	}
+
+	if opened.geoCountry, opened.geoASN, err = openGeoDBs(config); err != nil {
+		s.diag.Errorf("Config reload failed to open the GeoIP databases: %v", err)
+		return err
+	}
+
+	dbChanged := config.LogBackend != old.LogBackend || config.LogDBPath != old.LogDBPath ||
+		config.LogDBRetentionDays != old.LogDBRetentionDays
+	if s.options.logger == nil {
+		if dbChanged {
+			if opened.logDB, err = OpenLogDB(config, s.diag); err != nil {
+				s.diag.Errorf("Config reload failed to open the log database: %v", err)
+				return err
+			}
+		}
+		if opened.logFile, opened.logSize, err = openConfiguredLog(config); err != nil {
+			s.diag.Errorf("Config reload failed to reopen log file: %v", err)
+			return err
+		}
+	}
+
+	// Reconnect to the StatsD agent if its settings changed
+	statsdChanged := config.StatsdAddress != old.StatsdAddress || config.StatsdPrefix != old.StatsdPrefix ||
+		config.StatsdTags != old.StatsdTags || config.StatsdSampleRate != old.StatsdSampleRate
+	if statsdChanged {
+		if opened.statsd, err = NewStatsD(config); err != nil {
+			s.diag.Errorf("Config reload failed: %v", err)
+			return err
+		}
+	}
+
+	// Restart log shipping if its settings changed; the old shipper sends
+	// or spools what it has first
+	shipChanged := config.LogShipURL != old.LogShipURL || config.LogShipInterval != old.LogShipInterval ||
+		config.LogShipBatchSize != old.LogShipBatchSize || config.LogShipSpoolDir != old.LogShipSpoolDir ||
+		config.LogShipSpoolMaxMB != old.LogShipSpoolMaxMB
+	if shipChanged {
+		if opened.shipper, err = NewLogShipper(config, s.diag); err != nil {
+			s.diag.Errorf("Config reload failed to start log shipping: %v", err)
+			return err
+		}
+	}
+
+	// A supplied filter engine reloads its own rules, so it goes last: once
+	// it has succeeded nothing else can fail
+	if s.options.engine != nil && s.options.filter == nil {
+		if err := s.engine.Reload(); err != nil {
+			s.diag.Errorf("Config reload failed to reload the filter engine: %v", err)
+			return err
+		}
+	}
+
+	// Everything has loaded; apply it all
+	opened.committed = true
+	if filterLoad != nil {
+		filterLoad.commit()
+	}
+	if users != nil {
+		s.users.set(config.AuthUsersFile, users)
+	}
+	if tokens != nil {
+		s.tokens.set(config.AuthTokensFile, tokens)
+	}
+	s.mitm.set(config, ca, caKey)
+	s.geoip.swap(opened.geoCountry, opened.geoASN)
+	if s.options.logger == nil {
+		s.logger.apply(config, opened.logFile, opened.logSize)
+		if dbChanged {
+			go s.logger.SetDB(opened.logDB).Close()
+		}
+	}
+	if statsdChanged {
+		s.stats.statsd.Swap(opened.statsd).Close()
+	}
+	if shipChanged {
+		go s.logger.SetShipper(opened.shipper).Close()
+	}
+
+	// Pick up renewed certificates; a bad file keeps the current one
+	if config.HasTLSListener() {
+		if err := s.certs.Load(config.TLSCertFile, config.TLSKeyFile); err != nil {
+			s.diag.Errorf("Config reload kept the current TLS certificate: %v", err)
+		}
+	}
+
+	level, _ := ParseLogLevel(config.LogLevel)
+	s.diag.SetLevel(level)
+
+	s.limiter.Reconfigure(config)
+	s.errorPages.Reconfigure(config)
+	s.authHook.Reconfigure(config)
+	s.policyExec.Reconfigure(config)
+	s.allowlist.Reconfigure(config)
+	s.authFailures.Reconfigure(config)
+
+	if cache, ok := s.cache.(*Cache); ok && s.options.cache == nil {
+		cache.SetMaxEntries(config.CacheMaxEntries)
+		cache.SetMaxSize(config.CacheMaxSizeBytes())
+	}
+
+	// Publish the new config; in-flight requests keep the one they loaded
+	s.forwarder.SetConfig(config)
+	s.forwarder.SetHeaderRules(headerRules)
+	s.forwarder.SetRoutingRules(routes)
+	s.rewrites.Store(rewrites)
+	s.faults.Store(faults)
+	s.bandwidth.Store(bandwidth)
+	s.reverse.Store(reverseRoutes)
+	s.forwarder.SetUpstreamCAs(upstreamCAs)
+	policies.startLimiters(s.policies.Load(), config)
+	s.policies.Store(policies)
+	exprRules.startLimiters(s.exprRules.Load(), config)
+	s.exprRules.Store(exprRules)
+	s.safeSearch.Store(safeSearch)
+	s.config.Store(config)
+	listeners.commit()
+
+	s.diag.Infof("Configuration reloaded from %s", config.Source)
+	s.warnFaultInjection(config)
+	return nil
+}
+
+// reloadResources are what a reload opened or started for the new
+// configuration. Until the reload commits to them, abort closes them,
+// leaving the running ones in use.
+type reloadResources struct {
+	geoCountry, geoASN *maxminddb.Reader
+	logFile            *os.File // nil with log_backend=sqlite
+	logSize            int64
+	logDB              *LogDB
+	statsd             *StatsD
+	shipper            *LogShipper
+
+	committed bool
+}
+
+// abort closes everything opened, unless the reload committed
+func (r *reloadResources) abort() {
+	if r.committed {
+		return
+	}
+	closeGeoDBs(r.geoCountry, r.geoASN)
+	if r.logFile != nil {
+		r.logFile.Close()
+	}
+	r.logDB.Close()
+	r.statsd.Close()
+	r.shipper.Close()
+}
+
+// keepRestartOnlySettings copies settings that can't change at runtime from
+// the running config into the reloaded one, logging any that were changed
+func (s *Server) keepRestartOnlySettings(old, config *Config) {
+	if config.ReusePort != old.ReusePort {
+		s.diag.Warnf("Changing reuse_port requires a restart; keeping %t", old.ReusePort)
+		config.ReusePort = old.ReusePort
+	}
+	if config.RunAsUser != old.RunAsUser || config.RunAsGroup != old.RunAsGroup {
+		s.diag.Warnf("Changing run_as_user or run_as_group requires a restart; keeping %q and %q", old.RunAsUser, old.RunAsGroup)
+		config.RunAsUser, config.RunAsGroup = old.RunAsUser, old.RunAsGroup
+	}
+
+	oldMin, oldMax := old.PoolWorkerRange()
+	newMin, newMax := config.PoolWorkerRange()
+	if config.ConcurrencyModel != old.ConcurrencyModel || newMin != oldMin || newMax != oldMax ||
+		config.WorkerIdleTimeout != old.WorkerIdleTimeout || config.PoolQueueSize() != old.PoolQueueSize() {
+		s.diag.Warnf("Changing concurrency_model or the worker pool size, idle timeout or queue size requires a restart; keeping the current pool")
+		config.ConcurrencyModel = old.ConcurrencyModel
+		config.ThreadPoolSize = old.ThreadPoolSize
+		config.MinWorkers = old.MinWorkers
+		config.MaxWorkers = old.MaxWorkers
+		config.WorkerIdleTimeout = old.WorkerIdleTimeout
+		config.QueueSize = old.QueueSize
+	}
+
+	if config.EnableCaching != old.EnableCaching {
+		s.diag.Warnf("Changing enable_caching requires a restart; keeping %t", old.EnableCaching)
+		config.EnableCaching = old.EnableCaching
+	}
+
+	if config.CacheBackend != old.CacheBackend || config.RedisAddress != old.RedisAddress ||
+		config.RedisPassword != old.RedisPassword || config.RedisDB != old.RedisDB {
+		s.diag.Warnf("Changing cache_backend or the Redis settings requires a restart; keeping the current cache")
+		config.CacheBackend = old.CacheBackend
+		config.RedisAddress = old.RedisAddress
+		config.RedisPassword = old.RedisPassword
+		config.RedisDB = old.RedisDB
+	}
+
+	if config.ErrorLogPath != old.ErrorLogPath {
+		s.diag.Warnf("Changing error_log_path requires a restart; keeping %q", old.ErrorLogPath)
+		config.ErrorLogPath = old.ErrorLogPath
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeReloadConfig writes the files of a configuration blocking domain,
+// with header_rules_file set to headerRules
+func writeReloadConfig(t *testing.T, dir, domain, headerRules string) string {
+	t.Helper()
+	blocked := filepath.Join(dir, "blocked.txt")
+	if err := os.WriteFile(blocked, []byte(domain+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "proxy.conf")
+	content := fmt.Sprintf("blocked_domains_file = %s\nlog_file_path = %s\nheader_rules_file = %s\n",
+		blocked, filepath.Join(dir, "access.log"), headerRules)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReloadFailureChangesNothing(t *testing.T) {
+	dir := t.TempDir()
+	config, _, err := LoadConfigFile(writeReloadConfig(t, dir, "a.example", ""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	// The new rules file loads, but the header rules file named after it
+	// doesn't, so the reload must leave the old rules in place
+	writeReloadConfig(t, dir, "b.example", filepath.Join(dir, "missing.rules"))
+	if err := s.ReloadConfig(); err == nil {
+		t.Fatal("ReloadConfig succeeded with a missing header rules file")
+	}
+	if blocked, _ := s.filter.IsBlocked("a.example", 80); !blocked {
+		t.Error("a.example not blocked after a failed reload")
+	}
+	if blocked, _ := s.filter.IsBlocked("b.example", 80); blocked {
+		t.Error("b.example blocked after a failed reload")
+	}
+	if s.config.Load() != config {
+		t.Error("failed reload published a new config")
+	}
+
+	writeReloadConfig(t, dir, "b.example", "")
+	if err := s.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, _ := s.filter.IsBlocked("b.example", 80); !blocked {
+		t.Error("b.example not blocked after a successful reload")
+	}
+	if blocked, _ := s.filter.IsBlocked("a.example", 80); blocked {
+		t.Error("a.example still blocked after a successful reload")
+	}
+}
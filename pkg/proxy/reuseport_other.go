@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// setReusePort reports that SO_REUSEPORT isn't available on this platform
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("reuse_port is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// reverseRoute sends requests for hosts matching pattern to backend
+type reverseRoute struct {
+	pattern     string   // exact host or *.suffix, as in the filter
+	backend     *url.URL // scheme, host:port and a path prefix to add
+	stripPrefix string   // path prefix removed before backend's is added
+}
+
+// ReverseRoutes maps the Host of requests on reverse proxy listeners to
+// backends; the first matching route wins
+type ReverseRoutes struct {
+	routes []reverseRoute
+}
+
+// LoadReverseRoutes loads the reverse proxy routes from a file, one per
+// line:
+//
+//	host-pattern http[s]://backend[:port][/prefix] [strip_prefix=/path]
+//
+// An https backend is spoken to over TLS and verified like any origin. An
+// empty path loads no routes.
+func LoadReverseRoutes(path string) (*ReverseRoutes, error) {
+	rr := &ReverseRoutes{}
+	if path == "" {
+		return rr, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open reverse proxy file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if line == "" {
+			continue
+		}
+
+		route, err := parseReverseRoute(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		rr.routes = append(rr.routes, route)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read reverse proxy file: %w", err)
+	}
+
+	return rr, nil
+}
+
+// parseReverseRoute parses the fields of one reverse proxy route
+func parseReverseRoute(fields []string) (reverseRoute, error) {
+	if len(fields) < 2 {
+		return reverseRoute{}, fmt.Errorf("expected \"host-pattern backend-url\"")
+	}
+	backend, err := url.Parse(fields[1])
+	if err != nil || (backend.Scheme != "http" && backend.Scheme != "https") || backend.Hostname() == "" {
+		return reverseRoute{}, fmt.Errorf("backend %q must be an http:// or https:// URL", fields[1])
+	}
+	if backend.RawQuery != "" || backend.Fragment != "" || backend.User != nil {
+		return reverseRoute{}, fmt.Errorf("backend %q may only have a path after the host", fields[1])
+	}
+	backend.Path = strings.TrimSuffix(backend.Path, "/")
+	route := reverseRoute{pattern: strings.ToLower(fields[0]), backend: backend}
+
+	for _, option := range fields[2:] {
+		prefix, ok := strings.CutPrefix(option, "strip_prefix=")
+		if !ok {
+			return reverseRoute{}, fmt.Errorf("unknown option %q (want strip_prefix=/path)", option)
+		}
+		if !strings.HasPrefix(prefix, "/") {
+			return reverseRoute{}, fmt.Errorf("strip_prefix %q must start with /", prefix)
+		}
+		route.stripPrefix = strings.TrimSuffix(prefix, "/")
+	}
+	return route, nil
+}
+
+// Match returns the route for host
+func (rr *ReverseRoutes) Match(host string) (reverseRoute, bool) {
+	host = strings.ToLower(strings.TrimSpace(host))
+	for _, route := range rr.routes {
+		if route.pattern == host {
+			return route, true
+		}
+		if suffix, ok := strings.CutPrefix(route.pattern, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return route, true
+			}
+		}
+	}
+	return reverseRoute{}, false
+}
+
+// target returns the backend URL for an origin-form request target
+func (route reverseRoute) target(requestTarget string) string {
+	path := requestTarget
+	if route.stripPrefix != "" {
+		if rest, ok := strings.CutPrefix(path, route.stripPrefix); ok && (rest == "" || rest[0] == '/' || rest[0] == '?') {
+			path = rest
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return route.backend.Scheme + "://" + route.backend.Host + route.backend.Path + path
+}
+
+// isReverseListener reports whether the listener labelled label is one of
+// reverse_proxy_listeners
+func (c *Config) isReverseListener(label string) bool {
+	for _, l := range c.ReverseProxyListeners {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// routeReverse turns a request received on a reverse proxy listener into
+// one for the backend its Host maps to, so the rest of the pipeline
+// handles it like any proxied request, and adds the X-Forwarded-* headers.
+// Requests naming their own destination are refused with 421, and those
+// for unknown hosts answered per reverse_proxy_unknown_host; either way it
+// returns false.
+func (s *Server) routeReverse(conn net.Conn, req *HTTPRequest, config *Config) bool {
+	if req.IsConnect || strings.HasPrefix(req.RequestTarget, "http://") || strings.HasPrefix(req.RequestTarget, "https://") {
+		s.sendErrorResponse(conn, req, 421, "Misdirected Request")
+		s.logRequest(conn, req, "MISDIRECTED", 421, 0, 0, "proxy request on a reverse proxy listener")
+		return false
+	}
+
+	route, ok := s.reverse.Load().Match(req.Host)
+	if !ok {
+		reason := "no reverse proxy route for " + req.Host
+		if config.ReverseProxyUnknownHost == "404" {
+			s.sendErrorResponse(conn, req, 404, "Not Found")
+			s.logRequest(conn, req, "NO_ROUTE", 404, 0, 0, reason)
+		} else {
+			s.sendErrorResponseHeaders(conn, req, 302, "Found", []string{"Location: " + config.ReverseProxyUnknownHost})
+			s.logRequest(conn, req, "NO_ROUTE", 302, 0, 0, reason)
+		}
+		return false
+	}
+
+	proto := "http"
+	if lc := clientConn(conn); lc != nil {
+		if _, ok := lc.Conn.(*tls.Conn); ok {
+			proto = "https"
+		}
+	}
+	forwardedFor := GetClientIP(conn)
+	if existing := req.Headers["x-forwarded-for"]; existing != "" {
+		forwardedFor = existing + ", " + forwardedFor
+	}
+	req.Headers["x-forwarded-for"] = forwardedFor
+	req.Headers["x-forwarded-host"] = req.Headers["host"]
+	req.Headers["x-forwarded-proto"] = proto
+	req.Headers["host"] = route.backend.Host
+
+	req.RequestTarget = route.target(req.RequestTarget)
+	req.Host = route.backend.Hostname()
+	req.Port = 80
+	if route.backend.Scheme == "https" {
+		req.Port = 443
+	}
+	if port := route.backend.Port(); port != "" {
+		req.Port, _ = strconv.Atoi(port)
+	}
+	req.ReverseRoute = route.pattern
+	return true
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// rewriteRule is one line of the rewrite rules file
+type rewriteRule struct {
+	line        int
+	hostPattern string // exact host, *.suffix or * for every host
+	pathPattern string // glob the path must match; empty matches any, and CONNECT
+	host        string // new destination host, if any
+	port        int    // new destination port, if any
+	stripPrefix string
+	addPrefix   string
+	dropQuery   map[string]bool // query parameters to delete
+}
+
+// RewriteRules holds ordered rules that send requests to another host or
+// port and rewrite their paths and queries
+type RewriteRules struct {
+	rules []rewriteRule
+}
+
+// LoadRewriteRules loads rewrite rules from a file, one per line:
+//
+//	host-pattern[/path-pattern] [host=name[:port]] [port=n] [strip_prefix=/p] [add_prefix=/p] [drop_query=a,b]
+//
+// An empty path loads no rules.
+func LoadRewriteRules(path string) (*RewriteRules, error) {
+	rr := &RewriteRules{}
+	if path == "" {
+		return rr, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rewrite rules file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if line == "" {
+			continue
+		}
+
+		rule, err := parseRewriteRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		rule.line = lineNum
+		rr.rules = append(rr.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rewrite rules file: %w", err)
+	}
+
+	return rr, nil
+}
+
+// parseRewriteRule parses a single rule line
+func parseRewriteRule(line string) (rewriteRule, error) {
+	var rule rewriteRule
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return rule, fmt.Errorf("expected \"host-pattern[/path] action...\"")
+	}
+	pattern, path, hasPath := strings.Cut(fields[0], "/")
+	rule.hostPattern = strings.ToLower(pattern)
+	if hasPath {
+		rule.pathPattern = "/" + path
+	}
+	if rule.hostPattern == "" {
+		return rule, fmt.Errorf("missing host pattern in %q", fields[0])
+	}
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return rule, fmt.Errorf("expected key=value, got %q", field)
+		}
+		switch key {
+		case "host":
+			if host, port, err := net.SplitHostPort(value); err == nil {
+				n, err := strconv.Atoi(port)
+				if err != nil || n < 1 || n > 65535 {
+					return rule, fmt.Errorf("invalid port in %q", value)
+				}
+				rule.host, rule.port = host, n
+			} else {
+				rule.host = value
+			}
+			if rule.host == "" || strings.ContainsAny(rule.host, "/?#@") {
+				return rule, fmt.Errorf("invalid host %q", value)
+			}
+		case "port":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 65535 {
+				return rule, fmt.Errorf("invalid port %q", value)
+			}
+			rule.port = n
+		case "strip_prefix", "add_prefix":
+			if !strings.HasPrefix(value, "/") {
+				return rule, fmt.Errorf("%s must start with /", key)
+			}
+			if key == "strip_prefix" {
+				rule.stripPrefix = strings.TrimSuffix(value, "/")
+			} else {
+				rule.addPrefix = strings.TrimSuffix(value, "/")
+			}
+		case "drop_query":
+			rule.dropQuery = make(map[string]bool)
+			for _, name := range strings.Split(value, ",") {
+				if name != "" {
+					rule.dropQuery[name] = true
+				}
+			}
+		default:
+			return rule, fmt.Errorf("unknown action %q", key)
+		}
+	}
+	return rule, nil
+}
+
+// matches reports whether the rule applies to a request for host and path;
+// a *.example.com pattern matches example.com and its subdomains, and a
+// rule with a path pattern never matches a CONNECT
+func (r rewriteRule) matches(host, path string, connect bool) bool {
+	if r.pathPattern != "" && (connect || !globMatch(r.pathPattern, path)) {
+		return false
+	}
+	host = strings.ToLower(host)
+	if r.hostPattern == "*" {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(r.hostPattern, "*."); ok {
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}
+	return host == r.hostPattern
+}
+
+// Len returns the number of rules
+func (rr *RewriteRules) Len() int {
+	return len(rr.rules)
+}
+
+// Apply rewrites req. Each pass applies the first rule that matches and
+// changes the request, then matches the result again, until no rule
+// changes it or maxPasses rules have been applied. Host and port changes
+// are skipped unless moveHost is set; path and query changes never apply
+// to a CONNECT. It returns the lines of the rules applied, and whether
+// maxPasses cut the chain short.
+func (rr *RewriteRules) Apply(req *HTTPRequest, moveHost bool, maxPasses int) ([]int, bool) {
+	var applied []int
+	for pass := 0; ; pass++ {
+		rule, ok := rr.next(req, moveHost)
+		if !ok {
+			return applied, false
+		}
+		if pass == maxPasses {
+			return applied, true
+		}
+		rule.apply(req, moveHost)
+		applied = append(applied, rule.line)
+	}
+}
+
+// next returns the first rule that would change req
+func (rr *RewriteRules) next(req *HTTPRequest, moveHost bool) (rewriteRule, bool) {
+	u := requestURL(req)
+	path := ""
+	if u != nil {
+		path = u.Path
+	}
+	for _, rule := range rr.rules {
+		if !rule.matches(req.Host, path, req.IsConnect) {
+			continue
+		}
+		if moveHost && rule.host != "" && !strings.EqualFold(rule.host, req.Host) {
+			return rule, true
+		}
+		if moveHost && rule.port != 0 && rule.port != req.Port {
+			return rule, true
+		}
+		if u != nil {
+			if _, changed := rule.rewritePath(u.EscapedPath()); changed {
+				return rule, true
+			}
+			if _, changed := rule.rewriteQuery(u.RawQuery); changed {
+				return rule, true
+			}
+		}
+	}
+	return rewriteRule{}, false
+}
+
+// apply makes the rule's changes to req
+func (r rewriteRule) apply(req *HTTPRequest, moveHost bool) {
+	if moveHost && (r.host != "" || r.port != 0) {
+		host, port := r.host, r.port
+		if host == "" {
+			host = req.Host
+		}
+		if port == 0 {
+			port = req.Port
+		}
+		retarget(req, host, port)
+	}
+
+	u := requestURL(req)
+	if u == nil {
+		return
+	}
+	if path, changed := r.rewritePath(u.EscapedPath()); changed {
+		if unescaped, err := url.PathUnescape(path); err == nil {
+			u.Path, u.RawPath = unescaped, path
+		}
+	}
+	if query, changed := r.rewriteQuery(u.RawQuery); changed {
+		u.RawQuery = query
+		u.ForceQuery = false
+	}
+	req.RequestTarget = u.String()
+}
+
+// rewritePath strips and adds the rule's prefixes, reporting whether the
+// path changed
+func (r rewriteRule) rewritePath(path string) (string, bool) {
+	rewritten := path
+	if r.stripPrefix != "" {
+		if rest, ok := strings.CutPrefix(rewritten, r.stripPrefix); ok && (rest == "" || rest[0] == '/') {
+			rewritten = rest
+			if rewritten == "" {
+				rewritten = "/"
+			}
+		}
+	}
+	// A path already under the prefix keeps it, so a rule doesn't apply
+	// to its own result again
+	if r.addPrefix != "" && rewritten != r.addPrefix && !strings.HasPrefix(rewritten, r.addPrefix+"/") {
+		rewritten = r.addPrefix + rewritten
+	}
+	return rewritten, rewritten != path
+}
+
+// rewriteQuery deletes the rule's query parameters, keeping the others in
+// their order and encoding, and reports whether the query changed
+func (r rewriteRule) rewriteQuery(query string) (string, bool) {
+	if len(r.dropQuery) == 0 || query == "" {
+		return query, false
+	}
+	var kept []string
+	for _, param := range strings.Split(query, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !r.dropQuery[name] {
+			kept = append(kept, param)
+		}
+	}
+	rewritten := strings.Join(kept, "&")
+	return rewritten, rewritten != query
+}
+
+// requestURL parses req's target, or returns nil for a CONNECT or a target
+// that isn't a URL
+func requestURL(req *HTTPRequest) *url.URL {
+	if req.IsConnect {
+		return nil
+	}
+	u, err := url.Parse(req.RequestTarget)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// requestLocation describes where req is going, for the access log: its
+// target, or host:port for a CONNECT
+func requestLocation(req *HTTPRequest) string {
+	if req.IsConnect {
+		return net.JoinHostPort(req.Host, strconv.Itoa(req.Port))
+	}
+	return req.RequestTarget
+}
+
+// applyRewrites applies rewrite_rules_file to req, recording the change in
+// req.Rewrite if a rule made one. An intercepted request
+// already has its connection to the origin, so only its path and query
+// can change.
+func (s *Server) applyRewrites(req *HTTPRequest, config *Config, intercepted bool) {
+	rules := s.rewrites.Load()
+	if rules.Len() == 0 {
+		return
+	}
+
+	from := requestLocation(req)
+	applied, looped := rules.Apply(req, !intercepted, config.RewriteMaxPasses)
+	if looped {
+		s.diag.Warnf("Request %s: rewrite of %s stopped after %d passes (rewrite_max_passes); rules %v may loop", req.ID, from, len(applied), applied)
+	}
+	if len(applied) == 0 {
+		return
+	}
+	req.Rewrite = from + " → " + requestLocation(req)
+	s.diag.Debugf("Request %s: rewrite rules %v rewrote %s", req.ID, applied, req.Rewrite)
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRewriteRules writes rules to a rewrite rules file and returns its path
+func writeRewriteRules(t *testing.T, rules ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rewrite.rules")
+	if err := os.WriteFile(path, []byte(strings.Join(rules, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRewriteRulesApply(t *testing.T) {
+	rules, err := LoadRewriteRules(writeRewriteRules(t,
+		"old.internal host=new.internal:8080",
+		"new.internal/api/* strip_prefix=/api add_prefix=/v2",
+		"* drop_query=utm_source,utm_medium",
+		"a.loop host=b.loop",
+		"b.loop host=a.loop",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		req        *HTTPRequest
+		moveHost   bool
+		wantTarget string // target after the rewrite, host:port for a CONNECT
+		wantLines  []int
+		wantLooped bool
+	}{
+		// The host rule's result is matched again by the path rule, and
+		// both by the query rule
+		{"chained host and path", &HTTPRequest{Method: "GET", RequestTarget: "http://old.internal/api/items?utm_source=x&id=1", Host: "old.internal", Port: 80},
+			true, "http://new.internal:8080/v2/items?id=1", []int{1, 2, 3}, false},
+		{"path only", &HTTPRequest{Method: "GET", RequestTarget: "http://new.internal/api/items", Host: "new.internal", Port: 80},
+			true, "http://new.internal/v2/items", []int{2}, false},
+		// A request no rule changes is left alone, even where a rule
+		// matches it
+		{"no rule matches", &HTTPRequest{Method: "GET", RequestTarget: "http://other.example/page?id=1", Host: "other.example", Port: 80},
+			true, "http://other.example/page?id=1", nil, false},
+		{"already rewritten", &HTTPRequest{Method: "GET", RequestTarget: "http://new.internal:8080/v2/items?id=1", Host: "new.internal", Port: 8080},
+			true, "http://new.internal:8080/v2/items?id=1", nil, false},
+		// An intercepted request keeps its host
+		{"intercepted", &HTTPRequest{Method: "GET", RequestTarget: "http://old.internal/api/items?utm_medium=y", Host: "old.internal", Port: 80},
+			false, "http://old.internal/api/items", []int{3}, false},
+		// A CONNECT only moves
+		{"connect", &HTTPRequest{Method: "CONNECT", RequestTarget: "old.internal:443", Host: "old.internal", Port: 443, IsConnect: true},
+			true, "new.internal:8080", []int{1}, false},
+		// Rules rewriting each other's results stop at the limit
+		{"loop", &HTTPRequest{Method: "GET", RequestTarget: "http://a.loop/", Host: "a.loop", Port: 80},
+			true, "http://b.loop/", []int{4, 5, 4}, true},
+	}
+	for _, tt := range tests {
+		tt.req.Headers = map[string]string{"host": tt.req.Host}
+		lines, looped := rules.Apply(tt.req, tt.moveHost, 3)
+		if got := requestLocation(tt.req); got != tt.wantTarget {
+			t.Errorf("%s: rewritten to %s, want %s", tt.name, got, tt.wantTarget)
+		}
+		if !reflect.DeepEqual(lines, tt.wantLines) || looped != tt.wantLooped {
+			t.Errorf("%s: applied rules %v (looped %t), want %v (looped %t)", tt.name, lines, looped, tt.wantLines, tt.wantLooped)
+		}
+	}
+}
+
+func TestRewriteRequests(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Host, r.URL.RequestURI())
+	}))
+	defer origin.Close()
+	target := hostOf(origin.URL)
+
+	config := testConfig(t)
+	config.RewriteRulesFile = writeRewriteRules(t,
+		"retired.example host="+target,
+		"127.0.0.1/old/* strip_prefix=/old add_prefix=/new",
+		"* drop_query=utm_source",
+	)
+	s, addr := startServer(t, config)
+
+	tests := []struct {
+		url  string
+		want string // the host and target the origin got
+	}{
+		{"http://retired.example/old/page?utm_source=mail&id=7", target + " /new/page?id=7"},
+		{origin.URL + "/kept?id=7", target + " /kept?id=7"},
+	}
+	for _, tt := range tests {
+		resp := proxyGet(t, dialProxy(t, addr), tt.url, 5*time.Second)
+		if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != tt.want {
+			t.Errorf("GET %s reached the origin as %d %q, want %q", tt.url, resp.StatusCode, body, tt.want)
+		}
+	}
+
+	waitFor(t, func() bool { return s.Stats().TotalRequests == 2 })
+	s.Shutdown()
+	log, err := os.ReadFile(config.LogFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := " [REWRITE: http://retired.example/old/page?utm_source=mail&id=7 → http://" + target + "/new/page?id=7]"
+	if n := strings.Count(string(log), " [REWRITE: "); n != 1 || !strings.Contains(string(log), want) {
+		t.Errorf("log has %d rewrites, want only %q:\n%s", n, want, log)
+	}
+}
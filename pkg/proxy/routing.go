@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Route kinds
+const (
+	routeDirect = "DIRECT"
+	routeProxy  = "PROXY"  // parent HTTP proxy
+	routeSOCKS5 = "SOCKS5" // SOCKS5 proxy
+)
+
+// Route is how the proxy reaches an origin: directly, or through parent
+// HTTP or SOCKS5 proxies, tried in the order of Addrs
+type Route struct {
+	Kind  string
+	Addrs []string
+}
+
+// String returns the route as written in the rules file, e.g.
+// "PROXY 10.0.0.5:3128 10.0.0.6:3128"
+func (r Route) String() string {
+	if r.Kind == routeDirect || r.Kind == "" {
+		return routeDirect
+	}
+	return r.Kind + " " + strings.Join(r.Addrs, " ")
+}
+
+// parseRoute parses "DIRECT", or "PROXY" or "SOCKS5" followed by one or
+// more host:port addresses in priority order, separated by spaces or commas
+func parseRoute(s string) (Route, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Route{}, errors.New("empty route")
+	}
+
+	kind := strings.ToUpper(fields[0])
+	switch kind {
+	case routeDirect:
+		if len(fields) != 1 {
+			return Route{}, errors.New("DIRECT takes no address")
+		}
+		return Route{Kind: routeDirect}, nil
+	case routeProxy, routeSOCKS5:
+		route := Route{Kind: kind}
+		for _, field := range fields[1:] {
+			for _, addr := range strings.Split(field, ",") {
+				if addr == "" {
+					continue
+				}
+				if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+					return Route{}, fmt.Errorf("invalid %s address %q", kind, addr)
+				}
+				route.Addrs = append(route.Addrs, addr)
+			}
+		}
+		if len(route.Addrs) == 0 {
+			return Route{}, fmt.Errorf("%s needs a host:port address", kind)
+		}
+		return route, nil
+	}
+	return Route{}, fmt.Errorf("unknown route %q (want DIRECT, PROXY or SOCKS5)", fields[0])
+}
+
+// routingRule sends hosts matching pattern over route
+type routingRule struct {
+	pattern string // exact host or *.suffix, as in the filter
+	route   Route
+}
+
+// RoutingRules maps destination hosts to routes; the first matching rule
+// wins, and hosts matching none use the default route
+type RoutingRules struct {
+	rules        []routingRule
+	defaultRoute Route
+}
+
+// LoadRoutingRules loads routing rules from a file, one per line:
+//
+//	host-pattern DIRECT|PROXY host:port...|SOCKS5 host:port...
+//
+// An empty path loads no rules, so every host uses defaultRoute.
+func LoadRoutingRules(path string, defaultRoute string) (*RoutingRules, error) {
+	def, err := parseRoute(defaultRoute)
+	if err != nil {
+		return nil, fmt.Errorf("default_route: %w", err)
+	}
+	rr := &RoutingRules{defaultRoute: def}
+	if path == "" {
+		return rr, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open routing rules file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if line == "" {
+			continue
+		}
+
+		pattern, rest, _ := strings.Cut(line, " ")
+		route, err := parseRoute(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		rr.rules = append(rr.rules, routingRule{pattern: strings.ToLower(pattern), route: route})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read routing rules file: %w", err)
+	}
+
+	return rr, nil
+}
+
+// Match returns the route for host
+func (rr *RoutingRules) Match(host string) Route {
+	host = strings.ToLower(strings.TrimSpace(host))
+	for _, rule := range rr.rules {
+		if rule.pattern == host {
+			return rule.route
+		}
+		if suffix, ok := strings.CutPrefix(rule.pattern, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return rule.route
+			}
+		}
+	}
+	return rr.defaultRoute
+}
+
+// Parents returns the kind of every parent proxy the rules refer to, by
+// address
+func (rr *RoutingRules) Parents() map[string]string {
+	parents := make(map[string]string)
+	for _, addr := range rr.defaultRoute.Addrs {
+		parents[addr] = rr.defaultRoute.Kind
+	}
+	for _, rule := range rr.rules {
+		for _, addr := range rule.route.Addrs {
+			parents[addr] = rule.route.Kind
+		}
+	}
+	return parents
+}
+
+// dialParent connects to addr through the parent proxy of the given kind.
+// With tunnel set, a parent HTTP proxy is asked to CONNECT to addr, so the
+// result always reaches addr itself; otherwise the connection is to the
+// parent, which expects absolute-form requests.
+func dialParent(ctx context.Context, kind, parent, addr string, timeout time.Duration, tunnel bool) (net.Conn, error) {
+	route := Route{Kind: kind, Addrs: []string{parent}}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", parent)
+	if err != nil {
+		return nil, fmt.Errorf("route %s: %w", route, err)
+	}
+
+	// Bound the handshake with the parent by the connect timeout too, and
+	// abandon it if ctx is cancelled
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	switch {
+	case kind == routeSOCKS5:
+		err = socks5Connect(conn, addr)
+	case tunnel:
+		err = httpConnect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("route %s: %w", route, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// httpConnect opens a tunnel to addr through the parent HTTP proxy on
+// conn. The response is read a byte at a time so nothing the origin sends
+// after it is consumed.
+func httpConnect(conn net.Conn, addr string) error {
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return err
+	}
+
+	var head []byte
+	b := make([]byte, 1)
+	for !strings.HasSuffix(string(head), "\r\n\r\n") {
+		if _, err := conn.Read(b); err != nil {
+			return fmt.Errorf("reading CONNECT response: %w", err)
+		}
+		head = append(head, b[0])
+		if len(head) > 16*1024 {
+			return errors.New("CONNECT response headers too large")
+		}
+	}
+
+	statusLine, _, _ := strings.Cut(string(head), "\r\n")
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[1], "2") {
+		return fmt.Errorf("parent refused CONNECT: %s", statusLine)
+	}
+	return nil
+}
+
+// socks5Connect asks the SOCKS5 proxy on conn, without authentication, to
+// connect to addr (RFC 1928)
+func socks5Connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	// Greeting: version 5, one method, no authentication
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("reading SOCKS5 greeting: %w", err)
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		return errors.New("SOCKS5 proxy requires authentication")
+	}
+
+	request := []byte{5, 1, 0} // version, CONNECT, reserved
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(append(request, 1), ip.To4()...)
+	} else if ip != nil {
+		request = append(append(request, 4), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long for SOCKS5: %s", host)
+		}
+		request = append(append(request, 3, byte(len(host))), host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// Reply: version, status, reserved, then the bound address
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("reading SOCKS5 reply: %w", err)
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("SOCKS5 connect failed with status %d", header[1])
+	}
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("SOCKS5 reply has unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errNoRuntimeRule is returned by RemoveRule for a rule that wasn't added at
+// runtime
+var errNoRuntimeRule = errors.New("no such runtime rule")
+
+// FilterRule describes a blocking rule, as listed by ListRules and the admin
+// /filter/rules endpoint
+type FilterRule struct {
+	Rule     string     `json:"rule"`
+	Category string     `json:"category,omitempty"`
+	Source   string     `json:"source"` // "file" or "runtime"
+	File     string     `json:"file,omitempty"`
+	Line     int        `json:"line,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	AddedBy  string     `json:"added_by,omitempty"`
+}
+
+// canonicalRule lowercases and trims rule, and checks it is a single domain,
+// *.suffix or IP, with an optional :port, as the rules file would hold
+func canonicalRule(rule string) (string, error) {
+	rule = strings.ToLower(strings.TrimSpace(rule))
+	if rule == "" {
+		return "", errors.New("empty rule")
+	}
+	if err := checkRule(rule); err != nil {
+		return "", fmt.Errorf("invalid rule %q: %v", rule, err)
+	}
+	return rule, nil
+}
+
+// AddRule blocks rule until ttl has passed, or until it is removed if ttl is
+// 0, returning the rule in canonical form. Runtime rules are kept when the
+// rules file is reloaded; a rule also in the file stays blocked by it.
+func (f *Filter) AddRule(rule string, ttl time.Duration, addedBy string) (string, error) {
+	rule, err := canonicalRule(rule)
+	if err != nil {
+		return "", err
+	}
+	source := ruleSource{addedBy: addedBy, hits: &ruleHits{}, labels: infixLabels(rule)}
+	if ttl > 0 {
+		source.expires = time.Now().Add(ttl)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.purgeExpired()
+	rules := f.rulesFor(rule)
+	existing, ok := rules[rule]
+	if ok {
+		source.hits = existing.hits
+	}
+	f.runtimeRules[rule] = source
+	if !ok || existing.file == "" {
+		rules[rule] = source
+	}
+	return rule, nil
+}
+
+// RemoveRule removes a rule added with AddRule. Rules from the rules file
+// can only be removed by editing it.
+func (f *Filter) RemoveRule(rule string) (string, error) {
+	rule, err := canonicalRule(rule)
+	if err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.purgeExpired()
+	if _, ok := f.runtimeRules[rule]; !ok {
+		if source, ok := f.rulesFor(rule)[rule]; ok {
+			return "", fmt.Errorf("%w: %s is loaded from %s:%d", errNoRuntimeRule, rule, source.file, source.line)
+		}
+		return "", fmt.Errorf("%w: %s", errNoRuntimeRule, rule)
+	}
+	delete(f.runtimeRules, rule)
+	rules := f.rulesFor(rule)
+	if rules[rule].file == "" {
+		delete(rules, rule)
+	}
+	return rule, nil
+}
+
+// ListRules returns the rules from the file, the categories and those added
+// at runtime, sorted by rule. A rule in several is listed once for each.
+func (f *Filter) ListRules() []FilterRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.purgeExpired()
+
+	var list []FilterRule
+	add := func(rules map[string]ruleSource, category string) {
+		for rule, source := range rules {
+			if source.file != "" {
+				list = append(list, FilterRule{Rule: rule, Category: category, Source: "file", File: source.file, Line: source.line})
+			}
+		}
+	}
+	add(f.blockedDomains, "")
+	add(f.blockedIPs, "")
+	for _, set := range f.categories {
+		add(set.domains, set.Name)
+		add(set.ips, set.Name)
+	}
+	list = append(list, f.runtimeRuleList()...)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Rule < list[j].Rule })
+	return list
+}
+
+// runtimeRuleList returns the runtime rules; f.mu must be held
+func (f *Filter) runtimeRuleList() []FilterRule {
+	list := make([]FilterRule, 0, len(f.runtimeRules))
+	for rule, source := range f.runtimeRules {
+		entry := FilterRule{Rule: rule, Source: "runtime", AddedBy: source.addedBy}
+		if !source.expires.IsZero() {
+			expires := source.expires
+			entry.Expires = &expires
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+// purgeExpired drops runtime rules whose TTL has passed; f.mu must be held
+// for writing
+func (f *Filter) purgeExpired() {
+	now := time.Now()
+	for rule, source := range f.runtimeRules {
+		if !source.expired(now) {
+			continue
+		}
+		delete(f.runtimeRules, rule)
+		rules := f.rulesFor(rule)
+		if rules[rule].file == "" {
+			delete(rules, rule)
+		}
+		f.diag.Infof("Runtime filter rule %s expired", rule)
+	}
+}
+
+// mergeRuntimeRules adds the runtime rules to freshly loaded file rules;
+// f.mu must be held for writing
+func (f *Filter) mergeRuntimeRules() {
+	f.purgeExpired()
+	for rule, source := range f.runtimeRules {
+		rules := f.rulesFor(rule)
+		if _, ok := rules[rule]; !ok {
+			rules[rule] = source
+		}
+	}
+}
+
+// SaveRuntimeRules writes the runtime rules to path as JSON, replacing it
+// atomically
+func (f *Filter) SaveRuntimeRules(path string) error {
+	f.mu.RLock()
+	list := f.runtimeRuleList()
+	f.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Rule < list[j].Rule })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to save runtime rules: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save runtime rules: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save runtime rules: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save runtime rules: %w", err)
+	}
+	return nil
+}
+
+// LoadRuntimeRules adds the runtime rules saved in path by
+// SaveRuntimeRules, skipping any that have expired. A missing file is not
+// an error.
+func (f *Filter) LoadRuntimeRules(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read runtime rules: %w", err)
+	}
+	var list []FilterRule
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("invalid runtime rules file %s: %w", path, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, entry := range list {
+		rule, err := canonicalRule(entry.Rule)
+		if err != nil {
+			return fmt.Errorf("invalid runtime rules file %s: %w", path, err)
+		}
+		source := ruleSource{addedBy: entry.AddedBy, hits: &ruleHits{}, labels: infixLabels(rule)}
+		if existing, ok := f.rulesFor(rule)[rule]; ok {
+			source.hits = existing.hits
+		}
+		if entry.Expires != nil {
+			source.expires = *entry.Expires
+		}
+		f.runtimeRules[rule] = source
+	}
+	f.mergeRuntimeRules()
+	f.diag.Infof("Loaded %d runtime filter rules from %s", len(f.runtimeRules), path)
+	return nil
+}
+
+// handleFilterRules serves /filter/rules: GET lists the rules and POST adds
+// one, from a JSON body such as {"rule": "*.example.com", "ttl": "1h"}
+func (s *Server) handleFilterRules(w http.ResponseWriter, r *http.Request) {
+	if !s.hasBuiltinFilter(w) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.filter.ListRules())
+	case http.MethodPost:
+		var body struct {
+			Rule string `json:"rule"`
+			TTL  string `json:"ttl"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if body.TTL != "" {
+			var err error
+			if ttl, err = parseDuration(body.TTL); err != nil || ttl < 0 {
+				http.Error(w, fmt.Sprintf("invalid ttl %q", body.TTL), http.StatusBadRequest)
+				return
+			}
+		}
+		caller := adminCaller(r)
+		rule, err := s.filter.AddRule(body.Rule, ttl, caller)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ttl > 0 {
+			s.diag.Infof("Runtime filter rule %s added by %s for %s", rule, caller, ttl)
+		} else {
+			s.diag.Infof("Runtime filter rule %s added by %s", rule, caller)
+		}
+		if !s.saveRuntimeRules(w) {
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintln(w, rule)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFilterRule serves DELETE /filter/rules/{rule}, removing a runtime
+// rule
+func (s *Server) handleFilterRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.hasBuiltinFilter(w) {
+		return
+	}
+	rule, err := s.filter.RemoveRule(strings.TrimPrefix(r.URL.Path, "/filter/rules/"))
+	if errors.Is(err, errNoRuntimeRule) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.diag.Infof("Runtime filter rule %s removed by %s", rule, adminCaller(r))
+	if s.saveRuntimeRules(w) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// saveRuntimeRules writes the runtime rules to persist_runtime_rules, if
+// set, answering 500 and returning false if that fails. The change has
+// already taken effect either way.
+func (s *Server) saveRuntimeRules(w http.ResponseWriter) bool {
+	path := s.config.Load().PersistRuntimeRules
+	if path == "" {
+		return true
+	}
+	if err := s.filter.SaveRuntimeRules(path); err != nil {
+		s.diag.Errorf("%v", err)
+		http.Error(w, fmt.Sprintf("rule changed but not saved: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// hasBuiltinFilter answers 501 and returns false when a FilterEngine other
+// than the built-in filter makes the blocking decisions, as it has no
+// rules to list or change here
+func (s *Server) hasBuiltinFilter(w http.ResponseWriter) bool {
+	if s.filter == nil {
+		http.Error(w, "not supported by the configured filter engine", http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
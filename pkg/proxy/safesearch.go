@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// defaultSafeSearchHosts are the SafeSearch enforcement hosts the search
+// engines document for DNS-level enforcement
+var defaultSafeSearchHosts = []string{
+	"google.com=forcesafesearch.google.com",
+	"www.google.com=forcesafesearch.google.com",
+	"bing.com=strict.bing.com",
+	"www.bing.com=strict.bing.com",
+	"duckduckgo.com=safe.duckduckgo.com",
+	"www.duckduckgo.com=safe.duckduckgo.com",
+}
+
+// SafeSearch sends requests for search engines to their SafeSearch
+// enforcement hosts, as enforce_safesearch does
+type SafeSearch struct {
+	hosts   []safeSearchHost
+	targets map[string]bool // enforcement hosts, which are never rewritten
+}
+
+// safeSearchHost maps an exact host or *.suffix to an enforcement host
+type safeSearchHost struct {
+	pattern string
+	target  string
+}
+
+// NewSafeSearch parses the safesearch_hosts table from config, returning
+// nil when enforce_safesearch is off
+func NewSafeSearch(config *Config) (*SafeSearch, error) {
+	if !config.EnforceSafeSearch {
+		return nil, nil
+	}
+	return parseSafeSearchHosts(config.SafeSearchHosts)
+}
+
+// parseSafeSearchHosts parses host=enforcement-host entries
+func parseSafeSearchHosts(entries []string) (*SafeSearch, error) {
+	s := &SafeSearch{targets: make(map[string]bool)}
+	for _, entry := range entries {
+		pattern, target, ok := strings.Cut(entry, "=")
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		target = strings.ToLower(strings.TrimSpace(target))
+		if !ok || pattern == "" || target == "" || strings.ContainsAny(target, "*:/") {
+			return nil, fmt.Errorf("invalid entry %q (want host=enforcement-host)", entry)
+		}
+		s.hosts = append(s.hosts, safeSearchHost{pattern: pattern, target: target})
+		s.targets[target] = true
+	}
+	return s, nil
+}
+
+// Target returns the enforcement host for host, if it is a search engine
+// the table covers. Hosts that already are enforcement hosts aren't
+// rewritten, even if a *.suffix pattern covers them. A nil SafeSearch
+// rewrites nothing.
+func (s *SafeSearch) Target(host string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if s.targets[host] {
+		return "", false
+	}
+	for _, h := range s.hosts {
+		if h.pattern == host {
+			return h.target, true
+		}
+		if suffix, ok := strings.CutPrefix(h.pattern, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return h.target, true
+			}
+		}
+	}
+	return "", false
+}
+
+// applySafeSearch sends req to the enforcement host for its host, if any.
+// A CONNECT only has its destination changed: the client's TLS session
+// still names the search engine, which the enforcement hosts serve, as
+// they do when DNS points the engine at them. A plain HTTP request also has
+// its Host header and absolute target rewritten, so a parent proxy goes
+// there too.
+func (s *Server) applySafeSearch(req *HTTPRequest) {
+	target, ok := s.safeSearch.Load().Target(req.Host)
+	if !ok {
+		return
+	}
+	s.diag.Debugf("Request %s: SafeSearch rewrites %s to %s", req.ID, req.Host, target)
+	req.SafeSearchFrom = req.Host
+	req.Host = target
+	if req.IsConnect {
+		return
+	}
+
+	if hostHeader, ok := req.Headers["host"]; ok {
+		req.Headers["host"] = replaceHostname(hostHeader, target)
+	}
+	if strings.HasPrefix(req.RequestTarget, "http://") || strings.HasPrefix(req.RequestTarget, "https://") {
+		if u, err := url.Parse(req.RequestTarget); err == nil {
+			u.Host = replaceHostname(u.Host, target)
+			req.RequestTarget = u.String()
+		}
+	}
+}
+
+// replaceHostname swaps the name in a host or host:port for host, keeping
+// the port
+func replaceHostname(hostPort, host string) string {
+	if _, port, err := net.SplitHostPort(hostPort); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	return host
+}
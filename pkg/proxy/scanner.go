@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icapDefaultPort is the port of a scan_icap_url that doesn't give one
+const icapDefaultPort = "1344"
+
+// maxVerdictLength caps the scanner output kept as a verdict
+const maxVerdictLength = 200
+
+// MalwareError reports a response the scanner flagged; Verdict is what the
+// scanner said about it
+type MalwareError struct {
+	Verdict string
+}
+
+func (e *MalwareError) Error() string {
+	return "scanner flagged the response: " + e.Verdict
+}
+
+// ScanError reports a scanner that gave no verdict, which with
+// scan_fail_open off stops the response
+type ScanError struct {
+	Err error
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("response scan failed: %v", e.Err)
+}
+
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
+
+// wantsScan reports whether a response to req with headers is to be
+// scanned: a scanner must be configured, and the response must have one of
+// the scan_content_types or a file name with one of the scan_extensions,
+// or both lists must be empty
+func wantsScan(config *Config, req *HTTPRequest, headers []string) bool {
+	if config.ScanICAPURL == "" && config.ScanCommand == "" {
+		return false
+	}
+	if len(config.ScanContentTypes) == 0 && len(config.ScanExtensions) == 0 {
+		return true
+	}
+	if _, ok := matchExtension(config.ScanExtensions, requestFileName(req.RequestTarget)); ok {
+		return true
+	}
+	for _, line := range headers {
+		name, value, _ := strings.Cut(line, ":")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "content-type":
+			mediaType, _, _ := strings.Cut(value, ";")
+			if matchContentType(config.ScanContentTypes, strings.ToLower(strings.TrimSpace(mediaType))) {
+				return true
+			}
+		case "content-disposition":
+			if _, ok := matchExtension(config.ScanExtensions, contentDispositionFileName(strings.TrimSpace(value))); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchContentType reports whether mediaType is one of types, which are
+// type/subtype or type/*
+func matchContentType(types []string, mediaType string) bool {
+	for _, t := range types {
+		if t == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(t, "*"); ok && strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanResponse reads a response body, up to scan_max_bytes, and has it
+// scanned, returning the bytes read for the caller to relay ahead of the
+// rest. A longer body isn't scanned. A flagged body fails with
+// *MalwareError, and a scanner failure with *ScanError unless
+// scan_fail_open is set. The scan only holds up this request: nothing is
+// locked while it runs.
+func (f *Forwarder) scanResponse(ctx context.Context, req *HTTPRequest, statusLine string, headers []string, body io.Reader, upstreamConn net.Conn, config *Config) ([]byte, error) {
+	buffered, complete, err := f.bufferForScan(body, upstreamConn, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body for scanning: %w", err)
+	}
+	if !complete {
+		f.diag.Debugf("Request %s: response body exceeds scan_max_bytes, relayed unscanned", req.ID)
+		return buffered, nil
+	}
+
+	// The scanner gets the content, not the chunked framing relayed with it
+	content := buffered
+	for _, line := range headers {
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "transfer-encoding") && headerHasToken(value, "chunked") {
+			if decoded, err := io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(buffered))); err == nil {
+				content = decoded
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.ScanTimeout)
+	defer cancel()
+	started := time.Now()
+	var verdict string
+	if config.ScanICAPURL != "" {
+		verdict, err = scanWithICAP(ctx, config.ScanICAPURL, req, statusLine, headers, content)
+	} else {
+		verdict, err = scanWithCommand(ctx, config.ScanCommand, content)
+	}
+	if err != nil {
+		if !config.ScanFailOpen {
+			return nil, &ScanError{Err: err}
+		}
+		f.diag.Warnf("Request %s: response scan failed, relayed unscanned (scan_fail_open): %v", req.ID, err)
+		return buffered, nil
+	}
+	if verdict != "" {
+		return nil, &MalwareError{Verdict: verdict}
+	}
+	f.diag.Debugf("Request %s: %d byte response scanned clean in %s", req.ID, len(content), time.Since(started).Round(time.Millisecond))
+	return buffered, nil
+}
+
+// bufferForScan reads body up to scan_max_bytes, reporting whether that
+// was all of it
+func (f *Forwarder) bufferForScan(body io.Reader, upstreamConn net.Conn, config *Config) ([]byte, bool, error) {
+	var buffered bytes.Buffer
+	limited := io.LimitReader(body, config.ScanMaxBytes+1)
+	chunk := make([]byte, config.ReadBufferSize)
+	for {
+		f.extendDeadline(upstreamConn, config)
+		n, err := limited.Read(chunk)
+		buffered.Write(chunk[:n])
+		if err == io.EOF {
+			return buffered.Bytes(), int64(buffered.Len()) <= config.ScanMaxBytes, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// scanWithCommand runs scan_command with content on its standard input. An
+// exit status other than 0 is a detection, described by the first line the
+// command printed.
+func scanWithCommand(ctx context.Context, command string, content []byte) (string, error) {
+	fields := strings.Fields(command)
+	cmd := exec.CommandContext(ctx, fields[0], fields[1:]...)
+	cmd.Stdin = bytes.NewReader(content)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Children of a command killed at the timeout may hold its output open
+	cmd.WaitDelay = 100 * time.Millisecond
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("scan_command: %w", ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		verdict, _, _ := strings.Cut(strings.TrimSpace(output.String()), "\n")
+		if verdict = strings.TrimSpace(verdict); verdict == "" {
+			verdict = exitErr.Error()
+		}
+		return truncateVerdict(verdict), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("scan_command: %w", err)
+	}
+	return "", nil
+}
+
+// scanWithICAP sends the response to an ICAP server in a RESPMOD request.
+// 204 No Content passes it; a 200 means the server replaced it, and is a
+// detection described by the X-Infection-Found, X-Violations-Found or
+// X-Virus-ID header.
+func scanWithICAP(ctx context.Context, rawURL string, req *HTTPRequest, statusLine string, headers []string, content []byte) (string, error) {
+	service, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	addr := service.Host
+	if service.Port() == "" {
+		addr = net.JoinHostPort(service.Hostname(), icapDefaultPort)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("ICAP server %s: %w", addr, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	// The encapsulated request only names the resource, so credentials and
+	// cookies aren't passed on
+	target := req.RequestTarget
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		target = "http://" + net.JoinHostPort(req.Host, strconv.Itoa(req.Port)) + target
+	}
+	reqHead := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\n\r\n", req.Method, target, req.Host)
+	resHead := strings.TrimRight(statusLine, "\r\n") + "\r\n" + strings.Join(headers, "\r\n") + "\r\n\r\n"
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "RESPMOD %s ICAP/1.0\r\n", rawURL)
+	fmt.Fprintf(&message, "Host: %s\r\n", service.Host)
+	message.WriteString("Allow: 204\r\n")
+	fmt.Fprintf(&message, "Encapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n", len(reqHead), len(reqHead)+len(resHead))
+	message.WriteString(reqHead)
+	message.WriteString(resHead)
+	if len(content) > 0 {
+		fmt.Fprintf(&message, "%x\r\n", len(content))
+		message.Write(content)
+		message.WriteString("\r\n")
+	}
+	message.WriteString("0\r\n\r\n")
+	if _, err := conn.Write(message.Bytes()); err != nil {
+		return "", fmt.Errorf("ICAP server %s: %w", addr, err)
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	line, err := reader.ReadLine()
+	if err != nil {
+		return "", fmt.Errorf("ICAP server %s: %w", addr, err)
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "ICAP/") {
+		return "", fmt.Errorf("ICAP server %s: invalid status line %q", addr, line)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return "", fmt.Errorf("ICAP server %s: %w", addr, err)
+	}
+
+	switch parts[1] {
+	case "204":
+		return "", nil
+	case "200":
+		for _, name := range []string{"X-Infection-Found", "X-Violations-Found", "X-Virus-Id"} {
+			if value := header.Get(name); value != "" {
+				return truncateVerdict(value), nil
+			}
+		}
+		return "response replaced by ICAP server", nil
+	default:
+		return "", fmt.Errorf("ICAP server %s answered %q", addr, line)
+	}
+}
+
+// truncateVerdict keeps a verdict to a loggable length
+func truncateVerdict(verdict string) string {
+	if len(verdict) > maxVerdictLength {
+		return verdict[:maxVerdictLength] + "..."
+	}
+	return verdict
+}
@@ -0,0 +1,1521 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Server represents the proxy server
+type Server struct {
+	config          atomic.Pointer[Config] // swapped on reload, read once per request
+	engine          FilterEngine           // makes the blocking decisions, see WithFilterEngine
+	filter          *Filter                // engine, when it is the built-in filter; nil otherwise
+	policies        atomic.Pointer[Policies]
+	exprRules       atomic.Pointer[ExprRules]         // expression_rules_file, empty when it isn't set
+	rewrites        atomic.Pointer[RewriteRules]      // rewrite_rules_file, empty when it isn't set
+	faults          atomic.Pointer[FaultRules]        // fault_injection_file, empty unless enable_fault_injection is set
+	bandwidth       atomic.Pointer[BandwidthProfiles] // bandwidth_profiles_file, taken by each connection as it is accepted
+	safeSearch      atomic.Pointer[SafeSearch]        // nil unless enforce_safesearch is on
+	reverse         atomic.Pointer[ReverseRoutes]     // backends of reverse proxy listeners
+	logger          *Logger
+	diag            *DiagLogger
+	forwarder       *Forwarder
+	cache           CacheBackend
+	limiter         *RateLimiter
+	authHook        *AuthHook
+	allowlist       *ClientAllowlist
+	authFailures    *AuthFailureLimiter
+	policyExec      *PolicyExec // runs policy_exec, when it is set
+	stats           *Stats
+	timeseries      *Timeseries // per-minute statistics for the dashboard
+	shedder         *LoadShedder
+	errorPages      *ErrorPages
+	users           *UserFile    // Basic auth users, when auth_mode is basic
+	tokens          *TokenFile   // named tokens, when auth_tokens_file is set
+	mitm            *MITM        // TLS interception for mitm_domains
+	geoip           *GeoIP       // destination country and AS lookups for the access log
+	admin           *http.Server // health endpoints, when admin_listen is set
+	listeners       []*proxyListener
+	configListeners bool           // Listen bound the configured listeners, which reloads rebind
+	acceptErrs      chan error     // the first permanent accept failure, returned by Start
+	certs           certStore      // client-facing TLS certificate
+	mu              sync.Mutex     // guards listeners, configListeners and admin
+	acceptLoops     sync.WaitGroup // the running acceptLoops, which add to wg
+	wg              sync.WaitGroup
+	shutdown        chan struct{}
+	workerPool      *WorkerPool
+
+	activeConns atomic.Int64              // connections handled or queued, see trackConn
+	connFreed   chan struct{}             // signalled when a connection slot frees up
+	conns       map[*labeledConn]struct{} // tracked connections, closed when the grace period runs out
+	ipConns     map[string]int            // active connections per client, see connLimitKey
+	connsMu     sync.Mutex                // guards conns and ipConns
+	connIDs     atomic.Uint64             // last ID given to a tracked connection
+
+	shutdownOnce sync.Once
+	done         chan struct{} // closed once Shutdown has finished
+	forceOnce    sync.Once
+	force        chan struct{} // closed by ForceShutdown to cut the drain short
+
+	options serverOptions // components supplied to NewServer, left alone on reload
+
+	hooks   atomic.Pointer[hookChains] // see OnRequest, OnConnect and OnResponse
+	hooksMu sync.Mutex                 // serializes hook registration
+
+	baseCtx        context.Context         // parent of every request's context
+	cancelRequests context.CancelCauseFunc // cancels in-flight requests once the grace period runs out
+}
+
+// NewServer creates a new server instance. Components not supplied through
+// opts are built from config, which is validated first so that a Config
+// built in code gets the same checks as one loaded from a file.
+func NewServer(config *Config, opts ...Option) (*Server, error) {
+	config.inferAuthMode()
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	var options serverOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	// Initialize diagnostic logger
+	diag, err := NewDiagLogger(config.ErrorLogPath, config.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize error logger: %w", err)
+	}
+
+	// Load filter rules
+	engine, filter := options.engine, options.filter
+	if engine == nil {
+		if filter, err = NewFileFilter(config, diag); err != nil {
+			return nil, err
+		}
+		engine = filter
+	}
+	if filter != nil && config.PersistRuntimeRules != "" {
+		if err := filter.LoadRuntimeRules(config.PersistRuntimeRules); err != nil {
+			return nil, err
+		}
+	}
+
+	// Initialize logger
+	logger := options.logger
+	if logger == nil {
+		logger, err = NewLogger(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize logger: %w", err)
+		}
+	}
+	logger.diag = diag
+
+	// Ship the access log to a collector
+	shipper, err := NewLogShipper(config, diag)
+	if err != nil {
+		return nil, err
+	}
+	logger.SetShipper(shipper)
+
+	// Write the access log to SQLite as well as, or instead of, the file
+	logDB, err := OpenLogDB(config, diag)
+	if err != nil {
+		return nil, err
+	}
+	logger.SetDB(logDB)
+
+	// Load Basic auth users
+	users := NewUserFile(diag)
+	if config.AuthMode == "basic" {
+		if err := users.Load(config.AuthUsersFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// Load the interception CA
+	mitm := NewMITM()
+	if err := mitm.Reconfigure(config); err != nil {
+		return nil, err
+	}
+
+	// Open the GeoIP databases
+	geoip, err := NewGeoIP(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load named auth tokens
+	tokens := NewTokenFile(diag)
+	if config.AuthMode == "token" && config.AuthTokensFile != "" {
+		if err := tokens.Load(config.AuthTokensFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// Load header rules
+	headerRules, err := LoadHeaderRules(config.HeaderRulesFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAnonymityRules(config, headerRules); err != nil {
+		return nil, err
+	}
+
+	// Load routing rules
+	routes, err := LoadRoutingRules(config.RoutingRulesFile, config.DefaultRoute)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load rewrite rules
+	rewrites, err := LoadRewriteRules(config.RewriteRulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load fault injection rules, only used when enabled
+	faults, err := LoadFaultRules(config.faultRulesFile())
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the bandwidth profiles simulated for matching clients
+	bandwidth, err := LoadBandwidthProfiles(config.BandwidthProfilesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the backends of reverse proxy listeners
+	reverseRoutes, err := LoadReverseRoutes(config.ReverseProxyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the roots origin certificates are verified against
+	upstreamCAs, err := loadUpstreamCAs(config.UpstreamCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load per-user policies
+	policies, err := LoadPolicies(config.PoliciesFile, config.DefaultPolicy, config.StrictRules, diag)
+	if err != nil {
+		return nil, err
+	}
+	policies.startLimiters(nil, config)
+
+	// Load expression rules
+	exprRules, err := LoadExprRules(config.ExpressionRulesFile)
+	if err != nil {
+		return nil, err
+	}
+	exprRules.startLimiters(nil, config)
+
+	// Load the SafeSearch enforcement hosts
+	safeSearch, err := NewSafeSearch(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connect to the StatsD agent
+	statsd, err := NewStatsD(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize forwarder
+	forwarder := NewForwarder(config, diag)
+	forwarder.SetHeaderRules(headerRules)
+	forwarder.SetRoutingRules(routes)
+	forwarder.SetUpstreamCAs(upstreamCAs)
+
+	// Initialize cache if enabled
+	cache := options.cache
+	if cache == nil && config.EnableCaching {
+		if config.CacheBackend == "redis" {
+			cache = NewRedisCache(config, diag)
+		} else {
+			cache = NewCache(config.CacheMaxEntries, config.CacheMaxSizeBytes(), diag)
+		}
+	}
+
+	server := &Server{
+		engine:       engine,
+		filter:       filter,
+		logger:       logger,
+		diag:         diag,
+		forwarder:    forwarder,
+		cache:        cache,
+		limiter:      NewRateLimiter(config),
+		authHook:     NewAuthHook(config),
+		allowlist:    NewClientAllowlist(config),
+		authFailures: NewAuthFailureLimiter(config),
+		policyExec:   NewPolicyExec(config),
+		stats:        NewStats(),
+		timeseries:   NewTimeseries(),
+		shedder:      NewLoadShedder(),
+		errorPages:   NewErrorPages(config, diag),
+		users:        users,
+		tokens:       tokens,
+		geoip:        geoip,
+		mitm:         mitm,
+		options:      options,
+		shutdown:     make(chan struct{}),
+		acceptErrs:   make(chan error, 1),
+		connFreed:    make(chan struct{}, 1),
+		conns:        make(map[*labeledConn]struct{}),
+		ipConns:      make(map[string]int),
+		done:         make(chan struct{}),
+		force:        make(chan struct{}),
+	}
+
+	forwarder.SetAddrCheck(server.blockedAddr)
+	forwarder.SetResponseHook(server.runResponseHooks)
+
+	server.config.Store(config)
+	server.policies.Store(policies)
+	server.exprRules.Store(exprRules)
+	server.rewrites.Store(rewrites)
+	server.faults.Store(faults)
+	server.bandwidth.Store(bandwidth)
+	server.safeSearch.Store(safeSearch)
+	server.reverse.Store(reverseRoutes)
+	server.stats.statsd.Store(statsd)
+	server.baseCtx, server.cancelRequests = context.WithCancelCause(context.Background())
+
+	// Certificate load failures are startup errors
+	if config.HasTLSListener() {
+		if err := server.certs.Load(config.TLSCertFile, config.TLSKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// Initialize worker pool if using thread pool model
+	if config.ConcurrencyModel == "thread_pool" {
+		server.workerPool = NewWorkerPool(config, func(conn net.Conn, waited time.Duration) {
+			server.stats.RecordQueueWait(waited)
+			if lc := clientConn(conn); lc != nil {
+				lc.queueWait = waited
+			}
+			if limit := server.config.Load().QueueMaxWait; limit > 0 && waited > limit {
+				server.rejectQueueTimeout(conn, waited, limit)
+				return
+			}
+			// client_idle_timeout starts from here, so the wait doesn't count
+			// against the client
+			server.handleConnection(server.baseCtx, conn)
+		}, diag)
+	}
+
+	return server, nil
+}
+
+// Start binds every configured listener and serves them, all sharing the
+// same filter, cache, logger and forwarder: it is Listen followed by
+// Serve(nil). It returns when Shutdown has finished draining connections,
+// or when any accept loop fails, including those of listeners added by a
+// reload.
+func (s *Server) Start() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve(nil)
+}
+
+// Listen binds every configured listener, without accepting on any of them
+// until Serve. On failure nothing is left bound.
+func (s *Server) Listen() error {
+	config := s.config.Load()
+
+	var listeners []*proxyListener
+	for _, spec := range config.ListenerSpecs() {
+		pl, err := s.bindListener(spec, config.ReusePort)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, pl)
+	}
+	s.mu.Lock()
+	s.listeners = append(s.listeners, listeners...)
+	s.configListeners = true
+	s.mu.Unlock()
+	return nil
+}
+
+// Serve accepts connections on l, and on the listeners bound by Listen,
+// until Shutdown; l may be nil when Listen has bound the listeners. l can
+// be any net.Listener, such as one on port 0 for tests or one handed over
+// by another process; a reload leaves it alone. Serve binds admin_listen
+// and drops privileges per run_as_user before serving anything. It may be
+// called once, and returns as Start does; Shutdown closes l.
+func (s *Server) Serve(l net.Listener) error {
+	config := s.config.Load()
+	s.diag.Infof("Starting %s", VersionString())
+
+	s.mu.Lock()
+	select {
+	case <-s.shutdown:
+		s.mu.Unlock()
+		if l != nil {
+			l.Close()
+		}
+		return nil
+	default:
+	}
+	if l != nil {
+		pl := &proxyListener{Listener: l, address: l.Addr().String(), injected: true, stop: make(chan struct{})}
+		pl.setLabel("")
+		s.listeners = append(s.listeners, pl)
+	}
+	listeners := append([]*proxyListener(nil), s.listeners...)
+	s.mu.Unlock()
+	if len(listeners) == 0 {
+		return errors.New("no listeners to serve: call Listen first or pass one to Serve")
+	}
+
+	admin, err := s.bindAdmin(config)
+	if err == nil {
+		// With every port bound, give up root before serving anything
+		if err = s.dropPrivileges(config); err != nil && admin != nil {
+			admin.Close()
+		}
+	}
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return err
+	}
+	for _, l := range listeners {
+		s.diag.Infof("Proxy server listening on %s", l.describe())
+	}
+	s.warnFaultInjection(config)
+	if admin != nil {
+		s.startAdmin(admin, config)
+	}
+
+	// Probe parent proxies in the background
+	go s.forwarder.parents.Run(s.config.Load, s.shutdown)
+
+	// Roll up the dashboard's statistics every minute
+	go s.timeseries.Run(s.config.Load, s.ActiveConnections, s.shutdown)
+
+	// Summarize load shedding instead of logging each connection
+	go s.shedder.Run(s.diag, s.shutdown)
+
+	// Start worker pool if applicable
+	if s.workerPool != nil {
+		s.workerPool.Start()
+	}
+
+	for _, listener := range listeners {
+		s.serveListener(listener)
+	}
+
+	select {
+	case err := <-s.acceptErrs:
+		return err
+	case <-s.done:
+		return nil
+	}
+}
+
+// Addr returns the address of the first listener, such as the port picked
+// for a listener on port 0, or nil before Listen or Serve
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+// bindListener binds the listener spec describes
+func (s *Server) bindListener(spec ListenerSpec, reusePort bool) (*proxyListener, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = setReusePort
+	}
+	listener, err := lc.Listen(context.Background(), "tcp", spec.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", spec.Address, err)
+	}
+	pl := &proxyListener{Listener: listener, address: spec.Address, tls: spec.TLS, stop: make(chan struct{})}
+	pl.setLabel(spec.Label)
+	if spec.TLS {
+		pl.Listener = tls.NewListener(listener, s.certs.TLSConfig())
+	}
+	return pl, nil
+}
+
+// serveListener runs the accept loop of listener, handing a permanent
+// failure to Start. Once Shutdown has begun it starts nothing, so that
+// Shutdown can wait for every accept loop before waiting on wg.
+func (s *Server) serveListener(listener *proxyListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.shutdown:
+		return
+	default:
+	}
+	s.acceptLoops.Add(1)
+	go func() {
+		defer s.acceptLoops.Done()
+		if err := s.acceptLoop(listener); err != nil {
+			select {
+			case s.acceptErrs <- err:
+			default:
+			}
+		}
+	}()
+}
+
+// acceptLoop accepts connections on one listener until shutdown, or until a
+// reload removes the listener. Transient accept errors such as running out
+// of file descriptors are retried with exponential backoff; it returns an
+// error only for permanent failures.
+func (s *Server) acceptLoop(listener *proxyListener) error {
+	config := s.config.Load()
+	var backoff time.Duration
+
+	for {
+		select {
+		case <-s.shutdown:
+			return nil
+		case <-listener.stop:
+			return nil
+		default:
+			// In block mode, stop accepting while at max_connections
+			if !s.waitForConnSlot() {
+				return nil
+			}
+
+			// Shutdown and reloads stop a blocked Accept by closing the
+			// listener, so any net.Listener will do
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-s.shutdown:
+					return nil // Listener closed by Shutdown
+				case <-listener.stop:
+					return nil // Listener removed by a reload
+				default:
+				}
+				if isTransientAcceptError(err) {
+					backoff = nextAcceptBackoff(backoff)
+					s.diag.Warnf("Accept failed on %s, retrying in %s: %v", listener.Addr(), backoff, err)
+					select {
+					case <-s.shutdown:
+						return nil
+					case <-time.After(backoff):
+					}
+					continue
+				}
+				s.diag.Errorf("Accept failed on %s: %v", listener.Addr(), err)
+				return fmt.Errorf("failed to accept connection on %s: %w", listener.Addr(), err)
+			}
+			backoff = 0
+			s.stats.TotalConnections.Add(1)
+			label := listener.Label()
+
+			// Only clients in allowed_client_cidrs may use the proxy
+			if !s.allowlist.Allowed(conn.RemoteAddr()) {
+				s.wg.Add(1)
+				go s.rejectDeniedClient(conn, label)
+				continue
+			}
+
+			// Shed load before any parsing while under pressure
+			limits := s.config.Load()
+			if signal := s.shedSignal(limits); signal != "" {
+				s.wg.Add(1)
+				go s.shedConn(conn, limits, signal)
+				continue
+			}
+
+			// In reject mode, turn away connections over max_connections
+			if s.atConnLimit(limits) {
+				s.wg.Add(1)
+				go s.rejectOverloaded(conn, label, "max_connections")
+				continue
+			}
+
+			// Enforce the per-client limit before any parsing work
+			var ipKey string
+			if limits.MaxConnectionsPerIP > 0 {
+				ipKey = connLimitKey(conn.RemoteAddr(), limits.IPv6LimitPrefix)
+				if !s.acquireIPSlot(ipKey, limits.MaxConnectionsPerIP) {
+					s.wg.Add(1)
+					go s.rejectRateLimited(conn, label)
+					continue
+				}
+			}
+			conn = s.trackConn(conn, label, ipKey)
+
+			// Handle connection based on concurrency model
+			if config.ConcurrencyModel == "thread_per_connection" {
+				s.wg.Add(1)
+				go s.handleConnection(s.baseCtx, conn)
+			} else if config.ConcurrencyModel == "thread_pool" {
+				s.submitToPool(conn, label)
+			}
+		}
+	}
+}
+
+// submitToPool queues a connection for the worker pool, applying the
+// queue_overflow policy when the queue is full. A queued connection counts
+// as in flight until its worker's handleConnection returns, so Shutdown
+// waits for it as it does for thread_per_connection handlers.
+func (s *Server) submitToPool(conn net.Conn, label string) {
+	config := s.config.Load()
+
+	s.wg.Add(1)
+	var err error
+	if config.QueueOverflow == "block" {
+		err = s.workerPool.SubmitWait(conn, config.QueueWaitTimeout)
+	} else {
+		err = s.workerPool.Submit(conn)
+	}
+	if err == nil {
+		return
+	}
+	s.wg.Done()
+
+	if err == errQueueFull {
+		s.stats.QueueDrops.Add(1)
+		if config.QueueOverflow != "drop" {
+			s.wg.Add(1)
+			go s.rejectOverloaded(conn, label, "queue_overflow")
+			return
+		}
+	}
+	s.diag.Debugf("Closing connection from %s: %v", conn.RemoteAddr(), err)
+	conn.Close()
+}
+
+// handleConnection handles a single client connection. The request gets a
+// context derived from ctx, cancelled if the client goes away, after
+// max_request_duration, or when shutdown stops waiting for it.
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	// A connection that never starts a request is closed quietly
+	reader := bufio.NewReader(conn)
+	if !s.awaitRequest(conn, reader, s.config.Load()) {
+		return
+	}
+
+	// Requests the client pipelined behind the first are answered in turn,
+	// for as long as each response leaves the connection usable. There is
+	// no keep-alive: the connection closes once the buffer is empty.
+	for s.handleRequest(ctx, conn, reader) && reader.Buffered() > 0 {
+		s.diag.Debugf("Connection from %s: serving a pipelined request", conn.RemoteAddr())
+	}
+}
+
+// handleRequest reads and answers one request on conn, reporting whether
+// the connection can carry another
+func (s *Server) handleRequest(ctx context.Context, conn net.Conn, reader *bufio.Reader) bool {
+	config := s.config.Load()
+
+	// The whole head must arrive within client_header_timeout
+	setReadTimeout(conn, config.ClientHeaderTimeout)
+
+	// Parse request
+	req, err := ParseRequestHead(reader)
+	if err != nil {
+		req = &HTTPRequest{Method: "UNKNOWN", ID: newRequestID()}
+		if isTimeout(err) {
+			s.sendSlowClient(conn, req, 0, "client_header_timeout")
+			return false
+		}
+		s.sendErrorDetail(conn, req, 400, "Bad Request", err)
+		s.logRequest(conn, req, "ERROR", 400, 0, 0, err.Error())
+		return false
+	}
+
+	// Answer load balancer health checks, which needn't send a Host header
+	if isHealthCheck(config, req) {
+		s.sendHealthCheckResponse(conn)
+		return false
+	}
+
+	// Serve the PAC script, which browsers fetch without proxy credentials,
+	// except on reverse proxy listeners, whose paths belong to the backends
+	reverse := config.isReverseListener(listenerLabel(conn))
+	if !reverse && isPACRequest(config, req) {
+		s.sendPACResponse(conn, req, config)
+		return false
+	}
+
+	setReadTimeout(conn, config.ClientReadTimeout)
+	if err := req.CompleteRequest(reader); err != nil {
+		req.ID = newRequestID()
+		s.sendErrorDetail(conn, req, 400, "Bad Request", err)
+		s.logRequest(conn, req, "ERROR", 400, 0, 0, err.Error())
+		return false
+	}
+
+	assignRequestID(config, req)
+	clientConn(conn).beginRequest(req)
+	s.startTrace(conn, req, config)
+
+	// On a reverse proxy listener the destination comes from the routes,
+	// never from the client
+	if reverse && !s.routeReverse(conn, req, config) {
+		return false
+	}
+
+	// Pace the connection to the request's bandwidth profile, if it has one
+	clientConn(conn).shapeRequest(req)
+
+	// With log_failure_policy=block, requests that can't be logged aren't
+	// served either
+	if config.LogFailurePolicy == "block" && !s.logger.Available() {
+		s.sendErrorResponse(conn, req, 503, "Service Unavailable")
+		s.logRequest(conn, req, "LOG_UNAVAILABLE", 503, 0, 0, "log_failure_policy")
+		return false
+	}
+
+	ctx, cancel := requestContext(ctx, config)
+	defer cancel(nil)
+
+	// Per-client request rate limit; a CONNECT counts as one request
+	if allowed, wait := s.limiter.Allow(conn.RemoteAddr()); !allowed {
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		s.sendErrorResponseHeaders(conn, req, 429, "Too Many Requests", []string{fmt.Sprintf("Retry-After: %d", retryAfter)})
+		s.logRequest(conn, req, "RATE_LIMITED", 429, 0, 0, "rate_limit_rps")
+		return false
+	}
+
+	// Check authentication if enabled; a reverse proxy's clients don't
+	// know they are using a proxy, so it has no proxy authentication
+	auth := s.authenticator(config)
+	if _, none := auth.(NoAuth); !none && !reverse {
+		if blocked, wait := s.authFailures.Blocked(conn.RemoteAddr()); blocked {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			s.sendErrorResponseHeaders(conn, req, 429, "Too Many Requests", []string{fmt.Sprintf("Retry-After: %d", retryAfter)})
+			s.stats.AuthThrottled.Add(1)
+			s.logRequest(conn, req, "AUTH_THROTTLED", 429, 0, 0, "auth_failure_limit")
+			return false
+		}
+		username, ok, challenge := auth.Authenticate(req, connInfo(conn))
+		if !ok {
+			reason := errInvalidCredentials
+			if req.Headers["proxy-authorization"] == "" {
+				reason = errNoCredentials
+			} else {
+				s.authFailures.Fail(conn.RemoteAddr())
+			}
+			s.sendErrorResponseHeaders(conn, req, 407, "Proxy Authentication Required", authChallenge(config, challenge))
+			s.stats.AuthFailures.Add(1)
+			s.logRequest(conn, req, "AUTH_FAILED", 407, 0, 0, reason.Error())
+			return false
+		}
+		req.Username = username
+
+		// The credentials are for the proxy, not the origin
+		delete(req.Headers, "proxy-authorization")
+	}
+
+	// The user's policy replaces the global filter and adds its own limits
+	if req.Policy = s.policies.Load().Resolve(req.Username); req.Policy != nil {
+		if allowed, wait := req.Policy.Allow(conn.RemoteAddr()); !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			s.sendErrorResponseHeaders(conn, req, 429, "Too Many Requests", []string{fmt.Sprintf("Retry-After: %d", retryAfter)})
+			s.logRequest(conn, req, "RATE_LIMITED", 429, 0, 0, "policy "+req.Policy.Name+" rate")
+			return false
+		}
+		if !req.Policy.AllowsPort(req.Port) {
+			s.sendErrorResponse(conn, req, 403, "Forbidden")
+			s.logRequest(conn, req, "BLOCKED", 403, 0, 0, fmt.Sprintf("port %d not allowed by policy %s", req.Port, req.Policy.Name))
+			return false
+		}
+	}
+
+	// Ask the external hook, if any, whether the request may proceed
+	if s.authHook.Enabled() {
+		verdict, err := s.authHook.Check(GetClientIP(conn), req)
+		if err != nil {
+			s.diag.Warnf("Request %s: auth hook failed: %v", req.ID, err)
+			if !config.AuthHookFailOpen {
+				s.sendErrorResponse(conn, req, 503, "Service Unavailable")
+				s.logRequest(conn, req, "HOOK_ERROR", 503, 0, 0, err.Error())
+				return false
+			}
+		} else if !verdict.Allow {
+			status, message := verdict.denial()
+			s.sendErrorResponse(conn, req, status, message)
+			s.logRequest(conn, req, "HOOK_DENIED", status, 0, 0, message)
+			return false
+		}
+	}
+
+	// Ask the policy_exec program, which may also send the request elsewhere
+	if s.applyPolicyExec(conn, req, config) {
+		return false
+	}
+
+	// Handle CONNECT for HTTPS tunneling
+	if req.IsConnect {
+		if !config.EnableConnectTunnel {
+			s.sendErrorResponse(conn, req, 501, "Not Implemented")
+			s.logRequest(conn, req, "BLOCKED", 501, 0, 0, "CONNECT not enabled")
+			return false
+		}
+
+		if s.runRequestHooks(conn, req, s.loadHooks().connect) {
+			return false
+		}
+
+		// Check if blocked
+		if s.applyFilter(conn, req) {
+			return false
+		}
+
+		// Send the tunnel elsewhere if a rewrite rule says so
+		s.applyRewrites(req, config, false)
+
+		// Decrypt tunnels to mitm_domains so the request can be filtered
+		if s.mitm.Matches(req.Host) {
+			s.interceptCONNECT(ctx, conn, reader, req, config)
+			return false
+		}
+
+		// Delay or refuse the tunnel per fault_injection_file
+		if s.applyFault(ctx, conn, req, config) {
+			return false
+		}
+
+		// Tunnel search engines to their SafeSearch enforcement hosts
+		s.applySafeSearch(req)
+
+		// Handle CONNECT tunneling
+		err := s.forwarder.HandleCONNECT(ctx, req, conn, reader, s.sniCheck(config, req))
+		var sniErr *SNIBlockedError
+		var addrErr *ResolvedAddrBlockedError
+		if errors.As(err, &sniErr) {
+			s.logRequest(conn, req, "BLOCKED_SNI", 200, 0, 0, sniErr.ServerName+": "+sniErr.Rule)
+		} else if errors.As(err, &addrErr) {
+			s.logRequest(conn, req, "BLOCKED", 403, 0, 0, addrErr.Rule+" (resolved "+addrErr.IP+")")
+		} else if ctx.Err() != nil {
+			s.logRequest(conn, req, "CANCELLED", 0, 0, 0, context.Cause(ctx).Error())
+		} else if errors.As(err, new(*ClientAbortError)) {
+			s.stats.RecordClientAbort()
+			s.logRequest(conn, req, "CLIENT_ABORT", 200, 0, 0, err.Error())
+		} else if errors.Is(err, errUpstreamLimit) {
+			s.logRequest(conn, req, "UPSTREAM_LIMIT", 503, 0, 0, "max_connections_per_upstream")
+		} else if err != nil {
+			s.stats.RecordUpstreamError(err)
+			s.logRequest(conn, req, "ERROR", 0, 0, 0, err.Error())
+		} else {
+			s.logRequest(conn, req, "ALLOWED", 200, 0, 0, "")
+		}
+		return false
+	}
+
+	// A watched client's connection can't carry another request, since
+	// the watcher consumes whatever it sends
+	watched := watchAfterRequest(conn, reader, req, cancel)
+	s.serveRequest(ctx, conn, req, nil)
+	return req.Persistent && !watched()
+}
+
+// awaitRequest waits up to client_idle_timeout for the first byte of a
+// request. A client that closes the connection or stays silent isn't an
+// error worth an access log entry, so it is only noted at debug level.
+func (s *Server) awaitRequest(conn net.Conn, reader *bufio.Reader, config *Config) bool {
+	setReadTimeout(conn, config.ClientIdleTimeout)
+	_, err := reader.Peek(1)
+	if err == nil {
+		return true
+	}
+
+	// A connection closed while idle, by Shutdown or the admin API, is
+	// also quiet
+	if err == io.EOF || isTimeout(err) || errors.Is(err, net.ErrClosed) {
+		s.diag.Debugf("Connection from %s: CLOSED_IDLE (%v)", conn.RemoteAddr(), err)
+		return false
+	}
+	// Let the request parser report anything else, such as a failed TLS
+	// handshake
+	return true
+}
+
+// isTimeout reports whether err is a network timeout, such as an expired
+// deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// setReadTimeout sets conn's read deadline timeout from now; zero clears it
+func setReadTimeout(conn net.Conn, timeout time.Duration) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// assignRequestID reuses the client's correlation ID if it sent a usable
+// one, and otherwise generates a new one
+func assignRequestID(config *Config, req *HTTPRequest) {
+	req.ID = req.Headers["x-request-id"]
+	if !isValidRequestID(req.ID) {
+		req.ID = newRequestID()
+	}
+	if config.AddRequestIDHeader && !req.IsConnect {
+		req.Headers["x-request-id"] = req.ID
+	}
+}
+
+// matchFilter checks host, on req's port, against the blocklists of its
+// policy, or the global filter if it has none
+func (s *Server) matchFilter(req *HTTPRequest, host string) (FilterMatch, bool) {
+	if req.Policy != nil {
+		return req.Policy.Match(host, req.Port)
+	}
+	path := ""
+	if !req.IsConnect {
+		path = requestPath(req.RequestTarget)
+	}
+	return s.engine.Decide(host, req.Port, path)
+}
+
+// blockedAddr checks an address req's host name resolved to against the IP
+// rules that apply to req, so a name can't be used to reach a blocked
+// address
+func (s *Server) blockedAddr(req *HTTPRequest, ip net.IP) (string, bool) {
+	if m := req.RuleMatch; m != nil && m.Action == exprAllow {
+		return "", false
+	}
+	match, ok := s.matchFilter(req, ip.String())
+	if !ok || !match.Blocks() {
+		return "", false
+	}
+	return match.Rule, true
+}
+
+// applyFilter checks req against the expression rules and its host against
+// the filter, answering and logging it if it is blocked. A log_only or
+// max_bytes match is recorded in req, for its log entry and response limit,
+// and the request goes ahead.
+func (s *Server) applyFilter(conn net.Conn, req *HTTPRequest) bool {
+	match, ok := s.matchFilter(req, req.Host)
+	s.diag.Debugf("Request %s: filter decision for %s matched=%t rule=%q category=%q action=%s", req.ID, req.Host, ok, match.Rule, match.Category, match.Action)
+	// The expression rules come first, and may use the host's category
+	if answered, allowed := s.applyExprRules(conn, req, match); answered || allowed {
+		return answered
+	}
+	if !ok {
+		return false
+	}
+	req.FilterMatch = &match
+	if !match.Blocks() {
+		return false
+	}
+	if match.page != nil {
+		s.sendBlockPage(conn, req, match.page)
+	} else {
+		s.sendErrorResponse(conn, req, 403, "Forbidden")
+	}
+	s.logRequest(conn, req, "BLOCKED", 403, 0, 0, match.Rule)
+	return true
+}
+
+// serveRequest filters a parsed request, then answers it from the cache or
+// forwards it. upstream is an already established origin connection to use
+// instead of dialing one, or nil.
+func (s *Server) serveRequest(ctx context.Context, conn net.Conn, req *HTTPRequest, upstream net.Conn) {
+	if s.runRequestHooks(conn, req, s.loadHooks().request) {
+		return
+	}
+
+	// Check if blocked
+	if s.applyFilter(conn, req) {
+		return
+	}
+
+	// Rewrite the destination, path and query, before the cache is keyed
+	s.applyRewrites(req, s.config.Load(), upstream != nil)
+
+	// Send plain HTTP requests for https_upgrade_domains over HTTPS
+	if upstream == nil && s.applyHTTPSUpgrade(conn, req, s.config.Load()) {
+		return
+	}
+
+	// An intercepted request already has its connection to the origin
+	if upstream == nil {
+		s.applySafeSearch(req)
+	}
+
+	// Refuse downloads of blocked file types by their name in the URL
+	if s.applyExtensionFilter(conn, req, s.config.Load()) {
+		return
+	}
+
+	// A body declared larger than max_upload_bytes is refused before the
+	// upstream is contacted; a chunked one is stopped when it gets there
+	if limit := s.config.Load().MaxUploadBytes; limit > 0 && req.ContentLength > limit {
+		s.sendErrorResponse(conn, req, 413, "Payload Too Large")
+		s.logRequest(conn, req, "TOO_LARGE", 413, 0, 0, fmt.Sprintf("Content-Length %d exceeds max_upload_bytes", req.ContentLength))
+		return
+	}
+
+	// Answer from record_dir, or record the exchange there
+	if upstream == nil && s.applyRecording(conn, req, s.config.Load()) {
+		return
+	}
+
+	// Check cache for GET requests
+	cacheKey := MakeCacheKey(req)
+	var statusCode int
+	var bytesUpstream, bytesDownstream int64
+
+	if s.cache != nil && cacheKey != "" {
+		cachedEntry, found := s.cache.Get(cacheKey)
+		s.diag.Debugf("Request %s: cache lookup for %s hit=%t", req.ID, cacheKey, found)
+		if found {
+			s.stats.statsd.Load().Count("cache.hits", 1)
+		} else {
+			s.stats.statsd.Load().Count("cache.misses", 1)
+		}
+		if found {
+			// Serve from cache
+			s.serveCachedResponse(conn, cachedEntry)
+			s.logRequest(conn, req, "CACHE_HIT", cachedEntry.StatusCode, 0, int64(len(cachedEntry.Body)), "")
+			return
+		}
+		// Copy the response as it is relayed, to store it if it can be
+		_, authorized := req.Headers["authorization"]
+		config := s.config.Load()
+		req.CacheCapture = newCacheCapture(config.CacheMaxSizeBytes(), config.CacheDefaultTTL, authorized)
+	}
+
+	// Delay, fail or damage the response per fault_injection_file
+	if s.applyFault(ctx, conn, req, s.config.Load()) {
+		return
+	}
+
+	// Forward request
+	var err error
+	if upstream != nil {
+		statusCode, bytesUpstream, bytesDownstream, err = s.forwarder.ForwardRequestTo(ctx, req, conn, upstream)
+	} else {
+		statusCode, bytesUpstream, bytesDownstream, err = s.forwarder.ForwardRequest(ctx, req, conn)
+	}
+	if err != nil && ctx.Err() != nil {
+		s.sendCancelled(ctx, conn, req, bytesDownstream > 0, bytesUpstream, bytesDownstream)
+		return
+	}
+	// The client's connection has failed, so there is no one to answer
+	if errors.Is(err, errFaultDropped) {
+		resetOnClose(conn)
+		s.logRequest(conn, req, "FAULT_INJECTED", statusCode, bytesUpstream, bytesDownstream, req.Fault.Rule)
+		return
+	}
+	var abort *ClientAbortError
+	if errors.As(err, &abort) {
+		s.stats.RecordClientAbort()
+		req.Persistent = false
+		s.logRequest(conn, req, "CLIENT_ABORT", statusCode, bytesUpstream, bytesDownstream, abort.Error())
+		return
+	}
+	if errors.Is(err, errUpstreamLimit) {
+		s.sendUpstreamLimited(conn, req)
+		return
+	}
+	var addrErr *ResolvedAddrBlockedError
+	if errors.As(err, &addrErr) {
+		s.sendErrorResponse(conn, req, 403, "Forbidden")
+		s.logRequest(conn, req, "BLOCKED", 403, bytesUpstream, bytesDownstream, addrErr.Rule+" (resolved "+addrErr.IP+")")
+		return
+	}
+	if errors.Is(err, errResponseHeaderTimeout) {
+		s.stats.RecordUpstreamError(err)
+		s.sendErrorDetail(conn, req, 504, "Gateway Timeout", err)
+		s.logRequest(conn, req, "ERROR", 504, bytesUpstream, bytesDownstream, err.Error())
+		return
+	}
+	if errors.Is(err, errSlowUpload) && bytesDownstream == 0 {
+		s.sendSlowClient(conn, req, bytesUpstream, err.Error())
+		return
+	}
+	var truncated *TruncatedError
+	if errors.As(err, &truncated) {
+		// The head has been sent, so the client only learns the body is
+		// incomplete from the connection being reset; the response is
+		// never cached
+		resetOnClose(conn)
+		s.logRequest(conn, req, "TRUNCATED", statusCode, bytesUpstream, bytesDownstream, truncated.Error())
+		return
+	}
+	var malware *MalwareError
+	if errors.As(err, &malware) {
+		s.sendErrorResponse(conn, req, 403, "Forbidden")
+		s.logRequest(conn, req, "MALWARE_BLOCKED", 403, bytesUpstream, bytesDownstream, malware.Verdict)
+		return
+	}
+	var scanErr *ScanError
+	if errors.As(err, &scanErr) {
+		s.diag.Warnf("Request %s: %v", req.ID, scanErr)
+		s.sendErrorDetail(conn, req, 503, "Service Unavailable", scanErr)
+		s.logRequest(conn, req, "SCAN_ERROR", 503, bytesUpstream, bytesDownstream, scanErr.Error())
+		return
+	}
+	var extErr *BlockedExtensionError
+	if errors.As(err, &extErr) {
+		s.sendErrorResponse(conn, req, 403, "Forbidden")
+		s.logRequest(conn, req, "BLOCKED_EXTENSION", 403, bytesUpstream, bytesDownstream, extErr.Error())
+		return
+	}
+	if errors.Is(err, errUploadTooLarge) {
+		s.sendErrorResponse(conn, req, 413, "Payload Too Large")
+		s.logRequest(conn, req, "TOO_LARGE", 413, bytesUpstream, bytesDownstream, err.Error())
+		return
+	}
+	if err != nil {
+		s.stats.RecordUpstreamError(err)
+		s.sendErrorDetail(conn, req, 502, "Bad Gateway", err)
+		s.logRequest(conn, req, "ERROR", 502, bytesUpstream, bytesDownstream, err.Error())
+		return
+	}
+
+	// Store a cacheable response that was relayed whole
+	if s.cache != nil && IsCacheable(req.Method, statusCode) && cacheKey != "" {
+		if entry, ok := req.CacheCapture.entry(statusCode); ok && s.cache.Put(cacheKey, entry) {
+			s.diag.Debugf("Request %s: cached %s (%d bytes)", req.ID, cacheKey, len(entry.Body))
+		}
+	}
+
+	s.saveRecording(req, statusCode)
+	s.logRequest(conn, req, "ALLOWED", statusCode, bytesUpstream, bytesDownstream, "")
+}
+
+// sendSlowClient answers a client that was too slow sending its request:
+// one whose head took longer than its timeout, or whose body fell below
+// min_upload_rate or stalled
+func (s *Server) sendSlowClient(conn net.Conn, req *HTTPRequest, bytesUp int64, reason string) {
+	s.sendErrorResponse(conn, req, 408, "Request Timeout")
+	s.logRequest(conn, req, "SLOW_CLIENT", 408, bytesUp, 0, reason)
+}
+
+// sendUpstreamLimited answers a request whose destination already has
+// max_connections_per_upstream connections
+func (s *Server) sendUpstreamLimited(conn net.Conn, req *HTTPRequest) {
+	s.sendErrorResponse(conn, req, 503, "Service Unavailable")
+	s.logRequest(conn, req, "UPSTREAM_LIMIT", 503, 0, 0, "max_connections_per_upstream")
+}
+
+// serveCachedResponse serves a response from cache
+func (s *Server) serveCachedResponse(conn net.Conn, entry *CacheEntry) {
+	// Write status line, with the origin's reason phrase; an entry stored
+	// without one gets the standard phrase
+	statusText := entry.StatusText
+	if statusText == "" {
+		statusText = http.StatusText(entry.StatusCode)
+	}
+	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", entry.StatusCode, statusText)
+	conn.Write([]byte(statusLine))
+
+	// Write headers
+	for key, value := range entry.Headers {
+		headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
+		conn.Write([]byte(headerLine))
+	}
+	conn.Write([]byte("\r\n"))
+
+	// Write body
+	conn.Write(entry.Body)
+}
+
+// sendErrorResponse sends an HTTP error response
+func (s *Server) sendErrorResponse(conn net.Conn, req *HTTPRequest, statusCode int, message string) {
+	s.writeErrorResponse(conn, req, statusCode, message, nil, nil)
+}
+
+// sendErrorResponseHeaders sends an HTTP error response with extra
+// "Name: value" header lines
+func (s *Server) sendErrorResponseHeaders(conn net.Conn, req *HTTPRequest, statusCode int, message string, headers []string) {
+	s.writeErrorResponse(conn, req, statusCode, message, nil, headers)
+}
+
+// sendErrorDetail sends an HTTP error response caused by err, which is
+// only shown to the client when debug_errors is set
+func (s *Server) sendErrorDetail(conn net.Conn, req *HTTPRequest, statusCode int, message string, err error) {
+	s.writeErrorResponse(conn, req, statusCode, message, err, nil)
+}
+
+// writeErrorResponse writes an error response, with a body in the format
+// the client prefers (see ErrorPages)
+func (s *Server) writeErrorResponse(conn net.Conn, req *HTTPRequest, statusCode int, message string, cause error, headers []string) {
+	config := s.config.Load()
+	data := errorPageData{
+		Status:    statusCode,
+		Message:   message,
+		RequestID: req.ID,
+		Host:      req.Host,
+		Proxy:     Product(),
+	}
+	if config.DebugErrors && cause != nil {
+		data.Detail = cause.Error()
+	}
+	contentType, body := s.errorPages.render(req, data)
+	s.writeResponse(conn, req, statusCode, message, contentType, body, headers)
+}
+
+// writeResponse writes a response generated by the proxy itself, closing
+// the connection
+func (s *Server) writeResponse(conn net.Conn, req *HTTPRequest, statusCode int, message, contentType string, body []byte, headers []string) {
+	config := s.config.Load()
+	response := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, message)
+	response += "Content-Type: " + contentType + "\r\n"
+	response += fmt.Sprintf("Content-Length: %d\r\n", len(body))
+	if config.ServerHeader {
+		response += "Server: " + Product() + "\r\n"
+	}
+	if config.AddRequestIDHeader && req.ID != "" {
+		response += fmt.Sprintf("X-Request-Id: %s\r\n", req.ID)
+	}
+	for _, header := range headers {
+		response += header + "\r\n"
+	}
+	response += "Connection: close\r\n"
+	response += "\r\n"
+
+	conn.Write(append([]byte(response), body...))
+}
+
+// logRequest logs a request received on conn and counts it in the stats
+func (s *Server) logRequest(conn net.Conn, req *HTTPRequest, action string, statusCode int, bytesUp, bytesDown int64, blockedRule string) {
+	// A request whose connection was cut through the admin API is logged
+	// as such, whatever error that caused
+	if by := clientConn(conn).endRequest(); by != "" {
+		action, blockedRule = "ADMIN_TERMINATED", "terminated by admin "+by
+	}
+	// A request that was only delayed or had its response damaged went
+	// through, but is marked with the fault
+	if action == "ALLOWED" && req.Fault != nil {
+		action, blockedRule = "FAULT_INJECTED", req.Fault.Rule
+	}
+	s.finishTrace(req)
+
+	s.stats.RecordRequest(action, bytesUp, bytesDown)
+	s.shedder.Observe(req.UpstreamTTFB)
+	statsd := s.stats.statsd.Load()
+
+	clientPort := 0
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientPort = tcpAddr.Port
+	}
+
+	entry := LogEntry{
+		Timestamp:       time.Now(),
+		RequestID:       req.ID,
+		ClientIP:        GetClientIP(conn),
+		ClientPort:      clientPort,
+		DestinationHost: req.Host,
+		DestinationPort: req.Port,
+		DestinationIP:   req.UpstreamIP,
+		Method:          req.Method,
+		RequestTarget:   req.RequestTarget,
+		Action:          action,
+		UpstreamStatus:  statusCode,
+		BytesUpstream:   bytesUp,
+		BytesDownstream: bytesDown,
+		BlockedRule:     blockedRule,
+		Username:        req.Username,
+		Route:           req.Route,
+		Referer:         req.Headers["referer"],
+		UserAgent:       req.Headers["user-agent"],
+	}
+	if req.Policy != nil {
+		entry.Policy = req.Policy.Name
+	}
+	entry.SafeSearch = req.SafeSearchFrom
+	entry.HTTPSUpgrade = req.HTTPSUpgrade
+	entry.Rewrite = req.Rewrite
+	entry.Bandwidth = bandwidthProfile(conn)
+	if match := req.FilterMatch; match != nil {
+		entry.Category = match.Category
+		if !match.Blocks() {
+			entry.MatchedRule = match.Rule
+		}
+	}
+	if match := req.RuleMatch; match != nil && entry.MatchedRule == "" && blockedRule != match.Rule {
+		entry.MatchedRule = match.Rule
+	}
+	entry.Listener = listenerLabel(conn)
+	config := s.config.Load()
+	// Only an address the request already has is looked up, never the name
+	if config.LogGeoIPMaxConnections == 0 || s.ActiveConnections() <= int64(config.LogGeoIPMaxConnections) {
+		ip := req.UpstreamIP
+		if ip == "" {
+			ip = req.Host
+		}
+		entry.DestCountry, entry.DestASN = s.geoip.Lookup(ip)
+	}
+	for _, name := range config.LogHeaders {
+		if value, ok := req.Headers[strings.ToLower(name)]; ok {
+			if entry.Headers == nil {
+				entry.Headers = make(map[string]string)
+			}
+			entry.Headers[name] = value
+		}
+	}
+	s.timeseries.Record(&entry)
+	statsd.RecordRequest(&entry, req)
+	s.logger.Log(entry)
+}
+
+// resetOnClose makes closing conn reset the TCP connection rather than
+// end it cleanly, looking through the wrappers used for intercepted tunnels
+func resetOnClose(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			c.SetLinger(0)
+			return
+		case *labeledConn:
+			conn = c.Conn
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *bufferedConn:
+			conn = c.Conn
+		default:
+			return
+		}
+	}
+}
+
+// listenerLabel returns the label of the listener conn was accepted on
+func listenerLabel(conn net.Conn) string {
+	if lc := clientConn(conn); lc != nil {
+		return lc.label
+	}
+	return ""
+}
+
+// clientConn returns the labeledConn conn was accepted as, looking through
+// the wrappers used for intercepted tunnels, or nil
+func clientConn(conn net.Conn) *labeledConn {
+	for {
+		switch c := conn.(type) {
+		case *labeledConn:
+			return c
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *bufferedConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// proxyListener is a bound listener and the label used for it in logs
+type proxyListener struct {
+	net.Listener // possibly TLS-wrapped
+	label        atomic.Pointer[string]
+	address      string // as configured
+	tls          bool
+	injected     bool          // passed to Serve rather than bound from the configuration
+	stop         chan struct{} // closed when a reload removes the listener
+}
+
+// describe returns the configured address, or the bound one for port 0,
+// marked when it uses TLS
+func (pl *proxyListener) describe() string {
+	address := pl.address
+	if _, port, _ := net.SplitHostPort(address); port == "0" {
+		address = pl.Addr().String()
+	}
+	if pl.tls {
+		return address + " (TLS)"
+	}
+	return address
+}
+
+// Label returns the listener's label; a reload may change it
+func (pl *proxyListener) Label() string {
+	return *pl.label.Load()
+}
+
+// setLabel sets the listener's label
+func (pl *proxyListener) setLabel(label string) {
+	pl.label.Store(&label)
+}
+
+// maxAcceptBackoff caps the wait between retries of a failing Accept
+const maxAcceptBackoff = 1 * time.Second
+
+// isTransientAcceptError reports whether an Accept error is worth retrying:
+// running out of file descriptors, or a connection aborted before it was
+// accepted
+func isTransientAcceptError(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM)
+}
+
+// nextAcceptBackoff doubles the accept retry delay, starting at 5ms
+func nextAcceptBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return 5 * time.Millisecond
+	}
+	if backoff *= 2; backoff > maxAcceptBackoff {
+		return maxAcceptBackoff
+	}
+	return backoff
+}
+
+// newRequestID generates a 16 hex character correlation ID
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// isValidRequestID checks that a client-supplied ID is safe to log and echo
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' || c == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// Shutdown stops accepting connections and waits up to
+// shutdown_grace_period for in-flight connections to finish, then closes
+// any that remain. It is safe to call more than once.
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(s.shutdownAndDrain)
+}
+
+// ForceShutdown shuts down without waiting for in-flight connections: it
+// starts shutdown if Shutdown hasn't, cuts short any drain in progress and
+// closes every connection. It returns once shutdown has finished.
+func (s *Server) ForceShutdown() {
+	s.forceOnce.Do(func() { close(s.force) })
+	go s.Shutdown()
+	<-s.done
+}
+
+func (s *Server) shutdownAndDrain() {
+	s.diag.Infof("Shutting down server...")
+	close(s.shutdown)
+
+	s.mu.Lock()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.mu.Unlock()
+
+	// No accept loop adds to wg once they have all returned
+	s.acceptLoops.Wait()
+
+	// Let in-flight connections finish, then cut the rest
+	grace := s.config.Load().ShutdownGracePeriod
+	if n := s.ActiveConnections(); n > 0 {
+		s.diag.Infof("Waiting up to %s for %d active connection(s)", grace, n)
+	}
+	if !s.waitForDrain(grace) {
+		s.cancelRequests(errShuttingDown)
+		n := s.closeAllConns()
+		select {
+		case <-s.force:
+			s.diag.Warnf("Forced shutdown; closed %d connection(s)", n)
+		default:
+			s.diag.Warnf("Shutdown grace period expired; closed %d connection(s)", n)
+		}
+	}
+
+	// Workers handle whatever is still queued before the pool stops; every
+	// handler must have returned before the logger is closed under it
+	if s.workerPool != nil {
+		s.workerPool.Shutdown()
+	}
+	s.wg.Wait()
+	s.cancelRequests(errShuttingDown)
+
+	s.mu.Lock()
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	s.mu.Unlock()
+
+	if path := s.config.Load().FilterStatsFile; path != "" && s.filter != nil {
+		if err := s.filter.WriteRuleStats(path); err != nil {
+			s.diag.Errorf("%v", err)
+		}
+	}
+
+	// Close logger, sending what is left to the collector
+	s.logger.SetShipper(nil).Close()
+	s.logger.SetDB(nil).Close()
+	s.geoip.Close()
+	s.logger.Close()
+	s.stats.statsd.Load().Close()
+	if redis, ok := s.cache.(*RedisCache); ok && s.options.cache == nil {
+		redis.Close()
+	}
+
+	s.diag.Infof("Server shut down complete")
+	s.diag.Close()
+	close(s.done)
+}
+
+// drainProgressInterval is how often shutdown reports the connections it
+// is still waiting for
+const drainProgressInterval = 5 * time.Second
+
+// waitForDrain waits up to grace for all tracked connections to close,
+// reporting whether they did. Progress is logged every drainProgressInterval
+// so a long drain doesn't look hung, and ForceShutdown ends the wait early.
+func (s *Server) waitForDrain(grace time.Duration) bool {
+	deadline := time.Now().Add(grace)
+	nextProgress := time.Now().Add(drainProgressInterval)
+	for s.ActiveConnections() > 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		if time.Now().After(nextProgress) {
+			s.diag.Infof("Draining, %d connection(s) remaining", s.ActiveConnections())
+			nextProgress = nextProgress.Add(drainProgressInterval)
+		}
+		select {
+		case <-s.force:
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return true
+}
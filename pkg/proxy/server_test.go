@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testConfig returns the default configuration with its files in a
+// temporary directory and only errors logged
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.LogFilePath = filepath.Join(dir, "access.log")
+	config.BlockedDomainsFile = filepath.Join(dir, "blocked.txt")
+	if err := os.WriteFile(config.BlockedDomainsFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.LogLevel = "error"
+	return config
+}
+
+// startServer serves config on a loopback port until the test ends,
+// returning the server and its address
+func startServer(t *testing.T, config *Config, opts ...Option) (*Server, string) {
+	t.Helper()
+	s, err := NewServer(config, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(s.Shutdown)
+	return s, l.Addr().String()
+}
+
+// dialProxy opens a connection to the proxy at addr, closed when the test
+// ends
+func dialProxy(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// proxyGet sends a GET for url on conn and reads the response, failing
+// the test if none arrives within timeout
+func proxyGet(t *testing.T, conn net.Conn, url string, timeout time.Duration) *http.Response {
+	t.Helper()
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", url, hostOf(url))
+	return readResponse(t, conn, timeout)
+}
+
+// readResponse reads a response from conn, failing the test if none
+// arrives within timeout. The body is read into the response's buffer.
+func readResponse(t *testing.T, conn net.Conn, timeout time.Duration) *http.Response {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	return resp
+}
+
+// hostOf returns the host and port of an http:// URL
+func hostOf(url string) string {
+	host, _, _ := strings.Cut(strings.TrimPrefix(url, "http://"), "/")
+	return host
+}
+
+// flakyListener fails its first failures Accept calls with err
+type flakyListener struct {
+	net.Listener
+	mu       sync.Mutex
+	failures int
+	err      error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.failures > 0 {
+		l.failures--
+		l.mu.Unlock()
+		return nil, l.err
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+func TestAcceptRecoversFromTransientErrors(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	s, err := NewServer(testConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	flaky := &flakyListener{Listener: l, failures: 5, err: emfile}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(flaky) }()
+
+	resp := proxyGet(t, dialProxy(t, l.Addr().String()), origin.URL+"/", 5*time.Second)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("request after accept errors got %d, want 200", resp.StatusCode)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned after transient accept errors: %v", err)
+	default:
+	}
+}
+
+func TestAcceptFailsOnPermanentError(t *testing.T) {
+	s, err := NewServer(testConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := errors.New("listener broken")
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(&flakyListener{Listener: l, failures: 1, err: broken}) }()
+
+	select {
+	case err := <-served:
+		if !errors.Is(err, broken) {
+			t.Errorf("Serve returned %v, want the accept error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve kept running after a permanent accept error")
+	}
+}
+
+// TestListenOnEphemeralPort runs the whole server from its own
+// configuration, bound to port 0, and proxies through the port it got
+func TestListenOnEphemeralPort(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	config := testConfig(t)
+	config.ListenAddress, config.ListenPort = "127.0.0.1", 0
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	if s.Addr() != nil {
+		t.Errorf("Addr before Listen = %v, want nil", s.Addr())
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	addr := s.Addr().String()
+	if _, port, _ := net.SplitHostPort(addr); port == "0" {
+		t.Fatalf("Addr = %s, want the port bound", addr)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(nil) }()
+
+	resp := proxyGet(t, dialProxy(t, addr), origin.URL+"/", 5*time.Second)
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("request through %s got %d %q, want 200 \"ok\"", addr, resp.StatusCode, body)
+	}
+
+	s.Shutdown()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve returned %v after Shutdown, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve kept running after Shutdown")
+	}
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("%s still accepting after Shutdown", addr)
+	}
+}
+
+// TestReusePort binds two servers to the same port, which only reuse_port
+// allows
+func TestReusePort(t *testing.T) {
+	for _, reuse := range []bool{true, false} {
+		t.Run(fmt.Sprintf("reuse_port=%t", reuse), func(t *testing.T) {
+			listen := func(port int) (*Server, error) {
+				config := testConfig(t)
+				config.ListenAddress, config.ListenPort, config.ReusePort = "127.0.0.1", port, reuse
+				s, err := NewServer(config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(s.Shutdown)
+				return s, s.Listen()
+			}
+
+			first, err := listen(0)
+			if reuse && err != nil && strings.Contains(err.Error(), "not supported") {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			port := first.Addr().(*net.TCPAddr).Port
+			_, err = listen(port)
+			if reuse && err != nil {
+				t.Errorf("second server on port %d with reuse_port failed: %v", port, err)
+			}
+			if !reuse && !errors.Is(err, syscall.EADDRINUSE) {
+				t.Errorf("second server on port %d without reuse_port returned %v, want address in use", port, err)
+			}
+		})
+	}
+}
+
+// TestShutdownStopsListenerWithoutDeadlines checks that Shutdown stops
+// Serve on a listener Accept can't be given a deadline on, by closing it
+func TestShutdownStopsListenerWithoutDeadlines(t *testing.T) {
+	s, err := NewServer(testConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(struct{ net.Listener }{l}) }()
+	waitFor(t, func() bool { return s.Addr() != nil })
+
+	s.Shutdown()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve returned %v after Shutdown, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve kept running after Shutdown")
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept on the listener after Shutdown returned %v, want it closed", err)
+	}
+}
+
+func TestNextAcceptBackoff(t *testing.T) {
+	var backoff time.Duration
+	want := []time.Duration{5, 10, 20, 40, 80, 160, 320, 640, 1000, 1000}
+	for i, ms := range want {
+		backoff = nextAcceptBackoff(backoff)
+		if backoff != ms*time.Millisecond {
+			t.Errorf("backoff %d = %v, want %v", i+1, backoff, ms*time.Millisecond)
+		}
+	}
+}
+
+func TestShutdownWaitsForPoolRequest(t *testing.T) {
+	arrived := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, "slow")
+	}))
+	defer origin.Close()
+
+	config := testConfig(t)
+	config.ConcurrencyModel = "thread_pool"
+	config.ShutdownGracePeriod = 5 * time.Second
+	s, addr := startServer(t, config)
+
+	conn := dialProxy(t, addr)
+	fmt.Fprintf(conn, "GET %s/slow HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", origin.URL, hostOf(origin.URL))
+	<-arrived
+
+	shutdown := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(shutdown)
+	}()
+	resp := readResponse(t, conn, 5*time.Second)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "slow" {
+		t.Errorf("request in flight at shutdown got %d %q, want it finished", resp.StatusCode, body)
+	}
+
+	select {
+	case <-shutdown:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't return")
+	}
+	log, err := os.ReadFile(config.LogFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), "/slow") {
+		t.Errorf("request finished during shutdown wasn't logged:\n%s", log)
+	}
+}
+
+func TestPipelinedRequestsAnsweredInOrder(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "response to "+r.URL.Path)
+	}))
+	defer origin.Close()
+	_, addr := startServer(t, testConfig(t))
+
+	// Both requests arrive in one segment
+	conn := dialProxy(t, addr)
+	host := hostOf(origin.URL)
+	pipelined := fmt.Sprintf("GET %s/first HTTP/1.1\r\nHost: %s\r\n\r\nGET %s/second HTTP/1.1\r\nHost: %s\r\n\r\n", origin.URL, host, origin.URL, host)
+	if _, err := io.WriteString(conn, pipelined); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, path := range []string{"/first", "/second"} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("reading the response to %s: %v", path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK || string(body) != "response to "+path {
+			t.Errorf("response to %s was %d %q (%v)", path, resp.StatusCode, body, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadShedSummaryInterval is how often connections turned away by load
+// shedding are summarized in the diagnostic log, in place of an access log
+// entry for each
+const loadShedSummaryInterval = 10 * time.Second
+
+// latencyEWMAWeight is the weight of each new sample in the moving average
+// of the upstream time to first byte
+const latencyEWMAWeight = 0.1
+
+// latencyStaleAfter is how long the moving average counts without a new
+// sample. While shed_latency turns every connection away no samples
+// arrive, so without this the average could never come back down.
+const latencyStaleAfter = 10 * time.Second
+
+// shedWriteTimeout bounds writing the 503 to a shed connection
+const shedWriteTimeout = 2 * time.Second
+
+// LoadShedder turns connections away before their request is read while
+// the proxy is under pressure, answering with a prebuilt 503 carrying
+// Retry-After. The signals are the worker queue depth, active connections,
+// goroutines and a moving average of the upstream time to first byte, each
+// compared against its shed_* threshold.
+type LoadShedder struct {
+	latency    atomic.Int64 // moving average of the upstream TTFB, in nanoseconds
+	lastSample atomic.Int64 // when latency was last updated, in Unix nanoseconds
+
+	response atomic.Pointer[shedResponse]
+
+	mu     sync.Mutex
+	counts map[string]int64 // sheds per signal since the last summary
+}
+
+// shedResponse is the 503 sent to shed connections, built once per
+// shed_retry_after
+type shedResponse struct {
+	retryAfter time.Duration
+	data       []byte
+}
+
+// NewLoadShedder creates a load shedder
+func NewLoadShedder() *LoadShedder {
+	return &LoadShedder{counts: make(map[string]int64)}
+}
+
+// Observe adds an upstream time to first byte to the moving average
+func (ls *LoadShedder) Observe(ttfb time.Duration) {
+	if ttfb <= 0 {
+		return
+	}
+	for {
+		old := ls.latency.Load()
+		next := int64(ttfb)
+		if old > 0 {
+			next = old + int64(latencyEWMAWeight*float64(int64(ttfb)-old))
+		}
+		if ls.latency.CompareAndSwap(old, next) {
+			break
+		}
+	}
+	ls.lastSample.Store(time.Now().UnixNano())
+}
+
+// Latency returns the moving average of the upstream time to first byte,
+// or 0 if there has been no sample for latencyStaleAfter
+func (ls *LoadShedder) Latency() time.Duration {
+	if time.Since(time.Unix(0, ls.lastSample.Load())) > latencyStaleAfter {
+		return 0
+	}
+	return time.Duration(ls.latency.Load())
+}
+
+// responseFor returns the 503 for config's shed_retry_after
+func (ls *LoadShedder) responseFor(config *Config) []byte {
+	if r := ls.response.Load(); r != nil && r.retryAfter == config.ShedRetryAfter {
+		return r.data
+	}
+	body := "The proxy is overloaded; retry later.\n"
+	data := fmt.Sprintf("HTTP/1.1 503 Service Unavailable\r\nRetry-After: %d\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		int(config.ShedRetryAfter/time.Second), len(body), body)
+	r := &shedResponse{retryAfter: config.ShedRetryAfter, data: []byte(data)}
+	ls.response.Store(r)
+	return r.data
+}
+
+// record counts a connection shed for signal
+func (ls *LoadShedder) record(signal string) {
+	ls.mu.Lock()
+	ls.counts[signal]++
+	ls.mu.Unlock()
+}
+
+// Run logs a summary of the connections shed every
+// loadShedSummaryInterval in which there were any, until stop is closed
+func (ls *LoadShedder) Run(diag *DiagLogger, stop <-chan struct{}) {
+	ticker := time.NewTicker(loadShedSummaryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ls.mu.Lock()
+			counts := ls.counts
+			ls.counts = make(map[string]int64)
+			ls.mu.Unlock()
+			if len(counts) == 0 {
+				continue
+			}
+
+			var total int64
+			signals := make([]string, 0, len(counts))
+			for signal, n := range counts {
+				total += n
+				signals = append(signals, fmt.Sprintf("%s %d", signal, n))
+			}
+			sort.Strings(signals)
+			diag.Warnf("Load shedding: turned away %d connections in the last %s (%s)", total, loadShedSummaryInterval, strings.Join(signals, ", "))
+		}
+	}
+}
+
+// shedSignal returns the shed_* setting whose threshold is reached, or ""
+// when the connection can be admitted. The checks are ordered cheapest
+// first.
+func (s *Server) shedSignal(config *Config) string {
+	if config.ShedActiveConnections > 0 && s.activeConns.Load() >= int64(config.ShedActiveConnections) {
+		return "shed_active_connections"
+	}
+	if config.ShedQueueDepth > 0 && s.workerPool != nil && s.workerPool.QueueDepth() >= config.ShedQueueDepth {
+		return "shed_queue_depth"
+	}
+	if config.ShedLatency > 0 && s.shedder.Latency() >= config.ShedLatency {
+		return "shed_latency"
+	}
+	if config.ShedGoroutines > 0 && runtime.NumGoroutine() >= config.ShedGoroutines {
+		return "shed_goroutines"
+	}
+	return ""
+}
+
+// shedConn answers a connection turned away by load shedding with the
+// prebuilt 503 and closes it. It is counted in the stats and the periodic
+// summary rather than the access log, which would grow fastest exactly
+// when the proxy can least afford it.
+func (s *Server) shedConn(conn net.Conn, config *Config, signal string) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	s.stats.LoadShed.Add(1)
+	s.shedder.record(signal)
+	conn.SetWriteDeadline(time.Now().Add(shedWriteTimeout))
+	conn.Write(s.shedder.responseFor(config))
+}
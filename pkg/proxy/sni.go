@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// maxTLSRecord is the largest TLS record, header included
+const maxTLSRecord = 5 + 16384
+
+// SNIBlockedError reports a CONNECT tunnel torn down because of the server
+// name in its TLS ClientHello
+type SNIBlockedError struct {
+	ServerName string
+	Rule       string // blocking rule, or a description of the mismatch
+}
+
+func (e *SNIBlockedError) Error() string {
+	return fmt.Sprintf("TLS server name %q blocked: %s", e.ServerName, e.Rule)
+}
+
+// sniCheck returns the check applied to the server name of tunneled TLS
+// traffic, or nil if inspect_sni is off. The name must not be blocked and,
+// in strict mode, must match the CONNECT host.
+func (s *Server) sniCheck(config *Config, req *HTTPRequest) func(string) error {
+	if !config.InspectSNI {
+		return nil
+	}
+	return func(serverName string) error {
+		if serverName == "" {
+			return nil
+		}
+		if match, ok := s.matchFilter(req, serverName); ok && match.Blocks() {
+			return &SNIBlockedError{ServerName: serverName, Rule: match.Rule}
+		}
+		// A tunnel SafeSearch rewrote still names the search engine
+		host := req.Host
+		if req.SafeSearchFrom != "" {
+			host = req.SafeSearchFrom
+		}
+		if config.InspectSNIStrict && !strings.EqualFold(serverName, host) {
+			return &SNIBlockedError{ServerName: serverName, Rule: fmt.Sprintf("does not match CONNECT host %s", host)}
+		}
+		return nil
+	}
+}
+
+// sniffSNI peeks at the first bytes the client sends through a tunnel and,
+// if they are a TLS ClientHello, returns its server name. Nothing is
+// consumed from reader, so the bytes are still relayed. Traffic that isn't
+// TLS, or that doesn't arrive within timeout, returns an empty name.
+func sniffSNI(conn net.Conn, reader *bufio.Reader, timeout time.Duration) string {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	header, err := reader.Peek(5)
+	if err != nil || header[0] != 0x16 { // handshake record
+		return ""
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	record, err := reader.Peek(5 + length)
+	if err != nil {
+		return ""
+	}
+
+	serverName, err := parseClientHelloSNI(record[5:])
+	if err != nil {
+		return ""
+	}
+	return serverName
+}
+
+var errNoClientHello = errors.New("not a TLS ClientHello")
+
+// parseClientHelloSNI extracts the server_name extension from the body of
+// a handshake record holding a ClientHello
+func parseClientHelloSNI(data []byte) (string, error) {
+	// Handshake header: type (1 = ClientHello) and 24-bit length
+	if len(data) < 4 || data[0] != 1 {
+		return "", errNoClientHello
+	}
+	msg := data[4:]
+	if n := int(data[1])<<16 | int(data[2])<<8 | int(data[3]); n < len(msg) {
+		msg = msg[:n]
+	}
+
+	// Skip version and random, then the variable-length session ID,
+	// cipher suites and compression methods
+	if len(msg) < 34 {
+		return "", errNoClientHello
+	}
+	msg = msg[34:]
+	for _, lenBytes := range []int{1, 2, 1} {
+		if len(msg) < lenBytes {
+			return "", errNoClientHello
+		}
+		n := int(msg[0])
+		if lenBytes == 2 {
+			n = int(binary.BigEndian.Uint16(msg))
+		}
+		if len(msg) < lenBytes+n {
+			return "", errNoClientHello
+		}
+		msg = msg[lenBytes+n:]
+	}
+
+	// Extensions
+	if len(msg) < 2 {
+		return "", nil // no extensions, so no server name
+	}
+	exts := msg[2:]
+	if n := int(binary.BigEndian.Uint16(msg)); n < len(exts) {
+		exts = exts[:n]
+	}
+	for len(exts) >= 4 {
+		extType := binary.BigEndian.Uint16(exts)
+		extLen := int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+extLen {
+			return "", errNoClientHello
+		}
+		ext := exts[4 : 4+extLen]
+		exts = exts[4+extLen:]
+		if extType != 0 { // server_name
+			continue
+		}
+
+		// server_name_list of (type, 16-bit length, name) entries
+		if len(ext) < 2 {
+			return "", errNoClientHello
+		}
+		list := ext[2:]
+		for len(list) >= 3 {
+			nameType := list[0]
+			nameLen := int(binary.BigEndian.Uint16(list[1:]))
+			if len(list) < 3+nameLen {
+				return "", errNoClientHello
+			}
+			if nameType == 0 { // host_name
+				return strings.ToLower(string(list[3 : 3+nameLen])), nil
+			}
+			list = list[3+nameLen:]
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,528 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Stats holds the server's runtime counters. They are updated as requests
+// complete, without a shared lock, and read through Server.Stats, which the
+// SIGUSR1 dump, the admin /stats endpoint and /metrics share.
+type Stats struct {
+	started          time.Time
+	TotalConnections atomic.Int64
+	TotalRequests    atomic.Int64
+	BytesUpstream    atomic.Int64
+	BytesDownstream  atomic.Int64
+	AuthFailures     atomic.Int64
+	AuthThrottled    atomic.Int64 // requests refused for too many wrong credentials, see auth_failure_limit
+	ClientAborts     atomic.Int64 // responses and tunnels cut short by the client's connection
+	QueueDrops       atomic.Int64 // connections turned away by a full worker queue
+	LoadShed         atomic.Int64 // connections turned away by load shedding
+
+	queueWait *durationHistogram              // how long connections waited for a worker
+	phases    [tracePhases]*durationHistogram // time requests spent in each phase they reached, see RequestTrace
+
+	byAction       sync.Map // requests per log action, string -> *atomic.Int64
+	upstreamErrors sync.Map // failed upstream exchanges per category, see upstreamErrorCategory
+
+	statsd atomic.Pointer[StatsD] // also sent the counts, when statsd_address is set
+}
+
+// NewStats creates a Stats with the uptime clock started
+func NewStats() *Stats {
+	st := &Stats{started: time.Now(), queueWait: newDurationHistogram(queueWaitBuckets)}
+	for p := range st.phases {
+		st.phases[p] = newDurationHistogram(phaseBuckets)
+	}
+	return st
+}
+
+// phaseBuckets are the upper bounds of the request phase histograms
+var phaseBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 25 * time.Millisecond, 100 * time.Millisecond,
+	250 * time.Millisecond, 500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// queueWaitBuckets are the upper bounds of the queue wait histogram
+var queueWaitBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 25 * time.Millisecond, 100 * time.Millisecond,
+	250 * time.Millisecond, 500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second, 30 * time.Second,
+}
+
+// durationHistogram counts durations into fixed buckets, as Prometheus
+// histograms do
+type durationHistogram struct {
+	bounds []time.Duration
+	counts []atomic.Int64 // per bucket, with one more for those past the last bound
+	sum    atomic.Int64   // nanoseconds
+}
+
+// newDurationHistogram creates a histogram with the given ascending bucket
+// bounds
+func newDurationHistogram(bounds []time.Duration) *durationHistogram {
+	return &durationHistogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+}
+
+// Observe counts d in its bucket
+func (h *durationHistogram) Observe(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// HistogramBucket is the number of observations at or below LE seconds
+type HistogramBucket struct {
+	LE    float64 `json:"le"`
+	Count int64   `json:"count"`
+}
+
+// HistogramSnapshot is a copy of a durationHistogram with cumulative
+// buckets; the observations past the last bucket are Count less its count
+type HistogramSnapshot struct {
+	Count      int64             `json:"count"`
+	SumSeconds float64           `json:"sum_seconds"`
+	Buckets    []HistogramBucket `json:"buckets"`
+}
+
+// Snapshot copies the histogram
+func (h *durationHistogram) Snapshot() HistogramSnapshot {
+	var snap HistogramSnapshot
+	for i, bound := range h.bounds {
+		snap.Count += h.counts[i].Load()
+		snap.Buckets = append(snap.Buckets, HistogramBucket{LE: bound.Seconds(), Count: snap.Count})
+	}
+	snap.Count += h.counts[len(h.bounds)].Load()
+	snap.SumSeconds = time.Duration(h.sum.Load()).Seconds()
+	return snap
+}
+
+// RecordQueueWait counts how long a connection waited for a worker
+func (st *Stats) RecordQueueWait(waited time.Duration) {
+	st.queueWait.Observe(waited)
+	st.statsd.Load().Timing("queue.wait", waited)
+}
+
+// RecordTrace counts the time a finished request spent in each phase it
+// reached
+func (st *Stats) RecordTrace(trace *RequestTrace) {
+	statsd := st.statsd.Load()
+	for p, name := range phaseNames {
+		if tracePhase(p) != phaseProxy && !trace.entered[p] {
+			continue
+		}
+		st.phases[p].Observe(trace.durations[p])
+		statsd.Timing("request.phase."+name, trace.durations[p])
+	}
+}
+
+// RecordRequest counts a finished request under its log action
+func (st *Stats) RecordRequest(action string, bytesUp, bytesDown int64) {
+	st.TotalRequests.Add(1)
+	st.BytesUpstream.Add(bytesUp)
+	st.BytesDownstream.Add(bytesDown)
+	countKey(&st.byAction, action)
+}
+
+// RecordClientAbort counts a response or tunnel the client's connection
+// failed during
+func (st *Stats) RecordClientAbort() {
+	st.ClientAborts.Add(1)
+	st.statsd.Load().Count("client_aborts", 1)
+}
+
+// RecordUpstreamError counts a failed exchange with an upstream
+func (st *Stats) RecordUpstreamError(err error) {
+	category := upstreamErrorCategory(err)
+	countKey(&st.upstreamErrors, category)
+	st.statsd.Load().Count("upstream_errors", 1, "category", category)
+}
+
+// countKey increments the counter for key in m, creating it on first use
+func countKey(m *sync.Map, key string) {
+	counter, ok := m.Load(key)
+	if !ok {
+		counter, _ = m.LoadOrStore(key, new(atomic.Int64))
+	}
+	counter.(*atomic.Int64).Add(1)
+}
+
+// loadCounts copies the counters in m
+func loadCounts(m *sync.Map) map[string]int64 {
+	counts := make(map[string]int64)
+	m.Range(func(key, counter any) bool {
+		counts[key.(string)] = counter.(*atomic.Int64).Load()
+		return true
+	})
+	return counts
+}
+
+// upstreamErrorCategory classifies an upstream failure as dns, timeout,
+// refused, reset, tls or other
+func upstreamErrorCategory(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrUnexpectedEOF):
+		return "reset"
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr),
+		errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr), errors.As(err, &invalidCert):
+		return "tls"
+	}
+	return "other"
+}
+
+// StatsSnapshot is a point-in-time copy of the server's statistics
+type StatsSnapshot struct {
+	Build             BuildInfo         `json:"build"`
+	Uptime            time.Duration     `json:"uptime"`
+	Listeners         []ListenerStatus  `json:"listeners"`    // proxy listeners accepting connections
+	AdminListen       string            `json:"admin_listen"` // as configured
+	TotalConnections  int64             `json:"total_connections"`
+	TotalRequests     int64             `json:"total_requests"`
+	RequestsByAction  map[string]int64  `json:"requests_by_action"`
+	BytesUpstream     int64             `json:"bytes_upstream"`
+	BytesDownstream   int64             `json:"bytes_downstream"`
+	AuthFailures      int64             `json:"auth_failures"`
+	AuthThrottled     int64             `json:"auth_throttled"`
+	ClientAborts      int64             `json:"client_aborts"`
+	UpstreamErrors    map[string]int64  `json:"upstream_errors"` // by category, see upstreamErrorCategory
+	ActiveConnections int64             `json:"active_connections"`
+	Goroutines        int               `json:"goroutines"`
+	CacheEntries      int               `json:"cache_entries"`
+	CacheBytes        int64             `json:"cache_bytes"`
+	CacheMaxEntries   int               `json:"cache_max_entries"`
+	CacheMaxBytes     int64             `json:"cache_max_bytes"`
+	CacheHits         int64             `json:"cache_hits"`
+	CacheMisses       int64             `json:"cache_misses"`
+	CacheEvictions    int64             `json:"cache_evictions"`
+	CacheEvicted      map[string]int64  `json:"cache_evictions_by_reason"` // "entries" or "size", the limit that forced them, or "expired"
+	CachePuts         int64             `json:"cache_puts"`
+	CacheBytesServed  int64             `json:"cache_bytes_served"`
+	CacheHitRatio     float64           `json:"cache_hit_ratio"`
+	FilterDomains     int               `json:"filter_domains"`
+	FilterIPs         int               `json:"filter_ips"`
+	FilterHealthy     bool              `json:"filter_healthy"` // the filter rules last loaded without error
+	QueueDepth        int               `json:"queue_depth"`
+	QueueDrops        int64             `json:"queue_drops"`
+	QueueWait         HistogramSnapshot `json:"queue_wait"` // how long connections waited for a worker
+	LoadShed          int64             `json:"load_shed"`
+	UpstreamLatencyMs float64           `json:"upstream_latency_avg_ms"` // moving average of the upstream time to first byte
+	Workers           int               `json:"workers"`
+	WorkersAdded      int64             `json:"workers_added"`
+	WorkersRetired    int64             `json:"workers_retired"`
+	Parents           map[string]string `json:"parents,omitempty"` // parent proxy states, up or down
+	ParentTransitions int64             `json:"parent_transitions"`
+	UpstreamConns     map[string]int64  `json:"upstream_connections"` // open connections per destination host:port
+	LogWriteErrors    int64             `json:"log_write_errors"`
+	StatsdDropped     int64             `json:"statsd_dropped"`   // metric lines dropped for a full send queue
+	LogShipped        int64             `json:"log_shipped"`      // access log entries the collector accepted
+	LogShipSpooled    int64             `json:"log_ship_spooled"` // entries waiting to be resent
+	LogShipDropped    int64             `json:"log_ship_dropped"` // entries lost to a full queue or spool
+
+	RequestPhases map[string]HistogramSnapshot `json:"request_phases"` // time requests spent in each phase, see RequestTrace
+}
+
+// Stats gathers the current statistics from the counters and the server's
+// components. Counters are read one at a time, so a snapshot taken under
+// load may be off by the requests that finished while it was taken.
+func (s *Server) Stats() StatsSnapshot {
+	st := s.stats
+	snap := StatsSnapshot{
+		Build:             Build(),
+		Uptime:            time.Since(st.started),
+		Listeners:         s.Listeners(),
+		AdminListen:       s.config.Load().AdminListen,
+		TotalConnections:  st.TotalConnections.Load(),
+		TotalRequests:     st.TotalRequests.Load(),
+		RequestsByAction:  loadCounts(&st.byAction),
+		BytesUpstream:     st.BytesUpstream.Load(),
+		BytesDownstream:   st.BytesDownstream.Load(),
+		AuthFailures:      st.AuthFailures.Load(),
+		AuthThrottled:     st.AuthThrottled.Load(),
+		ClientAborts:      st.ClientAborts.Load(),
+		UpstreamErrors:    loadCounts(&st.upstreamErrors),
+		ActiveConnections: s.ActiveConnections(),
+		Goroutines:        runtime.NumGoroutine(),
+		QueueDrops:        st.QueueDrops.Load(),
+		LoadShed:          st.LoadShed.Load(),
+		RequestPhases:     make(map[string]HistogramSnapshot, len(phaseNames)),
+	}
+	for p, name := range phaseNames {
+		snap.RequestPhases[name] = st.phases[p].Snapshot()
+	}
+
+	if s.cache != nil {
+		cache := s.cache.Stats()
+		snap.CacheEntries, snap.CacheBytes = cache.Entries, cache.Bytes
+		snap.CacheMaxEntries, snap.CacheMaxBytes = cache.MaxEntries, cache.MaxBytes
+		snap.CacheHits, snap.CacheMisses, snap.CachePuts = cache.Hits, cache.Misses, cache.Puts
+		snap.CacheEvictions = cache.EntryEvictions + cache.SizeEvictions + cache.ExpiredEvictions
+		snap.CacheEvicted = map[string]int64{"entries": cache.EntryEvictions, "size": cache.SizeEvictions, "expired": cache.ExpiredEvictions}
+		snap.CacheBytesServed = cache.BytesServed
+		if snap.CacheHits+snap.CacheMisses > 0 {
+			snap.CacheHitRatio = float64(snap.CacheHits) / float64(snap.CacheHits+snap.CacheMisses)
+		}
+	}
+
+	filterStats := s.engine.Stats()
+	snap.FilterDomains, snap.FilterIPs = filterStats.Domains, filterStats.IPs
+	snap.FilterHealthy = filterStats.Healthy
+
+	snap.Parents = s.forwarder.parents.States()
+	snap.ParentTransitions = s.forwarder.parents.transitions.Load()
+	snap.UpstreamConns = s.forwarder.limiter.Active()
+	snap.LogWriteErrors = s.logger.WriteErrors()
+	snap.StatsdDropped = s.stats.statsd.Load().Dropped()
+	ship := s.logger.ShipStats()
+	snap.LogShipped, snap.LogShipSpooled, snap.LogShipDropped = ship.Shipped, ship.Spooled, ship.Dropped
+	snap.UpstreamLatencyMs = float64(s.shedder.Latency()) / float64(time.Millisecond)
+
+	if s.workerPool != nil {
+		snap.QueueDepth = s.workerPool.QueueDepth()
+		snap.QueueWait = st.queueWait.Snapshot()
+		snap.Workers, snap.WorkersAdded, snap.WorkersRetired = s.workerPool.Workers()
+	}
+
+	return snap
+}
+
+// DumpStats writes a human-readable statistics snapshot to w in a single
+// write, so it isn't interleaved with log lines
+func (s *Server) DumpStats(w io.Writer) {
+	snap := s.Stats()
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "=== Proxy statistics ===\n")
+	fmt.Fprintf(&b, "Version:            %s\n", VersionString())
+	fmt.Fprintf(&b, "Uptime:             %s\n", snap.Uptime.Round(time.Second))
+	fmt.Fprintf(&b, "Listeners:          %s\n", describeListeners(snap.Listeners))
+	fmt.Fprintf(&b, "Total connections:  %d\n", snap.TotalConnections)
+	fmt.Fprintf(&b, "Total requests:     %d\n", snap.TotalRequests)
+
+	for _, action := range sortedKeys(snap.RequestsByAction) {
+		fmt.Fprintf(&b, "  %-17s %d\n", action+":", snap.RequestsByAction[action])
+	}
+
+	fmt.Fprintf(&b, "Bytes up/down:      %d / %d\n", snap.BytesUpstream, snap.BytesDownstream)
+	fmt.Fprintf(&b, "Auth failures:      %d (%d throttled)\n", snap.AuthFailures, snap.AuthThrottled)
+	if len(snap.UpstreamErrors) > 0 {
+		var counts []string
+		for _, category := range sortedKeys(snap.UpstreamErrors) {
+			counts = append(counts, fmt.Sprintf("%s %d", category, snap.UpstreamErrors[category]))
+		}
+		fmt.Fprintf(&b, "Upstream errors:    %s\n", strings.Join(counts, ", "))
+	}
+	fmt.Fprintf(&b, "Client aborts:      %d\n", snap.ClientAborts)
+	fmt.Fprintf(&b, "Active connections: %d\n", snap.ActiveConnections)
+	fmt.Fprintf(&b, "Goroutines:         %d\n", snap.Goroutines)
+	if s.cache != nil {
+		fmt.Fprintf(&b, "Cache:              %d/%d entries, %d/%d bytes, %.1f%% hit ratio\n", snap.CacheEntries, snap.CacheMaxEntries, snap.CacheBytes, snap.CacheMaxBytes, snap.CacheHitRatio*100)
+		fmt.Fprintf(&b, "Cache lookups:      %d hits, %d misses, %d bytes served\n", snap.CacheHits, snap.CacheMisses, snap.CacheBytesServed)
+		fmt.Fprintf(&b, "Cache stores:       %d puts, %d evictions (%d for entries, %d for size, %d expired)\n", snap.CachePuts, snap.CacheEvictions, snap.CacheEvicted["entries"], snap.CacheEvicted["size"], snap.CacheEvicted["expired"])
+	} else {
+		fmt.Fprintf(&b, "Cache:              disabled\n")
+	}
+	fmt.Fprintf(&b, "Filter rules:       %d domains, %d IPs\n", snap.FilterDomains, snap.FilterIPs)
+	if !snap.FilterHealthy {
+		fmt.Fprintf(&b, "Filter health:      last load failed (filter_failure_policy=%s)\n", s.config.Load().FilterFailurePolicy)
+	}
+	fmt.Fprintf(&b, "Log write errors:   %d\n", snap.LogWriteErrors)
+	if s.config.Load().LogShipURL != "" {
+		fmt.Fprintf(&b, "Log shipping:       %d shipped, %d spooled, %d dropped\n", snap.LogShipped, snap.LogShipSpooled, snap.LogShipDropped)
+	}
+	if s.workerPool != nil {
+		fmt.Fprintf(&b, "Workers:            %d running, %d added under load, %d retired idle\n", snap.Workers, snap.WorkersAdded, snap.WorkersRetired)
+		fmt.Fprintf(&b, "Worker queue:       %d queued, %d turned away\n", snap.QueueDepth, snap.QueueDrops)
+		if snap.QueueWait.Count > 0 {
+			avg := time.Duration(snap.QueueWait.SumSeconds / float64(snap.QueueWait.Count) * float64(time.Second))
+			fmt.Fprintf(&b, "Queue wait:         %s average over %d connections\n", avg.Round(time.Microsecond), snap.QueueWait.Count)
+		}
+	}
+	fmt.Fprintf(&b, "Load shed:          %d (upstream latency avg %.1fms)\n", snap.LoadShed, snap.UpstreamLatencyMs)
+
+	if len(snap.Parents) > 0 {
+		var states []string
+		for _, addr := range sortedParents(snap.Parents) {
+			states = append(states, addr+" "+snap.Parents[addr])
+		}
+		fmt.Fprintf(&b, "Parent proxies:     %s (%d transitions)\n", strings.Join(states, ", "), snap.ParentTransitions)
+	}
+	if len(snap.UpstreamConns) > 0 {
+		var conns []string
+		for _, addr := range sortedKeys(snap.UpstreamConns) {
+			conns = append(conns, fmt.Sprintf("%s %d", addr, snap.UpstreamConns[addr]))
+		}
+		fmt.Fprintf(&b, "Upstream conns:     %s\n", strings.Join(conns, ", "))
+	}
+
+	io.WriteString(w, b.String())
+}
+
+// sortedKeys returns the keys of counts in order
+func sortedKeys(counts map[string]int64) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// LogStats writes the statistics snapshot to the diagnostic log
+func (s *Server) LogStats() {
+	s.DumpStats(s.diag)
+}
+
+// handleStats serves the statistics snapshot as JSON
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Stats())
+}
+
+// handleMetrics serves the statistics snapshot in the Prometheus text
+// exposition format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	snap := s.Stats()
+	var b strings.Builder
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	labeled := func(name, label string, counts map[string]int64) {
+		for _, key := range sortedKeys(counts) {
+			fmt.Fprintf(&b, "%s{%s=%q} %d\n", name, label, key, counts[key])
+		}
+	}
+
+	metric("proxy_build_info", "gauge", "Build information; always 1.")
+	fmt.Fprintf(&b, "proxy_build_info{version=%q,commit=%q,build_date=%q,goversion=%q} 1\n", snap.Build.Version, snap.Build.Commit, snap.Build.BuildDate, snap.Build.GoVersion)
+	metric("proxy_uptime_seconds", "gauge", "Seconds since the server started.")
+	fmt.Fprintf(&b, "proxy_uptime_seconds %g\n", snap.Uptime.Seconds())
+	metric("proxy_connections_total", "counter", "Client connections accepted.")
+	fmt.Fprintf(&b, "proxy_connections_total %d\n", snap.TotalConnections)
+	metric("proxy_active_connections", "gauge", "Client connections being handled or queued.")
+	fmt.Fprintf(&b, "proxy_active_connections %d\n", snap.ActiveConnections)
+	metric("proxy_requests_total", "counter", "Requests handled, by log action.")
+	labeled("proxy_requests_total", "action", snap.RequestsByAction)
+	metric("proxy_bytes_total", "counter", "Bytes relayed, by direction.")
+	fmt.Fprintf(&b, "proxy_bytes_total{direction=\"upstream\"} %d\n", snap.BytesUpstream)
+	fmt.Fprintf(&b, "proxy_bytes_total{direction=\"downstream\"} %d\n", snap.BytesDownstream)
+	metric("proxy_auth_failures_total", "counter", "Requests that failed proxy authentication.")
+	fmt.Fprintf(&b, "proxy_auth_failures_total %d\n", snap.AuthFailures)
+	metric("proxy_auth_throttled_total", "counter", "Requests refused for presenting too many wrong credentials (auth_failure_limit).")
+	fmt.Fprintf(&b, "proxy_auth_throttled_total %d\n", snap.AuthThrottled)
+	metric("proxy_upstream_errors_total", "counter", "Failed exchanges with upstreams, by category.")
+	labeled("proxy_upstream_errors_total", "category", snap.UpstreamErrors)
+	metric("proxy_client_aborts_total", "counter", "Responses and tunnels cut short by the client's connection failing.")
+	fmt.Fprintf(&b, "proxy_client_aborts_total %d\n", snap.ClientAborts)
+	if s.cache != nil {
+		metric("proxy_cache_entries", "gauge", "Responses in the cache.")
+		fmt.Fprintf(&b, "proxy_cache_entries %d\n", snap.CacheEntries)
+		metric("proxy_cache_bytes", "gauge", "Bytes held by the cache.")
+		fmt.Fprintf(&b, "proxy_cache_bytes %d\n", snap.CacheBytes)
+		metric("proxy_cache_max_entries", "gauge", "Responses the cache can hold (cache_max_entries).")
+		fmt.Fprintf(&b, "proxy_cache_max_entries %d\n", snap.CacheMaxEntries)
+		metric("proxy_cache_max_bytes", "gauge", "Bytes the cache can hold (cache_max_size_mb).")
+		fmt.Fprintf(&b, "proxy_cache_max_bytes %d\n", snap.CacheMaxBytes)
+		metric("proxy_cache_hits_total", "counter", "Cache lookups that found a response.")
+		fmt.Fprintf(&b, "proxy_cache_hits_total %d\n", snap.CacheHits)
+		metric("proxy_cache_misses_total", "counter", "Cache lookups that found nothing.")
+		fmt.Fprintf(&b, "proxy_cache_misses_total %d\n", snap.CacheMisses)
+		metric("proxy_cache_puts_total", "counter", "Responses stored in the cache.")
+		fmt.Fprintf(&b, "proxy_cache_puts_total %d\n", snap.CachePuts)
+		metric("proxy_cache_evictions_total", "counter", "Responses evicted from the cache, by the limit that forced them or because they expired.")
+		labeled("proxy_cache_evictions_total", "reason", snap.CacheEvicted)
+		metric("proxy_cache_served_bytes_total", "counter", "Response body bytes served from the cache.")
+		fmt.Fprintf(&b, "proxy_cache_served_bytes_total %d\n", snap.CacheBytesServed)
+	}
+	metric("proxy_filter_healthy", "gauge", "Whether the filter rules last loaded without error.")
+	healthy := 0
+	if snap.FilterHealthy {
+		healthy = 1
+	}
+	fmt.Fprintf(&b, "proxy_filter_healthy %d\n", healthy)
+	metric("proxy_log_write_errors_total", "counter", "Access log entries that couldn't be written to the log file.")
+	fmt.Fprintf(&b, "proxy_log_write_errors_total %d\n", snap.LogWriteErrors)
+	if s.config.Load().LogShipURL != "" {
+		metric("proxy_log_shipped_total", "counter", "Access log entries the collector accepted.")
+		fmt.Fprintf(&b, "proxy_log_shipped_total %d\n", snap.LogShipped)
+		metric("proxy_log_ship_spooled", "gauge", "Access log entries waiting in the spool to be resent.")
+		fmt.Fprintf(&b, "proxy_log_ship_spooled %d\n", snap.LogShipSpooled)
+		metric("proxy_log_ship_dropped_total", "counter", "Access log entries lost to a full queue or spool.")
+		fmt.Fprintf(&b, "proxy_log_ship_dropped_total %d\n", snap.LogShipDropped)
+	}
+	metric("proxy_goroutines", "gauge", "Running goroutines.")
+	fmt.Fprintf(&b, "proxy_goroutines %d\n", snap.Goroutines)
+	if s.workerPool != nil {
+		metric("proxy_workers", "gauge", "Running worker pool workers.")
+		fmt.Fprintf(&b, "proxy_workers %d\n", snap.Workers)
+		metric("proxy_queue_depth", "gauge", "Connections waiting for a worker.")
+		fmt.Fprintf(&b, "proxy_queue_depth %d\n", snap.QueueDepth)
+		metric("proxy_queue_wait_seconds", "histogram", "How long connections waited for a worker.")
+		for _, bucket := range snap.QueueWait.Buckets {
+			fmt.Fprintf(&b, "proxy_queue_wait_seconds_bucket{le=\"%g\"} %d\n", bucket.LE, bucket.Count)
+		}
+		fmt.Fprintf(&b, "proxy_queue_wait_seconds_bucket{le=\"+Inf\"} %d\n", snap.QueueWait.Count)
+		fmt.Fprintf(&b, "proxy_queue_wait_seconds_sum %g\n", snap.QueueWait.SumSeconds)
+		fmt.Fprintf(&b, "proxy_queue_wait_seconds_count %d\n", snap.QueueWait.Count)
+	}
+	metric("proxy_request_phase_seconds", "histogram", "Time requests spent in each phase: proxy, dns, connect, tls, write, wait and transfer.")
+	for _, name := range phaseNames {
+		phase := snap.RequestPhases[name]
+		for _, bucket := range phase.Buckets {
+			fmt.Fprintf(&b, "proxy_request_phase_seconds_bucket{phase=%q,le=\"%g\"} %d\n", name, bucket.LE, bucket.Count)
+		}
+		fmt.Fprintf(&b, "proxy_request_phase_seconds_bucket{phase=%q,le=\"+Inf\"} %d\n", name, phase.Count)
+		fmt.Fprintf(&b, "proxy_request_phase_seconds_sum{phase=%q} %g\n", name, phase.SumSeconds)
+		fmt.Fprintf(&b, "proxy_request_phase_seconds_count{phase=%q} %d\n", name, phase.Count)
+	}
+	metric("proxy_queue_drops_total", "counter", "Connections turned away by a full worker queue.")
+	fmt.Fprintf(&b, "proxy_queue_drops_total %d\n", snap.QueueDrops)
+	metric("proxy_load_shed_total", "counter", "Connections turned away by load shedding.")
+	fmt.Fprintf(&b, "proxy_load_shed_total %d\n", snap.LoadShed)
+	metric("proxy_upstream_latency_avg_seconds", "gauge", "Moving average of the upstream time to first byte.")
+	fmt.Fprintf(&b, "proxy_upstream_latency_avg_seconds %g\n", snap.UpstreamLatencyMs/1000)
+	if len(snap.Parents) > 0 {
+		metric("proxy_parent_up", "gauge", "Whether each parent proxy is up.")
+		for _, addr := range sortedParents(snap.Parents) {
+			up := 0
+			if snap.Parents[addr] == "up" {
+				up = 1
+			}
+			fmt.Fprintf(&b, "proxy_parent_up{parent=%q} %d\n", addr, up)
+		}
+	}
+	metric("proxy_upstream_connections", "gauge", "Open connections per destination host:port.")
+	labeled("proxy_upstream_connections", "upstream", snap.UpstreamConns)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDumpStats(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+
+	config := testConfig(t)
+	if err := os.WriteFile(config.BlockedDomainsFile, []byte("blocked.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, addr := startServer(t, config)
+
+	for i := 0; i < 2; i++ {
+		if resp := proxyGet(t, dialProxy(t, addr), origin.URL+"/", 5*time.Second); resp.StatusCode != http.StatusOK {
+			t.Fatalf("allowed request got %d", resp.StatusCode)
+		}
+	}
+	if resp := proxyGet(t, dialProxy(t, addr), "http://blocked.example/", 5*time.Second); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("blocked request got %d", resp.StatusCode)
+	}
+	waitFor(t, func() bool { return s.Stats().TotalRequests == 3 })
+
+	var b strings.Builder
+	s.DumpStats(&b)
+	out := b.String()
+	for _, want := range []string{
+		"=== Proxy statistics ===",
+		"Total connections:  3\n",
+		"Total requests:     3\n",
+		"  ALLOWED:          2\n",
+		"  BLOCKED:          1\n",
+		"Filter rules:       1 domains, 0 IPs\n",
+		"Active connections:",
+		"Goroutines:",
+		"Cache:",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("DumpStats output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+// Run with -race: recorders update the counters from many goroutines while
+// others take snapshots. No update may be lost.
+func TestStatsConcurrentUpdates(t *testing.T) {
+	s, err := NewServer(testConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	const recorders, perRecorder = 16, 500
+	actions := []string{"ALLOWED", "BLOCKED", "CACHE_HIT"}
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var b strings.Builder
+				s.DumpStats(&b)
+				if snap := s.Stats(); snap.BytesDownstream < snap.TotalRequests-int64(recorders) {
+					// bytes are added after the request count, so may lag
+					// by at most one request per recorder
+					t.Errorf("snapshot saw %d requests but only %d bytes", snap.TotalRequests, snap.BytesDownstream)
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < recorders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perRecorder; j++ {
+				s.stats.RecordRequest(actions[(i+j)%len(actions)], 2, 1)
+				s.stats.TotalConnections.Add(1)
+				if j%5 == 0 {
+					s.stats.RecordClientAbort()
+					s.stats.RecordUpstreamError(syscall.ECONNREFUSED)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	const total = recorders * perRecorder
+	snap := s.Stats()
+	if snap.TotalRequests != total || snap.TotalConnections != total {
+		t.Errorf("counted %d requests and %d connections, want %d of each", snap.TotalRequests, snap.TotalConnections, total)
+	}
+	if snap.BytesUpstream != 2*total || snap.BytesDownstream != total {
+		t.Errorf("counted %d bytes up and %d down, want %d and %d", snap.BytesUpstream, snap.BytesDownstream, 2*total, total)
+	}
+	var byAction int64
+	for _, action := range actions {
+		byAction += snap.RequestsByAction[action]
+	}
+	if byAction != total {
+		t.Errorf("requests by action add up to %d, want %d: %v", byAction, total, snap.RequestsByAction)
+	}
+	if want := int64(recorders * perRecorder / 5); snap.ClientAborts != want || snap.UpstreamErrors["refused"] != want {
+		t.Errorf("counted %d client aborts and %d refused upstreams, want %d of each", snap.ClientAborts, snap.UpstreamErrors["refused"], want)
+	}
+}
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsdMaxPacket keeps a batch of metrics within one unfragmented UDP
+// datagram on a standard Ethernet MTU
+const statsdMaxPacket = 1432
+
+// statsdQueueSize caps the metric lines waiting to be sent; more are
+// dropped, so a slow or missing agent can't grow memory
+const statsdQueueSize = 8192
+
+// statsdFlushInterval is how long a partly filled batch waits to be sent
+const statsdFlushInterval = time.Second
+
+// StatsD sends metrics to a StatsD or DogStatsD agent over UDP. Lines are
+// queued without blocking and sent in batches by a background goroutine;
+// when the queue is full they are dropped and counted. A nil StatsD sends
+// nothing.
+type StatsD struct {
+	conn       net.Conn
+	prefix     string
+	tags       bool // append DogStatsD tags instead of naming metrics after them
+	sampleRate float64
+	lines      chan string
+	dropped    atomic.Int64
+	stop       chan struct{}
+	stopped    chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewStatsD connects to statsd_address and starts sending, returning nil
+// when it isn't set
+func NewStatsD(config *Config) (*StatsD, error) {
+	if config.StatsdAddress == "" {
+		return nil, nil
+	}
+	conn, err := net.Dial("udp", config.StatsdAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up statsd_address: %w", err)
+	}
+	sd := &StatsD{
+		conn:       conn,
+		prefix:     config.StatsdPrefix,
+		tags:       config.StatsdTags,
+		sampleRate: config.StatsdSampleRate,
+		lines:      make(chan string, statsdQueueSize),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go sd.run()
+	return sd, nil
+}
+
+// Close sends what is queued and stops sending
+func (sd *StatsD) Close() {
+	if sd == nil {
+		return
+	}
+	sd.closeOnce.Do(func() {
+		close(sd.stop)
+		<-sd.stopped
+		sd.conn.Close()
+	})
+}
+
+// Dropped returns how many metric lines were dropped for a full queue
+func (sd *StatsD) Dropped() int64 {
+	if sd == nil {
+		return 0
+	}
+	return sd.dropped.Load()
+}
+
+// run batches queued lines into datagrams until Close. Send errors, such as
+// the ICMP refusals from a stopped agent, are ignored.
+func (sd *StatsD) run() {
+	defer close(sd.stopped)
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+
+	packet := make([]byte, 0, statsdMaxPacket)
+	flush := func() {
+		if len(packet) > 0 {
+			sd.conn.Write(packet)
+			packet = packet[:0]
+		}
+	}
+	add := func(line string) {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			flush()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+
+	for {
+		select {
+		case line := <-sd.lines:
+			add(line)
+		case <-ticker.C:
+			flush()
+		case <-sd.stop:
+			for {
+				select {
+				case line := <-sd.lines:
+					add(line)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// send queues a metric line, dropping it if the queue is full
+func (sd *StatsD) send(line string) {
+	select {
+	case sd.lines <- line:
+	default:
+		sd.dropped.Add(1)
+	}
+}
+
+// metric formats a line for name with value and kind, and its sample rate
+// and, with statsd_tags, its DogStatsD tags
+func (sd *StatsD) metric(name, value, kind string, rate float64, tags ...string) string {
+	var b strings.Builder
+	b.WriteString(sd.prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if rate < 1 {
+		b.WriteString("|@")
+		b.WriteString(strconv.FormatFloat(rate, 'g', -1, 64))
+	}
+	if sd.tags && len(tags) > 1 {
+		b.WriteString("|#")
+		first := true
+		for i := 0; i+1 < len(tags); i += 2 {
+			if tags[i+1] == "" {
+				continue
+			}
+			if !first {
+				b.WriteByte(',')
+			}
+			first = false
+			b.WriteString(tags[i])
+			b.WriteByte(':')
+			b.WriteString(statsdSanitize(strings.ToLower(tags[i+1])))
+		}
+	}
+	return b.String()
+}
+
+// Count adds n to a counter. tags are name, value pairs; empty values are
+// left out.
+func (sd *StatsD) Count(name string, n int64, tags ...string) {
+	if sd == nil {
+		return
+	}
+	sd.send(sd.metric(name, strconv.FormatInt(n, 10), "c", 1, tags...))
+}
+
+// Timing records a duration in milliseconds, for statsd_sample_rate of the
+// calls
+func (sd *StatsD) Timing(name string, d time.Duration, tags ...string) {
+	if sd == nil {
+		return
+	}
+	if sd.sampleRate < 1 && rand.Float64() >= sd.sampleRate {
+		return
+	}
+	ms := strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', -1, 64)
+	sd.send(sd.metric(name, ms, "ms", sd.sampleRate, tags...))
+}
+
+// RecordRequest emits the metrics for a logged request: its count and
+// bytes, and its duration and upstream time to first byte when they are
+// known. Without statsd_tags, requests are counted per action as
+// requests.<action> instead.
+func (sd *StatsD) RecordRequest(entry *LogEntry, req *HTTPRequest) {
+	if sd == nil {
+		return
+	}
+	tags := []string{"action", entry.Action, "method", entry.Method, "listener", entry.Listener}
+	if sd.tags {
+		sd.Count("requests", 1, tags...)
+	} else {
+		sd.Count("requests."+statsdSanitize(strings.ToLower(entry.Action)), 1)
+	}
+	if entry.BytesUpstream > 0 {
+		sd.Count("bytes.upstream", entry.BytesUpstream, tags...)
+	}
+	if entry.BytesDownstream > 0 {
+		sd.Count("bytes.downstream", entry.BytesDownstream, tags...)
+	}
+	if !req.Received.IsZero() {
+		sd.Timing("request.duration", entry.Timestamp.Sub(req.Received), tags...)
+	}
+	if req.UpstreamTTFB > 0 {
+		sd.Timing("upstream.ttfb", req.UpstreamTTFB, tags...)
+	}
+}
+
+// statsdSanitize replaces the characters that delimit StatsD fields and
+// DogStatsD tags
+func statsdSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == ':' || r == '|' || r == '@' || r == '#' || r == ',' || r <= ' ' || r > '~':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idleTimeoutServer starts a proxy closing connections that send nothing
+// for idle, and an origin answering "ok"
+func idleTimeoutServer(t *testing.T, idle time.Duration) (*Server, *Config, string, string) {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(origin.Close)
+
+	config := testConfig(t)
+	config.ClientIdleTimeout = idle
+	s, addr := startServer(t, config)
+	return s, config, addr, origin.URL
+}
+
+func TestIdleConnectionClosed(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	s, config, addr, _ := idleTimeoutServer(t, idle)
+
+	conn := dialProxy(t, addr)
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("idle connection read %d bytes, %v; want it closed unanswered", n, err)
+	}
+	if waited := time.Since(start); waited < idle-50*time.Millisecond {
+		t.Errorf("idle connection closed after %v, before client_idle_timeout %v", waited, idle)
+	}
+
+	// Closing it isn't an error worth logging
+	s.Shutdown()
+	log, err := os.ReadFile(config.LogFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 0 {
+		t.Errorf("idle connection was logged:\n%s", log)
+	}
+}
+
+func TestRequestJustBeforeIdleTimeout(t *testing.T) {
+	const idle = 400 * time.Millisecond
+	_, _, addr, url := idleTimeoutServer(t, idle)
+
+	conn := dialProxy(t, addr)
+	time.Sleep(idle - 150*time.Millisecond)
+	if resp := proxyGet(t, conn, url+"/", 5*time.Second); resp.StatusCode != http.StatusOK {
+		t.Errorf("request sent before client_idle_timeout got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestHeaderTimeoutSeparateFromIdle(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	_, _, addr, url := idleTimeoutServer(t, idle)
+
+	// Once the request has started, only client_header_timeout (30s by
+	// default) applies, so
+	// a head that takes longer than client_idle_timeout still arrives
+	conn := dialProxy(t, addr)
+	io.WriteString(conn, "G")
+	time.Sleep(2 * idle)
+	fmt.Fprintf(conn, "ET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", url, hostOf(url))
+	if resp := readResponse(t, conn, 5*time.Second); resp.StatusCode != http.StatusOK {
+		t.Errorf("request whose head outlasted client_idle_timeout got %d, want 200", resp.StatusCode)
+	}
+}
+
+// stallingUpstream accepts connections, reads a request head and answers
+// with respond, returning its address
+func stallingUpstream(t *testing.T, respond func(conn net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == "\r\n" {
+						break
+					}
+				}
+				respond(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	upstream := stallingUpstream(t, func(conn net.Conn) {
+		time.Sleep(5 * timeout)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	})
+	config := testConfig(t)
+	config.UpstreamResponseHeaderTimeout = timeout
+	s, addr := startServer(t, config)
+
+	start := time.Now()
+	resp := proxyGet(t, dialProxy(t, addr), "http://"+upstream+"/", 5*time.Second)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("upstream that delayed its status line got %d, want 504", resp.StatusCode)
+	}
+	if waited := time.Since(start); waited < timeout || waited >= 5*timeout {
+		t.Errorf("answered after %v, want soon after upstream_response_header_timeout %v", waited, timeout)
+	}
+
+	s.Shutdown()
+	log, err := os.ReadFile(config.LogFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), "upstream_response_header_timeout") {
+		t.Errorf("access log doesn't give the timeout as the reason:\n%s", log)
+	}
+}
+
+func TestResponseHeaderTimeoutSparesSlowBody(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	upstream := stallingUpstream(t, func(conn net.Conn) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\n")
+		for _, piece := range []string{"sl", "ow"} {
+			time.Sleep(timeout)
+			io.WriteString(conn, piece)
+		}
+	})
+	config := testConfig(t)
+	config.UpstreamResponseHeaderTimeout = timeout
+	_, addr := startServer(t, config)
+
+	// Once the head has arrived, the body has upstream_io_timeout between
+	// reads however long it takes overall
+	resp := proxyGet(t, dialProxy(t, addr), "http://"+upstream+"/", 5*time.Second)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "slow" {
+		t.Errorf("body slower than upstream_response_header_timeout gave %d %q, want it relayed", resp.StatusCode, body)
+	}
+}
+
+// trickle writes data to conn a byte at a time, every interval, until it
+// has all been sent or the connection fails
+func trickle(conn net.Conn, data string, interval time.Duration) {
+	for i := 0; i < len(data); i++ {
+		if _, err := io.WriteString(conn, data[i:i+1]); err != nil {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+func TestTricklingHeadTimesOut(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	config := testConfig(t)
+	config.ClientHeaderTimeout = timeout
+	s, addr := startServer(t, config)
+
+	// Every byte arrives well within the timeout, but the head as a whole
+	// doesn't
+	conn := dialProxy(t, addr)
+	start := time.Now()
+	go trickle(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-Padding: "+strings.Repeat("x", 100)+"\r\n\r\n", 20*time.Millisecond)
+	if resp := readResponse(t, conn, 5*time.Second); resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("trickling client got %d, want 408", resp.StatusCode)
+	}
+	if waited := time.Since(start); waited > 3*timeout {
+		t.Errorf("trickling client held its connection for %v, client_header_timeout is %v", waited, timeout)
+	}
+	waitFor(t, func() bool { return s.Stats().RequestsByAction["SLOW_CLIENT"] == 1 })
+}
+
+func TestTricklingUploadTimesOut(t *testing.T) {
+	origin := uploadOrigin(t)
+	config := testConfig(t)
+	config.MinUploadRate = 1000
+	config.MinUploadRateGrace = 200 * time.Millisecond
+	s, addr := startServer(t, config)
+
+	conn := dialProxy(t, addr)
+	url := origin.URL + "/upload"
+	fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: %s\r\nContent-Length: 1000\r\n\r\n", url, hostOf(url))
+	go trickle(conn, strings.Repeat("x", 1000), 20*time.Millisecond)
+	if resp := readResponse(t, conn, 5*time.Second); resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("upload below min_upload_rate got %d, want 408", resp.StatusCode)
+	}
+	waitFor(t, func() bool { return s.Stats().RequestsByAction["SLOW_CLIENT"] == 1 })
+}
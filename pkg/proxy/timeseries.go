@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeseriesInterval is the span of one timeseries point
+const timeseriesInterval = time.Minute
+
+// timeseriesTopHosts is how many destinations and blocked hosts each point
+// keeps once its minute is over
+const timeseriesTopHosts = 20
+
+// timeseriesMaxHosts caps the hosts counted in the current minute; requests
+// for any more are counted under timeseriesOtherHost
+const timeseriesMaxHosts = 10000
+
+// timeseriesOtherHost stands for the hosts past timeseriesMaxHosts
+const timeseriesOtherHost = "(other)"
+
+// maxStatsRetention bounds stats_retention, and so the memory the points
+// take
+const maxStatsRetention = 7 * 24 * time.Hour
+
+// recentErrorsKept is how many failed requests the dashboard lists
+const recentErrorsKept = 20
+
+// TimeseriesPoint aggregates the requests logged in one minute
+type TimeseriesPoint struct {
+	Time              time.Time `json:"time"` // start of the minute
+	Requests          int64     `json:"requests"`
+	CacheHits         int64     `json:"cache_hits"`
+	Blocked           int64     `json:"blocked"`
+	Errors            int64     `json:"errors"`
+	BytesUpstream     int64     `json:"bytes_upstream"`
+	BytesDownstream   int64     `json:"bytes_downstream"`
+	ActiveConnections int64     `json:"active_connections"` // sampled as the minute ended
+
+	destinations map[string]int64
+	blockedHosts map[string]int64
+}
+
+// HostCount is a host and how many requests went to it
+type HostCount struct {
+	Host  string `json:"host"`
+	Count int64  `json:"count"`
+}
+
+// RecentError is a failed request, as the dashboard lists it
+type RecentError struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Client    string    `json:"client"`
+	Host      string    `json:"host"`
+	Action    string    `json:"action"`
+	Status    int       `json:"status"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// Timeseries keeps per-minute aggregates of the access log for
+// stats_retention, for the admin dashboard. A request only updates the
+// current minute's counters; Run rolls them into a point once a minute,
+// keeping just the busiest hosts, so memory is bounded by the retention.
+type Timeseries struct {
+	mu      sync.Mutex
+	current TimeseriesPoint
+	points  []TimeseriesPoint // finished minutes, oldest first
+	errors  []RecentError     // the latest failures, oldest first
+}
+
+// NewTimeseries creates a Timeseries starting at the current minute
+func NewTimeseries() *Timeseries {
+	ts := &Timeseries{}
+	ts.reset(time.Now().Truncate(timeseriesInterval))
+	return ts
+}
+
+// reset starts a new current minute at start; the caller must hold ts.mu
+func (ts *Timeseries) reset(start time.Time) {
+	ts.current = TimeseriesPoint{
+		Time:         start,
+		destinations: make(map[string]int64),
+		blockedHosts: make(map[string]int64),
+	}
+}
+
+// Record counts a logged request in the current minute
+func (ts *Timeseries) Record(entry *LogEntry) {
+	blocked := strings.Contains(entry.Action, "BLOCKED")
+	failed := entry.Action == "ERROR" || strings.HasSuffix(entry.Action, "_ERROR")
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	p := &ts.current
+	p.Requests++
+	p.BytesUpstream += entry.BytesUpstream
+	p.BytesDownstream += entry.BytesDownstream
+	if entry.Action == "CACHE_HIT" {
+		p.CacheHits++
+	}
+	if entry.DestinationHost != "" {
+		countHost(p.destinations, entry.DestinationHost)
+	}
+	if blocked {
+		p.Blocked++
+		countHost(p.blockedHosts, entry.DestinationHost)
+	}
+	if failed {
+		p.Errors++
+		if len(ts.errors) == recentErrorsKept {
+			ts.errors = append(ts.errors[:0], ts.errors[1:]...)
+		}
+		ts.errors = append(ts.errors, RecentError{
+			Time:      entry.Timestamp,
+			RequestID: entry.RequestID,
+			Client:    entry.ClientIP,
+			Host:      entry.DestinationHost,
+			Action:    entry.Action,
+			Status:    entry.UpstreamStatus,
+			Reason:    entry.BlockedRule,
+		})
+	}
+}
+
+// countHost counts a request for host, under timeseriesOtherHost once
+// counts holds timeseriesMaxHosts hosts
+func countHost(counts map[string]int64, host string) {
+	if _, ok := counts[host]; !ok && len(counts) >= timeseriesMaxHosts {
+		host = timeseriesOtherHost
+	}
+	counts[host]++
+}
+
+// roll ends the current minute, sampling active as its connection count,
+// and drops points older than retention
+func (ts *Timeseries) roll(now time.Time, active int64, retention time.Duration) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	point := ts.current
+	point.ActiveConnections = active
+	point.destinations = topHostCounts(point.destinations, timeseriesTopHosts)
+	point.blockedHosts = topHostCounts(point.blockedHosts, timeseriesTopHosts)
+	ts.points = append(ts.points, point)
+	ts.reset(now.Truncate(timeseriesInterval))
+
+	cutoff := now.Add(-retention)
+	drop := 0
+	for drop < len(ts.points) && !ts.points[drop].Time.After(cutoff) {
+		drop++
+	}
+	ts.points = append(ts.points[:0], ts.points[drop:]...)
+}
+
+// topHostCounts keeps the n largest counts
+func topHostCounts(counts map[string]int64, n int) map[string]int64 {
+	if len(counts) <= n {
+		return counts
+	}
+	top := make(map[string]int64, n)
+	for _, hc := range rankHosts(counts, n) {
+		top[hc.Host] = hc.Count
+	}
+	return top
+}
+
+// rankHosts returns up to n hosts from counts, busiest first
+func rankHosts(counts map[string]int64, n int) []HostCount {
+	ranked := make([]HostCount, 0, len(counts))
+	for host, count := range counts {
+		ranked = append(ranked, HostCount{host, count})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Count != ranked[j].Count {
+			return ranked[i].Count > ranked[j].Count
+		}
+		return ranked[i].Host < ranked[j].Host
+	})
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// Run rolls up a point at the end of every minute until stop is closed
+func (ts *Timeseries) Run(config func() *Config, active func() int64, stop <-chan struct{}) {
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(timeseriesInterval).Add(timeseriesInterval).Sub(now))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case now := <-timer.C:
+			ts.roll(now, active(), config().StatsRetention)
+		}
+	}
+}
+
+// TimeseriesSnapshot is what /stats/timeseries serves: the finished
+// minutes, the one in progress, and the busiest hosts and latest failures
+// over the whole window. A point's host counts are trimmed to its busiest
+// hosts, so the window's rankings are approximate for the long tail.
+type TimeseriesSnapshot struct {
+	Interval        string            `json:"interval"`
+	Retention       string            `json:"retention"`
+	Points          []TimeseriesPoint `json:"points"`
+	Current         TimeseriesPoint   `json:"current"`
+	TopDestinations []HostCount       `json:"top_destinations"`
+	TopBlocked      []HostCount       `json:"top_blocked"`
+	RecentErrors    []RecentError     `json:"recent_errors"`
+}
+
+// Snapshot copies the series
+func (ts *Timeseries) Snapshot(retention time.Duration) TimeseriesSnapshot {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	snap := TimeseriesSnapshot{
+		Interval:     timeseriesInterval.String(),
+		Retention:    retention.String(),
+		Points:       append([]TimeseriesPoint{}, ts.points...),
+		Current:      ts.current,
+		RecentErrors: append([]RecentError{}, ts.errors...),
+	}
+	destinations := make(map[string]int64)
+	blocked := make(map[string]int64)
+	for _, p := range append(snap.Points, ts.current) {
+		for host, count := range p.destinations {
+			destinations[host] += count
+		}
+		for host, count := range p.blockedHosts {
+			blocked[host] += count
+		}
+	}
+	snap.TopDestinations = rankHosts(destinations, timeseriesTopHosts)
+	snap.TopBlocked = rankHosts(blocked, timeseriesTopHosts)
+	return snap
+}
+
+// handleTimeseries serves the per-minute statistics as JSON
+func (s *Server) handleTimeseries(w http.ResponseWriter, r *http.Request) {
+	retention := s.config.Load().StatsRetention
+	if retention == 0 {
+		http.Error(w, "stats_retention is 0", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.timeseries.Snapshot(retention))
+}
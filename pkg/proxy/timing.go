@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// tracePhase is one of the stretches a request's time is divided into
+type tracePhase int
+
+const (
+	phaseProxy    tracePhase = iota // the proxy's own work: reading the request, checks, waiting for an upstream slot, answering itself
+	phaseDNS                        // resolving the destination
+	phaseConnect                    // connecting to the destination or a parent proxy
+	phaseTLS                        // the TLS handshake with an https:// origin
+	phaseWrite                      // writing the request head upstream
+	phaseWait                       // waiting for the response head, while any request body is uploaded
+	phaseTransfer                   // relaying the response body, or the tunnel
+	tracePhases
+)
+
+// phaseNames are the names the phases are logged and measured under
+var phaseNames = [tracePhases]string{"proxy", "dns", "connect", "tls", "write", "wait", "transfer"}
+
+// RequestTrace divides the time a request took into phases. Every request
+// is traced, which costs a clock read per phase; the phases always add up
+// to the time from parsing to logging, and with Queue to the total.
+type RequestTrace struct {
+	Queue   time.Duration // how long the connection waited for a worker, for its first request
+	Verbose bool          // log the breakdown, see timing_debug_clients and timing_debug_header
+
+	durations [tracePhases]time.Duration
+	entered   [tracePhases]bool
+	current   tracePhase
+	since     time.Time // when current began; zero for a request that wasn't parsed
+	end       time.Time // when finish was called
+}
+
+// begin ends the current phase and starts p
+func (t *RequestTrace) begin(p tracePhase) {
+	if t.since.IsZero() || !t.end.IsZero() {
+		return
+	}
+	now := time.Now()
+	t.durations[t.current] += now.Sub(t.since)
+	t.current, t.since = p, now
+	t.entered[p] = true
+}
+
+// finish ends the trace as the request is logged
+func (t *RequestTrace) finish() {
+	if t.since.IsZero() || !t.end.IsZero() {
+		return
+	}
+	t.end = time.Now()
+	t.durations[t.current] += t.end.Sub(t.since)
+}
+
+// Total returns the time the request took, from its connection being
+// queued (or from parsing) to its trace finishing
+func (t *RequestTrace) Total() time.Duration {
+	total := t.Queue
+	for _, d := range t.durations {
+		total += d
+	}
+	return total
+}
+
+// String formats the breakdown for the error log, as
+// "total=12.3ms queue=0.0ms proxy=0.4ms dns=..."
+func (t *RequestTrace) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "total=%s queue=%s", formatMillis(t.Total()), formatMillis(t.Queue))
+	for p, name := range phaseNames {
+		fmt.Fprintf(&b, " %s=%s", name, formatMillis(t.durations[p]))
+	}
+	return b.String()
+}
+
+// header formats the phases up to the response head for X-Proxy-Timing,
+// in the syntax of Server-Timing: "queue;dur=0.0, proxy;dur=0.4, ..."
+func (t *RequestTrace) header() string {
+	parts := []string{fmt.Sprintf("queue;dur=%.1f", float64(t.Queue.Microseconds())/1000)}
+	for p := phaseProxy; p < phaseTransfer; p++ {
+		parts = append(parts, fmt.Sprintf("%s;dur=%.1f", phaseNames[p], float64(t.durations[p].Microseconds())/1000))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatMillis formats d in milliseconds with one decimal
+func formatMillis(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d.Microseconds())/1000)
+}
+
+// wantsTiming reports whether the breakdown of req from clientIP is logged:
+// the client is in timing_debug_clients, or the request carries
+// timing_debug_header
+func (c *Config) wantsTiming(clientIP net.IP, req *HTTPRequest) bool {
+	if c.TimingDebugHeader != "" {
+		if _, ok := req.Headers[strings.ToLower(c.TimingDebugHeader)]; ok {
+			return true
+		}
+	}
+	if len(c.TimingDebugClients) == 0 || clientIP == nil {
+		return false
+	}
+	// Validate has already checked the CIDRs
+	networks, _ := parseCIDRList(c.TimingDebugClients)
+	for _, network := range networks {
+		if network.Contains(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// startTrace marks req for a logged timing breakdown if the configuration
+// asks for one, taking the magic header off so it isn't forwarded, and
+// charges the connection's wait for a worker to its first request
+func (s *Server) startTrace(conn net.Conn, req *HTTPRequest, config *Config) {
+	lc := clientConn(conn)
+	if lc != nil {
+		req.Trace.Queue, lc.queueWait = lc.queueWait, 0
+	}
+	var clientIP net.IP
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = tcpAddr.IP
+	}
+	req.Trace.Verbose = config.wantsTiming(clientIP, req)
+	if config.TimingDebugHeader != "" {
+		delete(req.Headers, strings.ToLower(config.TimingDebugHeader))
+	}
+}
+
+// finishTrace ends req's trace as it is logged, feeding the phase metrics
+// and logging the breakdown if it was asked for
+func (s *Server) finishTrace(req *HTTPRequest) {
+	trace := &req.Trace
+	if trace.since.IsZero() || !trace.end.IsZero() {
+		return
+	}
+	trace.finish()
+	s.stats.RecordTrace(trace)
+	if trace.Verbose {
+		s.diag.Infof("Request %s timing: %s %s:%d: %s", req.ID, req.Method, req.Host, req.Port, trace)
+	}
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync/atomic"
+)
+
+// certStore holds the client-facing TLS certificate, which can be swapped
+// on reload without restarting the TLS listeners
+type certStore struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// Load reads the certificate and key files and makes them current; on
+// failure the previous certificate stays in use
+func (cs *certStore) Load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	cs.cert.Store(&cert)
+	return nil
+}
+
+// TLSConfig returns a server TLS config that always presents the current
+// certificate
+func (cs *certStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cs.cert.Load(), nil
+		},
+	}
+}
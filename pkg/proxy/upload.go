@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Causes of an upload being stopped by the proxy
+var (
+	errUploadTooLarge = errors.New("request body exceeds max_upload_bytes")
+	errSlowUpload     = errors.New("request body too slow")
+)
+
+// upload copies a request body from the client to the upstream while the
+// response is read, so neither side waits on the other: an origin that
+// answers before the body is complete (a 401 or 413, say) has its response
+// relayed, and the upload is then stopped.
+type upload struct {
+	clientConn   net.Conn
+	upstreamConn net.Conn
+	sent         func() // called once the whole body has been sent
+	done         chan struct{}
+
+	mu      sync.Mutex
+	stopped bool
+
+	written  int64 // bytes written upstream, including chunk framing
+	complete bool  // the whole body was read from the client
+	err      error
+}
+
+// startUpload starts sending req.Body over upstreamConn, calling sent once
+// all of it has been sent. Each read from the client may take up to
+// client_read_timeout, so a slow upload isn't cut off while data keeps
+// flowing.
+func (f *Forwarder) startUpload(req *HTTPRequest, clientConn net.Conn, upstreamConn net.Conn, config *Config, sent func()) *upload {
+	u := &upload{
+		clientConn:   clientConn,
+		upstreamConn: upstreamConn,
+		sent:         sent,
+		done:         make(chan struct{}),
+	}
+	go func() {
+		defer close(u.done)
+		u.err = u.copy(f, req, config)
+	}()
+	return u
+}
+
+// copy sends the body, re-encoding a chunked one. A body that can't be read
+// in full, or that exceeds max_upload_bytes, closes upstreamConn so the
+// origin doesn't act on a truncated request and the response read fails.
+func (u *upload) copy(f *Forwarder, req *HTTPRequest, config *Config) error {
+	chunked := req.ContentLength < 0
+	send := func(data []byte) error {
+		n, err := f.writeAll(u.upstreamConn, data)
+		u.written += n
+		if err != nil {
+			return fmt.Errorf("failed to send request body: %w", err)
+		}
+		return nil
+	}
+
+	var total int64
+	started := time.Now()
+	buffer := make([]byte, config.ReadBufferSize)
+	for {
+		if !u.extendDeadlines(f, config) {
+			return nil
+		}
+		n, err := req.Body.Read(buffer)
+		if n > 0 {
+			total += int64(n)
+			if config.MaxUploadBytes > 0 && total > config.MaxUploadBytes {
+				u.upstreamConn.Close()
+				return errUploadTooLarge
+			}
+			if err := checkUploadRate(total, started, config); err != nil {
+				u.upstreamConn.Close()
+				return err
+			}
+			data := buffer[:n]
+			if chunked {
+				data = append(fmt.Appendf(nil, "%x\r\n", n), data...)
+				data = append(data, "\r\n"...)
+			}
+			if sendErr := send(data); sendErr != nil {
+				return u.unlessStopped(sendErr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if u.isStopped() {
+				return nil
+			}
+			u.upstreamConn.Close()
+			if isTimeout(err) {
+				return fmt.Errorf("%w: nothing received for client_read_timeout: %w", errSlowUpload, err)
+			}
+			return fmt.Errorf("failed to read request body: %w", err)
+		}
+	}
+
+	u.complete = true
+	if chunked {
+		// The last chunk, with no trailer fields
+		if err := send([]byte("0\r\n\r\n")); err != nil {
+			return u.unlessStopped(err)
+		}
+	}
+	u.sent()
+	return nil
+}
+
+// checkUploadRate fails an upload that, once min_upload_rate_grace has
+// passed, has averaged less than min_upload_rate since it started
+func checkUploadRate(total int64, started time.Time, config *Config) error {
+	elapsed := time.Since(started)
+	if config.MinUploadRate <= 0 || elapsed <= config.MinUploadRateGrace {
+		return nil
+	}
+	if float64(total) < float64(config.MinUploadRate)*elapsed.Seconds() {
+		return fmt.Errorf("%w: %d bytes in %s is below min_upload_rate", errSlowUpload, total, elapsed.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// extendDeadlines gives the next read from the client and write to the
+// upstream their timeouts, unless the upload has been stopped
+func (u *upload) extendDeadlines(f *Forwarder, config *Config) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.stopped {
+		return false
+	}
+	setReadTimeout(u.clientConn, config.ClientReadTimeout)
+	f.extendDeadline(u.upstreamConn, config)
+	return true
+}
+
+func (u *upload) isStopped() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.stopped
+}
+
+// unlessStopped returns err, or nil if it came from stopping the upload
+func (u *upload) unlessStopped(err error) error {
+	if u.isStopped() {
+		return nil
+	}
+	return err
+}
+
+// finish stops the upload if it is still running, once the response has
+// been relayed or has failed, and returns the bytes sent, whether the whole
+// body was read, and the error that ended the upload, if any
+func (u *upload) finish() (int64, bool, error) {
+	select {
+	case <-u.done:
+	default:
+		u.mu.Lock()
+		u.stopped = true
+		u.clientConn.SetReadDeadline(time.Now())
+		u.upstreamConn.SetWriteDeadline(time.Now())
+		u.mu.Unlock()
+		<-u.done
+	}
+	return u.written, u.complete, u.err
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uploadOrigin answers each request with the size of the body it received,
+// except /early, which answers 401 without reading the body
+func uploadOrigin(t *testing.T) *httptest.Server {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/early" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%d", n)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// sendUpload writes a POST head for url on conn, then the body in 64KB
+// pieces, chunked if chunked is set, in the background so the response
+// can be read while it is still being sent
+func sendUpload(conn net.Conn, url string, size int, chunked bool) {
+	framing := fmt.Sprintf("Content-Length: %d", size)
+	if chunked {
+		framing = "Transfer-Encoding: chunked"
+	}
+	fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: %s\r\n%s\r\n\r\n", url, hostOf(url), framing)
+	go func() {
+		piece := strings.Repeat("x", 64<<10)
+		for sent := 0; sent < size; sent += len(piece) {
+			if size-sent < len(piece) {
+				piece = piece[:size-sent]
+			}
+			var err error
+			if chunked {
+				_, err = fmt.Fprintf(conn, "%x\r\n%s\r\n", len(piece), piece)
+			} else {
+				_, err = io.WriteString(conn, piece)
+			}
+			if err != nil {
+				return
+			}
+		}
+		if chunked {
+			io.WriteString(conn, "0\r\n\r\n")
+		}
+	}()
+}
+
+func TestUploadStreamed(t *testing.T) {
+	const size = 4 << 20
+	origin := uploadOrigin(t)
+
+	for _, chunked := range []bool{false, true} {
+		s, addr := startServer(t, testConfig(t))
+		conn := dialProxy(t, addr)
+		sendUpload(conn, origin.URL+"/upload", size, chunked)
+		resp := readResponse(t, conn, 10*time.Second)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != fmt.Sprint(size) {
+			t.Errorf("chunked=%t: origin answered %d %q, want the whole %d bytes received", chunked, resp.StatusCode, body, size)
+		}
+
+		// The log counts the body, not just the head
+		waitFor(t, func() bool { return s.Stats().TotalRequests == 1 })
+		if up := s.Stats().BytesUpstream; up < size {
+			t.Errorf("chunked=%t: %d bytes counted upstream, want at least the %d byte body", chunked, up, size)
+		}
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	const limit = 1 << 20
+	origin := uploadOrigin(t)
+	config := testConfig(t)
+	config.MaxUploadBytes = limit
+	s, addr := startServer(t, config)
+
+	// A declared length over the limit is refused before any body is
+	// read; a chunked body is cut off once it passes the limit
+	for i, chunked := range []bool{false, true} {
+		conn := dialProxy(t, addr)
+		sendUpload(conn, origin.URL+"/upload", 4*limit, chunked)
+		if resp := readResponse(t, conn, 10*time.Second); resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("chunked=%t: upload over max_upload_bytes got %d, want 413", chunked, resp.StatusCode)
+		}
+		waitFor(t, func() bool { return s.Stats().RequestsByAction["TOO_LARGE"] == int64(i+1) })
+	}
+
+	// One within it goes through
+	conn := dialProxy(t, addr)
+	sendUpload(conn, origin.URL+"/upload", limit, true)
+	if resp := readResponse(t, conn, 10*time.Second); resp.StatusCode != http.StatusOK {
+		t.Errorf("upload of exactly max_upload_bytes got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestUploadEarlyResponse(t *testing.T) {
+	origin := uploadOrigin(t)
+	_, addr := startServer(t, testConfig(t))
+
+	// The origin answers without reading the body; the proxy must relay
+	// that rather than wait for the upload to finish
+	for _, chunked := range []bool{false, true} {
+		conn := dialProxy(t, addr)
+		sendUpload(conn, origin.URL+"/early", 64<<20, chunked)
+		if resp := readResponse(t, conn, 10*time.Second); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("chunked=%t: early response relayed as %d, want 401", chunked, resp.StatusCode)
+		}
+	}
+}
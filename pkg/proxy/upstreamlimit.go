@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// errUpstreamLimit refuses a dial to a destination that already has
+// max_connections_per_upstream connections
+var errUpstreamLimit = errors.New("max_connections_per_upstream reached")
+
+// UpstreamLimiter counts the connections open to each destination host:port,
+// whether direct, through a parent or tunnelled, and caps them at
+// max_connections_per_upstream
+type UpstreamLimiter struct {
+	mu       sync.Mutex
+	active   map[string]int64
+	released chan struct{} // closed and replaced whenever a connection ends
+}
+
+// NewUpstreamLimiter creates a limiter with no connections open
+func NewUpstreamLimiter() *UpstreamLimiter {
+	return &UpstreamLimiter{
+		active:   make(map[string]int64),
+		released: make(chan struct{}),
+	}
+}
+
+// Acquire takes a connection slot for addr, waiting up to upstream_limit_wait
+// for one to be released when max_connections_per_upstream are in use. The
+// returned function gives the slot back.
+func (l *UpstreamLimiter) Acquire(ctx context.Context, addr string, config *Config) (func(), error) {
+	var timeout <-chan time.Time
+	if config.UpstreamLimitWait > 0 {
+		timer := time.NewTimer(config.UpstreamLimitWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		l.mu.Lock()
+		limit := int64(config.MaxConnectionsPerUpstream)
+		if limit <= 0 || l.active[addr] < limit {
+			l.active[addr]++
+			l.mu.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { l.release(addr) }) }, nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		if timeout == nil {
+			return nil, errUpstreamLimit
+		}
+		select {
+		case <-released:
+		case <-timeout:
+			return nil, errUpstreamLimit
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// release gives back a slot for addr and wakes any waiting dials
+func (l *UpstreamLimiter) release(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[addr]--; l.active[addr] <= 0 {
+		delete(l.active, addr)
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// Active returns the number of open connections per destination
+func (l *UpstreamLimiter) Active() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	active := make(map[string]int64, len(l.active))
+	for addr, n := range l.active {
+		active[addr] = n
+	}
+	return active
+}
+
+// limitedConn gives back its upstream connection slot when closed
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
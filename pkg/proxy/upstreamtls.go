@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// loadUpstreamCAs reads the PEM certificates origins are verified against;
+// an empty path means the system roots (a nil pool)
+func loadUpstreamCAs(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// SetUpstreamCAs replaces the roots origin certificates are verified
+// against; nil means the system roots
+func (f *Forwarder) SetUpstreamCAs(pool *x509.CertPool) {
+	f.roots.Store(pool)
+}
+
+// upstreamTLSConfig returns the client TLS configuration for an origin
+// named serverName, which is also sent as SNI
+func (f *Forwarder) upstreamTLSConfig(serverName string, config *Config) *tls.Config {
+	return &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            f.roots.Load(),
+		InsecureSkipVerify: config.UpstreamInsecureSkipVerify,
+		NextProtos:         []string{"http/1.1"},
+		MinVersion:         tls.VersionTLS12,
+	}
+}
+
+// handshakeUpstream starts TLS over conn to req's origin, within
+// upstream_connect_timeout. On failure conn is closed.
+func (f *Forwarder) handshakeUpstream(ctx context.Context, req *HTTPRequest, conn net.Conn, config *Config) (net.Conn, error) {
+	if config.UpstreamConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.UpstreamConnectTimeout)
+		defer cancel()
+	}
+	req.Trace.begin(phaseTLS)
+	tlsConn := tls.Client(conn, f.upstreamTLSConfig(req.Host, config))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", req.Host, err)
+	}
+	return tlsConn, nil
+}
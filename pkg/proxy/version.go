@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at link time, e.g.
+//
+//	go build -ldflags "-X custom-proxy/pkg/proxy.Version=1.4.2 \
+//	    -X custom-proxy/pkg/proxy.Commit=$(git rev-parse --short HEAD) \
+//	    -X custom-proxy/pkg/proxy.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// The Makefile's build target does this. Without ldflags, Commit and
+// BuildDate fall back to the VCS information Go embeds, when there is any.
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// productName identifies the proxy in Server and Via headers
+const productName = "custom-proxy"
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && Commit == "unknown":
+			Commit = setting.Value
+			if len(Commit) > 12 {
+				Commit = Commit[:12]
+			}
+		case setting.Key == "vcs.time" && BuildDate == "unknown":
+			BuildDate = setting.Value
+		}
+	}
+}
+
+// BuildInfo describes the running build
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Build returns the build information
+func Build() BuildInfo {
+	return BuildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// Product returns the product token sent in Server headers, e.g.
+// "custom-proxy/1.4.2"
+func Product() string {
+	return productName + "/" + Version
+}
+
+// VersionString describes the build on one line
+func VersionString() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", Product(), Commit, BuildDate, runtime.Version())
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors returned by WorkerPool.Submit; the caller still owns the connection
+var (
+	errPoolShutdown = errors.New("worker pool is shut down")
+	errQueueFull    = errors.New("worker pool queue is full")
+)
+
+// The pool grows when connections have been waiting in the queue for
+// poolScaleUpTicks consecutive checks, poolScaleInterval apart
+const (
+	poolScaleInterval = 500 * time.Millisecond
+	poolScaleUpTicks  = 2
+)
+
+// queuedConn is a connection waiting for a worker, with when it was queued
+type queuedConn struct {
+	conn   net.Conn
+	queued time.Time
+}
+
+// WorkerPool manages a pool of worker goroutines. It keeps between
+// minWorkers and maxWorkers running: it adds workers while connections are
+// queueing up, and workers idle for longer than idleTimeout exit. The
+// handler is told how long each connection waited in the queue.
+type WorkerPool struct {
+	minWorkers  int
+	maxWorkers  int
+	idleTimeout time.Duration
+	workQueue   chan queuedConn
+	handler     func(conn net.Conn, waited time.Duration)
+	diag        *DiagLogger
+	wg          sync.WaitGroup
+	mu          sync.RWMutex // held for writing while closing workQueue
+	closed      bool
+	quit        chan struct{} // closed when Shutdown starts, waking blocked submitters
+
+	workers    atomic.Int32
+	scaledUp   atomic.Int64 // workers added under load
+	scaledDown atomic.Int64 // idle workers retired
+}
+
+// NewWorkerPool creates a new worker pool sized from the configuration
+func NewWorkerPool(config *Config, handler func(conn net.Conn, waited time.Duration), diag *DiagLogger) *WorkerPool {
+	minWorkers, maxWorkers := config.PoolWorkerRange()
+	return &WorkerPool{
+		minWorkers:  minWorkers,
+		maxWorkers:  maxWorkers,
+		idleTimeout: config.WorkerIdleTimeout,
+		workQueue:   make(chan queuedConn, config.PoolQueueSize()),
+		handler:     handler,
+		diag:        diag,
+		quit:        make(chan struct{}),
+	}
+}
+
+// Start starts the minimum number of workers, and the scaler if the pool
+// may grow
+func (wp *WorkerPool) Start() {
+	wp.spawn(wp.minWorkers)
+	if wp.maxWorkers > wp.minWorkers {
+		go wp.scaler()
+	}
+}
+
+// spawn starts n more workers, unless the pool has been shut down
+func (wp *WorkerPool) spawn(n int) {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+
+	if wp.closed {
+		return
+	}
+	for i := 0; i < n; i++ {
+		wp.workers.Add(1)
+		wp.wg.Add(1)
+		go wp.worker()
+	}
+}
+
+// worker is the worker goroutine; it handles queued connections until the
+// queue is closed and empty, or until it has been idle for idleTimeout and
+// the pool is above its minimum size
+func (wp *WorkerPool) worker() {
+	defer wp.wg.Done()
+
+	idle := time.NewTimer(wp.idleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case item, ok := <-wp.workQueue:
+			if !ok {
+				wp.workers.Add(-1)
+				return
+			}
+			wp.handler(item.conn, time.Since(item.queued))
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(wp.idleTimeout)
+		case <-idle.C:
+			if wp.retire() {
+				return
+			}
+			idle.Reset(wp.idleTimeout)
+		}
+	}
+}
+
+// retire removes an idle worker if the pool is above its minimum size
+func (wp *WorkerPool) retire() bool {
+	for {
+		n := wp.workers.Load()
+		if int(n) <= wp.minWorkers {
+			return false
+		}
+		if wp.workers.CompareAndSwap(n, n-1) {
+			wp.scaledDown.Add(1)
+			wp.diag.Debugf("Worker pool: idle worker exited, %d workers", n-1)
+			return true
+		}
+	}
+}
+
+// scaler adds workers while connections keep waiting in the queue
+func (wp *WorkerPool) scaler() {
+	ticker := time.NewTicker(poolScaleInterval)
+	defer ticker.Stop()
+
+	busyTicks := 0
+	for {
+		select {
+		case <-wp.quit:
+			return
+		case <-ticker.C:
+		}
+
+		depth := wp.QueueDepth()
+		if depth == 0 {
+			busyTicks = 0
+			continue
+		}
+		if busyTicks++; busyTicks < poolScaleUpTicks {
+			continue
+		}
+		busyTicks = 0
+
+		n := wp.maxWorkers - int(wp.workers.Load())
+		if n > depth {
+			n = depth
+		}
+		if n > 0 {
+			wp.spawn(n)
+			wp.scaledUp.Add(int64(n))
+			wp.diag.Debugf("Worker pool: queue depth %d, added %d workers, %d workers", depth, n, wp.workers.Load())
+		}
+	}
+}
+
+// Submit queues a connection for a worker. It fails without blocking if the
+// queue is full or the pool has been shut down, leaving the caller to close
+// the connection.
+func (wp *WorkerPool) Submit(conn net.Conn) error {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+
+	if wp.closed {
+		return errPoolShutdown
+	}
+	select {
+	case wp.workQueue <- queuedConn{conn: conn, queued: time.Now()}:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// SubmitWait queues a connection for a worker, waiting up to timeout for
+// room in the queue. Time spent waiting for room counts as time queued.
+func (wp *WorkerPool) SubmitWait(conn net.Conn, timeout time.Duration) error {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+
+	if wp.closed {
+		return errPoolShutdown
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case wp.workQueue <- queuedConn{conn: conn, queued: time.Now()}:
+		return nil
+	case <-timer.C:
+		return errQueueFull
+	case <-wp.quit:
+		return errPoolShutdown
+	}
+}
+
+// Shutdown stops accepting submissions and waits for the workers to handle
+// every connection already queued
+func (wp *WorkerPool) Shutdown() {
+	// Wake blocked submitters so they release the read lock
+	select {
+	case <-wp.quit:
+	default:
+		close(wp.quit)
+	}
+
+	wp.mu.Lock()
+	if !wp.closed {
+		wp.closed = true
+		close(wp.workQueue)
+	}
+	wp.mu.Unlock()
+
+	wp.wg.Wait()
+}
+
+// QueueDepth returns the number of connections waiting for a worker
+func (wp *WorkerPool) QueueDepth() int {
+	return len(wp.workQueue)
+}
+
+// Workers returns the number of running workers and how many have been
+// added under load and retired when idle
+func (wp *WorkerPool) Workers() (int, int64, int64) {
+	return int(wp.workers.Load()), wp.scaledUp.Load(), wp.scaledDown.Load()
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestPool creates a pool of min to max workers and a queue of
+// queueSize, handling connections with handler
+func newTestPool(min, max, queueSize int, idleTimeout time.Duration, handler func(net.Conn, time.Duration)) *WorkerPool {
+	config := DefaultConfig()
+	config.MinWorkers, config.MaxWorkers = min, max
+	config.QueueSize = queueSize
+	config.WorkerIdleTimeout = idleTimeout
+	return NewWorkerPool(config, handler, nil)
+}
+
+// Run with -race: submitters keep submitting while the pool shuts down.
+// Nothing may panic, and every connection the pool accepted must be
+// handled exactly once.
+func TestWorkerPoolShutdownWhileSubmitting(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		var handled atomic.Int64
+		pool := newTestPool(4, 4, 8, time.Minute, func(conn net.Conn, waited time.Duration) {
+			if conn == nil {
+				t.Error("handler given a nil connection")
+				return
+			}
+			handled.Add(1)
+			conn.Close()
+		})
+		pool.Start()
+
+		var accepted atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(wait bool) {
+				defer wg.Done()
+				for {
+					client, server := net.Pipe()
+					client.Close()
+					var err error
+					if wait {
+						err = pool.SubmitWait(server, 10*time.Millisecond)
+					} else {
+						err = pool.Submit(server)
+					}
+					switch {
+					case err == nil:
+						accepted.Add(1)
+					case errors.Is(err, errPoolShutdown):
+						server.Close()
+						return
+					case errors.Is(err, errQueueFull):
+						server.Close()
+					default:
+						t.Errorf("Submit returned %v", err)
+						return
+					}
+				}
+			}(i%2 == 0)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+		pool.Shutdown()
+		wg.Wait()
+
+		if handled.Load() != accepted.Load() {
+			t.Fatalf("round %d: %d connections accepted but %d handled", round, accepted.Load(), handled.Load())
+		}
+		if depth := pool.QueueDepth(); depth != 0 {
+			t.Fatalf("round %d: %d connections left in the queue", round, depth)
+		}
+		if err := pool.Submit(nil); !errors.Is(err, errPoolShutdown) {
+			t.Fatalf("round %d: Submit after Shutdown returned %v", round, err)
+		}
+	}
+}
+
+// saturatePool starts a thread_pool server of one worker and a queue of
+// one with queue_overflow set to mode, and fills them: the worker holds an
+// idle connection and another waits in the queue. It returns the server,
+// its address and the two connections.
+func saturatePool(t *testing.T, mode string, wait time.Duration) (s *Server, addr string, held, queued net.Conn) {
+	t.Helper()
+	config := testConfig(t)
+	config.ConcurrencyModel = "thread_pool"
+	config.ThreadPoolSize = 1
+	config.QueueSize = 1
+	config.QueueOverflow = mode
+	config.QueueWaitTimeout = wait
+	s, addr = startServer(t, config)
+
+	held = dialProxy(t, addr)
+	waitFor(t, func() bool { return s.ActiveConnections() == 1 && s.workerPool.QueueDepth() == 0 })
+	queued = dialProxy(t, addr)
+	waitFor(t, func() bool { return s.workerPool.QueueDepth() == 1 })
+	return s, addr, held, queued
+}
+
+func TestQueueOverflowDrop(t *testing.T) {
+	s, addr, _, _ := saturatePool(t, "drop", 0)
+	conn := dialProxy(t, addr)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("dropped connection read %d bytes, %v; want it closed unanswered", n, err)
+	}
+	waitFor(t, func() bool { return s.Stats().QueueDrops == 1 })
+}
+
+func TestQueueOverflowReject(t *testing.T) {
+	s, addr, _, _ := saturatePool(t, "reject", 0)
+	resp := readResponse(t, dialProxy(t, addr), 5*time.Second)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("rejected connection got %d with Retry-After %q, want 503 with one", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	waitFor(t, func() bool { return s.Stats().QueueDrops == 1 })
+}
+
+func TestQueueOverflowBlockTimesOut(t *testing.T) {
+	const wait = 300 * time.Millisecond
+	_, addr, _, _ := saturatePool(t, "block", wait)
+	start := time.Now()
+	resp := readResponse(t, dialProxy(t, addr), 5*time.Second)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("connection that waited out queue_wait_timeout got %d, want 503", resp.StatusCode)
+	}
+	if waited := time.Since(start); waited < wait {
+		t.Errorf("answered after %v, before queue_wait_timeout %v", waited, wait)
+	}
+}
+
+func TestQueueOverflowBlockGetsSlot(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+	request := "GET " + origin.URL + "/ HTTP/1.1\r\nHost: " + hostOf(origin.URL) + "\r\n\r\n"
+
+	s, addr, held, queued := saturatePool(t, "block", 5*time.Second)
+	waiting := dialProxy(t, addr)
+	waitFor(t, func() bool { return s.Stats().TotalConnections == 3 })
+	for _, conn := range []net.Conn{queued, waiting} {
+		if _, err := io.WriteString(conn, request); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Freeing the worker lets the queued connection through, which makes
+	// room in the queue for the waiting one
+	held.Close()
+	for name, conn := range map[string]net.Conn{"queued": queued, "waiting": waiting} {
+		if resp := readResponse(t, conn, 5*time.Second); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s connection got %d, want 200", name, resp.StatusCode)
+		}
+	}
+}
+
+func TestWorkerPoolScalesWithLoad(t *testing.T) {
+	release := make(chan struct{})
+	pool := newTestPool(1, 4, 16, 200*time.Millisecond, func(conn net.Conn, waited time.Duration) {
+		<-release
+		conn.Close()
+	})
+	pool.Start()
+	defer pool.Shutdown()
+
+	// A burst the one worker can't keep up with grows the pool to its
+	// maximum
+	for i := 0; i < 8; i++ {
+		_, server := net.Pipe()
+		if err := pool.Submit(server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool {
+		workers, _, _ := pool.Workers()
+		return workers == 4
+	})
+
+	// Once it has passed, the extra workers go idle and exit
+	close(release)
+	waitFor(t, func() bool {
+		workers, _, _ := pool.Workers()
+		return workers == 1
+	})
+	if _, added, retired := pool.Workers(); added != 3 || retired != 3 {
+		t.Errorf("pool added %d and retired %d workers, want 3 and 3", added, retired)
+	}
+}
@@ -1,46 +0,0 @@
-package main
-
-import (
-	"flag"
-	"fmt"
-	"os"
-	"os/signal"
-	"syscall"
-)
-
-func main() {
-	configPath := flag.String("config", "config/proxy.conf", "Path to configuration file")
-	flag.Parse()
-
-	// Load configuration
-	config, err := LoadConfigFromINI(*configPath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
-		os.Exit(1)
-	}
-
-	// Create server
-	server, err := NewServer(config)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating server: %v\n", err)
-		os.Exit(1)
-	}
-
-	// Handle graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-
-	go func() {
-		<-sigChan
-		server.Shutdown()
-		os.Exit(0)
-	}()
-
-	// Start server
-	if err := server.Start(); err != nil {
-		fmt.Fprintf(os.Stderr, "Server error: %v\n", err)
-		server.Shutdown()
-		os.Exit(1)
-	}
-}
-
@@ -0,0 +1,121 @@
+#!/bin/bash
+
+# Fault injection tests
+#
+# Starts its own proxy (bin/proxy.exe, see "make build") with a "chaos"
+# listener that faults are injected on and a "main" listener they aren't,
+# and a local upstream. Checks the latency and error rate measured over
+# many requests against the rules, the body faults, and that the proxy
+# refuses to start with fault injection on but no listener named.
+
+CHAOS_PORT=18896
+MAIN_PORT=18895
+UPSTREAM_PORT=18894
+WORKDIR=$(mktemp -d)
+FAILED=0
+
+cleanup() {
+    kill $PROXY_PID $UPSTREAM_PID 2>/dev/null
+    wait $PROXY_PID $UPSTREAM_PID 2>/dev/null
+    rm -rf "$WORKDIR"
+}
+trap cleanup EXIT
+
+check() {
+    if [ "$2" = "$3" ]; then
+        echo "PASS: $1"
+    else
+        echo "FAIL: $1 (got $2, want $3)"
+        FAILED=1
+    fi
+}
+
+# between prints yes if $1 is within [$2, $3]
+between() {
+    awk -v x="$1" -v lo="$2" -v hi="$3" 'BEGIN {print (x >= lo && x <= hi) ? "yes" : "no"}'
+}
+
+echo "=== Fault Injection Tests ==="
+echo ""
+
+for name in slow flaky other; do
+    echo "$name" > "$WORKDIR/$name.html"
+done
+head -c 100000 /dev/zero > "$WORKDIR/big.bin"
+cp "$WORKDIR/big.bin" "$WORKDIR/short.bin"
+python3 -m http.server $UPSTREAM_PORT --bind 127.0.0.1 --directory "$WORKDIR" >/dev/null 2>&1 &
+UPSTREAM_PID=$!
+
+cat > "$WORKDIR/faults.txt" <<EOF
+127.0.0.1/slow.html latency=200ms jitter=50ms
+127.0.0.1/flaky.html status=503 probability=30%
+127.0.0.1/big.bin drop_after=1000
+127.0.0.1/short.bin truncate=1000
+EOF
+
+# Test: Fault injection without a listener to apply it on is refused
+timeout 5 ./bin/proxy.exe -config config/proxy.conf -listen-address 127.0.0.1 -listen-port $CHAOS_PORT \
+    -log-file-path "$WORKDIR/refused.log" -enable-fault-injection \
+    -fault-injection-file "$WORKDIR/faults.txt" 2>"$WORKDIR/refused.err"
+status=$?
+check "proxy refuses to start without fault_injection_listeners" "$([ $status -ne 0 ] && [ $status -ne 124 ] && echo yes)" yes
+
+./bin/proxy.exe -config config/proxy.conf -listeners chaos=127.0.0.1:$CHAOS_PORT,main=127.0.0.1:$MAIN_PORT \
+    -log-file-path "$WORKDIR/proxy.log" -enable-fault-injection \
+    -fault-injection-listeners chaos -fault-injection-file "$WORKDIR/faults.txt" \
+    2>"$WORKDIR/proxy.err" &
+PROXY_PID=$!
+sleep 1
+
+URL=http://127.0.0.1:$UPSTREAM_PORT
+
+# Test: Latency is 200ms±50ms on every request
+for i in {1..40}; do
+    curl -x 127.0.0.1:$CHAOS_PORT -s -o /dev/null -w "%{http_code} %{time_total}\n" $URL/slow.html >> "$WORKDIR/slow.out"
+done
+mean=$(awk '{sum += $2} END {print sum / NR}' "$WORKDIR/slow.out")
+fastest=$(awk '{print $2}' "$WORKDIR/slow.out" | sort -n | head -1)
+slowest=$(awk '{print $2}' "$WORKDIR/slow.out" | sort -n | tail -1)
+echo "Latency: mean ${mean}s, fastest ${fastest}s, slowest ${slowest}s"
+check "delayed requests are served" "$(grep -c '^200 ' "$WORKDIR/slow.out")" 40
+check "mean latency is near 200ms" "$(between "$mean" 0.17 0.28)" yes
+check "no request is faster than latency-jitter" "$(between "$fastest" 0.15 1)" yes
+check "no request is much slower than latency+jitter" "$(between "$slowest" 0 0.35)" yes
+
+# Test: About 30% of 200 requests get the injected 503
+for i in {1..200}; do
+    curl -x 127.0.0.1:$CHAOS_PORT -s -o /dev/null -w "%{http_code}\n" $URL/flaky.html >> "$WORKDIR/flaky.out"
+done
+errors=$(grep -c '^503' "$WORKDIR/flaky.out")
+served=$(grep -c '^200' "$WORKDIR/flaky.out")
+echo "Error rate: $errors of 200 requests"
+check "every request is either served or failed" "$((errors + served))" 200
+check "error rate is near 30%" "$(between "$errors" 30 90)" yes
+
+# Test: drop_after resets the connection after 1000 body bytes
+size=$(curl -x 127.0.0.1:$CHAOS_PORT -s -o "$WORKDIR/big.out" -w "%{size_download}" $URL/big.bin)
+check "dropped download fails" "$?" 56
+check "dropped download stops at drop_after" "$size" 1000
+
+# Test: truncate ends the body after 1000 bytes
+size=$(curl -x 127.0.0.1:$CHAOS_PORT -s -o "$WORKDIR/short.out" -w "%{size_download}" $URL/short.bin)
+check "truncated download is reported partial" "$?" 18
+check "truncated download stops at truncate" "$size" 1000
+
+# Test: Faults only apply on the listeners named
+for i in {1..20}; do
+    curl -x 127.0.0.1:$MAIN_PORT -s -o /dev/null -w "%{http_code}\n" $URL/flaky.html >> "$WORKDIR/main.out"
+done
+check "requests on another listener are untouched" "$(grep -c '^200' "$WORKDIR/main.out")" 20
+code=$(curl -x 127.0.0.1:$CHAOS_PORT -s -o /dev/null -w "%{http_code}" $URL/other.html)
+check "requests matching no rule are untouched" "$code" 200
+
+# Test: Affected requests are logged as FAULT_INJECTED with their rule
+sleep 0.5
+check "delayed requests are logged" "$(grep -c 'FAULT_INJECTED.*latency=200ms' "$WORKDIR/proxy.log")" 40
+check "failed requests are logged" "$(grep -c 'FAULT_INJECTED 503.*status=503' "$WORKDIR/proxy.log")" "$errors"
+check "startup warns that faults are active" "$(grep -c 'Fault injection is active on listeners chaos' "$WORKDIR/proxy.err")" 1
+
+echo ""
+echo "=== Fault Injection Tests Complete ==="
+exit $FAILED
@@ -0,0 +1,108 @@
+#!/bin/bash
+
+# Load shedding tests
+#
+# Starts its own proxy (bin/proxy.exe, see "make build") with
+# shed_active_connections=10 and a local upstream, holds connections open to
+# push it over the threshold, and checks that the excess is shed with 503
+# while admitted requests are still served.
+
+PROXY_PORT=18899
+ADMIN_PORT=18898
+UPSTREAM_PORT=18897
+WORKDIR=$(mktemp -d)
+FAILED=0
+
+cleanup() {
+    for fd in "${HELD[@]}"; do
+        eval "exec $fd>&-"
+    done
+    kill $PROXY_PID $UPSTREAM_PID 2>/dev/null
+    wait $PROXY_PID $UPSTREAM_PID 2>/dev/null
+    rm -rf "$WORKDIR"
+}
+trap cleanup EXIT
+
+check() {
+    if [ "$2" = "$3" ]; then
+        echo "PASS: $1"
+    else
+        echo "FAIL: $1 (got $2, want $3)"
+        FAILED=1
+    fi
+}
+
+# wait_active waits up to 5s for the proxy to count $1 active connections
+wait_active() {
+    for i in {1..50}; do
+        active=$(curl -s http://127.0.0.1:$ADMIN_PORT/stats | grep -o '"active_connections":[0-9]*' | cut -d: -f2)
+        [ "$active" = "$1" ] && return
+        sleep 0.1
+    done
+}
+
+echo "=== Load Shedding Tests ==="
+echo ""
+
+echo "hello" > "$WORKDIR/index.html"
+python3 -m http.server $UPSTREAM_PORT --bind 127.0.0.1 --directory "$WORKDIR" >/dev/null 2>&1 &
+UPSTREAM_PID=$!
+
+./bin/proxy.exe -config config/proxy.conf -listen-address 127.0.0.1 -listen-port $PROXY_PORT \
+    -admin-listen 127.0.0.1:$ADMIN_PORT -log-file-path "$WORKDIR/proxy.log" \
+    -shed-active-connections 10 -shed-retry-after 2 \
+    2>"$WORKDIR/proxy.err" &
+PROXY_PID=$!
+sleep 1
+
+URL=http://127.0.0.1:$UPSTREAM_PORT/index.html
+
+# Test: Under the threshold requests are served
+code=$(curl -x 127.0.0.1:$PROXY_PORT -s -o /dev/null -w "%{http_code}" $URL)
+check "request under the threshold is served" "$code" 200
+
+# Test: Hold 10 idle connections so every new one is over the threshold
+wait_active 0
+HELD=()
+for i in {1..10}; do
+    exec {fd}<>/dev/tcp/127.0.0.1/$PROXY_PORT
+    HELD+=($fd)
+done
+wait_active 10
+headers=$(curl -x 127.0.0.1:$PROXY_PORT -s -D - -o /dev/null $URL)
+code=$(echo "$headers" | head -1 | awk '{print $2}')
+retry=$(echo "$headers" | tr -d '\r' | awk -F': ' 'tolower($1) == "retry-after" {print $2}')
+check "request over the threshold is shed" "$code" 503
+check "shed response carries Retry-After" "$retry" 2
+
+# Test: Release half and send a burst of 30 concurrent requests; some are
+# admitted and served while the excess is shed
+for fd in "${HELD[@]:0:5}"; do
+    eval "exec $fd>&-"
+done
+HELD=("${HELD[@]:5}")
+wait_active 5
+CURLS=()
+for i in {1..30}; do
+    curl -x 127.0.0.1:$PROXY_PORT -s -o /dev/null -m 5 -w "%{http_code} %{time_total}\n" $URL >> "$WORKDIR/burst.out" &
+    CURLS+=($!)
+done
+wait "${CURLS[@]}"
+served=$(grep -c '^200 ' "$WORKDIR/burst.out")
+shed=$(grep -c '^503 ' "$WORKDIR/burst.out")
+other=$(grep -vc -e '^200 ' -e '^503 ' "$WORKDIR/burst.out")
+slowest=$(awk '$1 == 200 {print $2}' "$WORKDIR/burst.out" | sort -n | tail -1)
+echo "Burst: $served served (slowest ${slowest}s), $shed shed, $other other"
+check "burst has served requests" "$([ "$served" -gt 0 ] && echo yes)" yes
+check "burst has shed requests" "$([ "$shed" -gt 0 ] && echo yes)" yes
+check "burst has no failed requests" "$other" 0
+check "served requests stay fast" "$(awk -v t="$slowest" 'BEGIN {print (t < 1) ? "yes" : "no"}')" yes
+
+# Test: Shed connections are counted, not access logged
+count=$(curl -s http://127.0.0.1:$ADMIN_PORT/stats | grep -o '"load_shed":[0-9]*' | cut -d: -f2)
+check "stats count every shed connection" "$count" $((shed + 1))
+check "shed connections are not access logged" "$(grep -c ' 503 ' "$WORKDIR/proxy.log")" 0
+
+echo ""
+echo "=== Load Shedding Tests Complete ==="
+exit $FAILED
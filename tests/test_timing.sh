@@ -0,0 +1,142 @@
+#!/bin/bash
+
+# Request timing tests
+#
+# Starts its own proxy (bin/proxy.exe, see "make build") and a local
+# upstream that holds each response head back for 200ms and then trickles
+# the body out over about 100ms. Checks that breakdowns are only logged for
+# the requests asked for, that the phases add up to the total and land
+# where the upstream spent the time, and that the phase metrics count every
+# request.
+
+PROXY_PORT=18886
+ADMIN_PORT=18887
+UPSTREAM_PORT=18885
+WORKDIR=$(mktemp -d)
+FAILED=0
+
+cleanup() {
+    kill $PROXY_PID $UPSTREAM_PID 2>/dev/null
+    wait $PROXY_PID $UPSTREAM_PID 2>/dev/null
+    rm -rf "$WORKDIR"
+}
+trap cleanup EXIT
+
+check() {
+    if [ "$2" = "$3" ]; then
+        echo "PASS: $1"
+    else
+        echo "FAIL: $1 (got $2, want $3)"
+        FAILED=1
+    fi
+}
+
+# between prints yes if $1 is within [$2, $3]
+between() {
+    awk -v x="$1" -v lo="$2" -v hi="$3" 'BEGIN {print (x >= lo && x <= hi) ? "yes" : "no"}'
+}
+
+# phase prints the value in ms of phase $1 from timing line $2
+phase() {
+    echo "$2" | grep -o " $1=[0-9.]*ms" | sed 's/.*=//; s/ms//'
+}
+
+# start_proxy starts the proxy with the timing options given
+start_proxy() {
+    ./bin/proxy.exe -config config/proxy.conf -listen-address 127.0.0.1 -listen-port $PROXY_PORT \
+        -admin-listen 127.0.0.1:$ADMIN_PORT -log-file-path "$WORKDIR/proxy.log" \
+        -error-log-path "$WORKDIR/error.log" "$@" 2>/dev/null &
+    PROXY_PID=$!
+    sleep 1
+}
+
+echo "=== Request Timing Tests ==="
+echo ""
+
+cat > "$WORKDIR/upstream.py" <<'EOF'
+import sys, time
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+class Handler(BaseHTTPRequestHandler):
+    def do_GET(self):
+        time.sleep(0.2)
+        self.send_response(200)
+        self.send_header("Content-Length", "10000")
+        self.send_header("X-Saw-Debug-Header", "yes" if "X-Debug-Timing" in self.headers else "no")
+        self.end_headers()
+        self.wfile.flush()
+        for _ in range(10):
+            time.sleep(0.01)
+            self.wfile.write(b"x" * 1000)
+            self.wfile.flush()
+
+    def log_message(self, *args):
+        pass
+
+HTTPServer(("127.0.0.1", int(sys.argv[1])), Handler).serve_forever()
+EOF
+python3 "$WORKDIR/upstream.py" $UPSTREAM_PORT &
+UPSTREAM_PID=$!
+
+URL=http://127.0.0.1:$UPSTREAM_PORT/slow
+
+start_proxy -timing-debug-header X-Debug-Timing -timing-debug-response-header
+
+# Test: Requests without the header get no breakdown
+curl -x 127.0.0.1:$PROXY_PORT -s -o /dev/null $URL
+sleep 0.2
+check "no breakdown without the header" "$(grep -c 'timing:' "$WORKDIR/error.log")" 0
+
+# Test: The header asks for a breakdown, in the log and the response
+for i in {1..10}; do
+    curl -x 127.0.0.1:$PROXY_PORT -s -o /dev/null -D "$WORKDIR/headers.$i" \
+        -w "%{time_total}\n" -H "X-Debug-Timing: 1" $URL >> "$WORKDIR/curl.out"
+done
+sleep 0.2
+grep 'timing:' "$WORKDIR/error.log" > "$WORKDIR/timing.out"
+check "a breakdown is logged for each request with the header" "$(wc -l < "$WORKDIR/timing.out")" 10
+check "the header is removed before forwarding" "$(grep -ci 'X-Saw-Debug-Header: no' "$WORKDIR"/headers.* | awk -F: '{sum += $2} END {print sum}')" 10
+check "X-Proxy-Timing is returned" "$(grep -li '^X-Proxy-Timing: queue;dur=.*wait;dur=' "$WORKDIR"/headers.* | wc -l)" 10
+
+# Test: The phases add up to the total, to within the rounding of each
+bad=0
+while read -r line; do
+    total=$(phase total "$line")
+    sum=0
+    for name in queue proxy dns connect tls write wait transfer; do
+        sum=$(awk -v a="$sum" -v b="$(phase $name "$line")" 'BEGIN {print a + b}')
+    done
+    if [ "$(between "$(awk -v a="$sum" -v b="$total" 'BEGIN {print a - b}')" -0.5 0.5)" != yes ]; then
+        echo "  phases sum to ${sum}ms, total ${total}ms: $line"
+        bad=$((bad + 1))
+    fi
+done < "$WORKDIR/timing.out"
+check "phases sum to the total" "$bad" 0
+
+# Test: The time lands in the phases the upstream spent it in
+line=$(tail -1 "$WORKDIR/timing.out")
+echo "Breakdown: ${line#*timing: }"
+check "wait covers the upstream's 200ms" "$(between "$(phase wait "$line")" 195 350)" yes
+check "transfer covers the trickled body" "$(between "$(phase transfer "$line")" 90 250)" yes
+check "connect is short on loopback" "$(between "$(phase connect "$line")" 0 50)" yes
+curl_total=$(tail -1 "$WORKDIR/curl.out" | awk '{print $1 * 1000}')
+check "total is close to what the client saw (${curl_total}ms)" "$(between "$(phase total "$line")" $(awk -v t="$curl_total" 'BEGIN {print t - 50, t + 5}'))" yes
+
+# Test: Every forwarded request feeds the phase metrics
+count=$(curl -s http://127.0.0.1:$ADMIN_PORT/metrics | grep '^proxy_request_phase_seconds_count{phase="wait"}' | awk '{print $2}')
+check "phase metrics count every request" "$count" 11
+
+kill $PROXY_PID 2>/dev/null
+wait $PROXY_PID 2>/dev/null
+
+# Test: timing_debug_clients asks for breakdowns without the header
+rm -f "$WORKDIR/error.log"
+start_proxy -timing-debug-clients 127.0.0.1/32
+curl -x 127.0.0.1:$PROXY_PORT -s -o /dev/null -D "$WORKDIR/headers.client" $URL
+sleep 0.2
+check "breakdown is logged for a listed client" "$(grep -c 'timing: GET 127.0.0.1' "$WORKDIR/error.log")" 1
+check "X-Proxy-Timing is off by default" "$(grep -ci '^X-Proxy-Timing' "$WORKDIR/headers.client")" 0
+
+echo ""
+echo "=== Request Timing Tests Complete ==="
+exit $FAILED